@@ -3,6 +3,9 @@ module github.com/jfsmig/nginx-logs
 go 1.14
 
 require (
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/rs/zerolog v1.18.0
 	github.com/spf13/pflag v1.0.3
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,115 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AlbTimers are the extra fields of the timers of the load balancers, in
+// seconds, -1 when the step was not reached.
+var AlbTimers = []string{"request_processing_time", "target_processing_time", "response_processing_time"}
+
+// albTypes are the types of the requests leading the lines of an Application
+// Load Balancer, the Classic Load Balancer logging none.
+var albTypes = map[string]bool{"http": true, "https": true, "h2": true, "grpcs": true, "ws": true, "wss": true}
+
+// AlbFields are the extra fields of the quoted strings after the target group
+// of an Application Load Balancer, by position.
+var AlbFields = []string{
+	"trace_id", "domain_name", "chosen_cert_arn", "matched_rule_priority", "request_creation_time",
+	"actions_executed", "redirect_url", "error_reason", "targets", "target_status_codes",
+	"classification", "classification_reason",
+}
+
+// SplitAddrPort splits an address:port, the addresses of IPv6 bracketed or
+// not, e.g. the client or the target of a load balancer.
+func SplitAddrPort(s string) (string, string) {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return host, port
+	}
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// parseALBLine parses the access logs of the load balancers of AWS: the ones
+// of an Application Load Balancer, led by the type of the request, and the
+// ones of a Classic Load Balancer. The host of the absolute URL, the timers,
+// the status of the target, the TLS parameters and the trace id become extra
+// fields.
+func parseALBLine(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) > 0 && albTypes[t[0]] {
+		t = t[1:]
+		if len(t) < 17 {
+			return Record{}, false
+		}
+	} else if len(t) != 15 {
+		return Record{}, false
+	}
+	when, err := time.Parse(time.RFC3339Nano, t[0])
+	if err != nil {
+		return Record{}, false
+	}
+	code, err := strconv.Atoi(t[7])
+	if err != nil {
+		return Record{}, false
+	}
+	ip, _ := SplitAddrPort(t[2])
+	bytes, _ := strconv.ParseInt(t[10], 10, 64)
+	r := Record{Ip: ip, User: "-", When: when.Unix(), Code: code, Bytes: bytes, Referrer: "-", Agent: t[12]}
+	r.Method, r.Path, r.Version, _ = parseQuery(t[11])
+	if host, path, ok := splitAbsoluteURL(r.Path); ok {
+		r.Path = path
+		if h, port := SplitAddrPort(host); port != "" {
+			host = h
+			if p, err := strconv.ParseInt(port, 10, 32); err == nil {
+				r.SetExtra("port", p)
+			}
+		}
+		r.SetExtra("host", host)
+	}
+
+	r.SetExtra("elb", t[1])
+	if t[3] != "-" {
+		r.SetExtra("target", t[3])
+	}
+	total, complete := 0.0, true
+	for i, name := range AlbTimers {
+		v, _ := strconv.ParseFloat(t[4+i], 64)
+		r.SetExtra(name, v)
+		total += v
+		complete = complete && v >= 0
+	}
+	if complete {
+		r.SetExtra("request_time", total)
+	}
+	if status, err := strconv.ParseInt(t[8], 10, 32); err == nil {
+		r.SetExtra("target_status", status)
+	}
+	received, _ := strconv.ParseInt(t[9], 10, 64)
+	r.SetExtra("received_bytes", received)
+	if t[13] != "-" {
+		r.SetExtra("ssl_cipher", t[13])
+	}
+	if t[14] != "-" {
+		r.SetExtra("ssl_protocol", t[14])
+	}
+	if len(t) > 15 && t[15] != "-" {
+		r.SetExtra("target_group", t[15])
+	}
+	for i, name := range AlbFields {
+		if 16+i < len(t) && t[16+i] != "-" && t[16+i] != "" {
+			r.SetExtra(name, t[16+i])
+		}
+	}
+	return r, true
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// apacheDirective matches the directives of a LogFormat of Apache, with their
+// conditions, parameter and modifier, e.g. %>s or %{User-Agent}i
+var apacheDirective = regexp.MustCompile(`%!?[\d,]*(?:\{([^}]*)\})?[<>]?([a-zA-Z%])`)
+
+// apacheVariables are the variables of nginx equivalent to the directives of
+// Apache. The virtual host and the port are named as by vhost_combined.
+var apacheVariables = map[string]string{
+	"h": "$remote_addr", "a": "$remote_addr", "l": "$ident", "u": "$remote_user", "t": "[$time_local]",
+	"r": "$request", "m": "$request_method", "U": "$uri", "q": "$args", "H": "$server_protocol", "s": "$status",
+	"b": "$body_bytes_sent", "B": "$body_bytes_sent", "O": "$body_bytes_sent", "v": "$host", "V": "$host",
+	"p": "$port", "D": "$request_time_us", "T": "$request_time", "L": "$request_id", "%": "%",
+}
+
+// apacheTimeUnits are the units of %{UNIT}T
+var apacheTimeUnits = map[string]string{"s": "$request_time", "ms": "$request_time_ms", "us": "$request_time_us"}
+
+// isApacheLogFormat tells if the name of a format is rather a LogFormat of
+// Apache, e.g. '%h %l %u %t "%r" %>s %b'
+func isApacheLogFormat(name string) bool {
+	return apacheDirective.MatchString(name)
+}
+
+// apacheLogFormat translates a LogFormat of Apache into the log_format of
+// nginx that parses the same lines.
+func apacheLogFormat(spec string) (string, error) {
+	var out strings.Builder
+	var err error
+	last := 0
+	for _, loc := range apacheDirective.FindAllStringSubmatchIndex(spec, -1) {
+		out.WriteString(spec[last:loc[0]])
+		last = loc[1]
+		var param string
+		if loc[2] >= 0 {
+			param = spec[loc[2]:loc[3]]
+		}
+		directive := spec[loc[4]:loc[5]]
+		switch {
+		case directive == "i" && param != "":
+			out.WriteString("$http_" + strings.Replace(strings.ToLower(param), "-", "_", -1))
+		case directive == "T" && param != "":
+			v, ok := apacheTimeUnits[param]
+			if !ok {
+				err = fmt.Errorf("Unsupported unit %q of %%T", param)
+			}
+			out.WriteString(v)
+		case param == "" || directive == "a":
+			v, ok := apacheVariables[directive]
+			if !ok {
+				err = fmt.Errorf("Unsupported directive %%%s of the LogFormat", directive)
+			}
+			out.WriteString(v)
+		default:
+			err = fmt.Errorf("Unsupported directive %%{%s}%s of the LogFormat", param, directive)
+		}
+	}
+	out.WriteString(spec[last:])
+	return out.String(), err
+}
+
+// apacheFormats are the formats of the Apache distributions, the most
+// specific ones first, the timings of the requests being often appended.
+var apacheFormats = []string{
+	`%v:%p %h %l %u %t "%r" %>s %O "%{Referer}i" "%{User-Agent}i"`,
+	`%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i" %T/%D`,
+	`%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i" %D`,
+	`%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`,
+	`%h %l %u %t "%r" %>s %b %D`,
+	`%h %l %u %t "%r" %>s %b`,
+}
+
+// apacheFormat parses the lines of any of the apacheFormats, the ident of
+// the clients, if any, and the time taken, in seconds, being extra fields.
+func apacheFormat() *Format {
+	formats := make([]*Format, 0, len(apacheFormats))
+	for _, spec := range apacheFormats {
+		nginx, err := apacheLogFormat(spec)
+		if err == nil {
+			var f *Format
+			if f, err = nginxLogFormat(nginx); err == nil {
+				formats = append(formats, f)
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	return &Format{Name: "apache", Parse: func(line string) (Record, bool) {
+		for _, f := range formats {
+			if r, ok := f.Parse(line); ok {
+				return r, true
+			}
+		}
+		return Record{}, false
+	}}
+}
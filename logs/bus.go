@@ -0,0 +1,88 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"strings"
+)
+
+// Message is a line consumed from a message bus, acknowledged once parsed,
+// or else left to the bus to redeliver or to discard.
+type Message struct {
+	Text string
+	Ack  func(parsed bool)
+}
+
+// splitMessages returns the lines of the messages, in their order, and the
+// messages pending their parsing. The messages are queued before their lines,
+// past the lines sampled to detect the format. It stops consuming the
+// messages once done is closed.
+func splitMessages(in <-chan Message, sample int, done <-chan struct{}) (<-chan string, <-chan Message) {
+	text := make(chan string, 64)
+	pending := make(chan Message, sample+256)
+	go func() {
+		defer close(text)
+		defer close(pending)
+		for {
+			var m Message
+			select {
+			case <-done:
+				return
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				m = next
+			}
+			// A message per line, whatever its end
+			m.Text = strings.Replace(strings.TrimRight(m.Text, "\r\n"), "\n", " ", -1)
+			select {
+			case pending <- m:
+			case <-done:
+				return
+			}
+			if err := sendLine(text, m.Text, done); err != nil {
+				return
+			}
+		}
+	}()
+	return text, pending
+}
+
+// ackLines pairs the lines with their messages, the lines being the messages
+// in the same order, less the directives consumed before the parsing, e.g.
+// the ones of W3C. Once done is closed, the messages left are not
+// acknowledged, their lines being never parsed.
+func ackLines(in <-chan Line, pending <-chan Message, done <-chan struct{}) <-chan Line {
+	out := make(chan Line, 64)
+	go func() {
+		defer close(out)
+		for l := range in {
+			for m := range pending {
+				if m.Text == l.Text {
+					l.ack = m.Ack
+					break
+				}
+				if m.Ack != nil {
+					m.Ack(true)
+				}
+			}
+			out <- l
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		// The directives at the end
+		for m := range pending {
+			if m.Ack != nil {
+				m.Ack(true)
+			}
+		}
+	}()
+	return out
+}
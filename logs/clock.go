@@ -0,0 +1,127 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the time windows and drives the timers, so that the
+// time can be simulated instead of relying on time.Now.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers the ticks of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the system
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+
+func (t systemTicker) Stop() { t.t.Stop() }
+
+// shiftedClock is the system clock shifted to another time, e.g. to analyze
+// the week before a past incident with the ticks of the system.
+type shiftedClock struct {
+	offset time.Duration
+}
+
+// NewShiftedClock returns the system clock shifted to now
+func NewShiftedClock(now time.Time) Clock {
+	return shiftedClock{offset: time.Until(now)}
+}
+
+func (c shiftedClock) Now() time.Time { return time.Now().Add(c.offset) }
+
+func (c shiftedClock) NewTicker(d time.Duration) Ticker { return SystemClock.NewTicker(d) }
+
+// FakeClock is a Clock whose time only moves when advanced, firing the tickers
+// due meanwhile.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+// NewFakeClock returns a FakeClock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTicker panics on a non-positive period, as time.NewTicker does, that
+// would never move the ticker forward.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic(errors.New("non-positive interval for FakeClock.NewTicker"))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTicker{clock: c, period: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the time forward. Like the tickers of the system, a ticker
+// drops the ticks its reader is too slow for.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.tickers {
+		if other == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			break
+		}
+	}
+}
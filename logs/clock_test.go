@@ -0,0 +1,80 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+func TestFakeClockTicks(t *testing.T) {
+	c := NewFakeClock(epoch)
+	ticker := c.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	c.Advance(59 * time.Second)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("Unexpected tick at %v", tick)
+	default:
+	}
+
+	c.Advance(time.Second)
+	if tick := <-ticker.C(); !tick.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("Expected a tick at %v, got %v", epoch.Add(time.Minute), tick)
+	}
+	if now := c.Now(); !now.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("Expected the time %v, got %v", epoch.Add(time.Minute), now)
+	}
+}
+
+func TestFakeClockDropsTicks(t *testing.T) {
+	c := NewFakeClock(epoch)
+	ticker := c.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// As the tickers of the system, only one tick is kept for a slow reader
+	c.Advance(10 * time.Second)
+	if tick := <-ticker.C(); !tick.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("Expected the first tick, got %v", tick)
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("Unexpected tick at %v", tick)
+	default:
+	}
+	c.Advance(time.Second)
+	if tick := <-ticker.C(); !tick.Equal(epoch.Add(11 * time.Second)) {
+		t.Fatalf("Expected a tick at %v, got %v", epoch.Add(11*time.Second), tick)
+	}
+}
+
+func TestFakeClockStop(t *testing.T) {
+	c := NewFakeClock(epoch)
+	ticker := c.NewTicker(time.Second)
+	ticker.Stop()
+	c.Advance(time.Minute)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("Unexpected tick at %v", tick)
+	default:
+	}
+}
+
+func TestFakeClockNonPositivePeriod(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic with the period %v", d)
+				}
+			}()
+			NewFakeClock(epoch).NewTicker(d)
+		}()
+	}
+}
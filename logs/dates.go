@@ -0,0 +1,62 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	strictDate   = regexp.MustCompile(`^(\d\d)/([^/]+)/(\d{4}):(\d\d):(\d\d):(\d\d) ([+-]\d{4})$`)
+	tolerantDate = regexp.MustCompile(`^(\d{1,2})/([^/]+)/(\d{4}):(\d\d):(\d\d):(\d\d)(?: ([+-]\d{4}))?$`)
+)
+
+// DateParser parses the time_local of nginx whose month is not the English
+// abbreviation, whatever its case.
+type DateParser struct {
+	Months   map[string]time.Month
+	Tolerant bool
+}
+
+// TolerantDates is the fallback of parseDate, if configured
+var TolerantDates *DateParser
+
+func (dp *DateParser) parse(s string) (int64, error) {
+	re := strictDate
+	if dp.Tolerant {
+		re = tolerantDate
+	}
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid date %q", s)
+	}
+	name := strings.ToLower(m[2])
+	if dp.Tolerant {
+		name = strings.TrimSuffix(name, ".")
+	}
+	month, ok := dp.Months[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown month %q", m[2])
+	}
+	var n [5]int
+	for i, v := range []string{m[3], m[1], m[4], m[5], m[6]} {
+		n[i], _ = strconv.Atoi(v)
+	}
+	loc := time.Local
+	if m[7] != "" {
+		zone, _ := strconv.Atoi(m[7])
+		loc = time.FixedZone("", (zone/100*60+zone%100)*60)
+	}
+	t := time.Date(n[0], month, n[1], n[2], n[3], n[4], 0, loc)
+	if t.Day() != n[1] || t.Hour() != n[2] || t.Minute() != n[3] || t.Second() != n[4] {
+		return 0, fmt.Errorf("Invalid date %q", s)
+	}
+	return t.Unix(), nil
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DedupKey is what a duplicated line repeats: the time, the source, the
+// request and the status.
+func (r *Record) DedupKey() string {
+	sb := strings.Builder{}
+	sb.WriteString(strconv.FormatInt(r.When, 10))
+	sb.WriteByte(0)
+	sb.WriteString(r.Ip)
+	sb.WriteByte(0)
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Path)
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(r.Version))
+	sb.WriteByte(0)
+	sb.WriteString(strconv.Itoa(r.Code))
+	return sb.String()
+}
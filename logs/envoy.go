@@ -0,0 +1,133 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envoyFields are the fields of an access log of Envoy, in its default format
+// (the first 13) or in the one of Istio, e.g.
+// [%START_TIME%] "%REQ(:METHOD)% %REQ(X-ENVOY-ORIGINAL-PATH?:PATH)% %PROTOCOL%"
+// %RESPONSE_CODE% %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT% %DURATION%
+// %RESP(X-ENVOY-UPSTREAM-SERVICE-TIME)% "%REQ(X-FORWARDED-FOR)%" "%REQ(USER-AGENT)%"
+// "%REQ(X-REQUEST-ID)%" "%REQ(:AUTHORITY)%" "%UPSTREAM_HOST%"
+type envoyFields struct {
+	start, request, code, flags, details, received, sent, duration, upstreamTime string
+	forwardedFor, agent, id, authority, upstream, cluster, remote, sni, route    string
+}
+
+// parseEnvoyLine parses the access logs of Envoy, in its default format, in the
+// one of Istio or in JSON with the names of the variables as keys. The address
+// is the downstream one, or else the first one forwarded to Envoy. The
+// response flags, the upstream and the durations become extra fields.
+func parseEnvoyLine(line string) (Record, bool) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return parseEnvoyJSON(line)
+	}
+	t := tokenizeLine(line)
+	var f envoyFields
+	switch len(t) {
+	case 13:
+		f = envoyFields{
+			start: t[0], request: t[1], code: t[2], flags: t[3], received: t[4], sent: t[5], duration: t[6],
+			upstreamTime: t[7], forwardedFor: t[8], agent: t[9], id: t[10], authority: t[11], upstream: t[12],
+		}
+	case 22:
+		// Istio also logs the details, the termination and the failure
+		// after the flags, then the addresses, the SNI and the route
+		f = envoyFields{
+			start: t[0], request: t[1], code: t[2], flags: t[3], details: t[4], received: t[7], sent: t[8],
+			duration: t[9], upstreamTime: t[10], forwardedFor: t[11], agent: t[12], id: t[13], authority: t[14],
+			upstream: t[15], cluster: t[16], remote: t[19], sni: t[20], route: t[21],
+		}
+	default:
+		return Record{}, false
+	}
+	return f.record()
+}
+
+// parseEnvoyJSON parses the JSON access logs of Envoy, whose keys are the
+// lowercase names of the variables of the default format, as Istio logs them.
+func parseEnvoyJSON(line string) (Record, bool) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return Record{}, false
+	}
+	get := func(key string) string {
+		switch v := entry[key].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return "-"
+	}
+	method, path, protocol := get("method"), get("path"), get("protocol")
+	if method == "-" || path == "-" {
+		return Record{}, false
+	}
+	f := envoyFields{
+		start: get("start_time"), request: method + " " + path + " " + protocol, code: get("response_code"),
+		flags: get("response_flags"), details: get("response_code_details"), received: get("bytes_received"),
+		sent: get("bytes_sent"), duration: get("duration"), upstreamTime: get("upstream_service_time"),
+		forwardedFor: get("x_forwarded_for"), agent: get("user_agent"), id: get("request_id"),
+		authority: get("authority"), upstream: get("upstream_host"), cluster: get("upstream_cluster"),
+		remote: get("downstream_remote_address"), sni: get("requested_server_name"), route: get("route_name"),
+	}
+	return f.record()
+}
+
+func (f *envoyFields) record() (Record, bool) {
+	when, err := time.Parse(time.RFC3339Nano, f.start)
+	if err != nil {
+		return Record{}, false
+	}
+	code, err := strconv.Atoi(f.code)
+	if err != nil {
+		return Record{}, false
+	}
+	ip := ""
+	if f.remote != "-" && f.remote != "" {
+		ip, _ = SplitAddrPort(f.remote)
+	} else if f.forwardedFor != "-" {
+		ip = strings.TrimSpace(strings.Split(f.forwardedFor, ",")[0])
+	}
+	if ip == "" {
+		return Record{}, false
+	}
+	bytes, _ := strconv.ParseInt(f.sent, 10, 64)
+	r := Record{Ip: ip, User: "-", When: when.Unix(), Code: code, Bytes: bytes, Referrer: "-", Agent: f.agent}
+	r.Method, r.Path, r.Version, _ = parseQuery(f.request)
+	// Envoy names HTTP/2 without its minor version
+	if strings.HasSuffix(f.request, " HTTP/2") {
+		r.Version = VersionToCode["HTTP/2.0"]
+	}
+	if f.id != "-" {
+		r.ID = f.id
+	}
+	received, _ := strconv.ParseInt(f.received, 10, 64)
+	r.SetExtra("received_bytes", received)
+	if ms, err := strconv.ParseInt(f.duration, 10, 64); err == nil {
+		r.SetExtra("request_time", float64(ms)/1000)
+	}
+	if ms, err := strconv.ParseInt(f.upstreamTime, 10, 64); err == nil {
+		r.SetExtra("upstream_service_time", ms)
+	}
+	for _, s := range []struct{ name, value string }{
+		{"response_flags", f.flags}, {"response_code_details", f.details}, {"host", f.authority},
+		{"upstream", f.upstream}, {"upstream_cluster", f.cluster}, {"forwarded_for", f.forwardedFor},
+		{"sni", f.sni}, {"route", f.route},
+	} {
+		if s.value != "-" && s.value != "" {
+			r.SetExtra(s.name, s.value)
+		}
+	}
+	return r, true
+}
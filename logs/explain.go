@@ -0,0 +1,50 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+// The verdicts of the decisions
+const (
+	VerdictKeep   = "keep"
+	VerdictReject = "reject"
+	VerdictInfo   = "info"
+)
+
+// Decision is the verdict of a rule about a record, and its reason
+type Decision struct {
+	Rule    string `json:"rule"`
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// Rule decides about a record, and may enrich it for the next rules, e.g. with
+// the location of its source.
+type Rule func(r *Record) []Decision
+
+// Explain applies the rules in turn to the record, and tells whether it is
+// kept, i.e. no decision rejects it.
+func Explain(r Record, rules ...Rule) ([]Decision, bool) {
+	var out []Decision
+	kept := true
+	for _, rule := range rules {
+		for _, d := range rule(&r) {
+			if d.Verdict == VerdictReject {
+				kept = false
+			}
+			out = append(out, d)
+		}
+	}
+	return out, kept
+}
+
+// FilterRule is the rule of a filter, e.g. of WithFilters, given its name
+func FilterRule(name string, keep SieveFilter) Rule {
+	return func(r *Record) []Decision {
+		if keep(*r) {
+			return []Decision{{Rule: name, Verdict: VerdictKeep, Reason: "kept by the filter"}}
+		}
+		return []Decision{{Rule: name, Verdict: VerdictReject, Reason: "rejected by the filter"}}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RecordFields maps the names of the fields of the Record, as in the JSON
+// output, to their accessor.
+var RecordFields = map[string]func(r *Record) interface{}{
+	"id":       func(r *Record) interface{} { return r.ID },
+	"src":      func(r *Record) interface{} { return r.Ip },
+	"user":     func(r *Record) interface{} { return r.User },
+	"t":        func(r *Record) interface{} { return r.When },
+	"method":   func(r *Record) interface{} { return r.Method },
+	"path":     func(r *Record) interface{} { return r.Path },
+	"version":  func(r *Record) interface{} { return int64(r.Version) },
+	"status":   func(r *Record) interface{} { return int64(r.Code) },
+	"bytes":    func(r *Record) interface{} { return r.Bytes },
+	"referrer": func(r *Record) interface{} { return r.Referrer },
+	"agent":    func(r *Record) interface{} { return r.Agent },
+	"country":  func(r *Record) interface{} { return r.Country },
+	"asn":      func(r *Record) interface{} { return int64(r.ASN) },
+}
+
+// FieldAliases are alternative names of some fields of the Record
+var FieldAliases = map[string]string{
+	"ip":   "src",
+	"time": "t",
+}
+
+// Field returns the value of a field of the Record, including the derived
+// ones, or false if the Record has no such field.
+func (r *Record) Field(name string) (interface{}, bool) {
+	if get, ok := RecordFields[name]; ok {
+		return get(r), true
+	}
+	if alias, ok := FieldAliases[name]; ok {
+		return RecordFields[alias](r), true
+	}
+	v, ok := r.Extra[name]
+	return v, ok
+}
+
+// SetExtra sets a field beyond the usual ones
+func (r *Record) SetExtra(name string, value interface{}) {
+	if r.Extra == nil {
+		r.Extra = make(map[string]interface{})
+	}
+	r.Extra[name] = value
+}
+
+// ToString formats the value of a field as text
+func ToString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case []string:
+		return strings.Join(x, ",")
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// ToNumber converts the value into an int64 or a float64, if possible, and
+// returns the value as-is otherwise.
+func ToNumber(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int64, float64:
+		return x
+	case int:
+		return int64(x)
+	case bool:
+		if x {
+			return int64(1)
+		}
+		return int64(0)
+	case string:
+		if i, err := strconv.ParseInt(x, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return f
+		}
+	}
+	return v
+}
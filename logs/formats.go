@@ -0,0 +1,667 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Format parses the lines of a format of log into records
+type Format struct {
+	Name  string
+	Parse func(line string) (Record, bool)
+}
+
+// Line is a line of the input, with the format to parse it with
+type Line struct {
+	Text   string
+	Format *Format
+	// ack acknowledges the message of the line once parsed, if any
+	ack func(parsed bool)
+}
+
+// parse parses the line with its format, then acknowledges its message
+func (l Line) parse() (Record, bool) {
+	r, ok := l.Format.Parse(l.Text)
+	if l.ack != nil {
+		l.ack(ok)
+	}
+	return r, ok
+}
+
+// LogFormats are tried in that order when detecting the format of a line, the
+// most specific ones first.
+var LogFormats = []*Format{
+	jsonFormat("json", "short"),
+	jsonFormat("json-ecs", "ecs"),
+	jsonFormat("json-nginx", "nginx"),
+	{Name: "caddy", Parse: parseCaddyLine},
+	{Name: "traefik", Parse: parseTraefikLine},
+	{Name: "envoy", Parse: parseEnvoyLine},
+	{Name: "alb", Parse: parseALBLine},
+	{Name: "error", Parse: parseErrorLine},
+	w3cFormat(w3cDefaultFields),
+	{Name: "haproxy", Parse: parseHAProxyLine},
+	{Name: "combined", Parse: parseCombinedLine},
+	{Name: "common", Parse: parseCommonLine},
+	{Name: "vhost_combined", Parse: parseVhostCombinedLine},
+	{Name: "ingress_nginx", Parse: parseIngressNginxLine},
+	// After combined, that also matches its lines, so that the proxy requests
+	// logged by nginx keep their URL.
+	{Name: "varnish", Parse: parseVarnishLine},
+	// Last, for the formats of Apache unknown to nginx, e.g. with the timings
+	apacheFormat(),
+}
+
+// LookupFormat returns the format of that name, or of that log_format of nginx
+// or LogFormat of Apache
+func LookupFormat(name string) (*Format, error) {
+	if isNginxLogFormat(name) {
+		return nginxLogFormat(name)
+	}
+	if isApacheLogFormat(name) {
+		spec, err := apacheLogFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		return nginxLogFormat(spec)
+	}
+	if name == "mixed" {
+		combined, _ := LookupFormat("combined")
+		return MixedFormat(combined), nil
+	}
+	for _, f := range LogFormats {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown log format %q", name)
+}
+
+// matchFormat returns the first format able to parse the line, or nil
+func matchFormat(line string) *Format {
+	for _, f := range LogFormats {
+		if _, ok := f.Parse(line); ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// MixedFormat parses each line with the first format able to, starting with the
+// preferred one, for the inputs interleaving several formats.
+func MixedFormat(preferred *Format) *Format {
+	return &Format{Name: "mixed", Parse: func(line string) (Record, bool) {
+		if r, ok := preferred.Parse(line); ok {
+			return r, true
+		}
+		for _, f := range LogFormats {
+			if f == preferred {
+				continue
+			}
+			if r, ok := f.Parse(line); ok {
+				return r, true
+			}
+		}
+		return Record{}, false
+	}}
+}
+
+// parseCombinedLine parses the default format of nginx:
+// $remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"
+func parseCombinedLine(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) != 9 {
+		return Record{}, false
+	}
+	return expandRecord(RawRecord{
+		ip: t[0], user: t[2], when: t[3], req: t[4], code: t[5], bytes: t[6], referrer: t[7], agent: t[8],
+	})
+}
+
+// parseCommonLine parses the Common Log Format, i.e. the combined format
+// without the referrer and the User-Agent, left empty.
+func parseCommonLine(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) != 7 {
+		return Record{}, false
+	}
+	return expandRecord(RawRecord{
+		ip: t[0], user: t[2], when: t[3], req: t[4], code: t[5], bytes: t[6],
+	})
+}
+
+// parseVhostCombinedLine parses the combined format led by the virtual host,
+// e.g. the vhost_combined of the Debian packages: $host:$server_port then the
+// combined format. The host and the port become extra fields.
+func parseVhostCombinedLine(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) != 10 || net.ParseIP(t[1]) == nil {
+		return Record{}, false
+	}
+	r, ok := expandRecord(RawRecord{
+		ip: t[1], user: t[3], when: t[4], req: t[5], code: t[6], bytes: t[7], referrer: t[8], agent: t[9],
+	})
+	if !ok {
+		return r, false
+	}
+	host := t[0]
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		if port, err := strconv.ParseInt(host[i+1:], 10, 32); err == nil {
+			host = host[:i]
+			r.SetExtra("port", port)
+		}
+	}
+	r.SetExtra("host", host)
+	return r, true
+}
+
+// parseIngressNginxLine parses the default format of the ingress-nginx
+// controller of Kubernetes, i.e. the combined format followed by
+// $request_length $request_time [$proxy_upstream_name] [$proxy_alternative_upstream_name]
+// $upstream_addr $upstream_response_length $upstream_response_time $upstream_status $req_id
+// The upstream variables are lists when the request was retried, thus the
+// length of the lines varies. $req_id becomes the ID of the record.
+func parseIngressNginxLine(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) < 18 {
+		return Record{}, false
+	}
+	length, err := strconv.ParseInt(t[9], 10, 64)
+	if err != nil {
+		return Record{}, false
+	}
+	elapsed, err := strconv.ParseFloat(t[10], 64)
+	if err != nil {
+		return Record{}, false
+	}
+	r, ok := expandRecord(RawRecord{
+		ip: t[0], user: t[2], when: t[3], req: t[4], code: t[5], bytes: t[6], referrer: t[7], agent: t[8],
+	})
+	if !ok {
+		return r, false
+	}
+	r.SetExtra("request_length", length)
+	r.SetExtra("request_time", elapsed)
+	if t[11] != "" {
+		r.SetExtra("upstream", t[11])
+	}
+	if status, err := strconv.ParseInt(t[len(t)-2], 10, 32); err == nil {
+		r.SetExtra("upstream_status", status)
+	}
+	if id := t[len(t)-1]; id != "-" {
+		r.ID = id
+	}
+	return r, true
+}
+
+// parseVarnishLine parses the default format of varnishncsa, i.e. the combined
+// format with the absolute URL in the request. The host of the URL becomes an
+// extra field.
+func parseVarnishLine(line string) (Record, bool) {
+	r, ok := parseCombinedLine(line)
+	if !ok {
+		return r, false
+	}
+	if host, path, ok := splitAbsoluteURL(r.Path); ok {
+		r.Path = path
+		r.SetExtra("host", host)
+	}
+	return r, true
+}
+
+// splitAbsoluteURL splits the absolute URL of a request into its host and its
+// path, false if the URL is not absolute.
+func splitAbsoluteURL(url string) (host, path string, ok bool) {
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(url, scheme) {
+			rest := url[len(scheme):]
+			host, path = rest, "/"
+			if i := strings.IndexAny(rest, "/?"); i >= 0 {
+				host, path = rest[:i], rest[i:]
+				if path[0] == '?' {
+					path = "/" + path
+				}
+			}
+			return host, path, true
+		}
+	}
+	return "", url, false
+}
+
+var (
+	errorLineRegex   = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d) \[(\w+)\] (\d+)#(\d+): (?:\*(\d+) )?(.*)$`)
+	errorDetailRegex = regexp.MustCompile(`, (client|server|request|upstream|host|referrer): ("[^"]*"|[^,]*)`)
+)
+
+// parseErrorLine parses a line of the error log of nginx. The level and the
+// message of the error are extra fields, with the process, the thread, the
+// connection, the server and the upstream, and the status is 0.
+func parseErrorLine(line string) (Record, bool) {
+	m := errorLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Record{}, false
+	}
+	when, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+	if err != nil {
+		return Record{}, false
+	}
+	r := Record{When: when.Unix(), Referrer: "-"}
+	message := m[6]
+	if loc := errorDetailRegex.FindStringIndex(message); loc != nil {
+		message = message[:loc[0]]
+	}
+	for _, d := range errorDetailRegex.FindAllStringSubmatch(m[6], -1) {
+		value := strings.Trim(d[2], `"`)
+		switch d[1] {
+		case "client":
+			r.Ip = value
+		case "request":
+			r.Method, r.Path, r.Version, _ = parseQuery(value)
+		case "referrer":
+			r.Referrer = value
+		default:
+			r.SetExtra(d[1], value)
+		}
+	}
+	r.SetExtra("level", m[2])
+	r.SetExtra("message", message)
+	pid, _ := strconv.ParseInt(m[3], 10, 64)
+	tid, _ := strconv.ParseInt(m[4], 10, 64)
+	r.SetExtra("pid", pid)
+	r.SetExtra("tid", tid)
+	if m[5] != "" {
+		connection, _ := strconv.ParseInt(m[5], 10, 64)
+		r.SetExtra("connection", connection)
+	}
+	return r, true
+}
+
+// parseCaddyLine parses the JSON access logs of Caddy v2, whose request is a
+// nested object with its headers. The host, the bytes read and the duration,
+// in seconds as the $request_time of nginx, are extra fields.
+func parseCaddyLine(line string) (Record, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return Record{}, false
+	}
+	var entry struct {
+		TS      interface{} `json:"ts"`
+		Request *struct {
+			ClientIP   string              `json:"client_ip"`
+			RemoteIP   string              `json:"remote_ip"`
+			RemoteAddr string              `json:"remote_addr"`
+			Proto      string              `json:"proto"`
+			Method     string              `json:"method"`
+			Host       string              `json:"host"`
+			URI        string              `json:"uri"`
+			Headers    map[string][]string `json:"headers"`
+		} `json:"request"`
+		UserID    string      `json:"user_id"`
+		Duration  interface{} `json:"duration"`
+		BytesRead int64       `json:"bytes_read"`
+		Size      int64       `json:"size"`
+		Status    *int        `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Request == nil || entry.Status == nil {
+		return Record{}, false
+	}
+	req := entry.Request
+	when, ok := JsonTime(entry.TS)
+	if !ok {
+		return Record{}, false
+	}
+	r := Record{
+		Ip:       req.ClientIP,
+		User:     entry.UserID,
+		When:     when,
+		Method:   req.Method,
+		Path:     req.URI,
+		Version:  VersionToCode[req.Proto],
+		Code:     *entry.Status,
+		Bytes:    entry.Size,
+		Referrer: "-",
+		Agent:    "-",
+	}
+	if r.Ip == "" {
+		r.Ip = req.RemoteIP
+	}
+	if r.Ip == "" {
+		// Caddy before 2.5 logged the address with its port
+		r.Ip = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			r.Ip = host
+		}
+	}
+	if r.Ip == "" {
+		return Record{}, false
+	}
+	// The canonical names of the headers, as written by Caddy
+	if v := req.Headers["Referer"]; len(v) > 0 {
+		r.Referrer = v[0]
+	}
+	if v := req.Headers["User-Agent"]; len(v) > 0 {
+		r.Agent = v[0]
+	}
+	if req.Host != "" {
+		r.SetExtra("host", req.Host)
+	}
+	r.SetExtra("bytes_read", entry.BytesRead)
+	switch d := entry.Duration.(type) {
+	case float64:
+		r.SetExtra("request_time", d)
+	case string:
+		// With the duration_format string of the encoder, e.g. 1.2ms
+		if parsed, err := time.ParseDuration(d); err == nil {
+			r.SetExtra("request_time", parsed.Seconds())
+		}
+	}
+	return r, true
+}
+
+// jsonFormat parses the JSON records whose keys follow a preset, e.g. the
+// output of nlogx itself or an nginx log_format with escape=json.
+func jsonFormat(name, preset string) *Format {
+	keys := JsonPresets[preset]
+	return &Format{Name: name, Parse: func(line string) (Record, bool) {
+		return parseJSONLine(line, keys)
+	}}
+}
+
+func lookupNested(obj map[string]interface{}, key string) (interface{}, bool) {
+	parts := strings.Split(key, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := obj[p].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = sub
+	}
+	v, ok := obj[parts[len(parts)-1]]
+	return v, ok
+}
+
+func jsonInt(v interface{}) int64 {
+	switch x := ToNumber(v).(type) {
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	}
+	return 0
+}
+
+// JsonTime accepts the epoch, RFC 3339 and the time_local of nginx
+func JsonTime(v interface{}) (int64, bool) {
+	switch x := ToNumber(v).(type) {
+	case int64:
+		return x, true
+	case float64:
+		return int64(x), true
+	case string:
+		for _, layout := range []string{time.RFC3339, "02/Jan/2006:15:04:05 -0700"} {
+			if t, err := time.Parse(layout, x); err == nil {
+				return t.Unix(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func parseJSONLine(line string, keys map[string]JsonKey) (Record, bool) {
+	var r Record
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return r, false
+	}
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return r, false
+	}
+	// The aliases found, that the extra fields skip
+	known := map[string]bool{"time_iso8601": true, "request": true}
+	get := func(field string) (interface{}, bool) {
+		if v, ok := lookupNested(obj, keys[field].Key); ok {
+			return v, true
+		}
+		for _, alias := range keys[field].aliases {
+			if v, ok := lookupNested(obj, alias); ok {
+				known[strings.SplitN(alias, ".", 2)[0]] = true
+				return v, true
+			}
+		}
+		return nil, false
+	}
+	str := func(field string) string { v, _ := get(field); return ToString(v) }
+
+	src, ok := get("src")
+	if !ok {
+		return r, false
+	}
+	t, ok := get("t")
+	if !ok {
+		// nginx also offers the time in ISO 8601
+		if t, ok = obj["time_iso8601"]; !ok {
+			return r, false
+		}
+	}
+	if r.When, ok = JsonTime(t); !ok {
+		return r, false
+	}
+	r.ID, r.Ip = str("id"), ToString(src)
+	r.User = str("user")
+	if r.User == "-" {
+		r.User = ""
+	}
+	r.Method, r.Path = str("method"), str("path")
+	if request, ok := obj["request"].(string); ok && r.Path == "" {
+		r.Method, r.Path, r.Version, _ = parseQuery(request)
+	} else if v, ok := get("version"); ok {
+		if s, ok := v.(string); ok {
+			r.Version = VersionToCode["HTTP/"+strings.TrimPrefix(s, "HTTP/")]
+		} else {
+			r.Version = int(jsonInt(v))
+		}
+	}
+	status, _ := get("status")
+	bytes, _ := get("bytes")
+	asn, _ := get("asn")
+	r.Code, r.Bytes, r.ASN = int(jsonInt(status)), jsonInt(bytes), uint(jsonInt(asn))
+	r.Referrer, r.Agent, r.Country = str("referrer"), str("agent"), str("country")
+	if l, ok := get("indicators"); ok {
+		if l, ok := l.([]interface{}); ok {
+			for _, x := range l {
+				r.Indicators = append(r.Indicators, ToString(x))
+			}
+		}
+	}
+	if extra, ok := get("extra"); ok {
+		if extra, ok := extra.(map[string]interface{}); ok && len(extra) > 0 {
+			r.Extra = extra
+		}
+	}
+	// The other variables logged, e.g. the $gzip_ratio of nginx, or the
+	// objects of the log_format
+	for _, k := range keys {
+		known[strings.SplitN(k.Key, ".", 2)[0]] = true
+	}
+	for k, v := range obj {
+		if v != nil && !known[k] {
+			r.SetExtra(k, v)
+		}
+	}
+	return r, true
+}
+
+// DetectFormat samples the first lines of the input to find its most frequent
+// format, and reports the mixed inputs. Each line is then parsed with the
+// matching format, the most frequent one first. A tick of stop, if any, ends
+// the sample early, e.g. when following a log growing slowly.
+func DetectFormat(in <-chan string, sample int, stop <-chan time.Time) <-chan Line {
+	out := make(chan Line, 64)
+	go func() {
+		defer close(out)
+		lines := make([]string, 0, sample)
+	sampling:
+		for len(lines) < sample {
+			select {
+			case line, ok := <-in:
+				if !ok {
+					break sampling
+				}
+				lines = append(lines, line)
+			case <-stop:
+				if len(lines) > 0 {
+					break sampling
+				}
+			}
+		}
+
+		counts := make(map[string]int)
+		unknown := 0
+		sampled := &w3cDirectives{}
+		for _, line := range lines {
+			if sampled.consume(line) {
+				continue
+			}
+			if sampled.format != nil {
+				if _, ok := sampled.format.Parse(line); ok {
+					counts["w3c"]++
+					continue
+				}
+			}
+			if f := matchFormat(line); f != nil {
+				counts[f.Name]++
+			} else {
+				unknown++
+			}
+		}
+		chosen, _ := LookupFormat("combined")
+		best := 0
+		for _, f := range LogFormats {
+			if counts[f.Name] > best {
+				chosen, best = f, counts[f.Name]
+			}
+		}
+		if best == 0 && len(lines) > 0 {
+			Logger.Warn().Int("sampled", len(lines)).Msg("No known format in the sample, see --log-format")
+		} else if len(counts) > 1 || unknown > 0 {
+			formats := zerolog.Dict()
+			for _, f := range LogFormats {
+				if n := counts[f.Name]; n > 0 {
+					formats = formats.Int(f.Name, n)
+				}
+			}
+			Logger.Warn().Str("chosen", chosen.Name).Dict("formats", formats).
+				Int("unknown", unknown).Int("sampled", len(lines)).Msg("Mixed formats in the input")
+		} else {
+			Logger.Debug().Str("format", chosen.Name).Int("sampled", len(lines)).Msg("Format detected")
+		}
+
+		// The format may change past the sample, e.g. after a change of the
+		// configuration of nginx.
+		f := MixedFormat(chosen)
+		directives := &w3cDirectives{}
+		tag := func(line string) {
+			if directives.consume(line) {
+				return
+			}
+			if directives.mixed != nil {
+				out <- Line{Text: line, Format: directives.mixed}
+			} else {
+				out <- Line{Text: line, Format: f}
+			}
+		}
+		for _, line := range lines {
+			tag(line)
+		}
+		for line := range in {
+			tag(line)
+		}
+	}()
+	return out
+}
+
+// withFormat parses all the lines with the same format, the fields of the W3C
+// logs being set by their directives.
+func withFormat(in <-chan string, f *Format, sample int) <-chan Line {
+	out := make(chan Line, 64)
+	go func() {
+		defer close(out)
+		directives := &w3cDirectives{}
+		check := &formatCheck{format: f, left: sample, detected: make(map[string]int)}
+		defer check.report()
+		for line := range in {
+			if directives.consume(line) {
+				continue
+			}
+			switch {
+			case directives.format != nil && f.Name == "w3c":
+				out <- Line{Text: line, Format: directives.format}
+			case directives.format != nil && f.Name == "mixed":
+				out <- Line{Text: line, Format: directives.mixed}
+			default:
+				check.line(line)
+				out <- Line{Text: line, Format: f}
+			}
+		}
+	}()
+	return out
+}
+
+// formatCheck samples the first lines parsed with the format given, to report
+// a format that parses none of them, e.g. an error log read as an access log,
+// with the format detected instead, rather than silently producing no record.
+type formatCheck struct {
+	format        *Format
+	left, sampled int
+	parsed        int
+	detected      map[string]int
+	done          bool
+}
+
+func (c *formatCheck) line(line string) {
+	if c.done || c.format.Name == "mixed" {
+		return
+	}
+	c.sampled++
+	if _, ok := c.format.Parse(line); ok {
+		c.parsed++
+	} else if other := matchFormat(line); other != nil {
+		c.detected[other.Name]++
+	}
+	if c.left--; c.left <= 0 {
+		c.report()
+	}
+}
+
+// report warns once, at the end of the sample or of the input
+func (c *formatCheck) report() {
+	if c.done {
+		return
+	}
+	c.done = true
+	if c.sampled == 0 || c.parsed > 0 {
+		return
+	}
+	event := Logger.Warn().Str("format", c.format.Name).Int("sampled", c.sampled)
+	detected, best := "", 0
+	for _, f := range LogFormats {
+		if n := c.detected[f.Name]; n > best {
+			detected, best = f.Name, n
+		}
+	}
+	if detected != "" {
+		event = event.Str("detected", detected)
+	}
+	event.Msg("No line of the sample parses with the format, see --log-format and --type")
+}
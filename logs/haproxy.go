@@ -0,0 +1,136 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// haproxyLineRegex matches the HTTP log format of HAProxy, after the optional
+// prefix of syslog:
+// client:port [accept_date] frontend backend/server TR/Tw/Tc/Tr/Ta status bytes
+// req_cookie res_cookie termination actconn/feconn/beconn/srv_conn/retries
+// srv_queue/backend_queue {req_headers} {res_headers} "request"
+var haproxyLineRegex = regexp.MustCompile(`(?:^|\s)(\S+):\d+ \[(\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d)(?:\.\d+)?\] ` +
+	`(\S+) (\S+)/(\S+) (-?\d+)/(-?\d+)/(-?\d+)/(-?\d+)/\+?(-?\d+) (-?\d+) \+?(\d+) \S+ \S+ (\S{4}) ` +
+	`(\d+)/(\d+)/(\d+)/(\d+)/\+?(\d+) (\d+)/(\d+) (?:\{([^}]*)\} )?(?:\{([^}]*)\} )?"([^"]*)"`)
+
+// HaproxyCounters are the extra fields of the concurrent connections when the
+// request was logged: on the process, the frontend, the backend and the server.
+var HaproxyCounters = []string{"actconn", "feconn", "beconn", "srv_conn"}
+
+// HaproxyTimers are the extra fields of the timers of HAProxy, in milliseconds
+// and -1 when the step was not reached.
+var HaproxyTimers = []string{"time_request", "time_queue", "time_connect", "time_response", "time_active"}
+
+// HaproxyRequestCaptures and HaproxyResponseCaptures are the names of the
+// headers captured by the "capture request header" and "capture response
+// header" directives, in their order, if configured. Else the captures are
+// kept whole into the request_headers and response_headers extra fields.
+var HaproxyRequestCaptures, HaproxyResponseCaptures []string
+
+// haproxyCaptureField returns the field of a header captured, named as the
+// variables of nginx, e.g. http_host or sent_http_content_type
+func haproxyCaptureField(header string, response bool) string {
+	name := strings.ToLower(strings.Replace(header, "-", "_", -1))
+	if response {
+		return "sent_http_" + name
+	}
+	return "http_" + name
+}
+
+// HaproxyCaptureFields returns the extra fields of the headers captured
+func HaproxyCaptureFields() []string {
+	var out []string
+	for _, h := range HaproxyRequestCaptures {
+		if f := haproxyCaptureField(h, false); f != "http_user_agent" && f != "http_referer" {
+			out = append(out, f)
+		}
+	}
+	for _, h := range HaproxyResponseCaptures {
+		out = append(out, haproxyCaptureField(h, true))
+	}
+	return out
+}
+
+// setCaptures sets the fields of the headers captured, separated by '|'
+func (r *Record) setCaptures(captured string, names []string, response bool) {
+	for i, v := range strings.Split(captured, "|") {
+		if i >= len(names) || v == "" {
+			continue
+		}
+		switch f := haproxyCaptureField(names[i], response); f {
+		case "http_user_agent":
+			r.Agent = v
+		case "http_referer":
+			r.Referrer = v
+		default:
+			r.SetExtra(f, v)
+		}
+	}
+}
+
+// parseHAProxyLine parses the HTTP log format of HAProxy. The User-Agent and the
+// referrer are "-", as in the combined format, unless captured in the headers.
+// The frontends suffixed with '~' accept the connections over SSL/TLS.
+func parseHAProxyLine(line string) (Record, bool) {
+	m := haproxyLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Record{}, false
+	}
+	when, err := time.ParseInLocation("02/Jan/2006:15:04:05", m[2], time.Local)
+	if err != nil {
+		return Record{}, false
+	}
+	code, _ := strconv.Atoi(m[11])
+	bytes, _ := strconv.ParseInt(m[12], 10, 64)
+	r := Record{Ip: m[1], When: when.Unix(), Code: code, Bytes: bytes, Agent: "-", Referrer: "-"}
+	r.Method, r.Path, r.Version, _ = parseQuery(m[23])
+
+	r.SetExtra("frontend", strings.TrimSuffix(m[3], "~"))
+	r.SetExtra("ssl", strings.HasSuffix(m[3], "~"))
+	r.SetExtra("backend", m[4])
+	r.SetExtra("server", m[5])
+	for i, name := range HaproxyTimers {
+		ms, _ := strconv.ParseInt(m[6+i], 10, 64)
+		r.SetExtra(name, ms)
+	}
+	r.SetExtra("termination", m[13])
+	for i, name := range HaproxyCounters {
+		n, _ := strconv.ParseInt(m[14+i], 10, 64)
+		r.SetExtra(name, n)
+	}
+	retries, _ := strconv.ParseInt(m[18], 10, 64)
+	r.SetExtra("retries", retries)
+	// The requests queued before this one, for the server then the backend
+	srvQueue, _ := strconv.ParseInt(m[19], 10, 64)
+	r.SetExtra("srv_queue", srvQueue)
+	backendQueue, _ := strconv.ParseInt(m[20], 10, 64)
+	r.SetExtra("backend_queue", backendQueue)
+	// A single block is of the response when only its headers are captured
+	requestHeaders, responseHeaders := m[21], m[22]
+	if responseHeaders == "" && len(HaproxyRequestCaptures) == 0 && len(HaproxyResponseCaptures) > 0 {
+		requestHeaders, responseHeaders = "", requestHeaders
+	}
+	switch {
+	case requestHeaders == "":
+	case len(HaproxyRequestCaptures) > 0:
+		r.setCaptures(requestHeaders, HaproxyRequestCaptures, false)
+	default:
+		r.SetExtra("request_headers", requestHeaders)
+	}
+	switch {
+	case responseHeaders == "":
+	case len(HaproxyResponseCaptures) > 0:
+		r.setCaptures(responseHeaders, HaproxyResponseCaptures, true)
+	default:
+		r.SetExtra("response_headers", responseHeaders)
+	}
+	return r, true
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import "testing"
+
+const haproxyLine = `haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in~ static/srv1 ` +
+	`10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu|Mozilla/5.0} {text/html} "GET /index.html HTTP/1.1"`
+
+func TestHAProxyLine(t *testing.T) {
+	r, ok := parseHAProxyLine(haproxyLine)
+	if !ok {
+		t.Fatal("Expected the line to be parsed")
+	}
+	if r.Agent != "-" || r.Referrer != "-" {
+		t.Errorf("Expected the agent and the referrer missing, got %q and %q", r.Agent, r.Referrer)
+	}
+	if r.Extra["frontend"] != "http-in" || r.Extra["ssl"] != true {
+		t.Errorf("Expected the frontend http-in over SSL, got %v and %v", r.Extra["frontend"], r.Extra["ssl"])
+	}
+	if r.Extra["request_headers"] != "1wt.eu|Mozilla/5.0" || r.Extra["response_headers"] != "text/html" {
+		t.Errorf("Expected the captures kept whole, got %v", r.Extra)
+	}
+}
+
+func TestHAProxyCaptures(t *testing.T) {
+	HaproxyRequestCaptures, HaproxyResponseCaptures = []string{"Host", "User-Agent"}, []string{"Content-Type"}
+	defer func() { HaproxyRequestCaptures, HaproxyResponseCaptures = nil, nil }()
+
+	r, ok := parseHAProxyLine(haproxyLine)
+	if !ok {
+		t.Fatal("Expected the line to be parsed")
+	}
+	if r.Agent != "Mozilla/5.0" || r.Referrer != "-" {
+		t.Errorf("Expected the agent captured, got %q and %q", r.Agent, r.Referrer)
+	}
+	if r.Extra["http_host"] != "1wt.eu" || r.Extra["sent_http_content_type"] != "text/html" {
+		t.Errorf("Expected the headers captured as extra fields, got %v", r.Extra)
+	}
+	if _, ok := r.Extra["request_headers"]; ok {
+		t.Errorf("Unexpected captures kept whole: %v", r.Extra)
+	}
+}
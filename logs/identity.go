@@ -0,0 +1,49 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Identity is the UUIDv5 of the source, the time, the request and the agent
+// of the record. The same line shipped through several paths thus gets the
+// same ID, and two identical requests within the same second too.
+func (r *Record) Identity() string {
+	sb := strings.Builder{}
+	sb.WriteString("record\x00")
+	sb.WriteString(r.Ip)
+	sb.WriteByte(0)
+	sb.WriteString(strconv.FormatInt(r.When, 10))
+	sb.WriteByte(0)
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Path)
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(r.Version))
+	sb.WriteByte(0)
+	sb.WriteString(r.Agent)
+	return Uuid5(sb.String())
+}
+
+// nlogxNamespace is the UUIDv5 namespace of the indicators, so that exporting
+// twice the same sighting produces the same identifier and the threat-intel
+// platform deduplicates it.
+var nlogxNamespace = [16]byte{
+	0x6e, 0x6c, 0x6f, 0x67, 0x78, 0x2d, 0x4a, 0x8b,
+	0x9e, 0x21, 0x5d, 0x0c, 0x3b, 0x44, 0xa7, 0x19,
+}
+
+// Uuid5 returns the UUIDv5 of the name, in the namespace of nlogx
+func Uuid5(name string) string {
+	h := sha1.Sum(append(nlogxNamespace[:], name...))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
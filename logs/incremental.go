@@ -0,0 +1,142 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// inputPosition is the position reached in a log by the previous run, the log
+// identified by its device and inode whatever its name after a rotation, or by
+// its path where files have no inode.
+type inputPosition struct {
+	Path   string `json:"path"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+// runState is the state of the runs reading the same logs, e.g. from cron,
+// each one reading the lines appended since the previous one.
+type runState struct {
+	Inputs []inputPosition `json:"inputs"`
+}
+
+func loadRunState(path string) (*runState, error) {
+	s := &runState{}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(raw, s)
+}
+
+// lookup returns the position of the log in the previous run, if any
+func (s *runState) lookup(pos inputPosition, identified bool) (inputPosition, bool) {
+	for _, prev := range s.Inputs {
+		if identified && prev.Device == pos.Device && prev.Inode == pos.Inode ||
+			!identified && prev.Path == pos.Path {
+			return prev, true
+		}
+	}
+	return inputPosition{}, false
+}
+
+// readNewLines reads the lines of the files appended since the previous run,
+// from their position saved in the state file, then saves the positions
+// reached. A log shorter than its position, e.g. truncated by copytruncate, is
+// read again from its start. The partial line ending a log is left for the
+// next run. The compressed logs are read once, unless they change. An error
+// ends the lines, the state kept as it was, and is passed to fail.
+func readNewLines(paths []string, statePath string, done <-chan struct{}, fail func(err error)) <-chan string {
+	out := make(chan string, 64)
+	go func() {
+		defer close(out)
+		prev, err := loadRunState(statePath)
+		if err != nil {
+			readFailed(fail, fmt.Errorf("Failed to load the state %s: %v", statePath, err))
+			return
+		}
+		next := &runState{}
+		for _, path := range paths {
+			pos, err := readNewLinesOf(path, prev, out, done)
+			if err == errCancelled {
+				// The lines read might not all be consumed, the state stays
+				return
+			} else if err != nil {
+				readFailed(fail, fileError(path, err))
+				return
+			}
+			next.Inputs = append(next.Inputs, pos)
+		}
+		// The logs not read anymore, e.g. deleted, are forgotten
+		raw, _ := json.Marshal(next)
+		if err := WriteAtomic(statePath, raw); err != nil {
+			readFailed(fail, fmt.Errorf("Failed to save the state %s: %v", statePath, err))
+		}
+	}()
+	return out
+}
+
+func readNewLinesOf(path string, prev *runState, out chan<- string, done <-chan struct{}) (inputPosition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return inputPosition{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return inputPosition{}, err
+	}
+	pos := inputPosition{Path: path, Size: st.Size()}
+	var identified bool
+	pos.Device, pos.Inode, identified = fileIdentity(st)
+	last, known := prev.lookup(pos, identified)
+
+	in := bufio.NewReaderSize(f, 64*1024)
+	magic, _ := in.Peek(4)
+	if bytes.HasPrefix(magic, GzipMagic) || bytes.HasPrefix(magic, bzip2Magic) || bytes.HasPrefix(magic, zstdMagic) {
+		pos.Offset = pos.Size
+		if known && last.Size == pos.Size {
+			return pos, nil
+		}
+		return pos, scanLines(in, out, done)
+	}
+
+	if known && last.Offset <= pos.Size {
+		pos.Offset = last.Offset
+	} else if known {
+		Logger.Info().Str("path", path).Msg("Log truncated, read again")
+	}
+	if pos.Offset > 0 {
+		if _, err = f.Seek(pos.Offset, io.SeekStart); err != nil {
+			return pos, err
+		}
+		in.Reset(f)
+	}
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+		pos.Offset += int64(len(line))
+		if err = sendLine(out, strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), done); err != nil {
+			return pos, err
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ReadFiles reads the lines of the files in turn, as if concatenated, the
+// compressed ones decompressed. A read error, naming the file, ends the lines
+// and is passed to fail, or else logged.
+func ReadFiles(paths []string, fail func(err error)) <-chan string {
+	return readFiles(paths, nil, fail)
+}
+
+// readFiles is ReadFiles, stopping once done is closed
+func readFiles(paths []string, done <-chan struct{}, fail func(err error)) <-chan string {
+	out := make(chan string, 64)
+	go func() {
+		defer close(out)
+		for _, path := range paths {
+			if err := readFile(path, out, done); err == errCancelled {
+				return
+			} else if err != nil {
+				readFailed(fail, fileError(path, err))
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// fileError names the file in the error, unless already done
+func fileError(path string, err error) error {
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+	return fmt.Errorf("%s: %v", path, err)
+}
+
+func readFile(path string, out chan<- string, done <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanLines(f, out, done)
+}
+
+// followFile reads the lines of a live log, as tail -F does: at its end, it
+// waits for more lines, reads it again from its start once truncated, and
+// reopens the path once the log has been renamed by a rotation. It starts at
+// offset, and saves its position into cp, if any, until done is closed.
+func followFile(path string, offset int64, out chan<- string, clock Clock, cp *checkpoint, done <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	in := bufio.NewReaderSize(f, 64*1024)
+	// partial is the last line, until its end is written
+	partial := ""
+	readAvailable := func() error {
+		for {
+			chunk, err := in.ReadString('\n')
+			offset += int64(len(chunk))
+			partial += chunk
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := sendLine(out, strings.TrimSuffix(strings.TrimSuffix(partial, "\n"), "\r"), done); err != nil {
+				return err
+			}
+			partial = ""
+		}
+	}
+
+	ticker := clock.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := readAvailable(); err != nil {
+			return err
+		}
+		if cp != nil {
+			// The partial line is read again after a restart
+			cp.save(f, offset-int64(len(partial)))
+		}
+		select {
+		case <-ticker.C():
+		case <-done:
+			return errCancelled
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			// Between the rename of the log and the creation of the new one
+			continue
+		}
+		current, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		switch {
+		case !os.SameFile(current, st):
+			// The lines written before the rename end the old log
+			if err := readAvailable(); err != nil {
+				return err
+			}
+			if partial != "" {
+				if err := sendLine(out, partial, done); err != nil {
+					return err
+				}
+			}
+			Logger.Info().Str("path", path).Msg("Log rotated, reopened")
+			next, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			f = next
+		case st.Size() < offset:
+			Logger.Info().Str("path", path).Msg("Log truncated, read again")
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		in.Reset(f)
+		offset, partial = 0, ""
+	}
+}
+
+// rotatedLog splits the name of a rotated log into its base and its index,
+// e.g. access.log and 2 for access.log.2.gz
+var rotatedLog = regexp.MustCompile(`^(.*?)(?:\.(\d{1,3}))?(?:\.(?:gz|bz2|zst))?$`)
+
+// LogFile is a log to sort with its modification time, in nanoseconds
+type LogFile struct {
+	Path  string
+	Mtime int64
+}
+
+// SortLogs returns the paths of the logs, the oldest first: by decreasing
+// rotation index among the rotations of a log, by modification time
+// otherwise.
+func SortLogs(files []LogFile) []string {
+	type rotation struct {
+		LogFile
+		base  string
+		index int
+	}
+	all := make([]rotation, len(files))
+	for i, f := range files {
+		m := rotatedLog.FindStringSubmatch(f.Path)
+		index, _ := strconv.Atoi(m[2])
+		all[i] = rotation{LogFile: f, base: m[1], index: index}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		switch {
+		case a.base == b.base && a.index != b.index:
+			return a.index > b.index
+		case a.Mtime != b.Mtime:
+			return a.Mtime < b.Mtime
+		}
+		return a.Path < b.Path
+	})
+	out := make([]string, len(all))
+	for i, f := range all {
+		out[i] = f.Path
+	}
+	return out
+}
+
+var (
+	GzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns the content of the input, decompressed if its magic bytes
+// tell gzip, bzip2 or zstd. The standard library lacks zstd, so that the zstd
+// command, if installed, decompresses it.
+func Decompress(src io.Reader) (io.ReadCloser, error) {
+	in := bufio.NewReaderSize(src, 64*1024)
+	magic, _ := in.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, GzipMagic):
+		return gzip.NewReader(in)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(in)), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return ZstdCommand(in)
+	}
+	return ioutil.NopCloser(in), nil
+}
+
+// zstdReader is the output of a zstd command, whose status is checked once
+// the output has been read.
+type zstdReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	done bool
+	err  error
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	if z.done {
+		return 0, z.err
+	}
+	n, err := z.ReadCloser.Read(p)
+	if err == io.EOF {
+		z.done, z.err = true, io.EOF
+		if werr := z.cmd.Wait(); werr != nil {
+			z.err = fmt.Errorf("zstd: %v", werr)
+		}
+		return n, z.err
+	}
+	return n, err
+}
+
+func (z *zstdReader) Close() error {
+	z.ReadCloser.Close()
+	if !z.done {
+		z.done = true
+		z.cmd.Wait()
+	}
+	return nil
+}
+
+// ZstdCommand decompresses the input with the zstd command, if installed
+func ZstdCommand(in io.Reader) (io.ReadCloser, error) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, errors.New("zstd compressed input, but no zstd command to decompress it")
+	}
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = in
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &zstdReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// decodeInput skips the byte order mark of the input, and converts the UTF-16
+// inputs, e.g. the logs exported by the Windows tools, into UTF-8.
+func decodeInput(src io.Reader) io.Reader {
+	in := bufio.NewReaderSize(src, 64*1024)
+	bom, _ := in.Peek(3)
+	switch {
+	case len(bom) >= 3 && bom[0] == 0xEF && bom[1] == 0xBB && bom[2] == 0xBF:
+		in.Discard(3)
+	case len(bom) >= 2 && bom[0] == 0xFF && bom[1] == 0xFE:
+		in.Discard(2)
+		return &utf16Reader{in: in, order: binary.LittleEndian}
+	case len(bom) >= 2 && bom[0] == 0xFE && bom[1] == 0xFF:
+		in.Discard(2)
+		return &utf16Reader{in: in, order: binary.BigEndian}
+	}
+	return in
+}
+
+type utf16Reader struct {
+	in    *bufio.Reader
+	order binary.ByteOrder
+	unit  [2]byte
+}
+
+func (u *utf16Reader) next() (rune, error) {
+	if _, err := io.ReadFull(u.in, u.unit[:]); err != nil {
+		return 0, err
+	}
+	return rune(u.order.Uint16(u.unit[:])), nil
+}
+
+// Read decodes as many characters as fit, without waiting for more input than
+// already available once a character has been decoded.
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n+utf8.UTFMax <= len(p) && (n == 0 || u.in.Buffered() >= 2) {
+		r, err := u.next()
+		if err == nil && utf16.IsSurrogate(r) {
+			var r2 rune
+			if r2, err = u.next(); err == nil {
+				r = utf16.DecodeRune(r, r2)
+			}
+		}
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		n += utf8.EncodeRune(p[n:], r)
+	}
+	return n, nil
+}
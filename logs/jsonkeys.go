@@ -0,0 +1,78 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"time"
+)
+
+// JsonKey is the key of a field of the Record in the JSON output, and an
+// optional conversion of its value. Dots in the key produce nested objects.
+type JsonKey struct {
+	Key  string
+	Conv func(r *Record) interface{}
+	// aliases are the other keys accepted at the input, the usual names
+	// chosen in the log_format of nginx
+	aliases []string
+}
+
+var versionToProtocol = map[int]string{0: "1.0", 1: "1.1", 2: "2.0"}
+
+// JsonPresets maps the fields of the Record, plus "indicators" and "extra",
+// to the keys expected by the usual consumers.
+var JsonPresets = map[string]map[string]JsonKey{
+	"short": {
+		"id": {Key: "id"}, "src": {Key: "src"}, "user": {Key: "user"}, "t": {Key: "t"},
+		"method": {Key: "method"}, "path": {Key: "path"}, "version": {Key: "version"},
+		"status": {Key: "status"}, "bytes": {Key: "bytes"}, "referrer": {Key: "referrer"},
+		"agent": {Key: "agent"}, "country": {Key: "country"}, "asn": {Key: "asn"},
+		"indicators": {Key: "indicators"}, "extra": {Key: "extra"},
+	},
+	// Elastic Common Schema
+	"ecs": {
+		"id":   {Key: "event.id"},
+		"src":  {Key: "source.ip"},
+		"user": {Key: "user.name"},
+		"t": {Key: "@timestamp", Conv: func(r *Record) interface{} {
+			return time.Unix(r.When, 0).UTC().Format(time.RFC3339)
+		}},
+		"method": {Key: "http.request.method"},
+		"path":   {Key: "url.path"},
+		"version": {Key: "http.version", Conv: func(r *Record) interface{} {
+			return versionToProtocol[r.Version]
+		}},
+		"status":     {Key: "http.response.status_code"},
+		"bytes":      {Key: "http.response.body.bytes"},
+		"referrer":   {Key: "http.request.referrer"},
+		"agent":      {Key: "user_agent.original"},
+		"country":    {Key: "source.geo.country_iso_code"},
+		"asn":        {Key: "source.as.number"},
+		"indicators": {Key: "tags"},
+		"extra":      {Key: "labels"},
+	},
+	// The names of the variables of nginx
+	"nginx": {
+		"id":   {Key: "request_id"},
+		"src":  {Key: "remote_addr", aliases: []string{"remote_ip", "client_ip", "client"}},
+		"user": {Key: "remote_user"},
+		"t": {Key: "time_local", aliases: []string{"msec", "time", "timestamp", "@timestamp"}, Conv: func(r *Record) interface{} {
+			return time.Unix(r.When, 0).Format("02/Jan/2006:15:04:05 -0700")
+		}},
+		"method": {Key: "request_method", aliases: []string{"method"}},
+		"path":   {Key: "request_uri", aliases: []string{"uri", "path"}},
+		"version": {Key: "server_protocol", aliases: []string{"protocol"}, Conv: func(r *Record) interface{} {
+			return "HTTP/" + versionToProtocol[r.Version]
+		}},
+		"status":     {Key: "status"},
+		"bytes":      {Key: "body_bytes_sent", aliases: []string{"bytes_sent", "bytes"}},
+		"referrer":   {Key: "http_referer", aliases: []string{"referer", "referrer"}},
+		"agent":      {Key: "http_user_agent", aliases: []string{"user_agent", "agent"}},
+		"country":    {Key: "geoip_country_code"},
+		"asn":        {Key: "geoip_asn"},
+		"indicators": {Key: "indicators"},
+		"extra":      {Key: "extra"},
+	},
+}
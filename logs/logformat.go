@@ -0,0 +1,145 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nginxVariable matches the variables of a log_format, $name or ${name}
+var nginxVariable = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// isNginxLogFormat tells if the name of a format is rather the string of a
+// log_format of nginx, e.g. '$remote_addr - $remote_user [$time_local] ...'
+func isNginxLogFormat(name string) bool {
+	return nginxVariable.MatchString(name)
+}
+
+// nginxLogFormat parses the lines of a log_format of nginx. Each variable
+// matches up to the first character of the text after it, or the rest of the
+// line when last. The variables of the fields of the records fill them, the
+// others become extra fields, numbers when they look like ones.
+func nginxLogFormat(spec string) (*Format, error) {
+	var expr strings.Builder
+	var variables []string
+	expr.WriteByte('^')
+	locs := nginxVariable.FindAllStringSubmatchIndex(spec, -1)
+	last := 0
+	for i, loc := range locs {
+		expr.WriteString(regexp.QuoteMeta(spec[last:loc[0]]))
+		// ${name} or else $name
+		var name string
+		if loc[2] >= 0 {
+			name = spec[loc[2]:loc[3]]
+		} else {
+			name = spec[loc[4]:loc[5]]
+		}
+		variables = append(variables, name)
+		last = loc[1]
+		switch {
+		case last == len(spec):
+			expr.WriteString(`(.*)`)
+		case i+1 < len(locs) && locs[i+1][0] == last:
+			expr.WriteString(`(.*?)`)
+		default:
+			expr.WriteString(`([^` + regexp.QuoteMeta(spec[last:last+1]) + `]*)`)
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(spec[last:]))
+	expr.WriteByte('$')
+	if len(variables) == 0 {
+		return nil, errors.New("No variable in the log format")
+	}
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Format{Name: "log_format", Parse: func(line string) (Record, bool) {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			return Record{}, false
+		}
+		// Without referrer nor User-Agent, as the Common Log Format
+		var r Record
+		var hasTime, hasStatus bool
+		for i, name := range variables {
+			v := m[i+1]
+			var err error
+			switch name {
+			case "remote_addr":
+				r.Ip = v
+			case "remote_user":
+				if v != "-" {
+					r.User = v
+				}
+			case "time_local":
+				r.When, err = parseDate(v)
+				hasTime = err == nil
+			case "time_iso8601":
+				var t time.Time
+				t, err = time.Parse(time.RFC3339, v)
+				r.When, hasTime = t.Unix(), err == nil
+			case "msec":
+				var f float64
+				f, err = strconv.ParseFloat(v, 64)
+				r.When, hasTime = int64(f), err == nil
+			case "request":
+				r.Method, r.Path, r.Version, err = parseQuery(v)
+			case "request_method":
+				r.Method = v
+			case "request_uri":
+				r.Path = v
+			case "uri":
+				// Without the arguments, unless $request_uri is also logged
+				if r.Path == "" {
+					r.Path = v
+				}
+			case "server_protocol":
+				r.Version = VersionToCode[v]
+			case "status":
+				r.Code, err = strconv.Atoi(v)
+				hasStatus = err == nil
+			case "body_bytes_sent":
+				r.Bytes, _ = strconv.ParseInt(v, 10, 64)
+			case "http_referer":
+				r.Referrer = v
+			case "http_user_agent":
+				r.Agent = v
+			case "request_time_ms", "request_time_us":
+				// In seconds, as the $request_time of nginx
+				var f float64
+				f, err = strconv.ParseFloat(v, 64)
+				if name == "request_time_ms" {
+					r.SetExtra("request_time", f/1e3)
+				} else {
+					r.SetExtra("request_time", f/1e6)
+				}
+			case "request_id", "http_x_amz_cf_id":
+				// The id of the request at the edge of CloudFront, the
+				// same in its logs
+				if v != "-" {
+					r.ID = v
+				}
+			default:
+				if v != "-" && v != "" {
+					r.SetExtra(name, ToNumber(v))
+				}
+			}
+			if err != nil {
+				return Record{}, false
+			}
+		}
+		if r.Ip == "" || !hasTime || !hasStatus {
+			return Record{}, false
+		}
+		return r, true
+	}}, nil
+}
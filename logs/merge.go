@@ -0,0 +1,90 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"container/heap"
+)
+
+// timedLine is a line with the time of its record, or of the record before in
+// its log when the line does not parse, so that it stays among its neighbours.
+type timedLine struct {
+	raw  Line
+	when int64
+	// index is the one of the log, breaking the ties
+	index int
+}
+
+type timedLines struct {
+	heads []timedLine
+	logs  []<-chan timedLine
+}
+
+func (h *timedLines) Len() int { return len(h.heads) }
+
+func (h *timedLines) Less(i, j int) bool {
+	a, b := &h.heads[i], &h.heads[j]
+	if a.when != b.when {
+		return a.when < b.when
+	}
+	return a.index < b.index
+}
+
+func (h *timedLines) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *timedLines) Push(x interface{}) { h.heads = append(h.heads, x.(timedLine)) }
+
+func (h *timedLines) Pop() interface{} {
+	n := len(h.heads)
+	x := h.heads[n-1]
+	h.heads = h.heads[:n-1]
+	return x
+}
+
+// timeLines parses the lines of a log for their time, the records being
+// parsed again past the merge.
+func timeLines(in <-chan Line, index int) <-chan timedLine {
+	out := make(chan timedLine, 64)
+	go func() {
+		defer close(out)
+		var when int64
+		for l := range in {
+			if r, ok := l.Format.Parse(l.Text); ok {
+				when = r.When
+			}
+			out <- timedLine{raw: l, when: when, index: index}
+		}
+	}()
+	return out
+}
+
+// mergeLines merges the lines of the logs in time order, the logs being each in
+// time order, as a k-way merge: it waits for the next line of every log before
+// emitting the oldest one.
+func mergeLines(logs []<-chan timedLine) <-chan Line {
+	out := make(chan Line, 64)
+	go func() {
+		defer close(out)
+		h := &timedLines{logs: logs}
+		for _, log := range logs {
+			if l, ok := <-log; ok {
+				h.heads = append(h.heads, l)
+			}
+		}
+		heap.Init(h)
+		for h.Len() > 0 {
+			head := h.heads[0]
+			out <- head.raw
+			if l, ok := <-logs[head.index]; ok {
+				h.heads[0] = l
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"sync"
+)
+
+type expansion struct {
+	r  Record
+	ok bool
+}
+
+type expansionJob struct {
+	raw  Line
+	slot chan expansion
+}
+
+// expandParallel parses the lines with several workers. Unless the
+// order is preserved, each record is emitted as soon as it is expanded.
+func expandParallel(src <-chan Line, jobs int, ordered bool) <-chan Record {
+	out := make(chan Record, 64)
+	if !ordered {
+		var wg sync.WaitGroup
+		for i := 0; i < jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for l := range src {
+					if r, ok := l.parse(); ok {
+						out <- r
+					}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(out)
+		}()
+		return out
+	}
+
+	// The slots of the results are queued in the order of the input, before
+	// the jobs are dispatched to the workers.
+	queue := make(chan chan expansion, 64*jobs)
+	work := make(chan expansionJob, 64)
+	go func() {
+		defer close(work)
+		defer close(queue)
+		for l := range src {
+			slot := make(chan expansion, 1)
+			queue <- slot
+			work <- expansionJob{raw: l, slot: slot}
+		}
+	}()
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for j := range work {
+				r, ok := j.raw.parse()
+				j.slot <- expansion{r: r, ok: ok}
+			}
+		}()
+	}
+	go func() {
+		defer close(out)
+		for slot := range queue {
+			if e := <-slot; e.ok {
+				out <- e.r
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,557 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package logs parses the access logs into records, then passes them through
+// a Pipeline of filters, enrichers and sinks. The nlogx command is built on it.
+package logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stage is a step of a Pipeline, over the flow of records
+type Stage func(in <-chan Record) <-chan Record
+
+// Enricher annotates a record in place
+type Enricher func(r *Record)
+
+// Sink consumes the records at the end of a Pipeline
+type Sink func(r Record) error
+
+// Option configures a Pipeline
+type Option func(p *Pipeline) error
+
+type namedStage struct {
+	name string
+	run  Stage
+}
+
+// Pipeline parses a log into records, then passes them through its stages in
+// the order of their options. E.g.
+//
+//	p, err := NewPipeline(
+//		WithInput(f),
+//		WithFormat("combined"),
+//		WithFilters("errors", func(r Record) bool { return r.Code >= 500 }),
+//		WithEnrichers("app", func(r *Record) { r.SetExtra("app", "shop") }),
+//		WithSinks(func(r Record) error { return encoder.Encode(&r) }))
+type Pipeline struct {
+	clock   Clock
+	input   io.Reader
+	files   []string
+	follow  bool
+	rejects *rejectStats
+	format  *Format
+	sample  int
+	jobs    int
+	ordered bool
+	stuck   time.Duration
+	wd      *watchdog
+	stages  []namedStage
+	sinks   []Sink
+
+	// checkpoints is the directory of the positions of the followed logs
+	checkpoints string
+	// discovered are the paths of the logs to follow once created
+	discovered <-chan string
+	// state is the file of the positions reached in the files by the
+	// previous run
+	state string
+	// merge merges the logs in time order instead of reading them in turn
+	merge bool
+	// messages are consumed from a message bus, instead of the input
+	messages <-chan Message
+	// onError is told the errors ending the readers, besides the iterators
+	onError func(err error)
+	// failed is the failure of the last run of Records
+	failed *readFailure
+}
+
+// readFailure keeps the first error ending the readers of a run
+type readFailure struct {
+	lock    sync.Mutex
+	err     error
+	onError func(err error)
+}
+
+func (f *readFailure) fail(err error) {
+	f.lock.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.lock.Unlock()
+	if f.onError != nil {
+		f.onError(err)
+	}
+}
+
+func (f *readFailure) get() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.err
+}
+
+// NewPipeline returns a Pipeline reading the standard input, whose format is
+// detected, and configured by the options.
+func NewPipeline(opts ...Option) (*Pipeline, error) {
+	p := &Pipeline{clock: SystemClock, input: os.Stdin, sample: 100, jobs: 1}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// WithClock sets the clock of the timers, the system one by default
+func WithClock(c Clock) Option {
+	return func(p *Pipeline) error {
+		if c == nil {
+			return errors.New("No clock")
+		}
+		p.clock = c
+		return nil
+	}
+}
+
+// WithInput reads the log from r instead of the standard input
+func WithInput(r io.Reader) Option {
+	return func(p *Pipeline) error {
+		if r == nil {
+			return errors.New("No input")
+		}
+		p.input = r
+		return nil
+	}
+}
+
+// WithMessages reads the lines from the messages of a bus instead of the
+// standard input, each acknowledged once parsed.
+func WithMessages(messages <-chan Message) Option {
+	return func(p *Pipeline) error {
+		if messages == nil {
+			return errors.New("No messages")
+		}
+		p.messages = messages
+		return nil
+	}
+}
+
+// WithFiles reads the logs from the files in turn, instead of the standard
+// input, the compressed ones decompressed.
+func WithFiles(paths ...string) Option {
+	return func(p *Pipeline) error {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return err
+			}
+		}
+		p.files = paths
+		return nil
+	}
+}
+
+// WithFollow keeps reading the logs once at their end, as tail -F does, or
+// tells the input is live. The detection of the format then stops sampling
+// after a second.
+func WithFollow(follow bool) Option {
+	return func(p *Pipeline) error {
+		p.follow = follow
+		return nil
+	}
+}
+
+// WithCheckpoints saves the positions of the followed logs into the directory,
+// so that the next run resumes each of them where it stopped.
+func WithCheckpoints(dir string) Option {
+	return func(p *Pipeline) error {
+		if st, err := os.Stat(dir); err != nil {
+			return err
+		} else if !st.IsDir() {
+			return fmt.Errorf("%s: not a directory", dir)
+		}
+		p.checkpoints = dir
+		return nil
+	}
+}
+
+// WithState only reads the lines of the files appended since the previous run,
+// whose positions are saved into the state file.
+func WithState(path string) Option {
+	return func(p *Pipeline) error {
+		if path == "" {
+			return errors.New("No state file")
+		}
+		p.state = path
+		return nil
+	}
+}
+
+// WithMerge merges the files in time order, each log with its rotations, or
+// reads them in turn. The format is detected per log.
+func WithMerge(merge bool) Option {
+	return func(p *Pipeline) error {
+		p.merge = merge
+		return nil
+	}
+}
+
+// WithDiscovery also follows the logs whose paths are received, e.g. the ones
+// created in a watched directory.
+func WithDiscovery(paths <-chan string) Option {
+	return func(p *Pipeline) error {
+		if paths == nil {
+			return errors.New("No discovery")
+		}
+		p.discovered = paths
+		return nil
+	}
+}
+
+// WithRejectStats reports the lines rejected by the parsers, by class, once
+// all the lines have been parsed.
+func WithRejectStats() Option {
+	return func(p *Pipeline) error {
+		p.rejects = newRejectStats()
+		return nil
+	}
+}
+
+// WithFormat sets the format of the log, "auto" to detect it
+func WithFormat(name string) Option {
+	return func(p *Pipeline) error {
+		if name == "auto" {
+			p.format = nil
+			return nil
+		}
+		f, err := LookupFormat(name)
+		p.format = f
+		return err
+	}
+}
+
+// WithDetection sets the number of lines sampled to detect the format
+func WithDetection(sample int) Option {
+	return func(p *Pipeline) error {
+		if sample <= 0 {
+			return fmt.Errorf("Invalid number of lines to sample: %d", sample)
+		}
+		p.sample = sample
+		return nil
+	}
+}
+
+// WithWorkers parses the lines with several workers, in the order of the input
+// if ordered.
+func WithWorkers(jobs int, ordered bool) Option {
+	return func(p *Pipeline) error {
+		if jobs <= 0 {
+			return fmt.Errorf("Invalid number of workers: %d", jobs)
+		}
+		p.jobs, p.ordered = jobs, ordered
+		return nil
+	}
+}
+
+// WithWatchdog reports the stages when the pipeline is stuck for that long
+func WithWatchdog(period time.Duration) Option {
+	return func(p *Pipeline) error {
+		if period < 0 {
+			return fmt.Errorf("Invalid period of the watchdog: %v", period)
+		}
+		p.stuck = period
+		return nil
+	}
+}
+
+// WithStage appends a stage to the pipeline
+func WithStage(name string, s Stage) Option {
+	return func(p *Pipeline) error {
+		if s == nil {
+			return fmt.Errorf("No stage %s", name)
+		}
+		p.stages = append(p.stages, namedStage{name: name, run: s})
+		return nil
+	}
+}
+
+// WithFilters appends a stage keeping the records that all the filters keep
+func WithFilters(name string, filters ...SieveFilter) Option {
+	for _, keep := range filters {
+		if keep == nil {
+			return invalidOption(fmt.Errorf("No filter %s", name))
+		}
+	}
+	return WithStage(name, func(in <-chan Record) <-chan Record {
+		return Filter(in, func(r Record) bool {
+			for _, keep := range filters {
+				if !keep(r) {
+					return false
+				}
+			}
+			return true
+		})
+	})
+}
+
+// invalidOption is an option failing on err, whatever the pipeline
+func invalidOption(err error) Option {
+	return func(p *Pipeline) error { return err }
+}
+
+// WithEnrichers appends a stage applying the enrichers in order to each record
+func WithEnrichers(name string, enrichers ...Enricher) Option {
+	for _, enrich := range enrichers {
+		if enrich == nil {
+			return invalidOption(fmt.Errorf("No enricher %s", name))
+		}
+	}
+	return WithStage(name, func(in <-chan Record) <-chan Record {
+		out := make(chan Record, 32)
+		go func() {
+			defer close(out)
+			for r := range in {
+				for _, enrich := range enrichers {
+					enrich(&r)
+				}
+				out <- r
+			}
+		}()
+		return out
+	})
+}
+
+// WithErrorHandler tells h the errors ending the readers, e.g. a failed read
+// or a state that cannot be saved, as soon as they occur. The iterators also
+// return them once the records are consumed.
+func WithErrorHandler(h func(err error)) Option {
+	return func(p *Pipeline) error {
+		p.onError = h
+		return nil
+	}
+}
+
+// WithSinks sets the consumers of the records, for Run
+func WithSinks(sinks ...Sink) Option {
+	return func(p *Pipeline) error {
+		for _, sink := range sinks {
+			if sink == nil {
+				return errors.New("No sink")
+			}
+		}
+		p.sinks = append(p.sinks, sinks...)
+		return nil
+	}
+}
+
+// Records starts the pipeline and returns the flow of its records. Err then
+// tells whether they ended on an error.
+func (p *Pipeline) Records() <-chan Record {
+	records, failed := p.records(nil)
+	p.failed = failed
+	return records
+}
+
+// Err returns the error that ended the records of Records, once they are all
+// received, nil at the end of the log.
+func (p *Pipeline) Err() error {
+	if p.failed == nil {
+		return nil
+	}
+	return p.failed.get()
+}
+
+// records starts the pipeline, its readers stopping once done is closed and
+// their errors kept into the failure returned.
+func (p *Pipeline) records(done <-chan struct{}) (<-chan Record, *readFailure) {
+	failed := &readFailure{onError: p.onError}
+	if p.stuck > 0 {
+		p.wd = newWatchdog(p.clock, p.stuck)
+	}
+	var text <-chan string
+	var stop <-chan time.Time
+	var pending <-chan Message
+	switch {
+	case p.messages != nil:
+		text, pending = splitMessages(p.messages, p.sample, done)
+	case p.follow && (len(p.files) > 0 || p.discovered != nil):
+		text = followFiles(p.files, p.clock, p.checkpoints, p.discovered, done)
+	case len(p.files) > 0 && p.state != "":
+		text = readNewLines(p.files, p.state, done, failed.fail)
+	case len(p.files) > 0 && !p.merge:
+		text = readFiles(p.files, done, failed.fail)
+	case len(p.files) == 0:
+		text = readLines(p.input, done, failed.fail)
+	}
+	if p.follow {
+		ticker := p.clock.NewTicker(time.Second)
+		stop = ticker.C()
+		if done != nil {
+			go func() {
+				<-done
+				ticker.Stop()
+			}()
+		}
+	}
+	var lines <-chan Line
+	if text != nil {
+		lines = p.parseFormat(text, stop)
+	} else {
+		groups := groupRotations(p.files)
+		logs := make([]<-chan timedLine, len(groups))
+		for i, rotations := range groups {
+			logs[i] = timeLines(p.parseFormat(readFiles(sortRotations(rotations), done, failed.fail), nil), i)
+		}
+		lines = mergeLines(logs)
+	}
+	if pending != nil {
+		lines = ackLines(lines, pending, done)
+	}
+	if p.rejects != nil {
+		lines = p.rejects.watch(lines)
+	}
+	var r1 <-chan Record
+	if p.jobs > 1 {
+		r1 = expandParallel(lines, p.jobs, p.ordered)
+	} else {
+		r1 = expandRecords(lines)
+	}
+	r1 = p.watch("expand", r1)
+	if p.rejects != nil {
+		r1 = p.rejects.report(r1)
+	}
+	for _, s := range p.stages {
+		r1 = p.watch(s.name, s.run(r1))
+	}
+	return r1, failed
+}
+
+// parseFormat tags the lines with their format, detected unless set
+func (p *Pipeline) parseFormat(text <-chan string, stop <-chan time.Time) <-chan Line {
+	if p.format == nil {
+		return DetectFormat(text, p.sample, stop)
+	}
+	return withFormat(text, p.format, p.sample)
+}
+
+// Stages returns the names of the stages, in their order
+func (p *Pipeline) Stages() []string {
+	names := make([]string, 0, len(p.stages))
+	for _, s := range p.stages {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// Run passes all the records to the sinks, until a sink fails
+func (p *Pipeline) Run() error {
+	return p.ForEach(context.Background(), func(r Record) error {
+		for _, sink := range p.sinks {
+			if err := sink(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls fn with each record, until the end of the log, the
+// cancellation of ctx, an error of fn or of the readers, returned. The readers
+// of the pipeline then stop.
+func (p *Pipeline) ForEach(ctx context.Context, fn func(r Record) error) error {
+	it := p.Iterate(ctx)
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Record()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// Iterate starts the pipeline and returns an iterator over its records, e.g.
+//
+//	it := p.Iterate(ctx)
+//	defer it.Close()
+//	for it.Next() {
+//		r := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+func (p *Pipeline) Iterate(ctx context.Context) *RecordIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	records, failed := p.records(ctx.Done())
+	return &RecordIterator{ctx: ctx, cancel: cancel, records: records, failed: failed}
+}
+
+// RecordIterator walks the records of a Pipeline
+type RecordIterator struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	records <-chan Record
+	failed  *readFailure
+	current Record
+	err     error
+	done    bool
+}
+
+// Next waits for the next record, and tells false at the end of the log or
+// when the context is done.
+func (it *RecordIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	select {
+	case <-it.ctx.Done():
+		it.err = it.ctx.Err()
+	case r, ok := <-it.records:
+		if ok {
+			it.current = r
+			return true
+		}
+		it.err = it.failed.get()
+	}
+	it.Close()
+	return false
+}
+
+// Record returns the current record
+func (it *RecordIterator) Record() Record {
+	return it.current
+}
+
+// Err returns the cause of the end of the iteration, e.g. a read error, nil at
+// the end of the log
+func (it *RecordIterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration and the readers of the pipeline. The records
+// still queued are discarded in the background, so that the stages terminate
+// at the end of their input.
+func (it *RecordIterator) Close() {
+	if it.done {
+		return
+	}
+	it.done = true
+	it.cancel()
+	go func(records <-chan Record) {
+		for range records {
+		}
+	}(it.records)
+}
+
+// watch lets the watchdog, if any, follow the progress of a stage
+func (p *Pipeline) watch(name string, in <-chan Record) <-chan Record {
+	if p.wd == nil {
+		return in
+	}
+	return p.wd.watch(name, in)
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func accessLine(path string) string {
+	return `192.0.2.1 - - [04/Mar/2021:12:00:00 +0000] "GET ` + path + ` HTTP/1.1" 200 12 "-" "curl/7.68.0"` + "\n"
+}
+
+// nextRecord advances the clock, a tick of the follower at a time, until a
+// record is emitted.
+func nextRecord(t *testing.T, c *FakeClock, records <-chan Record) Record {
+	for i := 0; i < 100; i++ {
+		select {
+		case r, ok := <-records:
+			if !ok {
+				t.Fatal("Unexpected end of the records")
+			}
+			return r
+		case <-time.After(10 * time.Millisecond):
+			c.Advance(250 * time.Millisecond)
+		}
+	}
+	t.Fatal("No record after 25s of the clock")
+	return Record{}
+}
+
+func TestFollowWithFakeClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlogx-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	if err = ioutil.WriteFile(path, []byte(accessLine("/first")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewFakeClock(epoch)
+	p, err := NewPipeline(WithFiles(path), WithFollow(true), WithFormat("combined"), WithClock(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := p.Iterate(ctx)
+	records := make(chan Record)
+	go func() {
+		defer close(records)
+		for it.Next() {
+			records <- it.Record()
+		}
+	}()
+
+	if r := nextRecord(t, c, records); r.Path != "/first" {
+		t.Fatalf("Expected /first, got %q", r.Path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(accessLine("/appended"))
+	f.Close()
+	if r := nextRecord(t, c, records); r.Path != "/appended" {
+		t.Fatalf("Expected /appended, got %q", r.Path)
+	}
+
+	cancel()
+	for range records {
+	}
+	if err := it.Err(); err != context.Canceled {
+		t.Fatalf("Expected the cancellation, got %v", err)
+	}
+}
+
+func TestForEachReturnsReadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlogx-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log.gz")
+	corrupted := append(append([]byte(nil), GzipMagic...), "garbage, not deflated"...)
+	if err = ioutil.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPipeline(WithFiles(path), WithFormat("combined"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.ForEach(context.Background(), func(r Record) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Fatalf("Expected a read error naming %s, got %v", path, err)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	stepBegin   = iota
+	stepBare    = iota
+	stepQuote   = iota
+	stepBracket = iota
+)
+
+// RawRecord holds the fields of a line of the Common Log Format, unparsed
+type RawRecord struct {
+	ip       string
+	user     string
+	when     string
+	req      string
+	code     string
+	bytes    string
+	referrer string
+	agent    string
+}
+
+// Record is a request parsed from a line of a log
+type Record struct {
+	// ID is the stable identity of the record, if computed
+	ID string `json:"id,omitempty"`
+
+	Ip   string `json:"src"`
+	User string `json:"user,omitempty"`
+	When int64  `json:"t"`
+
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+
+	Code     int    `json:"status"`
+	Bytes    int64  `json:"bytes"`
+	Referrer string `json:"referrer"`
+	Agent    string `json:"agent"`
+
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+
+	Indicators []string `json:"indicators,omitempty"`
+
+	// Extra holds the fields beyond the usual ones, e.g. the derived fields
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// Logger reports what the parsing skips or fails on, e.g. the invalid lines
+var Logger = zerolog.
+	New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).
+	With().Timestamp().Logger()
+
+// VersionToCode maps the protocols to the Version of the records
+var VersionToCode = map[string]int{
+	"HTTP/0.9": 0,
+	"HTTP/1.0": 0,
+	"HTTP/1.1": 1,
+	"HTTP/2.0": 2,
+}
+
+var errMalformedQuery = errors.New("Invalid query")
+
+// SieveFilter tells if a record is kept
+type SieveFilter func(r Record) bool
+
+// expandRecord parses the fields of a raw record, or returns false if one of
+// them is invalid.
+func expandRecord(r0 RawRecord) (Record, bool) {
+	c64, err := strconv.ParseInt(r0.code, 10, 32)
+	if err != nil {
+		Logger.Debug().Str("code", r0.code).Err(err).Msg("Invalid status")
+		return Record{}, false
+	}
+	method, selector, version, err := parseQuery(r0.req)
+	if err != nil {
+		Logger.Debug().Str("query", r0.req).Err(err).Msg("Invalid query")
+		return Record{}, false
+	}
+	when, err := parseDate(r0.when)
+	if err != nil {
+		Logger.Debug().Str("date", r0.when).Err(err).Msg("Invalid date")
+		return Record{}, false
+	}
+	bytes, _ := strconv.ParseInt(r0.bytes, 10, 64)
+	user := r0.user
+	if user == "-" {
+		user = ""
+	}
+	return Record{
+		Ip:       r0.ip,
+		User:     user,
+		When:     when,
+		Method:   method,
+		Path:     selector,
+		Version:  version,
+		Code:     int(c64),
+		Bytes:    bytes,
+		Referrer: r0.referrer,
+		Agent:    r0.agent,
+	}, true
+}
+
+func expandRecords(src <-chan Line) <-chan Record {
+	out := make(chan Record, 64)
+	go func() {
+		defer close(out)
+		for l := range src {
+			if r, ok := l.parse(); ok {
+				out <- r
+			}
+		}
+	}()
+	return out
+}
+
+// ReadLines splits the input into lines, without their end of line, be it LF
+// or CRLF. A read error ends the lines, passed to fail, or else logged.
+func ReadLines(src io.Reader, fail func(err error)) <-chan string {
+	return readLines(src, nil, fail)
+}
+
+// readLines is ReadLines, stopping once done is closed
+func readLines(src io.Reader, done <-chan struct{}, fail func(err error)) <-chan string {
+	out := make(chan string, 64)
+	go func() {
+		defer close(out)
+		if err := scanLines(src, out, done); err != nil && err != errCancelled {
+			readFailed(fail, err)
+		}
+	}()
+	return out
+}
+
+// readFailed passes the error ending a reader to fail, or else logs it
+func readFailed(fail func(err error), err error) {
+	if fail == nil {
+		Logger.Error().Err(err).Msg("Read error")
+		return
+	}
+	fail(err)
+}
+
+// errCancelled stops the readers of a pipeline once cancelled
+var errCancelled = errors.New("Cancelled")
+
+// sendLine queues the line, unless done is closed first
+func sendLine(out chan<- string, line string, done <-chan struct{}) error {
+	select {
+	case out <- line:
+		return nil
+	case <-done:
+		return errCancelled
+	}
+}
+
+func scanLines(src io.Reader, out chan<- string, done <-chan struct{}) error {
+	plain, err := Decompress(src)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	in := bufio.NewReaderSize(decodeInput(plain), 64*1024)
+	for {
+		line, err := in.ReadString('\n')
+		if len(line) > 0 {
+			if err := sendLine(out, strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), done); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// tokenizeLine splits an access line into its bare, quoted and bracketed
+// tokens.
+func tokenizeLine(line string) []string {
+	step := stepBegin
+	token := strings.Builder{}
+	tokens := make([]string, 0, 9)
+
+	endOfToken := func() {
+		tokens = append(tokens, token.String())
+		token.Reset()
+	}
+
+	for _, r := range line {
+		switch step {
+		case stepBegin:
+			switch r {
+			case ' ': // Nothing
+			case '[':
+				step = stepBracket
+			case '"':
+				step = stepQuote
+			default:
+				token.WriteRune(r)
+				step = stepBare
+			}
+		case stepBare:
+			switch r {
+			case ' ':
+				endOfToken()
+				step = stepBegin
+			default:
+				token.WriteRune(r)
+			}
+		case stepQuote:
+			switch r {
+			case '"':
+				endOfToken()
+				step = stepBegin
+			default:
+				token.WriteRune(r)
+			}
+		case stepBracket:
+			switch r {
+			case ']':
+				endOfToken()
+				step = stepBegin
+			default:
+				token.WriteRune(r)
+			}
+		}
+	}
+	if step != stepBegin {
+		endOfToken()
+	}
+	return tokens
+}
+
+func parseQuery(query string) (method, path string, version int, err error) {
+	tokens := strings.SplitN(query, " ", 3)
+	if len(tokens) != 3 {
+		err = errMalformedQuery
+	} else {
+		method = tokens[0]
+		path = tokens[1]
+		version = VersionToCode[tokens[2]]
+	}
+	return
+}
+
+// parseDate parses the time_local of nginx, with the month names of the
+// configuration if it fails.
+func parseDate(s string) (int64, error) {
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", s)
+	if err != nil && TolerantDates != nil {
+		return TolerantDates.parse(s)
+	}
+	return t.Unix(), err
+}
+
+// Filter passes the records that keep tells to keep
+func Filter(in <-chan Record, keep SieveFilter) <-chan Record {
+	out := make(chan Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			if keep(r) {
+				out <- r
+			}
+		}
+	}()
+	return out
+}
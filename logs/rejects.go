@@ -0,0 +1,161 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// maxLineLength is the length beyond which a rejected line is deemed
+	// oversized, e.g. truncated by the writer of the log.
+	maxLineLength = 16 * 1024
+	// rejectSamples is the number of lines kept per class of rejection
+	rejectSamples = 3
+)
+
+// classifyRejection tells why the parsers rejected a line: oversized,
+// encoding, field_count, bad_json, bad_status, bad_request, bad_date, or
+// other. The checks follow the order of the parsers.
+func classifyRejection(line string) string {
+	switch {
+	case len(line) > maxLineLength:
+		return "oversized"
+	case !utf8.ValidString(line) || strings.IndexByte(line, 0) >= 0:
+		return "encoding"
+	case strings.HasPrefix(strings.TrimSpace(line), "{"):
+		obj := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			return "bad_json"
+		}
+		for _, keys := range JsonPresets {
+			if t, ok := lookupNested(obj, keys["t"].Key); ok {
+				if _, ok := JsonTime(t); !ok {
+					return "bad_date"
+				}
+			}
+		}
+		return "field_count"
+	}
+	t := tokenizeLine(line)
+	if len(t) != 9 && len(t) != 7 {
+		return "field_count"
+	}
+	if _, err := strconv.ParseInt(t[5], 10, 32); err != nil {
+		return "bad_status"
+	}
+	if _, _, _, err := parseQuery(t[4]); err != nil {
+		return "bad_request"
+	}
+	if _, err := parseDate(t[3]); err != nil {
+		return "bad_date"
+	}
+	return "other"
+}
+
+type rejectClass struct {
+	count   int
+	samples []string
+}
+
+// rejectStats counts the lines rejected by the parsers, per class, with a few
+// samples of each class.
+type rejectStats struct {
+	lock    sync.Mutex
+	lines   int
+	classes map[string]*rejectClass
+	// counting wraps the formats of the lines, once per format
+	counting map[*Format]*Format
+}
+
+func newRejectStats() *rejectStats {
+	return &rejectStats{classes: make(map[string]*rejectClass), counting: make(map[*Format]*Format)}
+}
+
+func (rs *rejectStats) reject(line string) {
+	class := classifyRejection(line)
+	if len(line) > 256 {
+		line = line[:256] + "..."
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	c, ok := rs.classes[class]
+	if !ok {
+		c = &rejectClass{}
+		rs.classes[class] = c
+	}
+	c.count++
+	if len(c.samples) < rejectSamples {
+		c.samples = append(c.samples, line)
+	}
+}
+
+// watch counts the lines, and wraps their format so that its rejections are
+// counted wherever the lines are parsed.
+func (rs *rejectStats) watch(in <-chan Line) <-chan Line {
+	out := make(chan Line, 64)
+	go func() {
+		defer close(out)
+		for l := range in {
+			f, ok := rs.counting[l.Format]
+			if !ok {
+				inner := l.Format
+				f = &Format{Name: inner.Name, Parse: func(line string) (Record, bool) {
+					r, ok := inner.Parse(line)
+					if !ok {
+						rs.reject(line)
+					}
+					return r, ok
+				}}
+				rs.counting[l.Format] = f
+			}
+			rs.lock.Lock()
+			rs.lines++
+			rs.lock.Unlock()
+			l.Format = f
+			out <- l
+		}
+	}()
+	return out
+}
+
+// report logs the statistics once all the lines have been parsed, i.e. once
+// the records of the parsers are exhausted.
+func (rs *rejectStats) report(in <-chan Record) <-chan Record {
+	out := make(chan Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			out <- r
+		}
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		rejected := 0
+		classes := make([]string, 0, len(rs.classes))
+		for name, c := range rs.classes {
+			rejected += c.count
+			classes = append(classes, name)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			ci, cj := rs.classes[classes[i]], rs.classes[classes[j]]
+			if ci.count != cj.count {
+				return ci.count > cj.count
+			}
+			return classes[i] < classes[j]
+		})
+		Logger.Info().Int("lines", rs.lines).Int("rejected", rejected).Msg("Parsing statistics")
+		for _, name := range classes {
+			c := rs.classes[name]
+			Logger.Warn().Str("class", name).Int("count", c.count).Strs("samples", c.samples).Msg("Rejected lines")
+		}
+	}()
+	return out
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// headSize is the length of the start of a log that identifies it, whatever
+// its name after the rotations.
+const headSize = 1024
+
+// checkpoint is the position of a followed log, saved into its own file so
+// that a restart resumes each log where it stopped. The position is the one
+// read, thus the lines still in the pipeline at a crash are lost.
+type checkpoint struct {
+	// Head is the digest of the first HeadSize bytes of the log
+	Head     string `json:"head"`
+	HeadSize int    `json:"head_size"`
+	Offset   int64  `json:"offset"`
+	Path     string `json:"path"`
+
+	file  string
+	f     *os.File
+	saved int64
+}
+
+// logHead returns the digest of the first bytes of a file, at most headSize
+func logHead(f *os.File, size int) (string, int, error) {
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	sum := sha1.Sum(buf[:n])
+	return hex.EncodeToString(sum[:]), n, nil
+}
+
+// loadCheckpoint returns the checkpoint of a log in the directory, empty if
+// the log has never been followed.
+func loadCheckpoint(dir, path string) *checkpoint {
+	key := sha1.Sum([]byte(path))
+	cp := &checkpoint{Path: path, file: filepath.Join(dir, hex.EncodeToString(key[:8])+".json"), saved: -1}
+	raw, err := ioutil.ReadFile(cp.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.Warn().Str("path", cp.file).Err(err).Msg("Failed to load the checkpoint")
+		}
+		return cp
+	}
+	if err = json.Unmarshal(raw, cp); err != nil {
+		Logger.Warn().Str("path", cp.file).Err(err).Msg("Invalid checkpoint, ignored")
+		cp.Head, cp.Offset = "", 0
+	}
+	return cp
+}
+
+// resume returns the index of the rotation the checkpoint is in, the rotations
+// being the oldest first, and false if none matches, e.g. with the
+// compressed ones, and the log is read from its start.
+func (cp *checkpoint) resume(rotations []string) (int, bool) {
+	if cp.Head == "" {
+		return 0, false
+	}
+	for i := len(rotations) - 1; i >= 0; i-- {
+		f, err := os.Open(rotations[i])
+		if err != nil {
+			continue
+		}
+		head, n, err := logHead(f, cp.HeadSize)
+		st, _ := f.Stat()
+		f.Close()
+		if err == nil && n == cp.HeadSize && head == cp.Head && st != nil && st.Size() >= cp.Offset {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// save records the offset reached in f, once changed
+func (cp *checkpoint) save(f *os.File, offset int64) {
+	if f == cp.f && offset == cp.saved {
+		return
+	}
+	if f != cp.f || offset < cp.saved || cp.HeadSize < headSize {
+		head, n, err := logHead(f, headSize)
+		if err != nil {
+			Logger.Warn().Str("path", cp.Path).Err(err).Msg("Failed to save the checkpoint")
+			return
+		}
+		cp.f, cp.Head, cp.HeadSize = f, head, n
+	}
+	cp.Offset = offset
+	raw, _ := json.Marshal(cp)
+	if err := WriteAtomic(cp.file, raw); err != nil {
+		Logger.Warn().Str("path", cp.file).Err(err).Msg("Failed to save the checkpoint")
+		return
+	}
+	cp.saved = offset
+}
+
+// WriteAtomic replaces the file with raw, never leaving a partial file
+func WriteAtomic(path string, raw []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// groupRotations groups the paths by log, each group being the rotations of a
+// log in the order of the paths, and the groups in the order of their first
+// path.
+func groupRotations(paths []string) [][]string {
+	index := make(map[string]int)
+	var out [][]string
+	for _, path := range paths {
+		base := rotatedLog.FindStringSubmatch(path)[1]
+		i, ok := index[base]
+		if !ok {
+			i = len(out)
+			index[base] = i
+			out = append(out, nil)
+		}
+		out[i] = append(out[i], path)
+	}
+	return out
+}
+
+// sortRotations returns the rotations of a log, the oldest first and the live
+// log last, whatever the order of the paths (like access.log*).
+func sortRotations(rotations []string) []string {
+	files := make([]LogFile, len(rotations))
+	for i, path := range rotations {
+		files[i] = LogFile{Path: path}
+		if st, err := os.Stat(path); err == nil {
+			files[i].Mtime = st.ModTime().UnixNano()
+		}
+	}
+	return SortLogs(files)
+}
+
+// compressedLog tells if the path is a compressed rotation, read but never
+// followed
+func compressedLog(path string) bool {
+	for _, ext := range []string{".gz", ".bz2", ".zst"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// followFiles follows each log concurrently, after its older rotations, so
+// that a log rotated, deleted or failing does not stall the others. With a
+// checkpoint directory, each log resumes where the previous run stopped. The
+// logs discovered later are followed from their start, and the output then
+// only ends once done is closed.
+func followFiles(paths []string, clock Clock, checkpoints string, discovered <-chan string, done <-chan struct{}) <-chan string {
+	out := make(chan string, 64)
+	var wg sync.WaitGroup
+	follow := func(rotations []string) {
+		defer wg.Done()
+		last := len(rotations) - 1
+		if compressedLog(rotations[last]) {
+			// No live log, only its rotations
+			for _, path := range rotations {
+				if err := readFileFrom(path, 0, out, done); err == errCancelled {
+					return
+				} else if err != nil {
+					Logger.Warn().Str("path", path).Err(err).Msg("Read error, the log is skipped")
+				}
+			}
+			return
+		}
+		var cp *checkpoint
+		start, offset := 0, int64(0)
+		if checkpoints != "" {
+			cp = loadCheckpoint(checkpoints, rotations[last])
+			if i, ok := cp.resume(rotations); ok {
+				start, offset = i, cp.Offset
+				Logger.Info().Str("path", rotations[i]).Int64("offset", offset).Msg("Log resumed")
+			}
+		}
+		for i := start; i < last; i++ {
+			if err := readFileFrom(rotations[i], offset, out, done); err == errCancelled {
+				return
+			} else if err != nil {
+				Logger.Warn().Str("path", rotations[i]).Err(err).Msg("Read error, the log is skipped")
+			}
+			offset = 0
+		}
+		if err := followFile(rotations[last], offset, out, clock, cp, done); err != nil && err != errCancelled {
+			Logger.Warn().Str("path", rotations[last]).Err(err).Msg("Read error, the log is not followed anymore")
+		}
+	}
+	followed := make(map[string]bool)
+	for _, rotations := range groupRotations(paths) {
+		followed[rotatedLog.FindStringSubmatch(rotations[0])[1]] = true
+		wg.Add(1)
+		go follow(sortRotations(rotations))
+	}
+	if discovered != nil {
+		// Only done once cancelled, for the logs still to come
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var path string
+				select {
+				case <-done:
+					return
+				case p, ok := <-discovered:
+					if !ok {
+						discovered = nil
+						continue
+					}
+					path = p
+				}
+				// The rotations and the recreations of a followed log
+				base := rotatedLog.FindStringSubmatch(path)[1]
+				if followed[base] {
+					continue
+				}
+				followed[base] = true
+				Logger.Info().Str("path", path).Msg("Log discovered, followed")
+				wg.Add(1)
+				go follow([]string{path})
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// readFileFrom reads the lines of a file after the offset
+func readFileFrom(path string, offset int64, out chan<- string, done <-chan struct{}) error {
+	if offset == 0 {
+		return readFile(path, out, done)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return scanLines(f, out, done)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTraefikLine parses the access logs of Traefik, in its common format or
+// in JSON. The router, the service and the duration become extra fields.
+func parseTraefikLine(line string) (Record, bool) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return parseTraefikJSON(line)
+	}
+	return parseTraefikCommon(line)
+}
+
+// parseTraefikCommon parses the common format of Traefik: the combined format
+// followed by the count of the requests, the router, the URL of the server
+// and the duration, e.g. 42 "api@docker" "http://10.0.0.2:80" 3ms
+func parseTraefikCommon(line string) (Record, bool) {
+	t := tokenizeLine(line)
+	if len(t) != 13 || !strings.HasSuffix(t[12], "ms") {
+		return Record{}, false
+	}
+	count, err := strconv.ParseInt(t[9], 10, 64)
+	if err != nil {
+		return Record{}, false
+	}
+	ms, err := strconv.ParseInt(strings.TrimSuffix(t[12], "ms"), 10, 64)
+	if err != nil {
+		return Record{}, false
+	}
+	r, ok := expandRecord(RawRecord{
+		ip: t[0], user: t[2], when: t[3], req: t[4], code: t[5], bytes: t[6], referrer: t[7], agent: t[8],
+	})
+	if !ok {
+		return r, false
+	}
+	r.SetExtra("request_count", count)
+	if t[10] != "-" {
+		r.SetExtra("router", t[10])
+	}
+	if t[11] != "-" {
+		r.SetExtra("service_url", t[11])
+	}
+	r.SetExtra("request_time", float64(ms)/1000)
+	return r, true
+}
+
+// parseTraefikJSON parses the JSON access logs of Traefik. The referrer and
+// the User-Agent are empty, unless Traefik keeps the headers.
+func parseTraefikJSON(line string) (Record, bool) {
+	var entry struct {
+		ClientHost            string `json:"ClientHost"`
+		ClientUsername        string `json:"ClientUsername"`
+		StartUTC              string `json:"StartUTC"`
+		StartLocal            string `json:"StartLocal"`
+		RequestMethod         string `json:"RequestMethod"`
+		RequestPath           string `json:"RequestPath"`
+		RequestProtocol       string `json:"RequestProtocol"`
+		RequestHost           string `json:"RequestHost"`
+		DownstreamStatus      *int   `json:"DownstreamStatus"`
+		DownstreamContentSize int64  `json:"DownstreamContentSize"`
+		OriginStatus          int64  `json:"OriginStatus"`
+		Duration              int64  `json:"Duration"`
+		RequestCount          int64  `json:"RequestCount"`
+		RetryAttempts         int64  `json:"RetryAttempts"`
+		RouterName            string `json:"RouterName"`
+		ServiceName           string `json:"ServiceName"`
+		ServiceURL            string `json:"ServiceURL"`
+		EntryPointName        string `json:"entryPointName"`
+		Referrer              string `json:"request_Referer"`
+		Agent                 string `json:"request_User-Agent"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.ClientHost == "" || entry.DownstreamStatus == nil {
+		return Record{}, false
+	}
+	start := entry.StartUTC
+	if start == "" {
+		start = entry.StartLocal
+	}
+	when, err := time.Parse(time.RFC3339Nano, start)
+	if err != nil {
+		return Record{}, false
+	}
+	user := entry.ClientUsername
+	if user == "" {
+		user = "-"
+	}
+	r := Record{
+		Ip:       entry.ClientHost,
+		User:     user,
+		When:     when.Unix(),
+		Method:   entry.RequestMethod,
+		Path:     entry.RequestPath,
+		Version:  VersionToCode[entry.RequestProtocol],
+		Code:     *entry.DownstreamStatus,
+		Bytes:    entry.DownstreamContentSize,
+		Referrer: entry.Referrer,
+		Agent:    entry.Agent,
+	}
+	for _, s := range []struct{ name, value string }{
+		{"host", entry.RequestHost}, {"router", entry.RouterName}, {"service", entry.ServiceName},
+		{"service_url", entry.ServiceURL}, {"entrypoint", entry.EntryPointName},
+	} {
+		if s.value != "" {
+			r.SetExtra(s.name, s.value)
+		}
+	}
+	if entry.OriginStatus != 0 {
+		r.SetExtra("origin_status", entry.OriginStatus)
+	}
+	r.SetExtra("request_count", entry.RequestCount)
+	r.SetExtra("retries", entry.RetryAttempts)
+	// In nanoseconds
+	r.SetExtra("request_time", float64(entry.Duration)/1e9)
+	return r, true
+}
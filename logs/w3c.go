@@ -0,0 +1,138 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// w3cDefaultFields are the fields logged by IIS by default, for the lines not
+// preceded by a #Fields directive.
+var w3cDefaultFields = strings.Fields("date time s-ip cs-method cs-uri-stem cs-uri-query s-port " +
+	"cs-username c-ip cs(User-Agent) cs(Referer) sc-status sc-substatus sc-win32-status time-taken")
+
+// CloudFrontFields are the extra fields of the logs of CloudFront, the CDN of
+// AWS, after their names in the #Fields directive.
+var CloudFrontFields = map[string]string{
+	"x-edge-location":             "edge_location",
+	"x-edge-result-type":          "edge_result",
+	"x-edge-response-result-type": "edge_response_result",
+	"x-edge-detailed-result-type": "edge_detailed_result",
+	"x-host-header":               "host",
+	"cs(host)":                    "distribution",
+	"cs-protocol":                 "scheme",
+	"cs-bytes":                    "request_bytes",
+	"x-forwarded-for":             "forwarded_for",
+	"ssl-protocol":                "ssl_protocol",
+	"ssl-cipher":                  "ssl_cipher",
+	"time-to-first-byte":          "time_to_first_byte",
+	"sc-content-type":             "content_type",
+	"c-port":                      "port",
+}
+
+// w3cFormat parses the lines of the W3C extended log format, as produced by
+// IIS, given the fields of the last #Fields directive. The time taken is an
+// extra field, in milliseconds. The lines of CloudFront, with its edge
+// location, also get the extra fields of the CDN, and the id of the request
+// at the edge, forwarded to the origin as X-Amz-Cf-Id, is their ID.
+func w3cFormat(fields []string) *Format {
+	index := make(map[string]int, len(fields))
+	for i, f := range fields {
+		index[strings.ToLower(f)] = i
+	}
+	_, cloudFront := index["x-edge-location"]
+	return &Format{Name: "w3c", Parse: func(line string) (Record, bool) {
+		values := strings.Fields(line)
+		if len(values) != len(fields) {
+			return Record{}, false
+		}
+		get := func(name string) string {
+			if i, ok := index[name]; ok && values[i] != "-" {
+				return values[i]
+			}
+			return ""
+		}
+		hms := get("time")
+		if i := strings.IndexByte(hms, '.'); i >= 0 {
+			hms = hms[:i]
+		}
+		when, err := time.Parse("2006-01-02 15:04:05", get("date")+" "+hms)
+		if err != nil {
+			return Record{}, false
+		}
+		code, err := strconv.Atoi(get("sc-status"))
+		if err != nil || get("c-ip") == "" {
+			return Record{}, false
+		}
+		r := Record{
+			Ip:       get("c-ip"),
+			User:     get("cs-username"),
+			When:     when.Unix(),
+			Method:   get("cs-method"),
+			Path:     get("cs-uri-stem"),
+			Version:  VersionToCode[get("cs-version")+get("cs-protocol-version")],
+			Code:     code,
+			Referrer: "-",
+			Agent:    "-",
+		}
+		if q := get("cs-uri-query"); q != "" {
+			r.Path += "?" + q
+		}
+		r.Bytes, _ = strconv.ParseInt(get("sc-bytes"), 10, 64)
+		if ref := get("cs(referer)"); ref != "" {
+			r.Referrer = ref
+		}
+		// IIS replaces the spaces of the User-Agent with '+'
+		if agent := get("cs(user-agent)"); agent != "" {
+			r.Agent = strings.Replace(agent, "+", " ", -1)
+		}
+		if !cloudFront {
+			if ms, err := strconv.ParseInt(get("time-taken"), 10, 64); err == nil {
+				r.SetExtra("time_taken", ms)
+			}
+			return r, true
+		}
+
+		// CloudFront encodes the headers as URLs, and logs the time in seconds
+		for _, h := range []*string{&r.Referrer, &r.Agent} {
+			if decoded, err := url.PathUnescape(*h); err == nil {
+				*h = decoded
+			}
+		}
+		if s, err := strconv.ParseFloat(get("time-taken"), 64); err == nil {
+			r.SetExtra("time_taken", int64(s*1000))
+		}
+		for name, extra := range CloudFrontFields {
+			if v := get(name); v != "" {
+				r.SetExtra(extra, ToNumber(v))
+			}
+		}
+		r.ID = get("x-edge-request-id")
+		return r, true
+	}}
+}
+
+// w3cDirectives follows the directives of the W3C extended logs, the #Fields
+// directive setting the fields of the lines after it.
+type w3cDirectives struct {
+	format *Format
+	mixed  *Format
+}
+
+// consume tells if the line is a directive, to be skipped
+func (d *w3cDirectives) consume(line string) bool {
+	if !strings.HasPrefix(line, "#") {
+		return false
+	}
+	if strings.HasPrefix(line, "#Fields:") {
+		d.format = w3cFormat(strings.Fields(line[len("#Fields:"):]))
+		d.mixed = MixedFormat(d.format)
+	}
+	return true
+}
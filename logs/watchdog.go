@@ -0,0 +1,120 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logs
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type watchedStage struct {
+	// count first, for its atomic access to be aligned on 32-bit platforms
+	count uint64
+	name  string
+	depth func() int
+	done  int32
+}
+
+// watchdog watches the progress of the stages of the pipeline and reports the
+// pipeline as stuck when no stage progresses while records are pending.
+type watchdog struct {
+	period time.Duration
+	clock  Clock
+
+	lock   sync.Mutex
+	stages []*watchedStage
+}
+
+func newWatchdog(clock Clock, period time.Duration) *watchdog {
+	wd := &watchdog{period: period, clock: clock}
+	go wd.run()
+	return wd
+}
+
+// watch counts the records emitted by a stage, and measures the depth of the
+// queue of the records waiting for the next stage.
+func (wd *watchdog) watch(name string, in <-chan Record) <-chan Record {
+	out := make(chan Record, 32)
+	s := &watchedStage{name: name, depth: func() int { return len(in) + len(out) }}
+	wd.lock.Lock()
+	wd.stages = append(wd.stages, s)
+	wd.lock.Unlock()
+	go func() {
+		defer close(out)
+		defer atomic.StoreInt32(&s.done, 1)
+		for r := range in {
+			out <- r
+			atomic.AddUint64(&s.count, 1)
+		}
+	}()
+	return out
+}
+
+func (wd *watchdog) run() {
+	last := make(map[*watchedStage]uint64)
+	reported := false
+	ticker := wd.clock.NewTicker(wd.period)
+	defer ticker.Stop()
+	for range ticker.C() {
+		wd.lock.Lock()
+		stages := append([]*watchedStage(nil), wd.stages...)
+		wd.lock.Unlock()
+
+		progress, finished := false, len(stages) > 0
+		stalled := ""
+		depths := make([]int, len(stages))
+		for i, s := range stages {
+			count := atomic.LoadUint64(&s.count)
+			if count != last[s] {
+				progress = true
+			}
+			last[s] = count
+			if atomic.LoadInt32(&s.done) == 0 {
+				finished = false
+			}
+			// The next stage of a non-empty queue is the suspect, until a
+			// pending queue is found further.
+			if depths[i] = s.depth(); depths[i] > 0 {
+				stalled = "output"
+				if i+1 < len(stages) {
+					stalled = stages[i+1].name
+				}
+			}
+		}
+		if finished {
+			return
+		}
+		if progress || stalled == "" {
+			// Either running or waiting for its input
+			reported = false
+			continue
+		}
+		if reported {
+			continue
+		}
+		reported = true
+		event := Logger.Warn().Dur("since", wd.period).Str("stalled", stalled)
+		for i, s := range stages {
+			event = event.Int(s.name, depths[i])
+		}
+		event.Msg("Pipeline stuck, queue depths per stage")
+		os.Stderr.Write(goroutineStacks())
+	}
+}
+
+func goroutineStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/rs/zerolog"
+	"github.com/spf13/pflag"
+)
+
+// agent ships the records of its input continuously, and obeys the commands
+// received on its control socket.
+type agent struct {
+	// counters first, for their atomic access to be aligned on 32-bit platforms
+	records uint64
+	flushes uint64
+
+	started time.Time
+	clock   logs.Clock
+	sf      *streamFlags
+
+	lock    sync.Mutex
+	out     *bufio.Writer
+	encode  func(r *logs.Record) error
+	flushed time.Time
+}
+
+func mainAgent(args []string) {
+	var sf streamFlags
+	var controlPath, outputPath, format string
+	var flushEvery time.Duration
+	var dryRun int
+
+	fs := pflag.NewFlagSet("agent", pflag.ExitOnError)
+	fs.StringVar(&controlPath, "control", "", "Path of the control socket")
+	fs.StringVarP(&outputPath, "output", "o", "", "Append the records to that file instead of the standard output")
+	fs.StringVarP(&format, "format", "f", "json", "Format of the records: json or msgpack")
+	fs.DurationVar(&flushEvery, "flush-every", time.Second, "Max delay before the records are flushed")
+	fs.IntVar(&dryRun, "dry-run", 0, "Only pass that many records through the pipeline, printed instead of written")
+	sf.register(fs, 0)
+	sf.parse(fs, args)
+
+	if flushEvery <= 0 {
+		Logger.Fatal().Str("every", flushEvery.String()).Msg("Invalid flush period")
+	}
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	var w io.Writer = os.Stdout
+	switch {
+	case dryRun > 0:
+		// The records are still encoded, for the errors of the format
+		w = ioutil.Discard
+	case outputPath != "":
+		f, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			Logger.Fatal().Str("path", outputPath).Err(err).Msg("Failed to open the output")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	clock := sf.getClock()
+	a := &agent{started: clock.Now(), clock: clock, sf: &sf, out: bufio.NewWriterSize(w, 64*1024)}
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(a.out)
+		a.encode = func(r *logs.Record) error { return encoder.Encode(r) }
+	case "msgpack":
+		mp := &msgpackWriter{w: a.out}
+		a.encode = func(r *logs.Record) error { mp.record(r); return nil }
+	default:
+		Logger.Fatal().Str("format", format).Msg("Unknown format")
+	}
+
+	sf.reloadable, sf.emits = true, true
+	p := sf.pipeline()
+	if dryRun > 0 {
+		a.dryRun(p, dryRun, outputPath, format)
+		return
+	}
+
+	if controlPath != "" {
+		// A socket left by a previous run would prevent the listening
+		os.Remove(controlPath)
+		l, err := net.Listen("unix", controlPath)
+		if err != nil {
+			Logger.Fatal().Str("path", controlPath).Err(err).Msg("Failed to open the control socket")
+		}
+		defer os.Remove(controlPath)
+		defer l.Close()
+		go a.serve(l)
+	}
+
+	go func() {
+		for range clock.NewTicker(flushEvery).C() {
+			a.flush()
+		}
+	}()
+
+	// Stop on a signal, with the pending records flushed
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		Logger.Info().Str("signal", s.String()).Msg("Stopping")
+		cancel()
+	}()
+
+	err := p.ForEach(ctx, func(r logs.Record) error {
+		a.lock.Lock()
+		err := a.encode(&r)
+		a.lock.Unlock()
+		atomic.AddUint64(&a.records, 1)
+		return err
+	})
+	if err != nil && err != context.Canceled {
+		Logger.Fatal().Err(err).Msg("Write error")
+	}
+	if err := a.flush(); err != nil {
+		Logger.Fatal().Err(err).Msg("Write error")
+	}
+}
+
+// dryRun passes the first n records through the pipeline and the encoder of
+// the output, and prints them as JSON lines instead of shipping them.
+func (a *agent) dryRun(p *logs.Pipeline, n int, outputPath, format string) {
+	if outputPath == "" {
+		outputPath = "-"
+	}
+	Logger.Info().Strs("stages", p.Stages()).Str("output", outputPath).Str("format", format).Int("records", n).Msg("Dry run, nothing written")
+	enough := errors.New("enough records")
+	encoder := json.NewEncoder(os.Stdout)
+	count := 0
+	err := p.ForEach(context.Background(), func(r logs.Record) error {
+		if err := a.encode(&r); err != nil {
+			return err
+		}
+		if err := encoder.Encode(&r); err != nil {
+			return err
+		}
+		if count++; count >= n {
+			return enough
+		}
+		return nil
+	})
+	if err != nil && err != enough {
+		Logger.Fatal().Err(err).Msg("Dry run failed")
+	}
+	Logger.Info().Int("records", count).Msg("Dry run done")
+}
+
+func (a *agent) flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.flushed = a.clock.Now()
+	atomic.AddUint64(&a.flushes, 1)
+	return a.out.Flush()
+}
+
+func (a *agent) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			Logger.Debug().Err(err).Msg("Control socket closed")
+			return
+		}
+		go a.control(conn)
+	}
+}
+
+// control executes the commands of a client of the control socket, one per
+// line. Each reply is a JSON object on a single line.
+func (a *agent) control(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for in.Scan() {
+		tokens := strings.Fields(in.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		reply, err := a.execute(tokens[0], tokens[1:])
+		if err != nil {
+			Logger.Warn().Str("command", tokens[0]).Err(err).Msg("Control command failed")
+			reply = map[string]interface{}{"ok": false, "error": err.Error()}
+		} else {
+			Logger.Debug().Str("command", tokens[0]).Msg("Control command")
+		}
+		if encoder.Encode(reply) != nil {
+			return
+		}
+	}
+}
+
+func (a *agent) execute(cmd string, args []string) (map[string]interface{}, error) {
+	ok := map[string]interface{}{"ok": true}
+	switch cmd {
+	case "reload-config":
+		if err := a.sf.live.reload(); err != nil {
+			return nil, err
+		}
+		ok["fields"] = len(a.sf.live.get().Fields)
+		return ok, nil
+	case "flush":
+		return ok, a.flush()
+	case "stats":
+		a.lock.Lock()
+		flushed := a.flushed
+		buffered := a.out.Buffered()
+		a.lock.Unlock()
+		ok["uptime"] = a.clock.Now().Sub(a.started).Round(time.Second).String()
+		ok["records"] = atomic.LoadUint64(&a.records)
+		ok["flushes"] = atomic.LoadUint64(&a.flushes)
+		ok["buffered"] = buffered
+		ok["level"] = zerolog.GlobalLevel().String()
+		if !flushed.IsZero() {
+			ok["flushed"] = flushed.UTC().Format(time.RFC3339)
+		}
+		return ok, nil
+	case "set-level":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("set-level expects a level")
+		}
+		level, err := zerolog.ParseLevel(args[0])
+		if err != nil {
+			return nil, err
+		}
+		zerolog.SetGlobalLevel(level)
+		return ok, nil
+	}
+	return nil, fmt.Errorf("Unknown command %q", cmd)
+}
@@ -0,0 +1,319 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+type accumulator interface {
+	add(v interface{})
+	value() interface{}
+}
+
+type metric struct {
+	name  string
+	fn    string
+	field string
+}
+
+var metricSyntax = regexp.MustCompile(`^([a-z0-9]+)(?:\(([A-Za-z0-9_]+)\))?$`)
+
+var percentileMetric = regexp.MustCompile(`^p([0-9]{1,2})$`)
+
+// parseMetrics parses the specs of the metrics, their fields checked by known
+func parseMetrics(specs []string, known func(name string) bool) ([]metric, error) {
+	out := make([]metric, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		m := metricSyntax.FindStringSubmatch(spec)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid metric %q", spec)
+		}
+		fn, field := m[1], m[2]
+		switch {
+		case fn == "count":
+		case fn == "unique", fn == "sum", fn == "avg", fn == "min", fn == "max", percentileMetric.MatchString(fn):
+			if field == "" {
+				return nil, fmt.Errorf("Metric %q expects a field", spec)
+			}
+			if !known(field) {
+				return nil, fmt.Errorf("Unknown field %s of the metric %q", field, spec)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown metric %q", spec)
+		}
+		out = append(out, metric{name: spec, fn: fn, field: field})
+	}
+	return out, nil
+}
+
+func (m metric) accumulator() accumulator {
+	switch m.fn {
+	case "count":
+		return &countAcc{}
+	case "unique":
+		return &uniqueAcc{seen: make(map[string]bool)}
+	case "sum":
+		return &sumAcc{}
+	case "avg":
+		return &avgAcc{}
+	case "min":
+		return &minMaxAcc{less: func(a, b float64) bool { return a < b }}
+	case "max":
+		return &minMaxAcc{less: func(a, b float64) bool { return a > b }}
+	}
+	p, _ := strconv.Atoi(percentileMetric.FindStringSubmatch(m.fn)[1])
+	return &percentileAcc{p: float64(p)}
+}
+
+type countAcc struct{ n int64 }
+
+func (a *countAcc) add(interface{})    { a.n++ }
+func (a *countAcc) value() interface{} { return a.n }
+
+type uniqueAcc struct{ seen map[string]bool }
+
+func (a *uniqueAcc) add(v interface{}) { a.seen[logs.ToString(v)] = true }
+func (a *uniqueAcc) value() interface{} {
+	return int64(len(a.seen))
+}
+
+type sumAcc struct {
+	i     int64
+	f     float64
+	float bool
+}
+
+func (a *sumAcc) add(v interface{}) {
+	switch x := logs.ToNumber(v).(type) {
+	case int64:
+		a.i += x
+	case float64:
+		a.f += x
+		a.float = true
+	}
+}
+
+func (a *sumAcc) value() interface{} {
+	if a.float {
+		return a.f + float64(a.i)
+	}
+	return a.i
+}
+
+type avgAcc struct {
+	sum float64
+	n   int64
+}
+
+func (a *avgAcc) add(v interface{}) {
+	if f, ok := toFloat(logs.ToNumber(v)); ok {
+		a.sum += f
+		a.n++
+	}
+}
+
+func (a *avgAcc) value() interface{} {
+	if a.n == 0 {
+		return nil
+	}
+	return a.sum / float64(a.n)
+}
+
+type minMaxAcc struct {
+	less func(a, b float64) bool
+	v    float64
+	set  bool
+}
+
+func (a *minMaxAcc) add(v interface{}) {
+	if f, ok := toFloat(logs.ToNumber(v)); ok && (!a.set || a.less(f, a.v)) {
+		a.v, a.set = f, true
+	}
+}
+
+func (a *minMaxAcc) value() interface{} {
+	if !a.set {
+		return nil
+	}
+	return compactNumber(a.v)
+}
+
+type percentileAcc struct {
+	p      float64
+	values []float64
+}
+
+func (a *percentileAcc) add(v interface{}) {
+	if f, ok := toFloat(logs.ToNumber(v)); ok {
+		a.values = append(a.values, f)
+	}
+}
+
+func (a *percentileAcc) value() interface{} {
+	return percentile(a.values, a.p)
+}
+
+// percentile computes the nearest-rank percentile, and sorts the values
+func percentile(values []float64, p float64) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return compactNumber(values[rank])
+}
+
+// compactNumber returns an int64 for the integral values
+func compactNumber(f float64) interface{} {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+	return f
+}
+
+type aggGroup struct {
+	keys []interface{}
+	accs []accumulator
+}
+
+// aggregator is a streaming GROUP BY over the fields of the records
+type aggregator struct {
+	groupBy []string
+	metrics []metric
+	groups  map[string]*aggGroup
+	order   []*aggGroup
+}
+
+func newAggregator(groupBy []string, metrics []metric) *aggregator {
+	return &aggregator{groupBy: groupBy, metrics: metrics, groups: make(map[string]*aggGroup)}
+}
+
+func (a *aggregator) add(r *logs.Record) {
+	keys := make([]interface{}, len(a.groupBy))
+	sb := strings.Builder{}
+	for i, name := range a.groupBy {
+		keys[i], _ = r.Field(name)
+		sb.WriteString(logs.ToString(keys[i]))
+		sb.WriteByte(0)
+	}
+	g, ok := a.groups[sb.String()]
+	if !ok {
+		g = &aggGroup{keys: keys, accs: make([]accumulator, len(a.metrics))}
+		for i, m := range a.metrics {
+			g.accs[i] = m.accumulator()
+		}
+		a.groups[sb.String()] = g
+		a.order = append(a.order, g)
+	}
+	for i, m := range a.metrics {
+		var v interface{}
+		if m.field != "" {
+			v, _ = r.Field(m.field)
+		}
+		g.accs[i].add(v)
+	}
+}
+
+// columns returns the names of the columns of the aggregate
+func (a *aggregator) columns() []string {
+	out := append([]string{}, a.groupBy...)
+	for _, m := range a.metrics {
+		out = append(out, m.name)
+	}
+	return out
+}
+
+// rows returns the groups, each as the values of its columns, ordered by key
+func (a *aggregator) rows() [][]interface{} {
+	out := make([][]interface{}, 0, len(a.order))
+	for _, g := range a.order {
+		row := append([]interface{}{}, g.keys...)
+		for _, acc := range g.accs {
+			row = append(row, acc.value())
+		}
+		out = append(out, row)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		for k := range a.groupBy {
+			if c := compareValues(out[i][k], out[j][k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return out
+}
+
+func mainAgg(args []string) {
+	var sf streamFlags
+	var flagJson bool
+	var groupBy, metricSpecs []string
+	var rf reportFlags
+	var table string
+	var nbColumns int64
+
+	fs := pflag.NewFlagSet("agg", pflag.ExitOnError)
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the groups as JSON objects")
+	fs.StringSliceVarP(&groupBy, "group-by", "g", make([]string, 0), "Fields to group the records by")
+	fs.StringSliceVarP(&metricSpecs, "metrics", "m", []string{"count"}, "Metrics of each group: count, unique(f), sum(f), avg(f), min(f), max(f), p50(f), p99(f)...")
+	fs.StringSliceVar(&rf.sortBy, "sort-by", make([]string, 0), "Sort the groups by columns (like count:desc)")
+	fs.IntVar(&rf.limit, "limit", 0, "Max number of groups displayed")
+	fs.StringVar(&table, "table", tablePlain, "Style of the table: plain, border or markdown")
+	fs.Int64VarP(&nbColumns, "columns", "c", terminalColumns(), "Max line length of the table")
+	sf.register(fs, 1)
+	sf.parse(fs, args)
+
+	// Else the groups would gather the records under a missing value
+	for _, name := range groupBy {
+		if !sf.knownField(name) {
+			Logger.Fatal().Str("field", name).Msg("Unknown field of --group-by, expected a field of the records or a derived one")
+		}
+	}
+	metrics, err := parseMetrics(metricSpecs, sf.knownField)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid metrics")
+	}
+
+	agg := newAggregator(groupBy, metrics)
+	rf.columns = make(map[string]bool)
+	for _, c := range agg.columns() {
+		rf.columns[c] = true
+	}
+	rf.check()
+	for r := range sf.records() {
+		agg.add(&r)
+	}
+
+	columns := agg.columns()
+	rows := rf.applyTable(columns, agg.rows())
+	if !flagJson {
+		renderTable(os.Stdout, table, int(nbColumns), columns, rows)
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, row := range rows {
+		obj := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			obj[c] = row[i]
+		}
+		encoder.Encode(obj)
+	}
+}
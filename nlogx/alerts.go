@@ -0,0 +1,101 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// alertKey identifies an event by its kind, its subject and the period of the
+// log, thus the same whenever the period is processed again.
+func alertKey(kind, subject string, start int64) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + subject + "\x00" + strconv.FormatInt(start, 10)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// digestKey identifies a digest by the keys of its events
+func digestKey(events []digestEvent) string {
+	keys := make([]string, 0, len(events))
+	for _, e := range events {
+		keys = append(keys, e.Key)
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sentAlerts are the keys of the events already notified, with the time they
+// were sent. Saved into a file, they survive a restart, so that a replay of
+// the same log notifies nothing twice.
+type sentAlerts struct {
+	path string
+	ttl  time.Duration
+	Sent map[string]int64 `json:"sent"`
+}
+
+// loadSentAlerts loads the keys sent, none if the file does not exist yet.
+// Without a path, the keys stay in memory.
+func loadSentAlerts(path string, ttl time.Duration) (*sentAlerts, error) {
+	s := &sentAlerts{path: path, ttl: ttl, Sent: make(map[string]int64)}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, s); err != nil {
+		return nil, err
+	}
+	if s.Sent == nil {
+		s.Sent = make(map[string]int64)
+	}
+	return s, nil
+}
+
+// unsent returns the events whose keys were never sent
+func (s *sentAlerts) unsent(events []digestEvent) []digestEvent {
+	out := make([]digestEvent, 0, len(events))
+	for _, e := range events {
+		if _, ok := s.Sent[e.Key]; !ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// add records the keys of the events sent, forgets the keys older than the
+// ttl, and saves the keys.
+func (s *sentAlerts) add(events []digestEvent, now time.Time) error {
+	for _, e := range events {
+		s.Sent[e.Key] = now.Unix()
+	}
+	if s.ttl > 0 {
+		oldest := now.Add(-s.ttl).Unix()
+		for k, t := range s.Sent {
+			if t < oldest {
+				delete(s.Sent, k)
+			}
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+	raw, _ := json.Marshal(s)
+	return logs.WriteAtomic(s.path, raw)
+}
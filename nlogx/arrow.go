@@ -0,0 +1,422 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// The Arrow IPC streaming format is a schema message followed by record batch
+// messages. Each message is a flatbuffer (the metadata) and a body made of the
+// buffers of the columns. Only the few flatbuffer tables required are encoded
+// here, to avoid depending on the whole Arrow library.
+
+const (
+	arrowBatchSize = 4096
+
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt       = 2
+	arrowTypeUtf8      = 5
+	arrowTypeTimestamp = 10
+	arrowTypeList      = 12
+)
+
+// fbObject is an object of a flatbuffer, written after the objects referring
+// to it, so that all the offsets are forward.
+type fbObject interface {
+	write(b *fbBuilder) int
+}
+
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) u32(v uint32) int {
+	pos := len(b.buf)
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b.buf[pos:], v)
+	return pos
+}
+
+// link writes the child and patches the offset at pos to refer to it
+func (b *fbBuilder) link(pos int, child fbObject) {
+	target := child.write(b)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+// fbSlot is a field of a table, either a scalar or a reference to an object
+type fbSlot struct {
+	scalar []byte
+	child  fbObject
+}
+
+type fbTable []fbSlot
+
+func fbBool(v bool) fbSlot {
+	if v {
+		return fbSlot{scalar: []byte{1}}
+	}
+	return fbSlot{scalar: []byte{0}}
+}
+
+func fbByte(v byte) fbSlot { return fbSlot{scalar: []byte{v}} }
+
+func fbShort(v int16) fbSlot {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(v))
+	return fbSlot{scalar: b}
+}
+
+func fbInt(v int32) fbSlot {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return fbSlot{scalar: b}
+}
+
+func fbLong(v int64) fbSlot {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return fbSlot{scalar: b}
+}
+
+func fbRef(o fbObject) fbSlot { return fbSlot{child: o} }
+
+func (t fbTable) write(b *fbBuilder) int {
+	// Lay out the fields after the offset to the vtable, each aligned on its
+	// size, the table itself being aligned on 8 bytes.
+	offsets := make([]int, len(t))
+	size := 4
+	for i, s := range t {
+		width := len(s.scalar)
+		if s.child != nil {
+			width = 4
+		}
+		if width == 0 {
+			continue
+		}
+		for size%width != 0 {
+			size++
+		}
+		offsets[i] = size
+		size += width
+	}
+
+	b.pad(2)
+	vtable := len(b.buf)
+	vt := make([]byte, 4+2*len(t))
+	binary.LittleEndian.PutUint16(vt[0:], uint16(len(vt)))
+	binary.LittleEndian.PutUint16(vt[2:], uint16(size))
+	for i, off := range offsets {
+		binary.LittleEndian.PutUint16(vt[4+2*i:], uint16(off))
+	}
+	b.buf = append(b.buf, vt...)
+
+	b.pad(8)
+	start := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[start:], uint32(start-vtable))
+	for i, s := range t {
+		if s.scalar != nil {
+			copy(b.buf[start+offsets[i]:], s.scalar)
+		}
+	}
+	for i, s := range t {
+		if s.child != nil {
+			b.link(start+offsets[i], s.child)
+		}
+	}
+	return start
+}
+
+type fbString string
+
+func (s fbString) write(b *fbBuilder) int {
+	b.pad(4)
+	pos := b.u32(uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
+
+type fbVector []fbObject
+
+func (v fbVector) write(b *fbBuilder) int {
+	b.pad(4)
+	pos := b.u32(uint32(len(v)))
+	slots := make([]int, len(v))
+	for i := range v {
+		slots[i] = b.u32(0)
+	}
+	for i, o := range v {
+		b.link(slots[i], o)
+	}
+	return pos
+}
+
+// fbLongPairs is a vector of structs made of two longs, like the FieldNode and
+// the Buffer of a record batch.
+type fbLongPairs [][2]int64
+
+func (v fbLongPairs) write(b *fbBuilder) int {
+	for (len(b.buf)+4)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := b.u32(uint32(len(v)))
+	for _, p := range v {
+		b.buf = append(b.buf, make([]byte, 16)...)
+		binary.LittleEndian.PutUint64(b.buf[len(b.buf)-16:], uint64(p[0]))
+		binary.LittleEndian.PutUint64(b.buf[len(b.buf)-8:], uint64(p[1]))
+	}
+	return pos
+}
+
+func fbFinish(root fbObject) []byte {
+	b := &fbBuilder{}
+	pos := b.u32(0)
+	b.link(pos, root)
+	b.pad(8)
+	return b.buf
+}
+
+// arrowColumn is a column of the Arrow schema and its accessor
+type arrowColumn struct {
+	name     string
+	kind     int
+	bits     int
+	nullable bool
+	text     func(r *logs.Record) string
+	number   func(r *logs.Record) int64
+	list     func(r *logs.Record) []string
+}
+
+func (c arrowColumn) field() fbTable {
+	var typ fbTable
+	children := fbVector{}
+	switch c.kind {
+	case arrowTypeInt:
+		typ = fbTable{fbInt(int32(c.bits)), fbBool(true)}
+	case arrowTypeTimestamp:
+		typ = fbTable{fbShort(0), fbRef(fbString("UTC"))}
+	case arrowTypeList:
+		typ = fbTable{}
+		item := arrowColumn{name: "item", kind: arrowTypeUtf8}
+		children = fbVector{item.field()}
+	default:
+		typ = fbTable{}
+	}
+	return fbTable{
+		fbRef(fbString(c.name)),
+		fbBool(c.nullable),
+		fbByte(byte(c.kind)),
+		fbRef(typ),
+		{},
+		fbRef(children),
+	}
+}
+
+// arrowWriter encodes the records as an Arrow IPC stream, by batches
+type arrowWriter struct {
+	w       io.Writer
+	columns []arrowColumn
+	batch   []logs.Record
+	err     error
+}
+
+func newArrowWriter(w io.Writer, extras []string) *arrowWriter {
+	str := func(name string, get func(r *logs.Record) string) arrowColumn {
+		return arrowColumn{name: name, kind: arrowTypeUtf8, text: get}
+	}
+	opt := func(name string, get func(r *logs.Record) string) arrowColumn {
+		return arrowColumn{name: name, kind: arrowTypeUtf8, nullable: true, text: get}
+	}
+	num := func(name string, bits int, get func(r *logs.Record) int64) arrowColumn {
+		return arrowColumn{name: name, kind: arrowTypeInt, bits: bits, number: get}
+	}
+	a := &arrowWriter{w: w}
+	a.columns = []arrowColumn{
+		str("src", func(r *logs.Record) string { return r.Ip }),
+		{name: "t", kind: arrowTypeTimestamp, number: func(r *logs.Record) int64 { return r.When }},
+		str("method", func(r *logs.Record) string { return r.Method }),
+		str("path", func(r *logs.Record) string { return r.Path }),
+		num("version", 32, func(r *logs.Record) int64 { return int64(r.Version) }),
+		num("status", 32, func(r *logs.Record) int64 { return int64(r.Code) }),
+		num("bytes", 64, func(r *logs.Record) int64 { return r.Bytes }),
+		str("referrer", func(r *logs.Record) string { return r.Referrer }),
+		str("agent", func(r *logs.Record) string { return r.Agent }),
+		opt("user", func(r *logs.Record) string { return r.User }),
+		opt("country", func(r *logs.Record) string { return r.Country }),
+		num("asn", 64, func(r *logs.Record) int64 { return int64(r.ASN) }),
+		{name: "indicators", kind: arrowTypeList, list: func(r *logs.Record) []string { return r.Indicators }},
+		opt("id", func(r *logs.Record) string { return r.ID }),
+	}
+	for _, name := range extras {
+		name := name
+		a.columns = append(a.columns, opt(name, func(r *logs.Record) string { return logs.ToString(r.Extra[name]) }))
+	}
+
+	fields := make(fbVector, len(a.columns))
+	for i, c := range a.columns {
+		fields[i] = c.field()
+	}
+	schema := fbTable{{}, fbRef(fields)}
+	a.message(arrowHeaderSchema, schema, nil)
+	return a
+}
+
+func (a *arrowWriter) message(kind byte, header fbTable, body []byte) {
+	if a.err != nil {
+		return
+	}
+	meta := fbFinish(fbTable{
+		fbShort(arrowMetadataV5),
+		fbByte(kind),
+		fbRef(header),
+		fbLong(int64(len(body))),
+	})
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	for _, b := range [][]byte{prefix, meta, body} {
+		if _, err := a.w.Write(b); err != nil {
+			a.err = err
+			return
+		}
+	}
+}
+
+func (a *arrowWriter) write(r logs.Record) {
+	a.batch = append(a.batch, r)
+	if len(a.batch) >= arrowBatchSize {
+		a.flush()
+	}
+}
+
+// arrowBody accumulates the buffers of a record batch, each aligned on 8 bytes
+type arrowBody struct {
+	data    []byte
+	nodes   fbLongPairs
+	buffers fbLongPairs
+}
+
+func (b *arrowBody) buffer(data []byte) {
+	b.buffers = append(b.buffers, [2]int64{int64(len(b.data)), int64(len(data))})
+	b.data = append(b.data, data...)
+	for len(b.data)%8 != 0 {
+		b.data = append(b.data, 0)
+	}
+}
+
+// validity appends the bitmap of the non-null values, or an empty buffer if
+// there is no null value.
+func (b *arrowBody) validity(valid []bool) {
+	nulls := 0
+	bitmap := make([]byte, (len(valid)+7)/8)
+	for i, v := range valid {
+		if v {
+			bitmap[i/8] |= 1 << uint(i%8)
+		} else {
+			nulls++
+		}
+	}
+	b.nodes = append(b.nodes, [2]int64{int64(len(valid)), int64(nulls)})
+	if nulls == 0 {
+		bitmap = nil
+	}
+	b.buffer(bitmap)
+}
+
+func (b *arrowBody) strings(values []string, valid []bool) {
+	b.validity(valid)
+	offsets := make([]byte, 4*(len(values)+1))
+	data := make([]byte, 0)
+	for i, s := range values {
+		data = append(data, s...)
+		binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+	}
+	b.buffer(offsets)
+	b.buffer(data)
+}
+
+func (a *arrowWriter) flush() {
+	n := len(a.batch)
+	if n == 0 {
+		return
+	}
+	body := &arrowBody{}
+	allValid := make([]bool, n)
+	for i := range allValid {
+		allValid[i] = true
+	}
+	for _, c := range a.columns {
+		switch c.kind {
+		case arrowTypeUtf8:
+			values, valid := make([]string, n), make([]bool, n)
+			for i := range a.batch {
+				values[i] = c.text(&a.batch[i])
+				valid[i] = !c.nullable || values[i] != ""
+			}
+			body.strings(values, valid)
+		case arrowTypeInt, arrowTypeTimestamp:
+			body.validity(allValid)
+			width := 8
+			if c.bits == 32 {
+				width = 4
+			}
+			data := make([]byte, width*n)
+			for i := range a.batch {
+				v := c.number(&a.batch[i])
+				if width == 4 {
+					binary.LittleEndian.PutUint32(data[4*i:], uint32(v))
+				} else {
+					binary.LittleEndian.PutUint64(data[8*i:], uint64(v))
+				}
+			}
+			body.buffer(data)
+		case arrowTypeList:
+			body.validity(allValid)
+			offsets := make([]byte, 4*(n+1))
+			items := make([]string, 0)
+			for i := range a.batch {
+				items = append(items, c.list(&a.batch[i])...)
+				binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(items)))
+			}
+			body.buffer(offsets)
+			valid := make([]bool, len(items))
+			for i := range valid {
+				valid[i] = true
+			}
+			body.strings(items, valid)
+		}
+	}
+	a.message(arrowHeaderRecordBatch, fbTable{
+		fbLong(int64(n)),
+		fbRef(body.nodes),
+		fbRef(body.buffers),
+	}, body.data)
+	a.batch = a.batch[:0]
+}
+
+// close flushes the last batch and ends the stream
+func (a *arrowWriter) close() error {
+	a.flush()
+	if a.err == nil {
+		_, a.err = a.w.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+	}
+	return a.err
+}
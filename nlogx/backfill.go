@@ -0,0 +1,191 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// backfillState is the checkpoint of a backfill: the files entirely shipped,
+// with their size to tell a file replaced since.
+type backfillState struct {
+	Completed map[string]int64 `json:"completed"`
+	Records   uint64           `json:"records"`
+}
+
+// throttledReader reads at most rate bytes per second, and counts them
+type throttledReader struct {
+	f       *os.File
+	rate    float64
+	clock   logs.Clock
+	started time.Time
+	read    *uint64
+	total   uint64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.f.Read(p)
+	t.total += uint64(n)
+	atomic.AddUint64(t.read, uint64(n))
+	if t.rate > 0 {
+		due := time.Duration(float64(t.total) / t.rate * float64(time.Second))
+		sleep(t.clock, due-t.clock.Now().Sub(t.started))
+	}
+	return n, err
+}
+
+func mainBackfill(args []string) {
+	var sf streamFlags
+	var checkpointPath, rateStr, format string
+	var progressEvery time.Duration
+
+	fs := pflag.NewFlagSet("backfill", pflag.ExitOnError)
+	fs.StringVar(&checkpointPath, "checkpoint", "", "Path of the checkpoint, to resume after the files already shipped")
+	fs.StringVar(&rateStr, "rate", "", "Max rate of the reads from the archive (like 20M, per second)")
+	fs.StringVarP(&format, "format", "f", "json", "Format of the records: json or msgpack")
+	fs.DurationVar(&progressEvery, "progress-every", 10*time.Second, "Period of the reports of the progress")
+	sf.register(fs, 0)
+	sf.parse(fs, args)
+
+	if progressEvery <= 0 {
+		Logger.Fatal().Str("every", progressEvery.String()).Msg("Invalid progress period")
+	}
+	sf.emits = true
+	clock := sf.getClock()
+	if sf.dir == "" {
+		if len(sf.files) != 1 {
+			Logger.Fatal().Msg("Expected the directory of the archive")
+		}
+		sf.dir, sf.files = sf.files[0], nil
+	}
+	paths, err := discoverLogs(sf.dir, sf.logNames())
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to discover the logs")
+	}
+	paths = append(paths, sf.files...)
+	sf.dir, sf.files = "", nil
+	var rate uint64
+	if rateStr != "" {
+		if rate, err = parseByteSize(rateStr); err != nil {
+			Logger.Fatal().Err(err).Msg("Invalid rate")
+		}
+	}
+
+	state := backfillState{Completed: make(map[string]int64)}
+	if checkpointPath != "" {
+		if raw, err := ioutil.ReadFile(checkpointPath); err == nil {
+			if err = json.Unmarshal(raw, &state); err != nil {
+				Logger.Fatal().Str("path", checkpointPath).Err(err).Msg("Invalid checkpoint")
+			}
+		} else if !os.IsNotExist(err) {
+			Logger.Fatal().Str("path", checkpointPath).Err(err).Msg("Failed to load the checkpoint")
+		}
+	}
+	sizes := make(map[string]int64, len(paths))
+	var todo []string
+	var totalBytes uint64
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			Logger.Fatal().Str("path", path).Err(err).Msg("Read error")
+		}
+		sizes[path] = st.Size()
+		if size, ok := state.Completed[path]; ok {
+			if size == st.Size() {
+				continue
+			}
+			Logger.Warn().Str("path", path).Msg("File changed since shipped, shipped again")
+		}
+		todo = append(todo, path)
+		totalBytes += uint64(st.Size())
+	}
+	Logger.Info().Int("files", len(todo)).Int("skipped", len(paths)-len(todo)).Str("bytes", fmtByteSize(float64(totalBytes))).Msg("Backfill started")
+
+	out := bufio.NewWriterSize(os.Stdout, 64*1024)
+	var encode func(r *logs.Record) error
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encode = func(r *logs.Record) error { return encoder.Encode(r) }
+	case "msgpack":
+		mp := &msgpackWriter{w: out}
+		encode = func(r *logs.Record) error { mp.record(r); return nil }
+	default:
+		Logger.Fatal().Str("format", format).Msg("Unknown format")
+	}
+
+	var read, records uint64
+	var current atomic.Value
+	current.Store("")
+	started := clock.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := clock.NewTicker(progressEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+			}
+			n := atomic.LoadUint64(&read)
+			elapsed := clock.Now().Sub(started)
+			ev := Logger.Info().Str("file", current.Load().(string)).
+				Str("read", fmtByteSize(float64(n))).Str("total", fmtByteSize(float64(totalBytes))).
+				Uint64("records", atomic.LoadUint64(&records)).
+				Str("rate", fmtByteSize(float64(n)/elapsed.Seconds())+"/s")
+			if n > 0 {
+				eta := time.Duration(float64(elapsed) * float64(totalBytes-n) / float64(n))
+				ev = ev.Str("eta", eta.Round(time.Second).String())
+			}
+			ev.Msg("Backfill progress")
+		}
+	}()
+
+	for i, path := range todo {
+		f, err := os.Open(path)
+		if err != nil {
+			Logger.Fatal().Str("path", path).Err(err).Msg("Read error")
+		}
+		current.Store(path)
+		sf.input = &throttledReader{f: f, rate: float64(rate), clock: clock, started: clock.Now(), read: &read}
+		var shipped uint64
+		err = sf.pipeline().ForEach(context.Background(), func(r logs.Record) error {
+			shipped++
+			atomic.AddUint64(&records, 1)
+			return encode(&r)
+		})
+		f.Close()
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			Logger.Fatal().Err(err).Msg("Write error")
+		}
+		// Shipped entirely, thus never read again
+		state.Completed[path] = sizes[path]
+		state.Records += shipped
+		if checkpointPath != "" {
+			raw, _ := json.Marshal(&state)
+			if err := logs.WriteAtomic(checkpointPath, raw); err != nil {
+				Logger.Fatal().Str("path", checkpointPath).Err(err).Msg("Failed to save the checkpoint")
+			}
+		}
+		Logger.Debug().Str("path", path).Int("done", i+1).Int("files", len(todo)).Msg("File shipped")
+	}
+	close(done)
+	Logger.Info().Int("files", len(todo)).Uint64("records", atomic.LoadUint64(&records)).
+		Str("elapsed", clock.Now().Sub(started).Round(time.Second).String()).Msg("Backfill done")
+}
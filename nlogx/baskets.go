@@ -0,0 +1,189 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// basket is the set of the paths requested in a session of a client
+type basket struct {
+	last    int64
+	paths   map[string]bool
+	order   []string
+	hostile bool
+	denied  int
+	total   int
+}
+
+// pathPair is a pair of paths requested in the same sessions
+type pathPair struct {
+	A            string  `json:"a"`
+	B            string  `json:"b"`
+	Sessions     int     `json:"sessions"`
+	Sweeps       int     `json:"sweeps"`
+	ConfidenceAB float64 `json:"confidence_ab"`
+	ConfidenceBA float64 `json:"confidence_ba"`
+	Lift         float64 `json:"lift"`
+	Kind         string  `json:"kind"`
+}
+
+// basketStats counts the paths and the pairs of paths over the sessions
+type basketStats struct {
+	maxPaths int
+	sessions int
+	paths    map[string]int
+	pairs    map[[2]string]int
+	// sweeps counts the pairs in the sessions of the scanners
+	sweeps map[[2]string]int
+}
+
+func (bs *basketStats) add(b *basket) {
+	// A session mostly denied, or matching a signature, is a sweep
+	sweep := b.hostile || 2*b.denied > b.total
+	paths := b.order
+	if len(paths) > bs.maxPaths {
+		paths = paths[:bs.maxPaths]
+	}
+	bs.sessions++
+	for i, a := range paths {
+		bs.paths[a]++
+		for _, c := range paths[i+1:] {
+			key := [2]string{a, c}
+			if c < a {
+				key = [2]string{c, a}
+			}
+			bs.pairs[key]++
+			if sweep {
+				bs.sweeps[key]++
+			}
+		}
+	}
+}
+
+// kind tells a bundle of assets worth preloading, a navigation between pages,
+// or a sweep of a scanner.
+func (p *pathPair) kind() string {
+	switch {
+	case 2*p.Sweeps > p.Sessions:
+		return "sweep"
+	case staticAssets.MatchString(p.A) && staticAssets.MatchString(p.B):
+		return "bundle"
+	}
+	return "navigation"
+}
+
+func mainBaskets(args []string) {
+	var sf streamFlags
+	var idle time.Duration
+	var minSessions int
+	var rf reportFlags
+	var kind string
+	var flagJson bool
+	bs := &basketStats{
+		paths:  make(map[string]int),
+		pairs:  make(map[[2]string]int),
+		sweeps: make(map[[2]string]int),
+	}
+
+	fs := pflag.NewFlagSet("baskets", pflag.ExitOnError)
+	fs.DurationVar(&idle, "idle", 30*time.Minute, "Idle period closing a session")
+	fs.IntVar(&minSessions, "min-sessions", 5, "Min number of sessions requesting both paths of a pair")
+	fs.IntVar(&bs.maxPaths, "max-paths", 50, "Max number of distinct paths of a session paired, the first ones")
+	fs.StringVar(&kind, "kind", "", "Only report the pairs of that kind: bundle, navigation or sweep")
+	rf.register(fs, "pairs", 30, pathPair{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the pairs as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	maxIdle := int64(idle / time.Second)
+	baskets := make(map[string]*basket)
+	for r := range sf.records() {
+		key := r.Ip + "\x00" + r.Agent
+		b, ok := baskets[key]
+		if ok && r.When-b.last > maxIdle {
+			bs.add(b)
+			ok = false
+		}
+		if !ok {
+			b = &basket{paths: make(map[string]bool)}
+			baskets[key] = b
+		}
+		b.last = r.When
+		b.total++
+		if isDenied(r.Code) {
+			b.denied++
+		}
+		if len(ts.match(r)) > 0 {
+			b.hostile = true
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		if !b.paths[p] {
+			b.paths[p] = true
+			b.order = append(b.order, p)
+		}
+	}
+	for _, b := range baskets {
+		bs.add(b)
+	}
+
+	pairs := make([]*pathPair, 0)
+	for key, n := range bs.pairs {
+		if n < minSessions {
+			continue
+		}
+		na, nb := float64(bs.paths[key[0]]), float64(bs.paths[key[1]])
+		p := &pathPair{
+			A: key[0], B: key[1], Sessions: n, Sweeps: bs.sweeps[key],
+			ConfidenceAB: float64(n) / na,
+			ConfidenceBA: float64(n) / nb,
+			Lift:         float64(n) * float64(bs.sessions) / (na * nb),
+		}
+		if p.Kind = p.kind(); kind == "" || p.Kind == kind {
+			pairs = append(pairs, p)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Lift != pairs[j].Lift {
+			return pairs[i].Lift > pairs[j].Lift
+		}
+		if pairs[i].Sessions != pairs[j].Sessions {
+			return pairs[i].Sessions > pairs[j].Sessions
+		}
+		return pairs[i].A+pairs[i].B < pairs[j].A+pairs[j].B
+	})
+	frequent := len(pairs)
+	rf.apply(&pairs)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, p := range pairs {
+			encoder.Encode(p)
+		}
+		return
+	}
+	for _, p := range pairs {
+		fmt.Printf("%-10s %6d sessions  lift %6.2f  %3.0f%% -> %3.0f%% <-  %s + %s\n",
+			p.Kind, p.Sessions, p.Lift, 100*p.ConfidenceAB, 100*p.ConfidenceBA, p.A, p.B)
+	}
+	fmt.Printf("%d sessions, %d pairs with at least %d sessions\n", bs.sessions, frequent, minSessions)
+}
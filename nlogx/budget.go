@@ -0,0 +1,113 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// outputBudget bounds the number of records and the bytes of the output, e.g.
+// against the unfiltered export of a huge archive.
+type outputBudget struct {
+	maxRecords int
+	maxBytes   int64
+	records    int
+	bytes      int64
+	// exceeded tells the records were stopped
+	exceeded bool
+}
+
+func (b *outputBudget) set() bool {
+	return b.maxRecords > 0 || b.maxBytes > 0
+}
+
+// fits tells if one more record of that size stays within the budget
+func (b *outputBudget) fits(size int64) bool {
+	return (b.maxRecords <= 0 || b.records < b.maxRecords) && (b.maxBytes <= 0 || b.bytes+size <= b.maxBytes)
+}
+
+func (b *outputBudget) add(size int64) {
+	b.records++
+	b.bytes += size
+}
+
+// estimatedSize approximates the size of a record at the output, the same for
+// all the formats: its fields and room for the separators and the keys of
+// JSON, so that the plainer formats are overestimated rather than under.
+func estimatedSize(r *logs.Record) int64 {
+	n := 128 + len(r.Ip) + len(r.Method) + len(r.Path) + len(r.Referrer) + len(r.Agent) + len(r.User) + len(r.Country)
+	for _, i := range r.Indicators {
+		n += len(i) + 1
+	}
+	for k, v := range r.Extra {
+		n += len(k) + len(logs.ToString(v)) + 2
+	}
+	return int64(n)
+}
+
+// limitOutput stops the records once the budget is exceeded, by their
+// estimated size.
+func limitOutput(in <-chan logs.Record, b *outputBudget) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			size := estimatedSize(&r)
+			if !b.fits(size) {
+				Logger.Warn().Int("records", b.records).Int64("bytes", b.bytes).Msg("Output budget exceeded, the output stops")
+				b.exceeded = true
+				return
+			}
+			b.add(size)
+			out <- r
+		}
+	}()
+	return out
+}
+
+// rotatingOutput writes the records into path, then into path.1, path.2, etc.
+// each time the budget of the current file is exceeded. Each write is expected
+// to be a whole record.
+type rotatingOutput struct {
+	path   string
+	budget outputBudget
+	file   *os.File
+	parts  int
+}
+
+func newRotatingOutput(path string, budget outputBudget) (*rotatingOutput, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingOutput{path: path, budget: budget, file: f}, nil
+}
+
+func (o *rotatingOutput) Write(p []byte) (int, error) {
+	size := int64(len(p))
+	// A record alone above the budget fills a file anyway
+	if o.budget.records > 0 && !o.budget.fits(size) {
+		if err := o.file.Close(); err != nil {
+			return 0, err
+		}
+		o.parts++
+		f, err := os.Create(fmt.Sprintf("%s.%d", o.path, o.parts))
+		if err != nil {
+			return 0, err
+		}
+		o.file = f
+		o.budget.records, o.budget.bytes = 0, 0
+	}
+	o.budget.add(size)
+	return o.file.Write(p)
+}
+
+func (o *rotatingOutput) Close() error {
+	return o.file.Close()
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// staticAssets matches the extensions of the assets worth a client cache
+	staticAssets = regexp.MustCompile(`(?i)\.(js|mjs|css|png|jpe?g|gif|webp|avif|svg|ico|woff2?|ttf|otf|eot|mp[34]|webm|json|xml|txt|pdf|wasm)$`)
+	// fingerprinted matches the assets with a hash in their name, never changed
+	fingerprinted = regexp.MustCompile(`[.-][0-9a-f]{6,}\.[a-z0-9]+$`)
+	maxAgeRegex   = regexp.MustCompile(`(?i)max-age=(\d+)`)
+)
+
+// pathCache accounts for the repeated downloads of an asset by its clients
+type pathCache struct {
+	Path           string `json:"path"`
+	Requests       int    `json:"requests"`
+	Repeats        int    `json:"repeats"`
+	Revalidated    int    `json:"revalidated"`
+	WastedBytes    int64  `json:"wasted_bytes"`
+	CacheControl   string `json:"cache_control,omitempty"`
+	Recommendation string `json:"recommendation"`
+}
+
+// cacheHeader returns the cache policy logged with the response, if any
+func cacheHeader(r *logs.Record) (string, bool) {
+	for _, name := range []string{"sent_http_cache_control", "cache_control"} {
+		if v, ok := r.Extra[name]; ok {
+			if s := logs.ToString(v); s != "-" {
+				return s, true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// recommendCache proposes a header to a path, given its current one and the
+// delay between the repeated downloads.
+func recommendCache(p *pathCache, logged bool, minDelay int64) string {
+	immutable := fingerprinted.MatchString(p.Path)
+	cc := strings.ToLower(p.CacheControl)
+	switch {
+	case immutable && !strings.Contains(cc, "immutable"):
+		return "Cache-Control: public, max-age=31536000, immutable"
+	case !logged:
+		return "log $sent_http_cache_control to know the current policy"
+	case cc == "" || strings.Contains(cc, "no-store") || strings.Contains(cc, "max-age=0"):
+		return "Cache-Control: public, max-age=3600, with an ETag for the revalidations"
+	case strings.Contains(cc, "no-cache") && p.Revalidated == 0:
+		return "an ETag or a Last-Modified, so that no-cache revalidates with a 304"
+	}
+	if m := maxAgeRegex.FindStringSubmatch(cc); m != nil {
+		if age, _ := strconv.ParseInt(m[1], 10, 64); age > minDelay {
+			return "the clients download again before max-age, check Vary and the cache busters"
+		}
+		return fmt.Sprintf("a max-age above %s", time.Duration(minDelay)*time.Second)
+	}
+	return "keep"
+}
+
+func mainCache(args []string) {
+	var sf streamFlags
+	var window time.Duration
+	var allPaths, flagJson bool
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("cache", pflag.ExitOnError)
+	fs.DurationVar(&window, "window", 24*time.Hour, "Max delay between two downloads by a client for the second to be wasted")
+	fs.BoolVar(&allPaths, "all-paths", false, "Audit all the paths, not only the static assets")
+	rf.register(fs, "paths", 20, pathCache{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the paths as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	maxDelay := int64(window / time.Second)
+	// The last download of each asset by each client, and the shortest delay
+	// between two downloads of each asset.
+	last := make(map[string]int64)
+	minDelays := make(map[string]int64)
+	paths := make(map[string]*pathCache)
+	logged := false
+	for r := range sf.records() {
+		if r.Method != "GET" || (r.Code != 200 && r.Code != 304) {
+			continue
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		if !allPaths && !staticAssets.MatchString(path.Ext(p)) {
+			continue
+		}
+		s, ok := paths[p]
+		if !ok {
+			s = &pathCache{Path: p}
+			paths[p] = s
+		}
+		s.Requests++
+		if cc, ok := cacheHeader(&r); ok {
+			logged = true
+			s.CacheControl = cc
+		}
+		if r.Code == 304 {
+			s.Revalidated++
+			continue
+		}
+		client := r.Ip + "\x00" + r.Agent + "\x00" + p
+		if t, ok := last[client]; ok && r.When-t <= maxDelay {
+			s.Repeats++
+			s.WastedBytes += r.Bytes
+			if d, ok := minDelays[p]; !ok || r.When-t < d {
+				minDelays[p] = r.When - t
+			}
+		}
+		last[client] = r.When
+	}
+
+	report := make([]*pathCache, 0)
+	var wasted int64
+	for p, s := range paths {
+		if s.Repeats == 0 {
+			continue
+		}
+		s.Recommendation = recommendCache(s, logged, minDelays[p])
+		wasted += s.WastedBytes
+		report = append(report, s)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].WastedBytes != report[j].WastedBytes {
+			return report[i].WastedBytes > report[j].WastedBytes
+		}
+		return report[i].Path < report[j].Path
+	})
+	rf.apply(&report)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, s := range report {
+			encoder.Encode(s)
+		}
+		return
+	}
+	for _, s := range report {
+		cc := s.CacheControl
+		if !logged {
+			cc = "?"
+		} else if cc == "" {
+			cc = "-"
+		}
+		fmt.Printf("%-40s %6d repeats / %6d requests %12s wasted, %d revalidated, Cache-Control: %s\n",
+			s.Path, s.Repeats, s.Requests, fmtByteSize(float64(s.WastedBytes)), s.Revalidated, cc)
+		fmt.Printf("  => %s\n", s.Recommendation)
+	}
+	fmt.Printf("%s wasted on the downloads repeated within %s\n", fmtByteSize(float64(wasted)), window)
+}
@@ -0,0 +1,334 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// hostileSource gathers the hostile activity of one source address
+type hostileSource struct {
+	ip       string
+	network  string
+	agents   map[string]int
+	paths    map[string]int
+	days     map[string]int
+	first    int64
+	last     int64
+	requests int
+}
+
+type campaign struct {
+	sources  []*hostileSource
+	links    map[string]bool
+	first    int64
+	last     int64
+	requests int
+}
+
+// unionFind is a disjoint-set forest over the indices of the hostile sources
+type unionFind []int
+
+func (uf unionFind) find(i int) int {
+	for uf[i] != i {
+		uf[i] = uf[uf[i]]
+		i = uf[i]
+	}
+	return i
+}
+
+func (uf unionFind) union(i, j int) {
+	uf[uf.find(i)] = uf.find(j)
+}
+
+// networkOf returns the /24 (IPv4) or /64 (IPv6) network of the address
+func networkOf(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// jaccard computes the similarity of the sets of keys of two maps
+func jaccard(a, b map[string]int) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	inter := 0
+	for k := range a {
+		if _, ok := b[k]; ok {
+			inter++
+		}
+	}
+	return float64(inter) / float64(len(a)+len(b)-inter)
+}
+
+// topKeys returns the n keys with the highest counters
+func topKeys(m map[string]int, n int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// clusterCampaigns links the hostile sources sharing a rare User-Agent, a
+// similar wordlist of probed paths or a network.
+func clusterCampaigns(sources []*hostileSource, rareAgents map[string]bool, similarity float64, minPaths int) []*campaign {
+	uf := make(unionFind, len(sources))
+	for i := range uf {
+		uf[i] = i
+	}
+	links := make([]map[string]bool, len(sources))
+	link := func(i, j int, why string) {
+		uf.union(i, j)
+		if links[i] == nil {
+			links[i] = make(map[string]bool)
+		}
+		links[i][why] = true
+	}
+
+	byAgent := make(map[string]int)
+	byNetwork := make(map[string]int)
+	for i, s := range sources {
+		for a := range s.agents {
+			if !rareAgents[a] {
+				continue
+			}
+			if j, ok := byAgent[a]; ok {
+				link(i, j, "agent")
+			} else {
+				byAgent[a] = i
+			}
+		}
+		if j, ok := byNetwork[s.network]; ok {
+			link(i, j, "network")
+		} else {
+			byNetwork[s.network] = i
+		}
+		if len(s.paths) >= minPaths {
+			for j := 0; j < i; j++ {
+				if len(sources[j].paths) >= minPaths && jaccard(s.paths, sources[j].paths) >= similarity {
+					link(i, j, "wordlist")
+				}
+			}
+		}
+	}
+
+	byRoot := make(map[int]*campaign)
+	out := make([]*campaign, 0)
+	for i, s := range sources {
+		root := uf.find(i)
+		c, ok := byRoot[root]
+		if !ok {
+			c = &campaign{links: make(map[string]bool), first: s.first}
+			byRoot[root] = c
+			out = append(out, c)
+		}
+		c.sources = append(c.sources, s)
+		for why := range links[i] {
+			c.links[why] = true
+		}
+		if s.first < c.first {
+			c.first = s.first
+		}
+		if s.last > c.last {
+			c.last = s.last
+		}
+		c.requests += s.requests
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].requests != out[j].requests {
+			return out[i].requests > out[j].requests
+		}
+		return out[i].first < out[j].first
+	})
+	return out
+}
+
+func (c *campaign) merged() (agents, paths, days, networks map[string]int) {
+	agents, paths, days, networks = make(map[string]int), make(map[string]int), make(map[string]int), make(map[string]int)
+	for _, s := range c.sources {
+		for k, v := range s.agents {
+			agents[k] += v
+		}
+		for k, v := range s.paths {
+			paths[k] += v
+		}
+		for k, v := range s.days {
+			days[k] += v
+		}
+		networks[s.network] += s.requests
+	}
+	return
+}
+
+func (c *campaign) summary(id int) map[string]interface{} {
+	agents, paths, days, networks := c.merged()
+	ips := make([]string, 0, len(c.sources))
+	for _, s := range c.sources {
+		ips = append(ips, s.ip)
+	}
+	sort.Strings(ips)
+	links := make([]string, 0, len(c.links))
+	for k := range c.links {
+		links = append(links, k)
+	}
+	sort.Strings(links)
+	return map[string]interface{}{
+		"id":       id,
+		"sources":  ips,
+		"requests": c.requests,
+		"first":    c.first,
+		"last":     c.last,
+		"links":    links,
+		"networks": networks,
+		"agents":   agents,
+		"paths":    paths,
+		"timeline": days,
+	}
+}
+
+func (c *campaign) print(id int) {
+	agents, paths, days, networks := c.merged()
+	links := make([]string, 0, len(c.links))
+	for k := range c.links {
+		links = append(links, k)
+	}
+	sort.Strings(links)
+	fmt.Printf("campaign %d: %d sources, %d requests, %s .. %s (%d days)\n",
+		id, len(c.sources), c.requests, fmtTime(c.first), fmtTime(c.last), len(days))
+	fmt.Printf("  links:    %s\n", strings.Join(links, ", "))
+	fmt.Printf("  networks: %s\n", strings.Join(topKeys(networks, 8), " "))
+	for _, a := range topKeys(agents, 3) {
+		fmt.Printf("  agent:    %6d %q\n", agents[a], a)
+	}
+	for _, p := range topKeys(paths, 10) {
+		fmt.Printf("  path:     %6d %s\n", paths[p], p)
+	}
+	timeline := make([]string, 0, len(days))
+	for d := range days {
+		timeline = append(timeline, d)
+	}
+	sort.Strings(timeline)
+	for _, d := range timeline {
+		fmt.Printf("  day:      %s %6d\n", d, days[d])
+	}
+}
+
+func mainCampaigns(args []string) {
+	var sf streamFlags
+	var flagJson bool
+	var rareShare, similarity float64
+	var minPaths, minSources int
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("campaigns", pflag.ExitOnError)
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the campaigns as JSON objects")
+	fs.Float64Var(&rareShare, "rare", 0.05, "Max share of all the sources for an User-Agent to be rare")
+	fs.Float64Var(&similarity, "similarity", 0.6, "Min Jaccard similarity of two wordlists")
+	fs.IntVar(&minPaths, "min-paths", 3, "Min size of a wordlist to be compared")
+	fs.IntVar(&minSources, "min-sources", 2, "Min number of sources in a campaign")
+	rf.registerColumns(fs, "campaigns", 0, []string{"id", "sources", "requests", "first", "last", "links", "networks", "agents", "paths", "timeline"})
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	agentUsers := make(map[string]map[string]bool)
+	allSources := make(map[string]bool)
+	bySource := make(map[string]*hostileSource)
+	for r := range sf.records() {
+		allSources[r.Ip] = true
+		if agentUsers[r.Agent] == nil {
+			agentUsers[r.Agent] = make(map[string]bool)
+		}
+		agentUsers[r.Agent][r.Ip] = true
+
+		if len(ts.match(r)) == 0 {
+			continue
+		}
+		s, ok := bySource[r.Ip]
+		if !ok {
+			s = &hostileSource{
+				ip: r.Ip, network: networkOf(r.Ip), first: r.When,
+				agents: make(map[string]int), paths: make(map[string]int), days: make(map[string]int),
+			}
+			if r.ASN != 0 {
+				s.network = fmt.Sprintf("AS%d", r.ASN)
+			}
+			bySource[r.Ip] = s
+		}
+		if r.When < s.first {
+			s.first = r.When
+		}
+		if r.When > s.last {
+			s.last = r.When
+		}
+		s.requests++
+		s.agents[r.Agent]++
+		s.paths[r.Path]++
+		s.days[time.Unix(r.When, 0).Format("2006-01-02")]++
+	}
+
+	rareAgents := make(map[string]bool)
+	for a, users := range agentUsers {
+		if a != "-" && float64(len(users)) <= rareShare*float64(len(allSources)) {
+			rareAgents[a] = true
+		}
+	}
+
+	sources := make([]*hostileSource, 0, len(bySource))
+	for _, s := range bySource {
+		sources = append(sources, s)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].ip < sources[j].ip })
+
+	// The campaigns are numbered in their default order, whatever the sort
+	campaigns := make([]*campaign, 0)
+	summaries := make([]map[string]interface{}, 0)
+	for _, c := range clusterCampaigns(sources, rareAgents, similarity, minPaths) {
+		if len(c.sources) < minSources {
+			continue
+		}
+		campaigns = append(campaigns, c)
+		summaries = append(summaries, c.summary(len(campaigns)))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, i := range rf.order(len(campaigns), func(i int, name string) interface{} { return summaries[i][name] }) {
+		if flagJson {
+			encoder.Encode(summaries[i])
+		} else {
+			campaigns[i].print(i + 1)
+		}
+	}
+}
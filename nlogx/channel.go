@@ -0,0 +1,264 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// The channels the traffic comes through
+const (
+	channelDirect   = "direct"
+	channelOrganic  = "organic"
+	channelReferral = "referral"
+	channelInternal = "internal"
+	channelBot      = "bot"
+)
+
+var channelNames = []string{channelDirect, channelOrganic, channelReferral, channelInternal, channelBot}
+
+// channelConfig is the "channels" section of the configuration. E.g.
+//
+//	channels:
+//	  sites: ["example.com", "shop.example.com"]
+//	  verify_bots: true
+type channelConfig struct {
+	// Sites are the hosts of the site itself, whose referrers are internal
+	Sites []string `yaml:"sites"`
+	// VerifyBots checks the claimed crawlers with a forward-confirmed
+	// reverse DNS lookup.
+	VerifyBots bool `yaml:"verify_bots"`
+}
+
+// searchEngines are the hosts of the referrers of the organic traffic
+var searchEngines = []string{
+	`(^|\.)google\.`,
+	`(^|\.)bing\.com$`,
+	`(^|\.)duckduckgo\.com$`,
+	`^search\.yahoo\.`,
+	`(^|\.)baidu\.com$`,
+	`(^|\.)yandex\.`,
+	`(^|\.)ecosia\.org$`,
+	`(^|\.)qwant\.com$`,
+	`(^|\.)startpage\.com$`,
+	`^search\.brave\.com$`,
+}
+
+// crawlerDomain maps the agent of a well-known crawler to the domains its
+// addresses resolve to.
+type crawlerDomain struct {
+	agent   *regexp.Regexp
+	domains []string
+}
+
+var knownCrawlers = []crawlerDomain{
+	{regexp.MustCompile(`(?i)googlebot`), []string{".googlebot.com", ".google.com"}},
+	{regexp.MustCompile(`(?i)bingbot`), []string{".search.msn.com"}},
+	{regexp.MustCompile(`(?i)yandex`), []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+	{regexp.MustCompile(`(?i)baiduspider`), []string{".baidu.com", ".baidu.jp"}},
+	{regexp.MustCompile(`(?i)applebot`), []string{".applebot.apple.com"}},
+}
+
+// channelClassifier tells the channel of each record, from its referrer, its
+// agent and, optionally, the verification of the crawlers.
+type channelClassifier struct {
+	bots    *regexp.Regexp
+	organic *regexp.Regexp
+	sites   []string
+	verify  bool
+	// verified caches the verification of the addresses, per crawler
+	verified map[string]bool
+}
+
+// newChannelClassifier must be called once the rules of the configuration
+// have been applied, so that the agents they add are bots.
+func newChannelClassifier(cfg channelConfig) (*channelClassifier, error) {
+	_, bots, err := makeOrRegex(avoidedAgents)
+	if err != nil {
+		return nil, err
+	}
+	_, organic, err := makeOrRegex(searchEngines)
+	if err != nil {
+		return nil, err
+	}
+	cc := &channelClassifier{bots: bots, organic: organic, verify: cfg.VerifyBots, verified: make(map[string]bool)}
+	for _, s := range cfg.Sites {
+		cc.sites = append(cc.sites, strings.ToLower(s))
+	}
+	return cc, nil
+}
+
+func (cc *channelClassifier) internal(host string) bool {
+	for _, s := range cc.sites {
+		if host == s || strings.HasSuffix(host, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCrawler checks that the address resolves to a domain of the crawler,
+// and that domain back to the address.
+func (cc *channelClassifier) verifyCrawler(ip string, c *crawlerDomain) bool {
+	key := ip + " " + c.agent.String()
+	if ok, found := cc.verified[key]; found {
+		return ok
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ok := false
+	names, _ := net.DefaultResolver.LookupAddr(ctx, ip)
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !hasAnySuffix(name, c.domains) {
+			continue
+		}
+		addrs, _ := net.DefaultResolver.LookupHost(ctx, name)
+		for _, a := range addrs {
+			ok = ok || a == ip
+		}
+	}
+	cc.verified[key] = ok
+	return ok
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *channelClassifier) channel(r *logs.Record) string {
+	if r.Agent == "-" || cc.bots.MatchString(r.Agent) {
+		return channelBot
+	}
+	if r.Referrer == "" || r.Referrer == "-" {
+		return channelDirect
+	}
+	u, err := url.Parse(r.Referrer)
+	if err != nil || u.Hostname() == "" {
+		return channelReferral
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case cc.internal(host):
+		return channelInternal
+	case cc.organic.MatchString(host):
+		return channelOrganic
+	}
+	return channelReferral
+}
+
+// enrich sets the "channel" extra field of the record, and "bot_verified" for
+// the claimed crawlers when they are verified.
+func (cc *channelClassifier) enrich(r *logs.Record) {
+	ch := cc.channel(r)
+	r.SetExtra("channel", ch)
+	if ch != channelBot || !cc.verify {
+		return
+	}
+	for i := range knownCrawlers {
+		if c := &knownCrawlers[i]; c.agent.MatchString(r.Agent) {
+			r.SetExtra("bot_verified", cc.verifyCrawler(r.Ip, c))
+			return
+		}
+	}
+}
+
+// channelMix counts the requests per channel over a period
+type channelMix struct {
+	Start    string         `json:"start"`
+	Requests int            `json:"requests"`
+	Channels map[string]int `json:"channels"`
+}
+
+func newChannelMix(start string) *channelMix {
+	return &channelMix{Start: start, Channels: make(map[string]int)}
+}
+
+func (m *channelMix) row() []interface{} {
+	row := []interface{}{m.Start, int64(m.Requests)}
+	for _, ch := range channelNames {
+		row = append(row, fmt.Sprintf("%.1f%%", 100*float64(m.Channels[ch])/float64(m.Requests)))
+	}
+	return row
+}
+
+func mainChannels(args []string) {
+	var sf streamFlags
+	var every time.Duration
+	var rf reportFlags
+	var flagJson bool
+	var table string
+	var nbColumns int64
+
+	fs := pflag.NewFlagSet("channels", pflag.ExitOnError)
+	fs.DurationVar(&every, "every", 24*time.Hour, "Period of the channel mix, in the time of the log")
+	rf.register(fs, "periods", 0, channelMix{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the periods as JSON objects")
+	fs.StringVar(&table, "table", tablePlain, "Style of the table: plain, border or markdown")
+	fs.Int64VarP(&nbColumns, "columns", "c", terminalColumns(), "Max line length of the table")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	if every < time.Second {
+		Logger.Fatal().Str("every", every.String()).Msg("Invalid period")
+	}
+	sf.channel = true
+
+	period := int64(every / time.Second)
+	var start int64 = -1
+	var m *channelMix
+	total := newChannelMix("total")
+	mixes := make([]*channelMix, 0)
+	for r := range sf.records() {
+		// The periods are aligned on the epoch, the records out of order
+		// counted in the current one.
+		if bucket := r.When - r.When%period; start < 0 || bucket > start {
+			start = bucket
+			m = newChannelMix(fmtTime(start))
+			mixes = append(mixes, m)
+		}
+		ch := logs.ToString(r.Extra["channel"])
+		m.Requests++
+		m.Channels[ch]++
+		total.Requests++
+		total.Channels[ch]++
+	}
+	rf.apply(&mixes)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, m := range mixes {
+			encoder.Encode(m)
+		}
+		return
+	}
+	columns := append([]string{"period", "requests"}, channelNames...)
+	rows := make([][]interface{}, 0, len(mixes)+1)
+	for _, m := range mixes {
+		rows = append(rows, m.row())
+	}
+	if total.Requests > 0 {
+		rows = append(rows, total.row())
+	}
+	renderTable(os.Stdout, table, int(nbColumns), columns, rows)
+}
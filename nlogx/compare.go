@@ -0,0 +1,127 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// runSummary gathers the distributions of a run compared to another
+type runSummary struct {
+	requests  int
+	classes   [6]float64
+	latencies []float64
+}
+
+func (s *runSummary) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.classes[5] / float64(s.requests)
+}
+
+// comparison is the result of a statistical test between two runs
+type comparison struct {
+	Metric      string  `json:"metric"`
+	Before      float64 `json:"before"`
+	After       float64 `json:"after"`
+	Test        string  `json:"test"`
+	Statistic   float64 `json:"statistic"`
+	P           float64 `json:"p"`
+	Significant bool    `json:"significant"`
+}
+
+func summarizeRun(sf streamFlags, path string) *runSummary {
+	f, err := os.Open(path)
+	if err != nil {
+		Logger.Fatal().Str("path", path).Err(err).Msg("Failed to open the log")
+	}
+	defer f.Close()
+	sf.input = f
+	s := &runSummary{}
+	for r := range sf.records() {
+		s.requests++
+		if class := r.Code / 100; class >= 1 && class <= 5 {
+			s.classes[class]++
+		}
+		if ms, ok := latencyMs(&r); ok {
+			s.latencies = append(s.latencies, float64(ms))
+		}
+	}
+	return s
+}
+
+func mainCompare(args []string) {
+	var sf streamFlags
+	var beforePath, afterPath string
+	var confidence float64
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("compare", pflag.ExitOnError)
+	fs.StringVar(&beforePath, "before", "", "Path to the log of the first run")
+	fs.StringVar(&afterPath, "after", "", "Path to the log of the second run")
+	fs.Float64Var(&confidence, "confidence", 0.95, "Confidence level of the significant differences")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the comparisons as JSON objects")
+	sf.register(fs, 0)
+	sf.parse(fs, args)
+
+	if beforePath == "" || afterPath == "" {
+		Logger.Fatal().Msg("Both --before and --after are required")
+	}
+	before, after := summarizeRun(sf, beforePath), summarizeRun(sf, afterPath)
+	alpha := 1 - confidence
+
+	var out []comparison
+	add := func(c comparison) {
+		c.Significant = c.P < alpha
+		out = append(out, c)
+	}
+	stat, _, p := chiSquareTest([][]float64{before.classes[1:], after.classes[1:]})
+	add(comparison{Metric: "statuses", Before: float64(before.requests), After: float64(after.requests),
+		Test: "chi-square", Statistic: stat, P: p})
+	stat, _, p = chiSquareTest([][]float64{
+		{before.classes[5], float64(before.requests) - before.classes[5]},
+		{after.classes[5], float64(after.requests) - after.classes[5]},
+	})
+	add(comparison{Metric: "error_rate", Before: before.errorRate(), After: after.errorRate(),
+		Test: "chi-square", Statistic: stat, P: p})
+	if len(before.latencies) > 0 && len(after.latencies) > 0 {
+		median := func(s *runSummary) float64 { return percentileMs(append([]float64(nil), s.latencies...), 50) }
+		_, z, p := mannWhitneyTest(before.latencies, after.latencies)
+		add(comparison{Metric: "latency_median_ms", Before: median(before), After: median(after),
+			Test: "mann-whitney", Statistic: z, P: p})
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, c := range out {
+			encoder.Encode(c)
+		}
+		return
+	}
+	fmt.Printf("%d requests before, %d after\n", before.requests, after.requests)
+	for _, c := range out {
+		verdict := "not significant"
+		if c.Significant {
+			verdict = fmt.Sprintf("significant at %g%%", 100*confidence)
+		}
+		switch c.Metric {
+		case "statuses":
+			fmt.Printf("%-18s %-36s %-12s stat=%-8.2f p=%-8.3g %s\n", c.Metric, "distribution of the status classes",
+				c.Test, c.Statistic, c.P, verdict)
+		case "error_rate":
+			fmt.Printf("%-18s %-36s %-12s stat=%-8.2f p=%-8.3g %s\n", c.Metric,
+				fmt.Sprintf("%.2f%% -> %.2f%%", 100*c.Before, 100*c.After), c.Test, c.Statistic, c.P, verdict)
+		default:
+			fmt.Printf("%-18s %-36s %-12s z=%-11.2f p=%-8.3g %s\n", c.Metric,
+				fmt.Sprintf("%.0fms -> %.0fms", c.Before, c.After), c.Test, c.Statistic, c.P, verdict)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// completion is the command line to complete, when run by "nlogx __complete".
+// The command then runs until it parses its flags, and completes them instead.
+type completion struct {
+	command string
+	words   []string
+}
+
+var completing *completion
+
+// parseFlags parses the flags of a command, or completes its command line
+func parseFlags(fs *pflag.FlagSet, args []string) {
+	if completing != nil {
+		for _, c := range completing.complete(fs) {
+			fmt.Println(c)
+		}
+		os.Exit(0)
+	}
+	fs.Parse(args)
+}
+
+// valueCompletions complete the values of the flags, by the name of the flag
+// or by the name of the command and the flag, and the arguments of a command
+// by its name and a slash. The other values are completed by the shell, as
+// paths.
+var valueCompletions = map[string]func(words []string) []string{
+	"log-format": func([]string) []string { return append([]string{"auto", "mixed"}, formatNames()...) },
+	"json-preset": func([]string) []string {
+		out := make([]string, 0, len(logs.JsonPresets))
+		for k := range logs.JsonPresets {
+			out = append(out, k)
+		}
+		sort.Strings(out)
+		return out
+	},
+	"table":             func([]string) []string { return []string{tablePlain, tableBorder, tableMarkdown} },
+	"group-by":          completeFields,
+	"sort-by":           completeFields,
+	"json-keys":         completeFields,
+	"sort-output":       func([]string) []string { return []string{"time"} },
+	"agent/format":      func([]string) []string { return []string{"json", "msgpack"} },
+	"export/format":     func([]string) []string { return []string{"stix", "misp"} },
+	"rule-stats/format": func([]string) []string { return []string{"text", "json", "csv"} },
+	"regions/by":        func([]string) []string { return []string{"country", "asn"} },
+	"baskets/kind":      func([]string) []string { return []string{"bundle", "navigation", "sweep"} },
+	"completion/":       func([]string) []string { return []string{"bash", "zsh", "fish"} },
+}
+
+// flagValue returns the value of a flag among the words, or def
+func flagValue(words []string, long, short, def string) string {
+	for i, w := range words {
+		switch {
+		case (w == "--"+long || (short != "" && w == "-"+short)) && i+1 < len(words):
+			def = words[i+1]
+		case strings.HasPrefix(w, "--"+long+"="):
+			def = w[len(long)+3:]
+		}
+	}
+	return def
+}
+
+// hasFlag tells if a boolean flag is among the words
+func hasFlag(words []string, long string) bool {
+	for _, w := range words {
+		if w == "--"+long || strings.HasPrefix(w, "--"+long+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// completeFields returns the names of the fields of the records, with the
+// extra fields of the format, the owners and the channels, and the derived fields of the
+// configuration.
+func completeFields(words []string) []string {
+	out := fieldNames()
+	for k := range logs.FieldAliases {
+		out = append(out, k)
+	}
+	if flagValue(words, "owners", "", "") != "" {
+		out = append(out, "owner")
+	}
+	if hasFlag(words, "channel") || (len(words) > 0 && words[0] == "channels") {
+		out = append(out, "channel", "bot_verified")
+	}
+	extras, _ := formatExtras(flagValue(words, "log-format", "", "auto"))
+	for k := range extras {
+		out = append(out, k)
+	}
+	if cfg, err := loadConfig(flagValue(words, "config", "C", "")); err == nil {
+		for _, d := range cfg.Fields {
+			out = append(out, d.name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// matching returns the values starting with cur, after the prefix
+func matching(values []string, prefix, cur string) []string {
+	var out []string
+	for _, v := range values {
+		if strings.HasPrefix(v, cur) {
+			out = append(out, prefix+v)
+		}
+	}
+	return out
+}
+
+// complete returns the candidates for the last word, the flags of the command
+// with their usage after a tab, or the values of the flag before.
+func (c *completion) complete(fs *pflag.FlagSet) []string {
+	words := c.words
+	cur := words[len(words)-1]
+	// The value of a flag, either the word after it or after its '='
+	var flag *pflag.Flag
+	prefix := ""
+	if i := strings.IndexByte(cur, '='); strings.HasPrefix(cur, "--") && i > 0 {
+		flag = fs.Lookup(cur[2:i])
+		prefix, cur = cur[:i+1], cur[i+1:]
+	} else if len(words) > 1 {
+		prev := words[len(words)-2]
+		if strings.HasPrefix(prev, "--") {
+			flag = fs.Lookup(prev[2:])
+		} else if len(prev) == 2 && prev[0] == '-' {
+			flag = fs.ShorthandLookup(prev[1:])
+		}
+		if flag != nil && flag.Value.Type() == "bool" {
+			flag = nil
+		}
+	}
+	if flag != nil {
+		complete, ok := valueCompletions[c.command+"/"+flag.Name]
+		if !ok {
+			complete = valueCompletions[flag.Name]
+		}
+		if complete == nil {
+			return nil
+		}
+		// The lists are completed after their last comma
+		if strings.HasSuffix(flag.Value.Type(), "Slice") {
+			if i := strings.LastIndexByte(cur, ','); i >= 0 {
+				prefix, cur = prefix+cur[:i+1], cur[i+1:]
+			}
+		}
+		return matching(complete(words), prefix, cur)
+	}
+
+	if !strings.HasPrefix(cur, "-") {
+		if complete := valueCompletions[c.command+"/"]; complete != nil {
+			return matching(complete(words), "", cur)
+		}
+		return nil
+	}
+	var out []string
+	fs.VisitAll(func(f *pflag.Flag) {
+		if !f.Hidden && strings.HasPrefix("--"+f.Name, cur) {
+			out = append(out, "--"+f.Name+"\t"+f.Usage)
+		}
+	})
+	return out
+}
+
+// mainComplete prints the candidates for the last word of the command line,
+// one per line, the commands for the first word. The shells call it through the scripts of "nlogx completion".
+func mainComplete(args []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	completing = &completion{words: args}
+	if len(args) == 1 && !strings.HasPrefix(args[0], "-") {
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, args[0]) {
+				fmt.Println(c.name + "\t" + c.brief)
+			}
+		}
+		os.Exit(0)
+	}
+	if len(args) > 1 {
+		for _, c := range commands {
+			if c.name == args[0] {
+				completing = &completion{command: c.name, words: args[1:]}
+				c.run(nil)
+				return
+			}
+		}
+	}
+}
+
+const bashCompletion = `# bash completion of nlogx, e.g. in ~/.local/share/bash-completion/completions/nlogx
+_nlogx() {
+	local line="${COMP_LINE:0:COMP_POINT}" cur="${COMP_WORDS[COMP_CWORD]}" words i
+	read -ra words <<< "$line"
+	[[ "$line" == *[[:space:]] ]] && words+=("")
+	local word="${words[${#words[@]}-1]}" IFS=$'\n'
+	COMPREPLY=($("$1" __complete "${words[@]:1}" 2>/dev/null | cut -f1))
+	if [ ${#COMPREPLY[@]} -eq 0 ]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+	fi
+	# The word of bash stops at the '=' and the ':'
+	for i in "${!COMPREPLY[@]}"; do
+		COMPREPLY[$i]="${COMPREPLY[$i]:$((${#word} - ${#cur}))}"
+	done
+}
+complete -o filenames -F _nlogx nlogx
+`
+
+const zshCompletion = `#compdef nlogx
+# zsh completion of nlogx, e.g. as _nlogx in a directory of $fpath
+_nlogx() {
+	local -a candidates
+	candidates=("${(@f)$("${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -z "${candidates[1]}" ]]; then
+		_files
+		return
+	fi
+	local c
+	local -a described
+	for c in "${candidates[@]}"; do
+		if [[ "$c" == *$'\t'* ]]; then
+			described+=("${${c%%$'\t'*}//:/\\:}:${c#*$'\t'}")
+		else
+			described+=("${c//:/\\:}")
+		fi
+	done
+	_describe 'nlogx' described
+}
+compdef _nlogx nlogx
+`
+
+const fishCompletion = `# fish completion of nlogx, e.g. in ~/.config/fish/completions/nlogx.fish
+function __nlogx_complete
+	set -l args (commandline -opc) (commandline -ct)
+	set -l out ($args[1] __complete $args[2..-1] 2>/dev/null)
+	if test (count $out) -eq 0
+		__fish_complete_path (commandline -ct)
+	else
+		printf '%s\n' $out
+	end
+end
+complete -c nlogx -f -a '(__nlogx_complete)'
+`
+
+func mainCompletion(args []string) {
+	fs := pflag.NewFlagSet("completion", pflag.ExitOnError)
+	parseFlags(fs, args)
+
+	scripts := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}
+	if fs.NArg() != 1 || scripts[fs.Arg(0)] == "" {
+		Logger.Fatal().Msg("Expected the shell: bash, zsh or fish")
+	}
+	fmt.Print(scripts[fs.Arg(0)])
+}
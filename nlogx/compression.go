@@ -0,0 +1,155 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// incompressibleTypes lists the content types and the extensions of the
+// payloads already compressed, that compression would not shrink.
+var incompressibleTypes = regexp.MustCompile(`(?i)^(image/(png|jpe?g|gif|webp|avif)|video/|audio/|font/woff2?|application/(zip|gzip|x-gzip|x-bzip2|x-xz|zstd|pdf|octet-stream))|\.(png|jpe?g|gif|webp|avif|ico|mp[34]|webm|ogg|woff2?|zip|gz|tgz|bz2|xz|zst|7z|rar|pdf)$`)
+
+// pathCompression accounts for the responses of a path
+type pathCompression struct {
+	Path         string  `json:"path"`
+	Requests     int     `json:"requests"`
+	Bytes        int64   `json:"bytes"`
+	Uncompressed int     `json:"uncompressed"`
+	RawBytes     int64   `json:"uncompressed_bytes"`
+	Savings      float64 `json:"savings"`
+
+	ratios []float64
+}
+
+// compressed tells whether the response was compressed, and its ratio when
+// $gzip_ratio is logged. Unknown if neither the ratio nor the encoding is.
+func compressed(r *logs.Record) (ok bool, ratio float64, known bool) {
+	if v, found := r.Extra["gzip_ratio"]; found {
+		if f, isNumber := toFloat(logs.ToNumber(v)); isNumber && f > 0 {
+			return true, f, true
+		}
+		known = true
+	}
+	for _, name := range []string{"sent_http_content_encoding", "content_encoding"} {
+		if v, found := r.Extra[name]; found {
+			enc := strings.ToLower(logs.ToString(v))
+			return enc != "" && enc != "-" && enc != "identity", 0, true
+		}
+	}
+	return false, 0, known
+}
+
+func mainCompression(args []string) {
+	var sf streamFlags
+	var assumedRatio float64
+	var minBytes int64
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("compression", pflag.ExitOnError)
+	fs.Float64Var(&assumedRatio, "assumed-ratio", 3, "Compression ratio assumed for the paths never served compressed")
+	fs.Int64Var(&minBytes, "min-bytes", 1024*1024, "Min volume served uncompressed for a path to be reported")
+	rf.register(fs, "paths", 20, pathCompression{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the paths as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	paths := make(map[string]*pathCompression)
+	var allRatios []float64
+	audited := 0
+	for r := range sf.records() {
+		if r.Code != 200 || r.Bytes <= 0 {
+			continue
+		}
+		ok, ratio, known := compressed(&r)
+		if !known {
+			continue
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		if incompressibleTypes.MatchString(logs.ToString(r.Extra["sent_http_content_type"])) ||
+			incompressibleTypes.MatchString(path.Ext(p)) {
+			continue
+		}
+		audited++
+		s, found := paths[p]
+		if !found {
+			s = &pathCompression{Path: p}
+			paths[p] = s
+		}
+		s.Requests++
+		s.Bytes += r.Bytes
+		if ok {
+			if ratio > 0 {
+				s.ratios = append(s.ratios, ratio)
+				allRatios = append(allRatios, ratio)
+			}
+		} else {
+			s.Uncompressed++
+			s.RawBytes += r.Bytes
+		}
+	}
+	if audited == 0 {
+		Logger.Warn().Msg("Neither $gzip_ratio nor $sent_http_content_encoding in the records")
+		return
+	}
+
+	// The ratio observed on the path, or else on the site, or else assumed
+	siteRatio := assumedRatio
+	if len(allRatios) > 0 {
+		siteRatio, _ = toFloat(percentile(allRatios, 50))
+	}
+	report := make([]*pathCompression, 0)
+	for _, s := range paths {
+		if s.RawBytes < minBytes {
+			continue
+		}
+		ratio := siteRatio
+		if len(s.ratios) > 0 {
+			ratio, _ = toFloat(percentile(s.ratios, 50))
+		}
+		if ratio > 1 {
+			s.Savings = float64(s.RawBytes) * (1 - 1/ratio)
+		}
+		report = append(report, s)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Savings != report[j].Savings {
+			return report[i].Savings > report[j].Savings
+		}
+		return report[i].Path < report[j].Path
+	})
+	rf.apply(&report)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, s := range report {
+			encoder.Encode(s)
+		}
+		return
+	}
+	total := 0.0
+	fmt.Printf("%-40s %8s %12s %12s %12s\n", "PATH", "RAW/ALL", "SERVED", "RAW BYTES", "SAVINGS")
+	for _, s := range report {
+		total += s.Savings
+		fmt.Printf("%-40s %3d/%-4d %12s %12s %12s\n", s.Path, s.Uncompressed, s.Requests,
+			fmtByteSize(float64(s.Bytes)), fmtByteSize(float64(s.RawBytes)), fmtByteSize(s.Savings))
+	}
+	fmt.Printf("%s could be saved, with a ratio of %.1f when unknown for the path\n", fmtByteSize(total), siteRatio)
+}
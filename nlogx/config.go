@@ -0,0 +1,254 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the optional configuration file of nlogx, in YAML. E.g.
+//
+//	fields:
+//	  app: path.split("/")[1]
+//	  status_class: status / 100
+//	rules:
+//	  agents: ["^Scrapy", "^curl/"]
+//	  paths: ["/\\.svn/"]
+//	  scopes:
+//	    api.example.com:
+//	      allow_agents: ["^curl/"]
+//	channels:
+//	  sites: ["example.com"]
+//	maintenance:
+//	  - name: deploy
+//	    schedule: "0 2 * * tue"
+//	    duration: 30m
+//	haproxy:
+//	  request_captures: [Host, User-Agent]
+type config struct {
+	Fields      derivedFields      `yaml:"fields"`
+	Rules       ruleLists          `yaml:"rules"`
+	Channels    channelConfig      `yaml:"channels"`
+	Dates       dateConfig         `yaml:"dates"`
+	Maintenance maintenanceWindows `yaml:"maintenance"`
+	Haproxy     haproxyConfig      `yaml:"haproxy"`
+}
+
+// haproxyConfig names the headers captured by HAProxy, in the order of its
+// capture directives
+type haproxyConfig struct {
+	RequestCaptures  []string `yaml:"request_captures"`
+	ResponseCaptures []string `yaml:"response_captures"`
+}
+
+// ruleLists are the patterns added to the built-in rules: the avoided agents
+// and referrers of the default display, and the paths of the attacks. The
+// scopes override the agents and the referrers per value of the scope field,
+// the host by default.
+type ruleLists struct {
+	Agents     []string             `yaml:"agents"`
+	Referrers  []string             `yaml:"referrers"`
+	Paths      []string             `yaml:"paths"`
+	ScopeField string               `yaml:"scope_field"`
+	Scopes     map[string]ruleScope `yaml:"scopes"`
+}
+
+var applyRulesOnce sync.Once
+
+// applyRules extends the built-in rules with the patterns of the configuration.
+// The rules, and the month names of the dates, are not reloaded with the
+// configuration, only the first one counts.
+func (c *config) applyRules() {
+	applyRulesOnce.Do(func() {
+		avoidedAgents = append(avoidedAgents, c.Rules.Agents...)
+		avoidedReferrer = append(avoidedReferrer, c.Rules.Referrers...)
+		attackPaths = append(attackPaths, c.Rules.Paths...)
+		// Validated by loadConfig
+		ruleScopes, _ = newScopeSet(c.Rules)
+		logs.TolerantDates, _ = newDateParser(c.Dates)
+		logs.HaproxyRequestCaptures = c.Haproxy.RequestCaptures
+		logs.HaproxyResponseCaptures = c.Haproxy.ResponseCaptures
+	})
+}
+
+type derivedField struct {
+	name string
+	src  string
+	expr expression
+}
+
+// derivedFields keeps the order of the configuration, so that a field can be
+// computed from the fields defined before.
+type derivedFields []derivedField
+
+func (d *derivedFields) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return errors.New("fields: expected a mapping of names to expressions")
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, src := node.Content[i].Value, node.Content[i+1].Value
+		if _, ok := logs.RecordFields[name]; ok || logs.FieldAliases[name] != "" {
+			return fmt.Errorf("fields: %s is already a field of the records", name)
+		}
+		// Their fields are checked once the enrichers and the format known
+		e, err := parseExpression(src, nil)
+		if err != nil {
+			return fmt.Errorf("fields: %s: %v", name, err)
+		}
+		*d = append(*d, derivedField{name: name, src: src, expr: e})
+	}
+	return nil
+}
+
+// defaultConfigPath returns the path of the configuration file to load when
+// none is explicitly set: $NLOGX_CONFIG or ~/.config/nlogx/config.yml
+func defaultConfigPath() string {
+	if path := os.Getenv("NLOGX_CONFIG"); path != "" {
+		return path
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "nlogx", "config.yml")
+	}
+	return ""
+}
+
+// loadConfig parses the configuration file. A missing file is only an error if
+// it has been explicitly required.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	if path == "" {
+		return cfg, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err = yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, patterns := range [][]string{cfg.Rules.Agents, cfg.Rules.Referrers, cfg.Rules.Paths} {
+		for _, p := range patterns {
+			if _, err = regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("%s: rules: %v", path, err)
+			}
+		}
+	}
+	if _, err = newScopeSet(cfg.Rules); err != nil {
+		return nil, fmt.Errorf("%s: rules: %v", path, err)
+	}
+	if _, err = newDateParser(cfg.Dates); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// derive computes the derived fields of each record
+func (c *config) derive(in <-chan logs.Record) <-chan logs.Record {
+	if len(c.Fields) == 0 {
+		return in
+	}
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			c.deriveRecord(&r)
+			out <- r
+		}
+	}()
+	return out
+}
+
+// derived tells if one of the first n derived fields has that name
+func (c *config) derived(name string, n int) bool {
+	for _, f := range c.Fields[:n] {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *config) deriveRecord(r *logs.Record) {
+	for _, f := range c.Fields {
+		v, err := f.expr.eval(r)
+		if err != nil {
+			Logger.Debug().Str("field", f.name).Str("expr", f.src).Err(err).Msg("Invalid derived field")
+			continue
+		}
+		r.SetExtra(f.name, v)
+	}
+}
+
+// liveConfig is a configuration that can be reloaded while the records flow
+// through the pipeline.
+type liveConfig struct {
+	path    string
+	current atomic.Value
+}
+
+func newLiveConfig(path string, cfg *config) *liveConfig {
+	l := &liveConfig{path: path}
+	l.current.Store(cfg)
+	return l
+}
+
+func (l *liveConfig) get() *config {
+	return l.current.Load().(*config)
+}
+
+// reload replaces the configuration, unless the new one is invalid
+func (l *liveConfig) reload() error {
+	cfg, err := loadConfig(l.path)
+	if err != nil {
+		return err
+	}
+	l.current.Store(cfg)
+	return nil
+}
+
+// derive computes the derived fields of each record with the configuration
+// current at its arrival.
+func (l *liveConfig) derive(in <-chan logs.Record) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			l.get().deriveRecord(&r)
+			out <- r
+		}
+	}()
+	return out
+}
+
+// makeWhereSieve keeps the records for which the expression is true, its
+// fields checked by known
+func makeWhereSieve(src string, known func(name string) bool) (logs.SieveFilter, error) {
+	e, err := parseExpression(src, known)
+	if err != nil {
+		return nil, err
+	}
+	return func(r logs.Record) bool {
+		v, err := e.eval(&r)
+		return err == nil && truthy(v)
+	}, nil
+}
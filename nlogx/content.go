@@ -0,0 +1,180 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// contentClasses are the classes of the content per extension
+var contentClasses = map[string]string{
+	"": "html", ".html": "html", ".htm": "html", ".php": "html", ".asp": "html", ".aspx": "html", ".jsp": "html",
+	".js": "js", ".mjs": "js", ".map": "js", ".wasm": "js",
+	".css": "css",
+	".png": "image", ".jpg": "image", ".jpeg": "image", ".gif": "image", ".webp": "image", ".avif": "image",
+	".svg": "image", ".ico": "image", ".bmp": "image",
+	".woff": "font", ".woff2": "font", ".ttf": "font", ".otf": "font", ".eot": "font",
+	".mp3": "media", ".mp4": "media", ".webm": "media", ".ogg": "media", ".m3u8": "media", ".ts": "media",
+	".pdf": "document", ".zip": "document", ".gz": "document", ".tar": "document", ".doc": "document",
+	".docx": "document", ".xls": "document", ".xlsx": "document",
+	".json": "api", ".xml": "api", ".txt": "document", ".csv": "document",
+}
+
+// contentTypeClasses are the classes per prefix of the content type logged,
+// which prevails over the extension
+var contentTypeClasses = []struct{ prefix, class string }{
+	{"text/html", "html"}, {"text/css", "css"}, {"application/javascript", "js"}, {"text/javascript", "js"},
+	{"image/", "image"}, {"font/", "font"}, {"application/font", "font"}, {"video/", "media"}, {"audio/", "media"},
+	{"application/json", "api"}, {"application/grpc", "api"}, {"application/graphql", "api"},
+}
+
+// contentExtension returns the extension of the path, lowercase
+func contentExtension(p string) string {
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	return strings.ToLower(path.Ext(p))
+}
+
+// contentClass tells what a response is: html, js, css, image, font, media,
+// document, api or other.
+func contentClass(r *logs.Record) string {
+	ct := strings.ToLower(logs.ToString(r.Extra["sent_http_content_type"]))
+	if ct == "" {
+		ct = strings.ToLower(logs.ToString(r.Extra["content_type"]))
+	}
+	for _, c := range contentTypeClasses {
+		if strings.HasPrefix(ct, c.prefix) {
+			return c.class
+		}
+	}
+	if strings.HasPrefix(r.Path, "/api/") || strings.HasPrefix(r.Path, "/graphql") {
+		return "api"
+	}
+	if class, ok := contentClasses[contentExtension(r.Path)]; ok {
+		return class
+	}
+	return "other"
+}
+
+// cacheStatus tells if a cache served the response, true for a hit, from the
+// status logged by nginx, CloudFront or the X-Cache header, if any.
+func cacheStatus(r *logs.Record) (hit bool, known bool) {
+	for _, name := range []string{"upstream_cache_status", "cache_status", "edge_result", "sent_http_x_cache"} {
+		v, ok := r.Extra[name]
+		if !ok {
+			continue
+		}
+		s := strings.ToUpper(logs.ToString(v))
+		switch {
+		case s == "" || s == "-":
+			continue
+		case strings.Contains(s, "HIT"), s == "STALE", s == "UPDATING", s == "REVALIDATED":
+			return true, true
+		}
+		return false, true
+	}
+	return false, false
+}
+
+// contentTraffic is the traffic of a class of content or of an extension
+type contentTraffic struct {
+	Name      string  `json:"name"`
+	Requests  int     `json:"requests"`
+	Bytes     int64   `json:"bytes"`
+	ByteShare float64 `json:"byte_share"`
+	Hits      int     `json:"cache_hits"`
+	Misses    int     `json:"cache_misses"`
+}
+
+func mainContent(args []string) {
+	var sf streamFlags
+	var by string
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("content", pflag.ExitOnError)
+	fs.StringVar(&by, "by", "class", "Group the requests by class of content or by extension")
+	rf.register(fs, "groups", 20, contentTraffic{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the groups as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	if by != "class" && by != "extension" {
+		Logger.Fatal().Str("by", by).Msg("Expected class or extension")
+	}
+	groups := make(map[string]*contentTraffic)
+	var total int64
+	cached := false
+	for r := range sf.records() {
+		name := contentClass(&r)
+		if by == "extension" {
+			if name = contentExtension(r.Path); name == "" {
+				name = "(none)"
+			}
+		}
+		g, ok := groups[name]
+		if !ok {
+			g = &contentTraffic{Name: name}
+			groups[name] = g
+		}
+		g.Requests++
+		g.Bytes += r.Bytes
+		total += r.Bytes
+		if hit, known := cacheStatus(&r); known {
+			cached = true
+			if hit {
+				g.Hits++
+			} else {
+				g.Misses++
+			}
+		}
+	}
+
+	report := make([]*contentTraffic, 0, len(groups))
+	for _, g := range groups {
+		if total > 0 {
+			g.ByteShare = float64(g.Bytes) / float64(total)
+		}
+		report = append(report, g)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Name < report[j].Name
+	})
+	rf.apply(&report)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, g := range report {
+			encoder.Encode(g)
+		}
+		return
+	}
+	fmt.Printf("%-12s %9s %12s %6s %10s %9s\n", strings.ToUpper(by), "REQUESTS", "BYTES", "SHARE", "MEAN", "CACHE HIT")
+	for _, g := range report {
+		hits := "-"
+		if g.Hits+g.Misses > 0 {
+			hits = fmt.Sprintf("%.1f%%", 100*float64(g.Hits)/float64(g.Hits+g.Misses))
+		}
+		fmt.Printf("%-12s %9d %12s %5.1f%% %10s %9s\n", g.Name, g.Requests, fmtByteSize(float64(g.Bytes)),
+			100*g.ByteShare, fmtByteSize(float64(g.Bytes)/float64(g.Requests)), hits)
+	}
+	if !cached {
+		fmt.Println("Log $upstream_cache_status for the cache hits")
+	}
+}
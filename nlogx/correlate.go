@@ -0,0 +1,173 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// latencyMs returns the latency of a record, in milliseconds, from the extra
+// fields of the formats that log it.
+func latencyMs(r *logs.Record) (int64, bool) {
+	for _, name := range []string{"time_taken", "time_active"} {
+		if ms, ok := toFloat(logs.ToNumber(r.Extra[name])); ok && ms >= 0 {
+			return int64(ms), true
+		}
+	}
+	// The $request_time of nginx, in seconds
+	if v, ok := r.Extra["request_time"]; ok {
+		if s, ok := toFloat(logs.ToNumber(v)); ok {
+			return int64(s * 1000), true
+		}
+	}
+	return 0, false
+}
+
+type hitKey struct {
+	method, path string
+}
+
+// originIndex holds the requests of the origin not matched yet
+type originIndex struct {
+	byID  map[string]int
+	byHit map[hitKey][]int
+	all   []logs.Record
+	used  []bool
+}
+
+func (o *originIndex) add(r logs.Record) {
+	i := len(o.all)
+	o.all = append(o.all, r)
+	o.used = append(o.used, false)
+	if r.ID != "" {
+		o.byID[r.ID] = i
+	}
+	k := hitKey{method: r.Method, path: r.Path}
+	o.byHit[k] = append(o.byHit[k], i)
+}
+
+// match returns the request of the origin with the same ID or else the
+// nearest in time with the same request, within the window.
+func (o *originIndex) match(r *logs.Record, window int64, matchIP bool) (*logs.Record, bool) {
+	if i, ok := o.byID[r.ID]; ok && r.ID != "" && !o.used[i] {
+		o.used[i] = true
+		return &o.all[i], true
+	}
+	best, bestGap := -1, window+1
+	for _, i := range o.byHit[hitKey{method: r.Method, path: r.Path}] {
+		if matchIP && o.all[i].Ip != r.Ip {
+			continue
+		}
+		gap := o.all[i].When - r.When
+		if gap < 0 {
+			gap = -gap
+		}
+		if !o.used[i] && gap < bestGap {
+			best, bestGap = i, gap
+		}
+	}
+	if best < 0 {
+		return nil, false
+	}
+	o.used[best] = true
+	return &o.all[best], true
+}
+
+func mainCorrelate(args []string) {
+	var sf streamFlags
+	var edgePath, originPath string
+	var window time.Duration
+	var matchIP, flagJson bool
+
+	fs := pflag.NewFlagSet("correlate", pflag.ExitOnError)
+	fs.StringVar(&edgePath, "edge", "", "Path to the log of the CDN")
+	fs.StringVar(&originPath, "origin", "", "Path to the log of the origin")
+	fs.DurationVar(&window, "window", 2*time.Second, "Max delay between the edge and the origin for a request")
+	fs.BoolVar(&matchIP, "match-ip", false, "Require the same source, when the origin logs the address of the client")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump JSON records")
+	sf.register(fs, 1)
+	sf.parse(fs, args)
+
+	if edgePath == "" || originPath == "" {
+		Logger.Fatal().Msg("Both --edge and --origin are required")
+	}
+	open := func(path string) *os.File {
+		f, err := os.Open(path)
+		if err != nil {
+			Logger.Fatal().Str("path", path).Err(err).Msg("Failed to open the log")
+		}
+		return f
+	}
+	edgeFile, originFile := open(edgePath), open(originPath)
+	defer edgeFile.Close()
+	defer originFile.Close()
+
+	// The budget bounds the records emitted, not the index of the origin
+	originFlags := sf
+	originFlags.input = originFile
+	originFlags.budget = outputBudget{}
+	origin := &originIndex{byID: make(map[string]int), byHit: make(map[hitKey][]int)}
+	for r := range originFlags.records() {
+		origin.add(r)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(r logs.Record) {
+		if flagJson {
+			encoder.Encode(&r)
+		} else {
+			fmt.Printf("%s %-15s %d %s %s %q%s\n", fmtTime(r.When), r.Ip, r.Code, r.Path, r.Referrer, r.Agent, fmtExtra(r))
+		}
+	}
+
+	edgeFlags := sf
+	edgeFlags.input, edgeFlags.emits = edgeFile, true
+	seconds := int64(window / time.Second)
+	for r := range edgeFlags.records() {
+		if ms, ok := latencyMs(&r); ok {
+			r.SetExtra("edge_latency", ms)
+		}
+		r.SetExtra("edge_status", int64(r.Code))
+		if o, ok := origin.match(&r, seconds, matchIP); ok {
+			r.SetExtra("served_by", "origin")
+			r.SetExtra("origin_status", int64(o.Code))
+			if ms, ok := latencyMs(o); ok {
+				r.SetExtra("origin_latency", ms)
+			}
+		} else {
+			r.SetExtra("served_by", "edge")
+		}
+		emit(r)
+	}
+	// The requests that reached the origin without going through the CDN,
+	// within what the edge left of the budget
+	if edgeFlags.budget.exceeded {
+		return
+	}
+	for i, r := range origin.all {
+		if !origin.used[i] {
+			r.SetExtra("served_by", "origin-only")
+			r.SetExtra("origin_status", int64(r.Code))
+			if ms, ok := latencyMs(&r); ok {
+				r.SetExtra("origin_latency", ms)
+			}
+			if size := estimatedSize(&r); edgeFlags.budget.set() {
+				if !edgeFlags.budget.fits(size) {
+					Logger.Warn().Int("records", edgeFlags.budget.records).Int64("bytes", edgeFlags.budget.bytes).Msg("Output budget exceeded, the output stops")
+					return
+				}
+				edgeFlags.budget.add(size)
+			}
+			emit(r)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// dateConfig is the "dates" section of the configuration, for the logs whose
+// month names have been localized or recased by their upstream tooling. E.g.
+//
+//	dates:
+//	  locales: [fr, de]
+//	  months: {"mär": 3, "okt": 10}
+//	  tolerant: true
+type dateConfig struct {
+	// Locales are the built-in tables of month names
+	Locales []string `yaml:"locales"`
+	// Months maps more names to the numbers of the months
+	Months map[string]int `yaml:"months"`
+	// Tolerant also accepts the full names, a day of one digit, and a time
+	// without zone, i.e. local.
+	Tolerant bool `yaml:"tolerant"`
+}
+
+// monthTables are the names of the months per locale, the abbreviations and
+// the full names.
+var monthTables = map[string][12][]string{
+	"en": {{"jan", "january"}, {"feb", "february"}, {"mar", "march"}, {"apr", "april"}, {"may"}, {"jun", "june"},
+		{"jul", "july"}, {"aug", "august"}, {"sep", "sept", "september"}, {"oct", "october"}, {"nov", "november"},
+		{"dec", "december"}},
+	"fr": {{"janv", "janvier"}, {"févr", "fevr", "février", "fevrier"}, {"mars"}, {"avr", "avril"}, {"mai"},
+		{"juin"}, {"juil", "juillet"}, {"août", "aout"}, {"sept", "septembre"}, {"oct", "octobre"},
+		{"nov", "novembre"}, {"déc", "dec", "décembre", "decembre"}},
+	"de": {{"jan", "januar"}, {"feb", "februar"}, {"mär", "mrz", "märz"}, {"apr", "april"}, {"mai"}, {"jun", "juni"},
+		{"jul", "juli"}, {"aug", "august"}, {"sep", "september"}, {"okt", "oktober"}, {"nov", "november"},
+		{"dez", "dezember"}},
+	"es": {{"ene", "enero"}, {"feb", "febrero"}, {"mar", "marzo"}, {"abr", "abril"}, {"may", "mayo"},
+		{"jun", "junio"}, {"jul", "julio"}, {"ago", "agosto"}, {"sep", "sept", "septiembre"}, {"oct", "octubre"},
+		{"nov", "noviembre"}, {"dic", "diciembre"}},
+	"it": {{"gen", "gennaio"}, {"feb", "febbraio"}, {"mar", "marzo"}, {"apr", "aprile"}, {"mag", "maggio"},
+		{"giu", "giugno"}, {"lug", "luglio"}, {"ago", "agosto"}, {"set", "settembre"}, {"ott", "ottobre"},
+		{"nov", "novembre"}, {"dic", "dicembre"}},
+	"pt": {{"jan", "janeiro"}, {"fev", "fevereiro"}, {"mar", "março", "marco"}, {"abr", "abril"}, {"mai", "maio"},
+		{"jun", "junho"}, {"jul", "julho"}, {"ago", "agosto"}, {"set", "setembro"}, {"out", "outubro"},
+		{"nov", "novembro"}, {"dez", "dezembro"}},
+	"nl": {{"jan", "januari"}, {"feb", "februari"}, {"mrt", "maart"}, {"apr", "april"}, {"mei"}, {"jun", "juni"},
+		{"jul", "juli"}, {"aug", "augustus"}, {"sep", "september"}, {"okt", "oktober"}, {"nov", "november"},
+		{"dec", "december"}},
+}
+
+func newDateParser(c dateConfig) (*logs.DateParser, error) {
+	if len(c.Locales) == 0 && len(c.Months) == 0 && !c.Tolerant {
+		return nil, nil
+	}
+	dp := &logs.DateParser{Months: make(map[string]time.Month), Tolerant: c.Tolerant}
+	add := func(names [12][]string, all bool) {
+		for i, aliases := range names {
+			for j, name := range aliases {
+				if all || j == 0 {
+					dp.Months[name] = time.Month(i + 1)
+				}
+			}
+		}
+	}
+	// The full names are only tolerated, the abbreviations always accepted
+	add(monthTables["en"], c.Tolerant)
+	for _, l := range c.Locales {
+		table, ok := monthTables[l]
+		if !ok {
+			return nil, fmt.Errorf("dates: unknown locale %q", l)
+		}
+		add(table, c.Tolerant)
+	}
+	for name, m := range c.Months {
+		if m < 1 || m > 12 {
+			return nil, fmt.Errorf("dates: %s: invalid month %d", name, m)
+		}
+		dp.Months[strings.ToLower(name)] = time.Month(m)
+	}
+	return dp, nil
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// dedupRecords drops the records repeating one of the window before the
+// latest record, e.g. the lines both at the end of access.log.1 and at the
+// start of access.log after a copytruncate. Only the keys of the window are
+// kept, the memory is bounded by the traffic of the window.
+func dedupRecords(window time.Duration) logs.Stage {
+	span := int64(window / time.Second)
+	return func(in <-chan logs.Record) <-chan logs.Record {
+		out := make(chan logs.Record, 32)
+		go func() {
+			defer close(out)
+			type seen struct {
+				key  string
+				when int64
+			}
+			keys := make(map[string]bool)
+			// The keys in their order of arrival, the oldest first
+			var queue []seen
+			var latest int64
+			dropped := 0
+			for r := range in {
+				if r.When > latest {
+					latest = r.When
+				}
+				for len(queue) > 0 && queue[0].when < latest-span {
+					delete(keys, queue[0].key)
+					queue = queue[1:]
+				}
+				key := r.DedupKey()
+				if keys[key] {
+					dropped++
+					continue
+				}
+				keys[key] = true
+				queue = append(queue, seen{key: key, when: r.When})
+				out <- r
+			}
+			if dropped > 0 {
+				Logger.Info().Int("dropped", dropped).Msg("Duplicate records dropped")
+			}
+		}()
+		return out
+	}
+}
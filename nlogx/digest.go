@@ -0,0 +1,398 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// digestEvent is a notable change of the traffic, between two periods
+type digestEvent struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+	// Key deduplicates the event, the same when the period is replayed
+	Key string `json:"key"`
+	// Severity is set on the conditions raising an incident, and Resolved on
+	// the ones clearing it.
+	Severity string `json:"severity,omitempty"`
+	Resolved bool   `json:"resolved,omitempty"`
+}
+
+// digest gathers the events of a period into a single notification
+type digest struct {
+	Start  string        `json:"start"`
+	End    string        `json:"end"`
+	Text   string        `json:"text"`
+	Events []digestEvent `json:"events"`
+	// Key deduplicates the digest, e.g. as the dedup_key of an incident
+	Key string `json:"key"`
+	// Maintenance is the maintenance window open during the period, if any
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// digestWindow accumulates the traffic of a period
+type digestWindow struct {
+	requests  int
+	errors    int
+	hostile   int
+	attacks   map[string]int
+	countries map[string]int
+	// talkers are the bytes sent per source or per network
+	talkers map[string]int64
+}
+
+func newDigestWindow() *digestWindow {
+	return &digestWindow{attacks: make(map[string]int), countries: make(map[string]int), talkers: make(map[string]int64)}
+}
+
+// topTalkers returns the n sources of most bytes, the lowest first among the
+// ties.
+func (w *digestWindow) topTalkers(n int) []string {
+	out := make([]string, 0, len(w.talkers))
+	for src := range w.talkers {
+		out = append(out, src)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if w.talkers[out[i]] != w.talkers[out[j]] {
+			return w.talkers[out[i]] > w.talkers[out[j]]
+		}
+		return out[i] < out[j]
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// talkerSmoothing is the weight of the last period in the baseline of the
+// bytes of a talker, a moving average.
+const talkerSmoothing = 0.3
+
+// topAttacker returns the source of most hostile requests, the lowest address
+// among the ties.
+func (w *digestWindow) topAttacker() (string, int) {
+	top, max := "", 0
+	for ip, n := range w.attacks {
+		if n > max || (n == max && ip < top) {
+			top, max = ip, n
+		}
+	}
+	return top, max
+}
+
+// digester compares each period with the previous ones
+type digester struct {
+	errorRate   float64
+	minRequests int
+	attackBurst int
+	talkers     int
+	// talkerGrowth is the ratio of the bytes of a top talker to its baseline
+	// notified as a growth
+	talkerGrowth float64
+	// The state of the previous periods
+	started      bool
+	attackers    map[string]bool
+	aboveRate    bool
+	aboveAttacks bool
+	countries    map[string]bool
+	// The talkers once in the top, and the baseline of all the talkers
+	topTalkers map[string]bool
+	baselines  map[string]float64
+}
+
+// events returns the events of the period, the conditions frozen during a
+// maintenance window suppressing the notifications, so that a burst of errors
+// still notified after the window is the one that lasts.
+func (d *digester) events(w *digestWindow, frozen bool) []digestEvent {
+	var out []digestEvent
+	add := func(kind, subject, format string, args ...interface{}) {
+		out = append(out, digestEvent{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...)})
+	}
+	// A condition raises an incident, resolved when the condition clears
+	condition := func(severity string, above bool) {
+		if above {
+			out[len(out)-1].Severity = severity
+		} else {
+			out[len(out)-1].Resolved = true
+		}
+	}
+
+	// Only the first time a source tops the attackers
+	if ip, n := w.topAttacker(); ip != "" && !d.attackers[ip] {
+		add("top_attacker", ip, "%s is the new top attacker, with %d hostile requests", ip, n)
+		d.attackers[ip] = true
+	}
+	if w.requests >= d.minRequests && !frozen {
+		rate := float64(w.errors) / float64(w.requests)
+		if above := rate > d.errorRate; above != d.aboveRate {
+			if above {
+				add("error_rate", "5xx", "The error rate rose to %.2f%%, above %.2f%%", 100*rate, 100*d.errorRate)
+			} else {
+				add("error_rate", "5xx", "The error rate fell to %.2f%%, below %.2f%%", 100*rate, 100*d.errorRate)
+			}
+			condition("error", above)
+			d.aboveRate = above
+		}
+	}
+	if d.attackBurst > 0 && !frozen {
+		if above := w.hostile >= d.attackBurst; above != d.aboveAttacks {
+			if above {
+				add("attack_burst", "attacks", "The hostile requests rose to %d, at or above %d", w.hostile, d.attackBurst)
+			} else {
+				add("attack_burst", "attacks", "The hostile requests fell to %d, below %d", w.hostile, d.attackBurst)
+			}
+			condition("warning", above)
+			d.aboveAttacks = above
+		}
+	}
+	// The countries of the first period are the baseline
+	countries := make([]string, 0)
+	for c := range w.countries {
+		if !d.countries[c] {
+			countries = append(countries, c)
+			d.countries[c] = true
+		}
+	}
+	if d.started {
+		sort.Strings(countries)
+		for _, c := range countries {
+			add("new_country", c, "The first requests from %s, %d of them", c, w.countries[c])
+		}
+	}
+	// The top talkers of the first period are the baseline, the others are
+	// notified when they enter the top or when they grow
+	if d.talkers > 0 {
+		for _, src := range w.topTalkers(d.talkers) {
+			bytes := float64(w.talkers[src])
+			baseline := d.baselines[src]
+			switch {
+			case !d.started:
+			case !d.topTalkers[src]:
+				add("new_talker", src, "%s entered the top %d talkers, with %s", src, d.talkers, fmtByteSize(bytes))
+			case baseline > 0 && bytes > baseline*d.talkerGrowth:
+				add("talker_growth", src, "%s grew to %s, +%.0f%% over its baseline of %s",
+					src, fmtByteSize(bytes), 100*(bytes/baseline-1), fmtByteSize(baseline))
+			}
+			d.topTalkers[src] = true
+		}
+		// The absent talkers decay, forgotten below a byte
+		for src, baseline := range d.baselines {
+			if baseline *= 1 - talkerSmoothing; baseline < 1 {
+				delete(d.baselines, src)
+			} else {
+				d.baselines[src] = baseline
+			}
+		}
+		for src, bytes := range w.talkers {
+			if _, ok := d.baselines[src]; ok {
+				d.baselines[src] += talkerSmoothing * float64(bytes)
+			} else {
+				d.baselines[src] = float64(bytes)
+			}
+		}
+	}
+	d.started = true
+	return out
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify sends the digest to the webhook, or prints it, and tells if it was
+// delivered. The key of the digest is also its Idempotency-Key header.
+func notify(dg *digest, webhook string, flagJson bool) bool {
+	var sb strings.Builder
+	plural := "s"
+	if len(dg.Events) == 1 {
+		plural = ""
+	}
+	fmt.Fprintf(&sb, "nlogx digest from %s to %s, %d event%s", dg.Start, dg.End, len(dg.Events), plural)
+	if dg.Maintenance != "" {
+		fmt.Fprintf(&sb, " during the maintenance window %s", dg.Maintenance)
+	}
+	sb.WriteString("\n")
+	for _, e := range dg.Events {
+		fmt.Fprintf(&sb, "- %s\n", e.Message)
+	}
+	dg.Text = sb.String()
+	dg.Key = digestKey(dg.Events)
+
+	if webhook == "" {
+		if flagJson {
+			json.NewEncoder(os.Stdout).Encode(dg)
+		} else {
+			fmt.Print(dg.Text)
+		}
+		return true
+	}
+	// The "text" field suits the incoming webhooks of the usual chats
+	body, _ := json.Marshal(dg)
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		Logger.Warn().Err(err).Msg("Failed to send the digest")
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", dg.Key)
+	rep, err := webhookClient.Do(req)
+	if err != nil {
+		Logger.Warn().Err(err).Msg("Failed to send the digest")
+		return false
+	}
+	rep.Body.Close()
+	if rep.StatusCode/100 != 2 {
+		Logger.Warn().Int("status", rep.StatusCode).Msg("Digest refused by the webhook")
+		return false
+	}
+	return true
+}
+
+func mainDigest(args []string) {
+	var sf streamFlags
+	var every time.Duration
+	var webhook, sentPath, pagerDutyKey, pagerDutyURL, opsgenieKey, opsgenieURL, incidentPrefix string
+	var sentTTL time.Duration
+	var flagJson bool
+	var talkerGrowth float64
+	var talkersByNetwork bool
+	d := &digester{attackers: make(map[string]bool), countries: make(map[string]bool),
+		topTalkers: make(map[string]bool), baselines: make(map[string]float64)}
+
+	fs := pflag.NewFlagSet("digest", pflag.ExitOnError)
+	fs.DurationVar(&every, "every", time.Hour, "Period of the digests, in the time of the log")
+	fs.Float64Var(&d.errorRate, "error-rate", 0.05, "Rate of the 5xx whose crossing is notified")
+	fs.IntVar(&d.minRequests, "min-requests", 20, "Min number of requests of a period to check its error rate")
+	fs.IntVar(&d.attackBurst, "attack-burst", 100, "Number of hostile requests of a period notified as a burst (0 to disable)")
+	fs.IntVar(&d.talkers, "talkers", 10, "Number of top talkers, by bytes, whose entries and growths are notified (0 to disable)")
+	fs.Float64Var(&talkerGrowth, "talker-growth", 100, "Growth of a top talker over its baseline notified, in percent")
+	fs.BoolVar(&talkersByNetwork, "talkers-by-network", false, "Count the talkers by network, /24 or /64, rather than by address")
+	fs.StringVar(&webhook, "webhook", "", "URL to POST the digests to, as JSON, instead of printing them")
+	fs.StringVar(&sentPath, "sent-alerts", "", "Path of the keys of the events notified, never notified again")
+	fs.DurationVar(&sentTTL, "sent-ttl", 30*24*time.Hour, "Period the keys of the events notified are kept")
+	fs.StringVar(&pagerDutyKey, "pagerduty", "", "Routing key of PagerDuty, to raise and resolve the incidents of the conditions")
+	fs.StringVar(&pagerDutyURL, "pagerduty-url", "https://events.pagerduty.com/v2/enqueue", "URL of the Events API of PagerDuty")
+	fs.StringVar(&opsgenieKey, "opsgenie", "", "API key of Opsgenie, to raise and close the alerts of the conditions")
+	fs.StringVar(&opsgenieURL, "opsgenie-url", "https://api.opsgenie.com/v2/alerts", "URL of the Alert API of Opsgenie")
+	fs.StringVar(&incidentPrefix, "incident-prefix", "nlogx", "Prefix of the dedup keys of the incidents, e.g. the site")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Print the digests as JSON objects")
+	sf.register(fs, 0)
+	sf.parse(fs, args)
+
+	if every < time.Second {
+		Logger.Fatal().Str("every", every.String()).Msg("Invalid period")
+	}
+	d.talkerGrowth = 1 + talkerGrowth/100
+	sieve, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	sent, err := loadSentAlerts(sentPath, sentTTL)
+	if err != nil {
+		Logger.Fatal().Str("path", sentPath).Err(err).Msg("Failed to load the alerts sent")
+	}
+
+	var tools []*incidentTool
+	if pagerDutyKey != "" {
+		tools = append(tools, pagerDuty(pagerDutyURL, pagerDutyKey))
+	}
+	if opsgenieKey != "" {
+		tools = append(tools, opsgenie(opsgenieURL, opsgenieKey))
+	}
+
+	period := int64(every / time.Second)
+	var start int64 = -1
+	w := newDigestWindow()
+	records := sf.records()
+	flush := func() {
+		end := start + period
+		mw := sf.cfg.Maintenance.during(start, end)
+		suppressed := mw != nil && mw.Action == "suppress"
+		events := d.events(w, suppressed)
+		for i := range events {
+			events[i].Key = alertKey(events[i].Kind, events[i].Subject, start)
+		}
+		if n := len(events); n > 0 && !suppressed {
+			if events = sent.unsent(events); len(events) < n {
+				Logger.Debug().Str("start", fmtTime(start)).Int("events", n-len(events)).Msg("Events already notified")
+			}
+		}
+		switch {
+		case len(events) == 0:
+		case suppressed:
+			Logger.Info().Str("window", mw.Name).Str("start", fmtTime(start)).Int("events", len(events)).
+				Msg("Digest suppressed by a maintenance window")
+		default:
+			dg := &digest{Start: fmtTime(start), End: fmtTime(end), Events: events}
+			if mw != nil {
+				dg.Maintenance = mw.Name
+			}
+			delivered := notify(dg, webhook, flagJson)
+			for i := range events {
+				e := events[i]
+				if e.Severity == "" && !e.Resolved {
+					continue
+				}
+				// Tagged by a maintenance window, the condition pages nobody
+				if mw != nil && !e.Resolved {
+					e.Severity = "info"
+				}
+				for _, tool := range tools {
+					if err := tool.send(&e, incidentPrefix); err != nil {
+						Logger.Warn().Str("tool", tool.name).Str("kind", e.Kind).Err(err).Msg("Failed to send the incident")
+						delivered = false
+					}
+				}
+			}
+			if delivered {
+				if err := sent.add(events, sf.getClock().Now()); err != nil {
+					Logger.Warn().Str("path", sentPath).Err(err).Msg("Failed to save the alerts sent")
+				}
+			}
+		}
+		w = newDigestWindow()
+	}
+	for r := range records {
+		// The periods are aligned on the epoch, the records out of order
+		// counted in the current one.
+		if bucket := r.When - r.When%period; start < 0 {
+			start = bucket
+		} else if bucket > start {
+			flush()
+			start = bucket
+		}
+		w.requests++
+		if r.Code >= 500 {
+			w.errors++
+		}
+		if len(sieve.match(r)) > 0 {
+			w.hostile++
+			w.attacks[r.Ip]++
+		}
+		if r.Country != "" {
+			w.countries[r.Country]++
+		}
+		if d.talkers > 0 {
+			src := r.Ip
+			if talkersByNetwork {
+				src = networkOf(r.Ip)
+			}
+			w.talkers[src] += r.Bytes
+		}
+	}
+	if start >= 0 {
+		flush()
+	}
+}
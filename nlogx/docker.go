@@ -0,0 +1,202 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dockerClient talks to the API of the Docker daemon of $DOCKER_HOST, its
+// local socket by default.
+type dockerClient struct {
+	http *http.Client
+	base string
+}
+
+func newDockerClient() (*dockerClient, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", u.Path)
+		}
+		return &dockerClient{http: &http.Client{Transport: &http.Transport{DialContext: dial}}, base: "http://docker"}, nil
+	case "tcp", "http":
+		return &dockerClient{http: &http.Client{}, base: "http://" + u.Host}, nil
+	}
+	return nil, fmt.Errorf("Unsupported DOCKER_HOST %q", host)
+}
+
+func (d *dockerClient) get(path string, query url.Values, out interface{}) (*http.Response, error) {
+	rep, err := d.http.Get(d.base + path + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode != http.StatusOK {
+		defer rep.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(rep.Body).Decode(&e)
+		return nil, fmt.Errorf("docker: %s: %d %s", path, rep.StatusCode, e.Message)
+	}
+	if out != nil {
+		defer rep.Body.Close()
+		return rep, json.NewDecoder(rep.Body).Decode(out)
+	}
+	return rep, nil
+}
+
+type dockerContainer struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	tty   bool
+}
+
+// containers returns the running containers matching the filters, each like
+// name=nginx, label=app=web or ancestor=nginx, the filters of "docker ps".
+func (d *dockerClient) containers(filters []string) ([]dockerContainer, error) {
+	byKey := make(map[string][]string)
+	for _, f := range filters {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid container filter %q, expected KEY=VALUE", f)
+		}
+		byKey[kv[0]] = append(byKey[kv[0]], kv[1])
+	}
+	encoded, _ := json.Marshal(byKey)
+	var out []dockerContainer
+	if _, err := d.get("/containers/json", url.Values{"filters": {string(encoded)}}, &out); err != nil {
+		return nil, err
+	}
+	// The logs of the containers without TTY are multiplexed
+	for i := range out {
+		var inspect struct {
+			Config struct {
+				Tty bool `json:"Tty"`
+			} `json:"Config"`
+		}
+		if _, err := d.get("/containers/"+out[i].ID+"/json", url.Values{}, &inspect); err != nil {
+			return nil, err
+		}
+		out[i].tty = inspect.Config.Tty
+	}
+	return out, nil
+}
+
+// lineWriter writes whole lines to out, whatever the chunks written to it, so
+// that the lines of the concurrent containers do not mix.
+type lineWriter struct {
+	out     io.Writer
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	if i := bytes.LastIndexByte(w.partial, '\n'); i >= 0 {
+		if _, err := w.out.Write(w.partial[:i+1]); err != nil {
+			return 0, err
+		}
+		w.partial = append(w.partial[:0], w.partial[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// demuxDockerLogs copies the stdout of a log stream of the Docker API: frames
+// of an 8 bytes header, the stream then the size, followed by the payload.
+func demuxDockerLogs(in io.Reader, out io.Writer) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(in, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		dst := ioutil.Discard
+		if header[0] == 1 {
+			dst = out
+		}
+		if _, err := io.CopyN(dst, in, size); err != nil {
+			return err
+		}
+	}
+}
+
+// readDocker returns the lines logged to their stdout by the containers
+// matching the filters, merged. since is an epoch, or 0 for all the logs.
+func readDocker(filters []string, since int64, follow bool) (io.Reader, error) {
+	d, err := newDockerClient()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := d.containers(filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, errors.New("No running container matches the filters")
+	}
+	query := url.Values{"stdout": {"1"}, "stderr": {"0"}, "follow": {strconv.FormatBool(follow)}}
+	if since > 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+
+	pr, pw := io.Pipe()
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		wg.Add(1)
+		go func(c dockerContainer) {
+			defer wg.Done()
+			rep, err := d.get("/containers/"+c.ID+"/logs", query, nil)
+			if err != nil {
+				Logger.Warn().Strs("container", c.Names).Err(err).Msg("Failed to read the logs of the container")
+				return
+			}
+			defer rep.Body.Close()
+			w := &lineWriter{out: pw}
+			if c.tty {
+				_, err = io.Copy(w, rep.Body)
+			} else {
+				err = demuxDockerLogs(rep.Body, w)
+			}
+			if len(w.partial) > 0 {
+				w.Write([]byte("\n"))
+			}
+			if err != nil {
+				Logger.Warn().Strs("container", c.Names).Err(err).Msg("Failed to read the logs of the container")
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		pw.Close()
+	}()
+	return pr, nil
+}
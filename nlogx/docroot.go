@@ -0,0 +1,217 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// The classes of the paths requested, against the files of the docroot
+const (
+	docrootFileClass    = "file"
+	docrootDirClass     = "directory"
+	docrootMissingClass = "missing"
+)
+
+// docrootCacheSize bounds the classes cached, the probes of the scanners
+// requesting countless paths
+const docrootCacheSize = 100000
+
+// docrootFile returns the file of the docroot serving the path, never out of
+// the docroot.
+func docrootFile(root, p string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// docrootPath returns the path requested, without its arguments and decoded
+func docrootPath(p string) string {
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	if decoded, err := url.PathUnescape(p); err == nil {
+		return decoded
+	}
+	return p
+}
+
+// docrootClassifier tells if the paths requested are files, directories or
+// missing in the docroot.
+type docrootClassifier struct {
+	root  string
+	cache map[string]string
+}
+
+func newDocrootClassifier(root string) (*docrootClassifier, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", root)
+	}
+	return &docrootClassifier{root: root, cache: make(map[string]string)}, nil
+}
+
+func (dc *docrootClassifier) class(p string) string {
+	if c, ok := dc.cache[p]; ok {
+		return c
+	}
+	c := docrootMissingClass
+	if st, err := os.Stat(docrootFile(dc.root, p)); err == nil {
+		if st.IsDir() {
+			c = docrootDirClass
+		} else if st.Mode().IsRegular() {
+			c = docrootFileClass
+		}
+	}
+	if len(dc.cache) >= docrootCacheSize {
+		dc.cache = make(map[string]string)
+	}
+	dc.cache[p] = c
+	return c
+}
+
+// enrich sets the "docroot" extra field of the record
+func (dc *docrootClassifier) enrich(r *logs.Record) {
+	r.SetExtra("docroot", dc.class(docrootPath(r.Path)))
+}
+
+// missingPath is a path missing from the docroot, hostile or a broken link
+type missingPath struct {
+	Path     string `json:"path"`
+	Hits     int    `json:"hits"`
+	Referrer string `json:"referrer,omitempty"`
+
+	referrers map[string]int
+}
+
+func mainDocroot(args []string) {
+	var sf streamFlags
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("docroot", pflag.ExitOnError)
+	rf.register(fs, "broken links", 20, missingPath{})
+	fs.Lookup("limit").Usage = "Max number of broken links and of files never requested reported"
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the classes, the broken links and the files never requested as JSON objects")
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+	rf.check()
+
+	if sf.docroot == "" {
+		Logger.Fatal().Msg("Expected the files served, with --docroot")
+	}
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	classes := make(map[string]int)
+	requested := make(map[string]bool)
+	broken := make(map[string]*missingPath)
+	hostile := 0
+	for r := range sf.records() {
+		class := logs.ToString(r.Extra["docroot"])
+		classes[class]++
+		p := docrootPath(r.Path)
+		switch {
+		case class == docrootFileClass:
+			requested[docrootFile(sf.docroot, p)] = true
+		case class == docrootDirClass:
+			// Served by its index, if any
+			dir := docrootFile(sf.docroot, p)
+			requested[filepath.Join(dir, "index.html")] = true
+			requested[filepath.Join(dir, "index.htm")] = true
+		case len(ts.match(r)) > 0:
+			hostile++
+		default:
+			m, ok := broken[p]
+			if !ok {
+				m = &missingPath{Path: p, referrers: make(map[string]int)}
+				broken[p] = m
+			}
+			m.Hits++
+			if r.Referrer != "-" && r.Referrer != "" {
+				m.referrers[r.Referrer]++
+			}
+		}
+	}
+
+	links := make([]*missingPath, 0, len(broken))
+	for _, m := range broken {
+		best := 0
+		for ref, n := range m.referrers {
+			if n > best || n == best && ref < m.Referrer {
+				m.Referrer, best = ref, n
+			}
+		}
+		links = append(links, m)
+	}
+	// The links followed from a page first, the others being rather typos
+	sort.Slice(links, func(i, j int) bool {
+		if (links[i].Referrer != "") != (links[j].Referrer != "") {
+			return links[i].Referrer != ""
+		}
+		if links[i].Hits != links[j].Hits {
+			return links[i].Hits > links[j].Hits
+		}
+		return links[i].Path < links[j].Path
+	})
+	unrequested := make([]string, 0)
+	err = filepath.Walk(sf.docroot, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !requested[name] {
+			rel, _ := filepath.Rel(sf.docroot, name)
+			unrequested = append(unrequested, "/"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		Logger.Fatal().Str("path", sf.docroot).Err(err).Msg("Failed to walk the docroot")
+	}
+	total := len(unrequested)
+	rf.apply(&links)
+	if rf.limit > 0 && len(unrequested) > rf.limit {
+		unrequested = unrequested[:rf.limit]
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.Encode(map[string]interface{}{"classes": classes, "hostile": hostile, "never_requested": total})
+		for _, m := range links {
+			encoder.Encode(map[string]interface{}{"path": m.Path, "hits": m.Hits, "referrer": m.Referrer, "diff": "broken-link"})
+		}
+		for _, p := range unrequested {
+			encoder.Encode(map[string]interface{}{"path": p, "hits": 0, "diff": "never-requested"})
+		}
+		return
+	}
+	fmt.Printf("%d requests of files, %d of directories, %d of missing paths including %d hostile\n",
+		classes[docrootFileClass], classes[docrootDirClass], classes[docrootMissingClass], hostile)
+	fmt.Printf("Broken links: %d paths\n", len(broken))
+	for _, m := range links {
+		if m.Referrer != "" {
+			fmt.Printf("  %8d %s from %s\n", m.Hits, m.Path, m.Referrer)
+		} else {
+			fmt.Printf("  %8d %s\n", m.Hits, m.Path)
+		}
+	}
+	fmt.Printf("Files never requested: %d\n", total)
+	for _, p := range unrequested {
+		fmt.Printf("  %s\n", p)
+	}
+}
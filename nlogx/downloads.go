@@ -0,0 +1,175 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// fileDownloads estimates the downloads of a large file completed and aborted,
+// a client completing it with the bytes of all its requests, whole or ranges.
+type fileDownloads struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	Estimated bool    `json:"size_estimated"`
+	Requests  int     `json:"requests"`
+	Ranges    int     `json:"ranges"`
+	Clients   int     `json:"clients"`
+	Completed int     `json:"completed"`
+	Aborted   int     `json:"aborted"`
+	Rate      float64 `json:"completion_rate"`
+	Bytes     int64   `json:"bytes"`
+
+	// sent are the bytes per client, address and User-Agent
+	sent map[string]int64
+	// largest is the largest whole response, the size when unknown
+	largest int64
+}
+
+// loadManifest reads the sizes of the files, one "PATH SIZE" per line, the
+// lines led by # being comments.
+func loadManifest(name string) (map[string]int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sizes := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected PATH SIZE", n)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("line %d: invalid size %q", n, fields[1])
+		}
+		sizes[fields[0]] = size
+	}
+	return sizes, scanner.Err()
+}
+
+func mainDownloads(args []string) {
+	var sf streamFlags
+	var manifestPath string
+	var minSize int64
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("downloads", pflag.ExitOnError)
+	fs.StringVar(&manifestPath, "manifest", "", "Path of the sizes of the files, one 'PATH SIZE' per line")
+	fs.Int64Var(&minSize, "min-size", 10*1024*1024, "Min size of the files audited, in bytes")
+	rf.register(fs, "files", 20, fileDownloads{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the files as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	sizes := make(map[string]int64)
+	if manifestPath != "" {
+		var err error
+		if sizes, err = loadManifest(manifestPath); err != nil {
+			Logger.Fatal().Str("path", manifestPath).Err(err).Msg("Invalid manifest")
+		}
+	}
+	// The size of each path, -1 when neither in the manifest nor in the docroot
+	sizeOf := func(p string) int64 {
+		if size, ok := sizes[p]; ok {
+			return size
+		}
+		size := int64(-1)
+		if sf.docroot != "" {
+			if st, err := os.Stat(docrootFile(sf.docroot, p)); err == nil && st.Mode().IsRegular() {
+				size = st.Size()
+			}
+		}
+		sizes[p] = size
+		return size
+	}
+
+	files := make(map[string]*fileDownloads)
+	for r := range sf.records() {
+		if r.Method != "GET" || (r.Code != 200 && r.Code != 206) {
+			continue
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		f, ok := files[p]
+		if !ok {
+			f = &fileDownloads{Path: p, Size: sizeOf(p), sent: make(map[string]int64)}
+			files[p] = f
+		}
+		f.Requests++
+		f.Bytes += r.Bytes
+		f.sent[r.Ip+" "+r.Agent] += r.Bytes
+		if r.Code == 206 {
+			f.Ranges++
+		} else if r.Bytes > f.largest {
+			f.largest = r.Bytes
+		}
+	}
+
+	report := make([]*fileDownloads, 0)
+	for _, f := range files {
+		if f.Size < 0 {
+			f.Size, f.Estimated = f.largest, true
+		}
+		if f.Size < minSize {
+			continue
+		}
+		f.Clients = len(f.sent)
+		for _, sent := range f.sent {
+			if sent >= f.Size {
+				f.Completed++
+			} else {
+				f.Aborted++
+			}
+		}
+		f.Rate = float64(f.Completed) / float64(f.Clients)
+		report = append(report, f)
+	}
+	// The most aborted first, the bandwidth they wasted being the largest
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Aborted != report[j].Aborted {
+			return report[i].Aborted > report[j].Aborted
+		}
+		return report[i].Path < report[j].Path
+	})
+	rf.apply(&report)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, f := range report {
+			encoder.Encode(f)
+		}
+		return
+	}
+	fmt.Printf("%-40s %11s %8s %7s %8s %9s %7s %6s %11s\n",
+		"PATH", "SIZE", "REQUESTS", "RANGES", "CLIENTS", "COMPLETED", "ABORTED", "RATE", "SENT")
+	for _, f := range report {
+		size := fmtByteSize(float64(f.Size))
+		if f.Estimated {
+			size = "~" + size
+		}
+		fmt.Printf("%-40s %11s %8d %7d %8d %9d %7d %5.1f%% %11s\n", f.Path, size, f.Requests, f.Ranges,
+			f.Clients, f.Completed, f.Aborted, 100*f.Rate, fmtByteSize(float64(f.Bytes)))
+	}
+}
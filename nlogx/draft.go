@@ -0,0 +1,146 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// maxDraftValues bounds the distinct values listed by a drafted rule, above
+// which only their common prefix is kept.
+const maxDraftValues = 5
+
+// draftRule is a rule proposed from a selection of records, to review before
+// moving its patterns into the rules of the configuration.
+type draftRule struct {
+	Agents  []string `yaml:"agents,omitempty"`
+	Paths   []string `yaml:"paths,omitempty"`
+	Sources []string `yaml:"sources,omitempty"`
+}
+
+// commonPrefix returns the longest prefix of all the values
+func commonPrefix(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	prefix := values[0]
+	for _, v := range values[1:] {
+		for !strings.HasPrefix(v, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// draftPatterns returns the exact patterns of a few values, or else the pattern
+// of their common prefix if it is significant.
+func draftPatterns(values []string, minPrefix int) []string {
+	if len(values) <= maxDraftValues {
+		out := make([]string, 0, len(values))
+		for _, v := range values {
+			out = append(out, "^"+regexp.QuoteMeta(v)+"$")
+		}
+		return out
+	}
+	if p := commonPrefix(values); len(p) >= minPrefix {
+		return []string{"^" + regexp.QuoteMeta(p)}
+	}
+	return nil
+}
+
+// draftNetworks returns the networks of the addresses, the addresses sharing a
+// /24 (or a /64) being grouped.
+func draftNetworks(addrs []string) []string {
+	groups := make(map[string][]string)
+	for _, a := range addrs {
+		if net.ParseIP(a) != nil {
+			groups[networkOf(a)] = append(groups[networkOf(a)], a)
+		}
+	}
+	out := make([]string, 0, len(groups))
+	for network, members := range groups {
+		if len(members) > 1 {
+			out = append(out, network)
+		} else if strings.Contains(members[0], ":") {
+			out = append(out, members[0]+"/128")
+		} else {
+			out = append(out, members[0]+"/32")
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func distinctValues(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for v := range set {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func mainDraftRule(args []string) {
+	var sf streamFlags
+	var pendingPath string
+	var fields []string
+
+	fs := pflag.NewFlagSet("draft-rule", pflag.ExitOnError)
+	fs.StringVarP(&pendingPath, "pending", "o", "pending-rules.yml", "Append the drafted rule to that file")
+	fs.StringSliceVar(&fields, "from", []string{"agent", "path", "src"}, "Fields the rule is drafted from")
+	sf.register(fs, 1)
+	sf.parse(fs, args)
+
+	agents, paths, addrs := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	count := 0
+	for r := range sf.records() {
+		count++
+		agents[r.Agent] = true
+		paths[r.Path] = true
+		addrs[r.Ip] = true
+	}
+	if count == 0 {
+		Logger.Fatal().Msg("No record selected")
+	}
+
+	var rule draftRule
+	for _, field := range fields {
+		switch field {
+		case "agent":
+			rule.Agents = draftPatterns(distinctValues(agents), 4)
+		case "path":
+			rule.Paths = draftPatterns(distinctValues(paths), 2)
+		case "src":
+			rule.Sources = draftNetworks(distinctValues(addrs))
+		default:
+			Logger.Fatal().Str("field", field).Msg("Unknown field, expected agent, path or src")
+		}
+	}
+
+	raw, err := yaml.Marshal([]draftRule{rule})
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to encode the rule")
+	}
+	f, err := os.OpenFile(pendingPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		Logger.Fatal().Str("path", pendingPath).Err(err).Msg("Failed to open the pending rules")
+	}
+	defer f.Close()
+	header := fmt.Sprintf("# drafted %s from %d records\n", sf.getClock().Now().UTC().Format(time.RFC3339), count)
+	if _, err = f.WriteString(header + string(raw)); err != nil {
+		Logger.Fatal().Str("path", pendingPath).Err(err).Msg("Failed to append the rule")
+	}
+	os.Stdout.Write(raw)
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// egressCost is the estimated cost of the bytes sent for a path, a client or a
+// country.
+type egressCost struct {
+	By       string  `json:"by"`
+	Name     string  `json:"name"`
+	Requests int     `json:"requests"`
+	Bytes    int64   `json:"bytes"`
+	Cost     float64 `json:"cost"`
+}
+
+// parseCountryPrices parses the prices per GB of the countries, CC=PRICE
+func parseCountryPrices(prices []string) (map[string]float64, error) {
+	out := make(map[string]float64, len(prices))
+	for _, p := range prices {
+		i := strings.LastIndexByte(p, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid price %q, expected COUNTRY=PRICE", p)
+		}
+		price, err := strconv.ParseFloat(p[i+1:], 64)
+		if err != nil || price < 0 {
+			return nil, fmt.Errorf("Invalid price %q, expected a positive number", p)
+		}
+		out[strings.ToUpper(p[:i])] = price
+	}
+	return out, nil
+}
+
+// fmtCost prints a cost with its significant digits, the small sites costing
+// cents
+func fmtCost(cost float64) string {
+	switch {
+	case cost >= 100:
+		return fmt.Sprintf("%.0f", cost)
+	case cost >= 1:
+		return fmt.Sprintf("%.2f", cost)
+	}
+	return fmt.Sprintf("%.4f", cost)
+}
+
+// topCosts returns the most expensive entries, the ties by name, unless
+// sorted otherwise by the flags of the report
+func topCosts(costs map[string]*egressCost, rf *reportFlags) []*egressCost {
+	out := make([]*egressCost, 0, len(costs))
+	for _, c := range costs {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cost != out[j].Cost {
+			return out[i].Cost > out[j].Cost
+		}
+		return out[i].Name < out[j].Name
+	})
+	rf.apply(&out)
+	return out
+}
+
+func mainEgress(args []string) {
+	var sf streamFlags
+	var price float64
+	var countryPrices []string
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("egress", pflag.ExitOnError)
+	fs.Float64Var(&price, "price", 0.09, "Price of a GB sent (2^30 bytes), as the cloud providers bill the egress")
+	fs.StringArrayVar(&countryPrices, "country-price", nil, "Price of a GB sent to a country, --price by default (like IN=0.11)")
+	rf.register(fs, "paths, clients and countries", 10, egressCost{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the costs as JSON objects")
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+	rf.check()
+
+	prices, err := parseCountryPrices(countryPrices)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid --country-price")
+	}
+	if sf.geoPath == "" {
+		Logger.Warn().Msg("Without --geoip, the costs are not broken down by country")
+	}
+
+	groups := map[string]map[string]*egressCost{"path": {}, "client": {}, "country": {}}
+	total := &egressCost{By: "total", Name: "*"}
+	var first, last int64
+	for r := range sf.records() {
+		if r.Bytes <= 0 {
+			continue
+		}
+		country := r.Country
+		if country == "" {
+			country = "?"
+		}
+		p, ok := prices[country]
+		if !ok {
+			p = price
+		}
+		cost := float64(r.Bytes) / (1 << 30) * p
+		path := r.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		for by, name := range map[string]string{"path": path, "client": r.Ip, "country": country} {
+			c, ok := groups[by][name]
+			if !ok {
+				c = &egressCost{By: by, Name: name}
+				groups[by][name] = c
+			}
+			c.Requests++
+			c.Bytes += r.Bytes
+			c.Cost += cost
+		}
+		total.Requests++
+		total.Bytes += r.Bytes
+		total.Cost += cost
+		if first == 0 || r.When < first {
+			first = r.When
+		}
+		if r.When > last {
+			last = r.When
+		}
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, by := range []string{"path", "client", "country"} {
+			for _, c := range topCosts(groups[by], &rf) {
+				encoder.Encode(c)
+			}
+		}
+		encoder.Encode(total)
+		return
+	}
+	for _, by := range []string{"path", "client", "country"} {
+		fmt.Printf("%-40s %9s %12s %10s\n", strings.ToUpper(by), "REQUESTS", "SENT", "COST")
+		for _, c := range topCosts(groups[by], &rf) {
+			fmt.Printf("%-40s %9d %12s %10s\n", c.Name, c.Requests, fmtByteSize(float64(c.Bytes)), fmtCost(c.Cost))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%s sent for %s", fmtByteSize(float64(total.Bytes)), fmtCost(total.Cost))
+	// At least an hour, for the rate not to be absurd
+	if span := last - first; span >= 3600 {
+		fmt.Printf(", %s per 30 days at this rate", fmtCost(total.Cost*30*86400/float64(span)))
+	}
+	fmt.Println()
+}
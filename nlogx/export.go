@@ -0,0 +1,212 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+type sighting struct {
+	kind    string
+	value   string
+	first   int64
+	last    int64
+	count   int
+	reasons map[string]bool
+}
+
+type sightings map[string]*sighting
+
+func (ss sightings) add(kind, value string, when int64, sigs []signature) {
+	s, ok := ss[value]
+	if !ok {
+		s = &sighting{kind: kind, value: value, first: when, last: when, reasons: make(map[string]bool)}
+		ss[value] = s
+	}
+	if when < s.first {
+		s.first = when
+	}
+	if when > s.last {
+		s.last = when
+	}
+	s.count++
+	for _, sig := range sigs {
+		s.reasons[sig.field+" "+sig.expr] = true
+	}
+}
+
+func (ss sightings) sorted() []*sighting {
+	out := make([]*sighting, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].value < out[j].value })
+	return out
+}
+
+func (s *sighting) description() string {
+	reasons := make([]string, 0, len(s.reasons))
+	for r := range s.reasons {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("%d hostile requests, matched: %s", s.count, strings.Join(reasons, ", "))
+}
+
+func fmtStixTime(epoch int64) string {
+	return time.Unix(epoch, 0).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func stixEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+func stixBundle(all []*sighting, validity time.Duration) interface{} {
+	objects := make([]interface{}, 0, len(all))
+	ids := make([]string, 0, len(all))
+	for _, s := range all {
+		var pattern, name string
+		switch s.kind {
+		case "ip":
+			family := "ipv4-addr"
+			if ip := net.ParseIP(s.value); ip != nil && ip.To4() == nil {
+				family = "ipv6-addr"
+			}
+			pattern = fmt.Sprintf("[%s:value = '%s']", family, stixEscape(s.value))
+			name = "Hostile source " + s.value
+		case "url":
+			pattern = fmt.Sprintf("[url:value = '%s']", stixEscape(s.value))
+			name = "Hostile payload " + s.value
+		}
+		id := "indicator--" + logs.Uuid5(pattern)
+		ids = append(ids, id)
+		objects = append(objects, map[string]interface{}{
+			"type":            "indicator",
+			"spec_version":    "2.1",
+			"id":              id,
+			"created":         fmtStixTime(s.first),
+			"modified":        fmtStixTime(s.last),
+			"name":            name,
+			"description":     s.description(),
+			"indicator_types": []string{"malicious-activity"},
+			"pattern":         pattern,
+			"pattern_type":    "stix",
+			"valid_from":      fmtStixTime(s.first),
+			"valid_until":     fmtStixTime(s.last + int64(validity/time.Second)),
+		})
+	}
+	return map[string]interface{}{
+		"type":    "bundle",
+		"id":      "bundle--" + logs.Uuid5(strings.Join(ids, ",")),
+		"objects": objects,
+	}
+}
+
+func mispEvent(all []*sighting, validity time.Duration) interface{} {
+	var first, last int64
+	attributes := make([]interface{}, 0, len(all))
+	uuids := make([]string, 0, len(all))
+	for _, s := range all {
+		if first == 0 || s.first < first {
+			first = s.first
+		}
+		if s.last > last {
+			last = s.last
+		}
+		kind := "ip-src"
+		if s.kind == "url" {
+			kind = "uri"
+		}
+		id := logs.Uuid5(kind + ":" + s.value)
+		uuids = append(uuids, id)
+		attributes = append(attributes, map[string]interface{}{
+			"uuid":       id,
+			"type":       kind,
+			"category":   "Network activity",
+			"value":      s.value,
+			"to_ids":     true,
+			"comment":    s.description() + ", valid until " + fmtStixTime(s.last+int64(validity/time.Second)),
+			"first_seen": fmtStixTime(s.first),
+			"last_seen":  fmtStixTime(s.last),
+			"timestamp":  strconv.FormatInt(s.last, 10),
+		})
+	}
+	return map[string]interface{}{
+		"Event": map[string]interface{}{
+			"uuid":            logs.Uuid5(strings.Join(uuids, ",")),
+			"info":            fmt.Sprintf("nlogx: hostile traffic from %s to %s", fmtTime(first), fmtTime(last)),
+			"date":            time.Unix(last, 0).UTC().Format("2006-01-02"),
+			"timestamp":       strconv.FormatInt(last, 10),
+			"threat_level_id": "2",
+			"analysis":        "2",
+			"distribution":    "0",
+			"published":       false,
+			"Attribute":       attributes,
+		},
+	}
+}
+
+func mainExport(args []string) {
+	var sf streamFlags
+	var validity time.Duration
+	var format, site string
+
+	fs := pflag.NewFlagSet("export", pflag.ExitOnError)
+	fs.StringVarP(&format, "format", "f", "stix", "Format of the indicators (stix, misp)")
+	fs.DurationVar(&validity, "valid-for", 7*24*time.Hour, "Validity of an indicator after its last sighting")
+	fs.StringVar(&site, "site", "", "Prefix of the payload URLs (like https://example.com)")
+	sf.register(fs, 1)
+	sf.parse(fs, args)
+
+	if format != "stix" && format != "misp" {
+		Logger.Fatal().Str("format", format).Msg("Unknown indicator format")
+	}
+
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	r1 := sf.records()
+
+	ips, urls := make(sightings), make(sightings)
+	for r := range r1 {
+		sigs := ts.match(r)
+		if len(sigs) == 0 {
+			continue
+		}
+		ips.add("ip", r.Ip, r.When, sigs)
+		for _, sig := range sigs {
+			if sig.field == "path" {
+				urls.add("url", site+r.Path, r.When, sigs)
+				break
+			}
+		}
+	}
+
+	all := append(ips.sorted(), urls.sorted()...)
+	var out interface{}
+	if format == "stix" {
+		out = stixBundle(all, validity)
+	} else {
+		out = mispEvent(all, validity)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		Logger.Fatal().Err(err).Msg("Write error")
+	}
+}
@@ -0,0 +1,657 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// An expression computes a value of a Record. The values are either nil, a
+// string, an int64, a float64, a bool or a []string. The syntax is close to
+// the usual scripting languages:
+//
+//	path.split("/")[1]
+//	status / 100
+//	if(status >= 500 || agent =~ "(?i)bot", "bad", "good")
+type expression interface {
+	eval(r *logs.Record) (interface{}, error)
+}
+
+var errDivByZero = errors.New("Division by zero")
+
+type exprLiteral struct{ value interface{} }
+
+type exprField struct{ name string }
+
+type exprUnary struct {
+	op string
+	x  expression
+}
+
+type exprBinary struct {
+	op   string
+	x, y expression
+}
+
+type exprMatch struct {
+	negate bool
+	x      expression
+	re     *regexp.Regexp
+}
+
+type exprIndex struct{ x, index expression }
+
+type exprCall struct {
+	name string
+	recv expression // nil for a function
+	args []expression
+}
+
+func (e *exprLiteral) eval(*logs.Record) (interface{}, error) { return e.value, nil }
+
+func (e *exprField) eval(r *logs.Record) (interface{}, error) {
+	v, _ := r.Field(e.name)
+	return v, nil
+}
+
+func (e *exprUnary) eval(r *logs.Record) (interface{}, error) {
+	v, err := e.x.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !truthy(v), nil
+	}
+	switch x := logs.ToNumber(v).(type) {
+	case int64:
+		return -x, nil
+	case float64:
+		return -x, nil
+	}
+	return nil, fmt.Errorf("Not a number: %v", v)
+}
+
+func (e *exprMatch) eval(r *logs.Record) (interface{}, error) {
+	v, err := e.x.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	return e.re.MatchString(logs.ToString(v)) != e.negate, nil
+}
+
+func (e *exprIndex) eval(r *logs.Record) (interface{}, error) {
+	v, err := e.x.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := e.index.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := logs.ToNumber(iv).(int64)
+	if !ok {
+		return nil, fmt.Errorf("Not an index: %v", iv)
+	}
+	switch x := v.(type) {
+	case []string:
+		if i < 0 {
+			i += int64(len(x))
+		}
+		if i < 0 || i >= int64(len(x)) {
+			return "", nil
+		}
+		return x[i], nil
+	case string:
+		if i < 0 {
+			i += int64(len(x))
+		}
+		if i < 0 || i >= int64(len(x)) {
+			return "", nil
+		}
+		return x[i : i+1], nil
+	}
+	return nil, fmt.Errorf("Not indexable: %v", v)
+}
+
+func (e *exprBinary) eval(r *logs.Record) (interface{}, error) {
+	x, err := e.x.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit the logical operators
+	switch e.op {
+	case "&&":
+		if !truthy(x) {
+			return false, nil
+		}
+		y, err := e.y.eval(r)
+		return truthy(y), err
+	case "||":
+		if truthy(x) {
+			return true, nil
+		}
+		y, err := e.y.eval(r)
+		return truthy(y), err
+	}
+	y, err := e.y.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		c := compareValues(x, y)
+		switch e.op {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	if e.op == "+" {
+		if xs, ok := x.(string); ok {
+			return xs + logs.ToString(y), nil
+		}
+		if ys, ok := y.(string); ok {
+			return logs.ToString(x) + ys, nil
+		}
+	}
+	return arithmetic(e.op, logs.ToNumber(x), logs.ToNumber(y))
+}
+
+func arithmetic(op string, x, y interface{}) (interface{}, error) {
+	xi, xInt := x.(int64)
+	yi, yInt := y.(int64)
+	if xInt && yInt {
+		switch op {
+		case "+":
+			return xi + yi, nil
+		case "-":
+			return xi - yi, nil
+		case "*":
+			return xi * yi, nil
+		case "/", "%":
+			if yi == 0 {
+				return nil, errDivByZero
+			}
+			if op == "/" {
+				return xi / yi, nil
+			}
+			return xi % yi, nil
+		}
+	}
+	xf, ok1 := toFloat(x)
+	yf, ok2 := toFloat(y)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("Not a number: %v %s %v", x, op, y)
+	}
+	switch op {
+	case "+":
+		return xf + yf, nil
+	case "-":
+		return xf - yf, nil
+	case "*":
+		return xf * yf, nil
+	case "/":
+		if yf == 0 {
+			return nil, errDivByZero
+		}
+		return xf / yf, nil
+	case "%":
+		if yf == 0 {
+			return nil, errDivByZero
+		}
+		return math.Mod(xf, yf), nil
+	}
+	return nil, fmt.Errorf("Unknown operator %s", op)
+}
+
+func (e *exprCall) eval(r *logs.Record) (interface{}, error) {
+	args := make([]interface{}, 0, len(e.args)+1)
+	if e.recv != nil {
+		v, err := e.recv.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	if e.name == "if" {
+		if len(e.args) != 3 {
+			return nil, errors.New("if() expects 3 arguments")
+		}
+		c, err := e.args[0].eval(r)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(c) {
+			return e.args[1].eval(r)
+		}
+		return e.args[2].eval(r)
+	}
+	for _, a := range e.args {
+		v, err := a.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	// Any field, e.g. a key of the JSON records unknown in advance
+	if e.name == "field" {
+		if len(args) != 1 {
+			return nil, errors.New("field() expects 1 argument")
+		}
+		v, _ := r.Field(logs.ToString(args[0]))
+		return v, nil
+	}
+	fn, ok := exprFunctions[e.name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %s()", e.name)
+	}
+	if len(args) < fn.min || (fn.max >= 0 && len(args) > fn.max) {
+		return nil, fmt.Errorf("Wrong number of arguments for %s()", e.name)
+	}
+	return fn.call(args)
+}
+
+type exprFunction struct {
+	min, max int
+	call     func(args []interface{}) (interface{}, error)
+}
+
+// exprFunctions are available either as functions, like lower(agent), or as
+// methods of their first argument, like agent.lower()
+var exprFunctions = map[string]exprFunction{
+	"lower": {1, 1, func(a []interface{}) (interface{}, error) { return strings.ToLower(logs.ToString(a[0])), nil }},
+	"upper": {1, 1, func(a []interface{}) (interface{}, error) { return strings.ToUpper(logs.ToString(a[0])), nil }},
+	"trim": {1, 2, func(a []interface{}) (interface{}, error) {
+		if len(a) > 1 {
+			return strings.Trim(logs.ToString(a[0]), logs.ToString(a[1])), nil
+		}
+		return strings.TrimSpace(logs.ToString(a[0])), nil
+	}},
+	"split": {2, 2, func(a []interface{}) (interface{}, error) {
+		return strings.Split(logs.ToString(a[0]), logs.ToString(a[1])), nil
+	}},
+	"join": {2, 2, func(a []interface{}) (interface{}, error) {
+		if l, ok := a[0].([]string); ok {
+			return strings.Join(l, logs.ToString(a[1])), nil
+		}
+		return logs.ToString(a[0]), nil
+	}},
+	"replace": {3, 3, func(a []interface{}) (interface{}, error) {
+		return strings.ReplaceAll(logs.ToString(a[0]), logs.ToString(a[1]), logs.ToString(a[2])), nil
+	}},
+	"contains": {2, 2, func(a []interface{}) (interface{}, error) {
+		return strings.Contains(logs.ToString(a[0]), logs.ToString(a[1])), nil
+	}},
+	"startswith": {2, 2, func(a []interface{}) (interface{}, error) {
+		return strings.HasPrefix(logs.ToString(a[0]), logs.ToString(a[1])), nil
+	}},
+	"endswith": {2, 2, func(a []interface{}) (interface{}, error) {
+		return strings.HasSuffix(logs.ToString(a[0]), logs.ToString(a[1])), nil
+	}},
+	"len": {1, 1, func(a []interface{}) (interface{}, error) {
+		if l, ok := a[0].([]string); ok {
+			return int64(len(l)), nil
+		}
+		return int64(len(logs.ToString(a[0]))), nil
+	}},
+	"str": {1, 1, func(a []interface{}) (interface{}, error) { return logs.ToString(a[0]), nil }},
+	"int": {1, 1, func(a []interface{}) (interface{}, error) {
+		switch x := logs.ToNumber(a[0]).(type) {
+		case int64:
+			return x, nil
+		case float64:
+			return int64(x), nil
+		}
+		return int64(0), nil
+	}},
+	"float": {1, 1, func(a []interface{}) (interface{}, error) {
+		f, _ := toFloat(logs.ToNumber(a[0]))
+		return f, nil
+	}},
+	"coalesce": {1, -1, func(a []interface{}) (interface{}, error) {
+		for _, v := range a {
+			if s := logs.ToString(v); s != "" && s != "-" {
+				return v, nil
+			}
+		}
+		return "", nil
+	}},
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != "" && x != "-"
+	case int64:
+		return x != 0
+	case float64:
+		return x != 0
+	case []string:
+		return len(x) > 0
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// compareValues compares numerically two numbers, and lexically otherwise
+func compareValues(x, y interface{}) int {
+	xf, ok1 := toFloat(logs.ToNumber(x))
+	yf, ok2 := toFloat(logs.ToNumber(y))
+	if ok1 && ok2 {
+		switch {
+		case xf < yf:
+			return -1
+		case xf > yf:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(logs.ToString(x), logs.ToString(y))
+}
+
+type exprToken struct {
+	kind  rune // 'n'umber, 's'tring, 'i'dentifier, 'o'perator, 0 at the end
+	text  string
+	value interface{}
+}
+
+func lexExpression(src string) ([]exprToken, error) {
+	out := make([]exprToken, 0)
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			text := string(runes[i:j])
+			if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+				out = append(out, exprToken{kind: 'n', text: text, value: v})
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				out = append(out, exprToken{kind: 'n', text: text, value: f})
+			} else {
+				return nil, fmt.Errorf("Invalid number %s", text)
+			}
+			i = j
+		case c == '"' || c == '\'':
+			sb := strings.Builder{}
+			j := i + 1
+			for ; j < len(runes) && runes[j] != c; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+					switch runes[j] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					default:
+						sb.WriteRune(runes[j])
+					}
+					continue
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, errors.New("Unterminated string")
+			}
+			out = append(out, exprToken{kind: 's', text: string(runes[i : j+1]), value: sb.String()})
+			i = j + 1
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			out = append(out, exprToken{kind: 'i', text: string(runes[i:j])})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||", "=~", "!~":
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/%<>!()[].,", op) && len(op) == 1 {
+				return nil, fmt.Errorf("Unexpected character %q", c)
+			}
+			out = append(out, exprToken{kind: 'o', text: op})
+			i += len(op)
+		}
+	}
+	return append(out, exprToken{}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	known  func(name string) bool
+}
+
+// parseExpression compiles the source of an expression, its fields checked by
+// known unless nil.
+func parseExpression(src string, known func(name string) bool) (expression, error) {
+	tokens, err := lexExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, known: known}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != 0 {
+		return nil, fmt.Errorf("Unexpected %q", p.peek().text)
+	}
+	return e, nil
+}
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "=~": 3, "!~": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) expect(op string) error {
+	if t := p.next(); t.kind != 'o' || t.text != op {
+		return fmt.Errorf("Expected %q instead of %q", op, t.text)
+	}
+	return nil
+}
+
+func (p *exprParser) binary(minPrec int) (expression, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := exprPrecedence[t.text]
+		if t.kind != 'o' || !ok || prec <= minPrec {
+			return x, nil
+		}
+		p.next()
+		y, err := p.binary(prec)
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "=~" || t.text == "!~" {
+			lit, ok := y.(*exprLiteral)
+			if !ok {
+				return nil, errors.New("Expected a literal regex")
+			}
+			re, err := regexp.Compile(logs.ToString(lit.value))
+			if err != nil {
+				return nil, err
+			}
+			x = &exprMatch{negate: t.text == "!~", x: x, re: re}
+		} else {
+			x = &exprBinary{op: t.text, x: x, y: y}
+		}
+	}
+}
+
+func (p *exprParser) unary() (expression, error) {
+	if t := p.peek(); t.kind == 'o' && (t.text == "!" || t.text == "-") {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op: t.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *exprParser) postfix() (expression, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == 'o' && t.text == ".":
+			p.next()
+			name := p.next()
+			if name.kind != 'i' {
+				return nil, fmt.Errorf("Expected a method instead of %q", name.text)
+			}
+			if _, ok := exprFunctions[name.text]; !ok {
+				return nil, fmt.Errorf("Unknown method %s()", name.text)
+			}
+			args, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			x = &exprCall{name: name.text, recv: x, args: args}
+		case t.kind == 'o' && t.text == "[":
+			p.next()
+			index, err := p.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprIndex{x: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) arguments() ([]expression, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make([]expression, 0)
+	if t := p.peek(); t.kind == 'o' && t.text == ")" {
+		p.next()
+		return args, nil
+	}
+	for {
+		a, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		t := p.next()
+		if t.kind == 'o' && t.text == ")" {
+			return args, nil
+		}
+		if t.kind != 'o' || t.text != "," {
+			return nil, fmt.Errorf("Expected ',' or ')' instead of %q", t.text)
+		}
+	}
+}
+
+func (p *exprParser) primary() (expression, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n', 's':
+		return &exprLiteral{value: t.value}, nil
+	case 'i':
+		switch t.text {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		}
+		if n := p.peek(); n.kind == 'o' && n.text == "(" {
+			args, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := exprFunctions[t.text]; !ok && t.text != "if" && t.text != "field" {
+				return nil, fmt.Errorf("Unknown function %s()", t.text)
+			}
+			return &exprCall{name: t.text, args: args}, nil
+		}
+		// Else a typo would silently be a missing field, e.g. stauts
+		if p.known != nil && !p.known(t.text) {
+			return nil, fmt.Errorf("Unknown field %s, use field(%q) for an extra field of the input", t.text, t.text)
+		}
+		return &exprField{name: t.text}, nil
+	case 'o':
+		if t.text == "(" {
+			x, err := p.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	if t.kind == 0 {
+		return nil, errors.New("Unexpected end of expression")
+	}
+	return nil, fmt.Errorf("Unexpected %q", t.text)
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+func TestUnknownFields(t *testing.T) {
+	sf := streamFlags{logFormat: "auto", cfg: &config{}}
+	for src, valid := range map[string]bool{
+		"status >= 500":                  true,
+		"stauts >= 500":                  false,
+		"ip == \"192.0.2.1\"":            true,
+		"request_time > 1":               true,
+		"lower(agnet).contains(\"bot\")": false,
+		"field(\"tenant\") == \"acme\"":  true,
+		"owner == \"web\"":               false,
+	} {
+		if _, err := parseExpression(src, sf.knownField); (err == nil) != valid {
+			t.Errorf("%s: expected valid=%v, got %v", src, valid, err)
+		}
+	}
+}
+
+func TestFieldFunction(t *testing.T) {
+	e, err := parseExpression(`field("tenant") == "acme" && status == 200`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := logs.Record{Code: 200}
+	r.SetExtra("tenant", "acme")
+	if v, err := e.eval(&r); err != nil || v != true {
+		t.Fatalf("Expected true, got %v (%v)", v, err)
+	}
+}
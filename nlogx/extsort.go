@@ -0,0 +1,251 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// mergeFanIn is the number of runs of the same tier merged into a run of the
+// next tier, thus the max number of runs open at once.
+const mergeFanIn = 16
+
+// sortSpill bounds the memory of the sorts: beyond maxRecords, the records are
+// spilled into temporary files in dir.
+type sortSpill struct {
+	dir        string
+	maxRecords int
+}
+
+// sortRun is a sorted run spilled into a file, its tier being the number of
+// merges it went through.
+type sortRun struct {
+	path string
+	tier int
+}
+
+// externalSort sorts the records in bounded memory: each batch of maxRecords
+// records is sorted into a run, the runs of a tier are merged into a run of
+// the next tier once mergeFanIn, and the runs left are merged at the end. The
+// runs stay in the order of arrival and the merges prefer the older runs, so
+// that the equal records keep their order of arrival, as with sortRecords.
+type externalSort struct {
+	keys  []sortKey
+	spill sortSpill
+	dir   string
+	runs  []sortRun
+	count int
+}
+
+func (s *externalSort) less(a, b *logs.Record) bool {
+	getA := func(name string) interface{} { v, _ := a.Field(name); return v }
+	getB := func(name string) interface{} { v, _ := b.Field(name); return v }
+	return compareByKeys(s.keys, getA, getB) < 0
+}
+
+func (s *externalSort) newRun(tier int) (*os.File, sortRun, error) {
+	if s.dir == "" {
+		dir, err := ioutil.TempDir(s.spill.dir, "nlogx-sort-")
+		if err != nil {
+			return nil, sortRun{}, err
+		}
+		s.dir = dir
+	}
+	s.count++
+	path := filepath.Join(s.dir, "run-"+strconv.Itoa(s.count))
+	f, err := os.Create(path)
+	return f, sortRun{path: path, tier: tier}, err
+}
+
+// add spills a batch of records as a run, then merges the runs of the tiers
+// complete, the newest runs being the ones of the lowest tiers.
+func (s *externalSort) add(batch []logs.Record) error {
+	sort.SliceStable(batch, func(i, j int) bool { return s.less(&batch[i], &batch[j]) })
+	f, run, err := s.newRun(0)
+	if err != nil {
+		return err
+	}
+	mw := newMsgpackWriter(f)
+	for i := range batch {
+		mw.record(&batch[i])
+	}
+	if err = mw.flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+
+	for {
+		n := len(s.runs)
+		if n < mergeFanIn || s.runs[n-mergeFanIn].tier != s.runs[n-1].tier {
+			return nil
+		}
+		tail := s.runs[n-mergeFanIn:]
+		f, merged, err := s.newRun(tail[0].tier + 1)
+		if err != nil {
+			return err
+		}
+		mw := newMsgpackWriter(f)
+		err = s.merge(tail, nil, func(r *logs.Record) error { mw.record(r); return nil })
+		if err == nil {
+			err = mw.flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		for _, run := range tail {
+			os.Remove(run.path)
+		}
+		s.runs = append(s.runs[:n-mergeFanIn], merged)
+	}
+}
+
+// mergeSource is the head of a run being merged, its index in the order of
+// arrival breaking the ties.
+type mergeSource struct {
+	head  logs.Record
+	index int
+	next  func() (logs.Record, error)
+}
+
+type mergeHeap struct {
+	sources []*mergeSource
+	s       *externalSort
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[i], h.sources[j]
+	if h.s.less(&a.head, &b.head) {
+		return true
+	}
+	if h.s.less(&b.head, &a.head) {
+		return false
+	}
+	return a.index < b.index
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.sources)
+	x := h.sources[n-1]
+	h.sources = h.sources[:n-1]
+	return x
+}
+
+// merge emits the records of the runs then of the sorted records in memory,
+// the newest, in the order of the keys.
+func (s *externalSort) merge(runs []sortRun, memory []logs.Record, emit func(r *logs.Record) error) error {
+	h := &mergeHeap{s: s}
+	for i, run := range runs {
+		f, err := os.Open(run.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in := &msgpackReader{r: bufio.NewReaderSize(f, 64*1024)}
+		h.sources = append(h.sources, &mergeSource{index: i, next: in.record})
+	}
+	if len(memory) > 0 {
+		h.sources = append(h.sources, &mergeSource{index: len(runs), next: func() (logs.Record, error) {
+			if len(memory) == 0 {
+				return logs.Record{}, io.EOF
+			}
+			r := memory[0]
+			memory = memory[1:]
+			return r, nil
+		}})
+	}
+	// Primed, the exhausted sources dropped
+	sources := h.sources[:0]
+	for _, src := range h.sources {
+		r, err := src.next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		src.head = r
+		sources = append(sources, src)
+	}
+	h.sources = sources
+	heap.Init(h)
+	for h.Len() > 0 {
+		src := h.sources[0]
+		if err := emit(&src.head); err != nil {
+			return err
+		}
+		r, err := src.next()
+		switch {
+		case err == io.EOF:
+			heap.Pop(h)
+		case err != nil:
+			return err
+		default:
+			src.head = r
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+func (s *externalSort) close() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// sortRecordsSpilled sorts the records as sortRecords does, the records beyond
+// the memory of the spill sorted into temporary files.
+func sortRecordsSpilled(in <-chan logs.Record, keys []sortKey, spill sortSpill) <-chan logs.Record {
+	if spill.maxRecords <= 0 {
+		return sortRecords(in, keys)
+	}
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		s := &externalSort{keys: keys, spill: spill}
+		defer s.close()
+		batch := make([]logs.Record, 0)
+		for r := range in {
+			if batch = append(batch, r); len(batch) >= spill.maxRecords {
+				if err := s.add(batch); err != nil {
+					Logger.Fatal().Str("dir", spill.dir).Err(err).Msg("Failed to spill the sorted records")
+				}
+				batch = batch[:0]
+			}
+		}
+		sort.SliceStable(batch, func(i, j int) bool { return s.less(&batch[i], &batch[j]) })
+		err := s.merge(s.runs, batch, func(r *logs.Record) error {
+			out <- *r
+			return nil
+		})
+		if err != nil {
+			Logger.Fatal().Str("dir", spill.dir).Err(err).Msg("Failed to merge the sorted records")
+		}
+	}()
+	return out
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// fairQueue is the backlog of a label, e.g. of a virtual host
+type fairQueue struct {
+	label   string
+	records []logs.Record
+	weight  int
+	current int
+	dropped int
+}
+
+// fairInterleave shares the output between the values of the field, e.g. the
+// virtual hosts, so that a busy one does not starve the others when the
+// output is slower than the input, e.g. a sink whose rate is bounded. While
+// the output keeps up, the records flow in their order. Once it lags, each
+// label queues its records, up to queueSize (the newer ones beyond are
+// dropped and reported), and the queues are served by the smooth weighted
+// round-robin of the upstreams of nginx, per the weights of the labels, 1 by
+// default.
+func fairInterleave(field string, weights map[string]int, queueSize int, clock logs.Clock) logs.Stage {
+	return func(in <-chan logs.Record) <-chan logs.Record {
+		out := make(chan logs.Record, 32)
+		go func() {
+			defer close(out)
+			queues := make(map[string]*fairQueue)
+			// The labels in their order of arrival, for the ties
+			var order []*fairQueue
+			report := clock.NewTicker(time.Minute)
+			defer report.Stop()
+			reportDrops := func() {
+				dropped := make(map[string]interface{})
+				for _, q := range order {
+					if q.dropped > 0 {
+						dropped[q.label] = q.dropped
+						q.dropped = 0
+					}
+				}
+				if len(dropped) > 0 {
+					Logger.Warn().Fields(dropped).Msg("Records dropped by the fair interleaving, the output lagging")
+				}
+			}
+			defer reportDrops()
+
+			// pick returns the queue served next, or nil if all are empty
+			pick := func() *fairQueue {
+				var best *fairQueue
+				total := 0
+				for _, q := range order {
+					if len(q.records) == 0 {
+						continue
+					}
+					q.current += q.weight
+					total += q.weight
+					if best == nil || q.current > best.current {
+						best = q
+					}
+				}
+				if best != nil {
+					best.current -= total
+				}
+				return best
+			}
+
+			var chosen *fairQueue
+			for {
+				if chosen == nil {
+					chosen = pick()
+				}
+				if chosen == nil && in == nil {
+					return
+				}
+				var send chan<- logs.Record
+				var next logs.Record
+				if chosen != nil {
+					send, next = out, chosen.records[0]
+				}
+				select {
+				case r, ok := <-in:
+					if !ok {
+						in = nil
+						continue
+					}
+					v, _ := r.Field(field)
+					label := logs.ToString(v)
+					q, ok := queues[label]
+					if !ok {
+						q = &fairQueue{label: label, weight: 1}
+						if w, ok := weights[label]; ok {
+							q.weight = w
+						}
+						queues[label] = q
+						order = append(order, q)
+					}
+					if len(q.records) >= queueSize {
+						q.dropped++
+						continue
+					}
+					q.records = append(q.records, r)
+				case send <- next:
+					chosen.records[0] = logs.Record{}
+					chosen.records = chosen.records[1:]
+					chosen = nil
+				case <-report.C():
+					reportDrops()
+				}
+			}
+		}()
+		return out
+	}
+}
+
+// parseFairQuotas parses the weights of the labels, like api.example.com=3
+func parseFairQuotas(quotas []string) (map[string]int, error) {
+	out := make(map[string]int, len(quotas))
+	for _, q := range quotas {
+		i := strings.LastIndexByte(q, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid quota %q, expected LABEL=WEIGHT", q)
+		}
+		w, err := strconv.Atoi(q[i+1:])
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("Invalid weight of the quota %q, expected a positive integer", q)
+		}
+		out[q[:i]] = w
+	}
+	return out, nil
+}
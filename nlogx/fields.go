@@ -0,0 +1,42 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// fieldNames returns the sorted names of the fields of the Record
+func fieldNames() []string {
+	out := make([]string, 0, len(logs.RecordFields))
+	for k := range logs.RecordFields {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func fmtExtra(r logs.Record) string {
+	if len(r.Extra) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(r.Extra))
+	for k := range r.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sb := strings.Builder{}
+	for _, k := range keys {
+		sb.WriteRune(' ')
+		sb.WriteString(k)
+		sb.WriteRune('=')
+		sb.WriteString(logs.ToString(r.Extra[k]))
+	}
+	return sb.String()
+}
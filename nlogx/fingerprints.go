@@ -0,0 +1,179 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// fingerprintParts splits a fingerprinted asset into its name, its hash and
+// its extension, e.g. /static/app, 3f9a2c and .js
+var fingerprintParts = regexp.MustCompile(`^(.*)[.-]([0-9a-f]{6,})(\.[a-z0-9]+)$`)
+
+// assetVersion is a fingerprint of an asset, i.e. a build deployed
+type assetVersion struct {
+	Fingerprint string `json:"fingerprint"`
+	FirstSeen   string `json:"first_seen"`
+	LastSeen    string `json:"last_seen"`
+	Requests    int    `json:"requests"`
+	Clients     int    `json:"clients"`
+	// Migrated counts the clients of a previous version that came to this one
+	Migrated     int     `json:"migrated"`
+	MigrationP50 float64 `json:"migration_p50_s,omitempty"`
+	MigrationP90 float64 `json:"migration_p90_s,omitempty"`
+	// Stale counts the requests once a newer version appeared
+	Stale int `json:"stale_requests"`
+
+	index      int
+	first      int64
+	last       int64
+	clients    map[string]bool
+	migrations []float64
+}
+
+// assetFamily is the sequence of the versions of an asset, in the order they
+// appeared.
+type assetFamily struct {
+	Asset    string          `json:"asset"`
+	Versions []*assetVersion `json:"versions"`
+
+	byHash map[string]*assetVersion
+	// current is the latest version requested by each client
+	current map[string]*assetVersion
+}
+
+func (f *assetFamily) add(r *logs.Record, client, hash string) {
+	v, ok := f.byHash[hash]
+	if !ok {
+		v = &assetVersion{Fingerprint: hash, first: r.When, index: len(f.Versions), clients: make(map[string]bool)}
+		f.byHash[hash] = v
+		f.Versions = append(f.Versions, v)
+	}
+	v.Requests++
+	v.last = r.When
+	if v.index < len(f.Versions)-1 {
+		v.Stale++
+	}
+	if !v.clients[client] {
+		v.clients[client] = true
+		// The delay of a client moving from an older version
+		if prev, ok := f.current[client]; ok && prev.index < v.index {
+			delay := r.When - v.first
+			if delay < 0 {
+				delay = 0
+			}
+			v.migrations = append(v.migrations, float64(delay))
+		}
+	}
+	if prev, ok := f.current[client]; !ok || prev.index < v.index {
+		f.current[client] = v
+	}
+}
+
+// matchesAsset tells if the asset contains one of the strings, if any
+func matchesAsset(asset string, only []string) bool {
+	for _, o := range only {
+		if strings.Contains(asset, o) {
+			return true
+		}
+	}
+	return len(only) == 0
+}
+
+func mainFingerprints(args []string) {
+	var sf streamFlags
+	var only []string
+	var changedOnly, flagJson bool
+	var rf reportFlags
+	var table string
+	var nbColumns int64
+
+	fs := pflag.NewFlagSet("fingerprints", pflag.ExitOnError)
+	fs.StringSliceVar(&only, "asset", make([]string, 0), "Only report the assets containing that string, like app.js")
+	fs.BoolVar(&changedOnly, "changed", false, "Only report the assets with several fingerprints")
+	rf.register(fs, "assets", 0, assetFamily{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the assets as JSON objects")
+	fs.StringVar(&table, "table", tablePlain, "Style of the table: plain, border or markdown")
+	fs.Int64VarP(&nbColumns, "columns", "c", terminalColumns(), "Max line length of the table")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	families := make(map[string]*assetFamily)
+	for r := range sf.records() {
+		if r.Method != "GET" || (r.Code != 200 && r.Code != 304) {
+			continue
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		m := fingerprintParts.FindStringSubmatch(p)
+		if m == nil {
+			continue
+		}
+		asset := m[1] + m[3]
+		if !matchesAsset(asset, only) {
+			continue
+		}
+		f, ok := families[asset]
+		if !ok {
+			f = &assetFamily{Asset: asset, byHash: make(map[string]*assetVersion), current: make(map[string]*assetVersion)}
+			families[asset] = f
+		}
+		f.add(&r, r.Ip+"\x00"+r.Agent, m[2])
+	}
+
+	out := make([]*assetFamily, 0, len(families))
+	for _, f := range families {
+		if changedOnly && len(f.Versions) < 2 {
+			continue
+		}
+		for _, v := range f.Versions {
+			v.FirstSeen, v.LastSeen = fmtTime(v.first), fmtTime(v.last)
+			v.Clients = len(v.clients)
+			v.Migrated = len(v.migrations)
+			if len(v.migrations) > 0 {
+				v.MigrationP50 = percentileMs(v.migrations, 50)
+				v.MigrationP90 = percentileMs(v.migrations, 90)
+			}
+		}
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Asset < out[j].Asset })
+	rf.apply(&out)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, f := range out {
+			encoder.Encode(f)
+		}
+		return
+	}
+	columns := []string{"asset", "fingerprint", "first_seen", "last_seen", "requests", "clients", "migrated",
+		"migration_p50", "migration_p90", "stale"}
+	rows := make([][]interface{}, 0)
+	for _, f := range out {
+		for _, v := range f.Versions {
+			var p50, p90 interface{}
+			if v.Migrated > 0 {
+				p50 = (time.Duration(v.MigrationP50) * time.Second).String()
+				p90 = (time.Duration(v.MigrationP90) * time.Second).String()
+			}
+			rows = append(rows, []interface{}{f.Asset, v.Fingerprint, v.FirstSeen, v.LastSeen, int64(v.Requests),
+				int64(v.Clients), int64(v.Migrated), p50, p90, int64(v.Stale)})
+		}
+	}
+	renderTable(os.Stdout, table, int(nbColumns), columns, rows)
+}
@@ -0,0 +1,24 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+func formatNames() []string {
+	out := make([]string, 0, len(logs.LogFormats))
+	for _, f := range logs.LogFormats {
+		out = append(out, f.Name)
+	}
+	return out
+}
+
+func fmtFormatNames() string {
+	return "auto, mixed, " + strings.Join(formatNames(), ", ")
+}
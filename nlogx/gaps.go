@@ -0,0 +1,158 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// logGap is a period without any record, while the site was busy before
+type logGap struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Before is the number of records in the period of the same length before
+	Before int `json:"before"`
+	Record int `json:"record"`
+	// Maintenance is the window tagging the gap, if any
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// logDisorder is a run of records older than a record before them, e.g. after
+// a bad merge of rotated logs.
+type logDisorder struct {
+	Record  int   `json:"record"`
+	Records int   `json:"records"`
+	Latest  int64 `json:"latest"`
+	Oldest  int64 `json:"oldest"`
+	// Maintenance is the window tagging the disorder, if any
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+func mainGaps(args []string) {
+	var sf streamFlags
+	var minGap, maxSkew time.Duration
+	var minBefore int
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("gaps", pflag.ExitOnError)
+	fs.DurationVar(&minGap, "min-gap", 5*time.Minute, "Min period without any record")
+	fs.IntVar(&minBefore, "min-before", 20, "Min number of records in the period before, on a busy site")
+	fs.DurationVar(&maxSkew, "max-skew", time.Minute, "Max delay of a record behind the latest one")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the anomalies as JSON objects")
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+
+	// All the lines count, in the order of the input
+	sf.allSources = true
+	sf.ordered = true
+
+	gap, skew := int64(minGap/time.Second), int64(maxSkew/time.Second)
+	// The latest times seen, sorted, to count the records before a gap
+	var times []int64
+	var gaps []logGap
+	var disorders []logDisorder
+	var latest int64
+	var current *logDisorder
+	count := 0
+	for r := range sf.records() {
+		count++
+		if count == 1 {
+			latest = r.When
+			times = append(times, r.When)
+			continue
+		}
+		if r.When < latest-skew {
+			if current == nil {
+				disorders = append(disorders, logDisorder{Record: count, Latest: latest, Oldest: r.When})
+				current = &disorders[len(disorders)-1]
+			}
+			current.Records++
+			if r.When < current.Oldest {
+				current.Oldest = r.When
+			}
+			continue
+		}
+		current = nil
+		if r.When-latest >= gap {
+			// The records in the period of the same length before the gap
+			from := latest - (r.When - latest)
+			before := len(times) - sort.Search(len(times), func(j int) bool { return times[j] >= from })
+			if before >= minBefore {
+				gaps = append(gaps, logGap{Start: latest, End: r.When, Before: before, Record: count})
+			}
+		}
+		if r.When > latest {
+			latest = r.When
+		}
+		// Only the records in order, for the searches to stay valid
+		times = append(times, latest)
+	}
+
+	// The anomalies during the maintenance windows are suppressed or tagged
+	suppressed := 0
+	windows := sf.cfg.Maintenance
+	keptGaps := gaps[:0]
+	for _, g := range gaps {
+		if mw := windows.during(g.Start, g.End); mw == nil {
+			keptGaps = append(keptGaps, g)
+		} else if mw.Action == "tag" {
+			g.Maintenance = mw.Name
+			keptGaps = append(keptGaps, g)
+		} else {
+			suppressed++
+		}
+	}
+	gaps = keptGaps
+	keptDisorders := disorders[:0]
+	for _, d := range disorders {
+		if mw := windows.during(d.Oldest, d.Latest); mw == nil {
+			keptDisorders = append(keptDisorders, d)
+		} else if mw.Action == "tag" {
+			d.Maintenance = mw.Name
+			keptDisorders = append(keptDisorders, d)
+		} else {
+			suppressed++
+		}
+	}
+	disorders = keptDisorders
+	tag := func(window string) string {
+		if window == "" {
+			return ""
+		}
+		return " during the maintenance window " + window
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, g := range gaps {
+			encoder.Encode(map[string]interface{}{"gap": g})
+		}
+		for _, d := range disorders {
+			encoder.Encode(map[string]interface{}{"disorder": d})
+		}
+		return
+	}
+	fmt.Printf("%d records, %d gaps, %d disorders", count, len(gaps), len(disorders))
+	if suppressed > 0 {
+		fmt.Printf(", %d suppressed during the maintenance windows", suppressed)
+	}
+	fmt.Println()
+	for _, g := range gaps {
+		fmt.Printf("gap      %s .. %s %10s without records, %d records the period before (record %d)%s\n",
+			fmtTime(g.Start), fmtTime(g.End), time.Duration(g.End-g.Start)*time.Second, g.Before, g.Record,
+			tag(g.Maintenance))
+	}
+	for _, d := range disorders {
+		fmt.Printf("disorder record %d: %d records back to %s, behind %s%s\n",
+			d.Record, d.Records, fmtTime(d.Oldest), fmtTime(d.Latest), tag(d.Maintenance))
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+const (
+	// gelfMaxChunks is the max number of chunks of a message, as Graylog
+	gelfMaxChunks = 128
+	// gelfChunkTimeout drops the messages whose chunks do not all arrive
+	gelfChunkTimeout = 5 * time.Second
+)
+
+// gelfLine returns the raw line of a GELF message, compressed or not: the
+// short message, as shipped by the GELF drivers, or else the full one.
+func gelfLine(payload []byte) (string, error) {
+	var r io.Reader = bytes.NewReader(payload)
+	var err error
+	switch {
+	case bytes.HasPrefix(payload, logs.GzipMagic):
+		r, err = gzip.NewReader(r)
+	case len(payload) >= 2 && payload[0] == 0x78:
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return "", err
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return "", err
+	}
+	var msg struct {
+		Short string `json:"short_message"`
+		Full  string `json:"full_message"`
+	}
+	if err = json.Unmarshal(raw, &msg); err != nil {
+		return "", err
+	}
+	if msg.Short != "" {
+		return msg.Short, nil
+	}
+	if msg.Full != "" {
+		return msg.Full, nil
+	}
+	return "", errors.New("No message in the GELF payload")
+}
+
+// gelfChunks reassembles the chunked messages of GELF over UDP
+type gelfChunks struct {
+	pending map[string]*gelfChunked
+}
+
+type gelfChunked struct {
+	parts    [][]byte
+	received int
+	first    time.Time
+}
+
+// add returns the message once all its chunks are received
+func (gc *gelfChunks) add(chunk []byte, now time.Time) ([]byte, error) {
+	// magic, id of 8 bytes, sequence number, sequence count
+	if len(chunk) < 12 {
+		return nil, errors.New("Truncated GELF chunk")
+	}
+	id, seq, count := string(chunk[2:10]), int(chunk[10]), int(chunk[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, errors.New("Invalid GELF chunk sequence")
+	}
+	for key, m := range gc.pending {
+		if now.Sub(m.first) > gelfChunkTimeout {
+			delete(gc.pending, key)
+		}
+	}
+	m, ok := gc.pending[id]
+	if !ok {
+		m = &gelfChunked{parts: make([][]byte, count), first: now}
+		gc.pending[id] = m
+	}
+	if len(m.parts) != count {
+		delete(gc.pending, id)
+		return nil, errors.New("Inconsistent GELF chunk count")
+	}
+	if m.parts[seq] == nil {
+		m.parts[seq] = append([]byte(nil), chunk[12:]...)
+		m.received++
+	}
+	if m.received < count {
+		return nil, nil
+	}
+	delete(gc.pending, id)
+	return bytes.Join(m.parts, nil), nil
+}
+
+func serveGELFUDP(addr string, out io.Writer, clock logs.Clock) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	Logger.Info().Str("addr", conn.LocalAddr().String()).Msg("Listening for GELF over UDP")
+	chunks := &gelfChunks{pending: make(map[string]*gelfChunked)}
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		payload := buf[:n]
+		if bytes.HasPrefix(payload, gelfChunkMagic) {
+			if payload, err = chunks.add(payload, clock.Now()); err != nil || payload == nil {
+				if err != nil {
+					Logger.Warn().Str("peer", peer.String()).Err(err).Msg("Invalid GELF message")
+				}
+				continue
+			}
+		}
+		line, err := gelfLine(payload)
+		if err != nil {
+			Logger.Warn().Str("peer", peer.String()).Err(err).Msg("Invalid GELF message")
+			continue
+		}
+		if err = writeFrame(line, out); err != nil {
+			return err
+		}
+	}
+}
+
+// serveGELFTCP receives the GELF messages delimited by null bytes, as the
+// TCP inputs of Graylog.
+func serveGELFTCP(addr string, out io.Writer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	Logger.Info().Str("addr", l.Addr().String()).Msg("Listening for GELF over TCP")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			in := bufio.NewReader(conn)
+			for {
+				frame, err := in.ReadBytes(0)
+				if frame = bytes.TrimSuffix(frame, []byte{0}); len(bytes.TrimSpace(frame)) > 0 {
+					line, perr := gelfLine(frame)
+					if perr != nil {
+						Logger.Warn().Str("peer", conn.RemoteAddr().String()).Err(perr).Msg("Invalid GELF message")
+					} else if werr := writeFrame(line, out); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					if err != io.EOF {
+						Logger.Warn().Str("peer", conn.RemoteAddr().String()).Err(err).Msg("GELF connection failed")
+					}
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type geoLocation struct {
+	Country string
+	City    string
+	Lat     float64
+	Lon     float64
+	ASN     uint
+	Org     string
+	located bool
+}
+
+// geoDB resolves the addresses with the MaxMind databases (GeoLite2-City or
+// GeoLite2-Country, and GeoLite2-ASN), and caches the answers. The enrich
+// stage and the commands looking up the locations share the cache.
+type geoDB struct {
+	city  *maxminddb.Reader
+	asn   *maxminddb.Reader
+	lock  sync.Mutex
+	cache map[string]geoLocation
+}
+
+func openGeoDB(cityPath, asnPath string) (*geoDB, error) {
+	var err error
+	g := &geoDB{cache: make(map[string]geoLocation)}
+	if cityPath != "" {
+		if g.city, err = maxminddb.Open(cityPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *geoDB) lookup(addr string) geoLocation {
+	g.lock.Lock()
+	loc, ok := g.cache[addr]
+	g.lock.Unlock()
+	if ok {
+		return loc
+	}
+	loc = g.resolve(addr)
+	g.lock.Lock()
+	g.cache[addr] = loc
+	g.lock.Unlock()
+	return loc
+}
+
+func (g *geoDB) resolve(addr string) geoLocation {
+	var loc geoLocation
+	if ip := net.ParseIP(addr); ip != nil {
+		if g.city != nil {
+			var rec struct {
+				Country struct {
+					IsoCode string `maxminddb:"iso_code"`
+				} `maxminddb:"country"`
+				City struct {
+					Names map[string]string `maxminddb:"names"`
+				} `maxminddb:"city"`
+				Location struct {
+					Latitude  *float64 `maxminddb:"latitude"`
+					Longitude *float64 `maxminddb:"longitude"`
+				} `maxminddb:"location"`
+			}
+			if err := g.city.Lookup(ip, &rec); err == nil {
+				loc.Country = rec.Country.IsoCode
+				loc.City = rec.City.Names["en"]
+				if rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+					loc.Lat, loc.Lon, loc.located = *rec.Location.Latitude, *rec.Location.Longitude, true
+				}
+			}
+		}
+		if g.asn != nil {
+			var rec struct {
+				Number uint   `maxminddb:"autonomous_system_number"`
+				Org    string `maxminddb:"autonomous_system_organization"`
+			}
+			if err := g.asn.Lookup(ip, &rec); err == nil {
+				loc.ASN, loc.Org = rec.Number, rec.Org
+			}
+		}
+	}
+	return loc
+}
+
+// enrich annotates the records with the country and the AS of their source
+func (g *geoDB) enrich(in <-chan logs.Record) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			loc := g.lookup(r.Ip)
+			r.Country, r.ASN = loc.Country, loc.ASN
+			out <- r
+		}
+	}()
+	return out
+}
+
+// distanceKm computes the great-circle distance between two locations
+func distanceKm(a, b geoLocation) float64 {
+	const earthRadius = 6371.0
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat, dLon := rad(b.Lat-a.Lat), rad(b.Lon-a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
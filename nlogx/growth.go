@@ -0,0 +1,193 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// maxForecastDays bounds the projection of the growth of the log
+const maxForecastDays = 10 * 365
+
+// minTrendDays is the min number of full days to fit the trend of the growth
+const minTrendDays = 3
+
+type dayVolume struct {
+	Day   string `json:"day"`
+	Lines int64  `json:"lines"`
+	Bytes int64  `json:"bytes"`
+}
+
+// parseByteSize parses a size with an optional K, M, G or T suffix, in powers
+// of 1024.
+func parseByteSize(src string) (uint64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(src), "B")
+	mult := uint64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult, s = 1<<(10*uint(i+1)), s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid size %q", src)
+	}
+	return uint64(v * float64(mult)), nil
+}
+
+func fmtByteSize(n float64) string {
+	if n < 0 {
+		return "-" + fmtByteSize(-n)
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n, i = n/1024, i+1
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// linearTrend fits y = a + b*x by the least squares
+func linearTrend(ys []float64) (a, b float64) {
+	n := float64(len(ys))
+	var sx, sy, sxx, sxy float64
+	for i, y := range ys {
+		x := float64(i)
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	if d := n*sxx - sx*sx; d != 0 {
+		b = (n*sxy - sx*sy) / d
+	}
+	return (sy - b*sx) / n, b
+}
+
+func mainGrowth(args []string) {
+	var sample int
+	var partition, free string
+	var flagJson bool
+	var sf streamFlags
+
+	fs := pflag.NewFlagSet("growth", pflag.ExitOnError)
+	fs.IntVar(&sample, "detect-lines", 100, "Number of lines sampled to detect the format of the input")
+	fs.StringVar(&partition, "partition", "", "Path on the partition of the logs, to project when it fills")
+	fs.StringVar(&free, "free", "", "Space left for the logs (like 20G), instead of the free space of --partition")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the report as a JSON object")
+	fs.StringVar(&sf.now, "now", "", "Pretend to run at that time, e.g. for the date the partition fills (like 2021-03-04T12:00:00Z)")
+	parseFlags(fs, args)
+
+	// The raw lines, all of them, for their size
+	days := make(map[string]*dayVolume)
+	text := logs.ReadLines(os.Stdin, readFailed)
+	if fs.NArg() > 0 {
+		text = logs.ReadFiles(fs.Args(), readFailed)
+	}
+	for line := range logs.DetectFormat(text, sample, nil) {
+		r, ok := line.Format.Parse(line.Text)
+		if !ok {
+			continue
+		}
+		day := time.Unix(r.When, 0).Format("2006-01-02")
+		v, ok := days[day]
+		if !ok {
+			v = &dayVolume{Day: day}
+			days[day] = v
+		}
+		v.Lines++
+		v.Bytes += int64(len(line.Text)) + 1
+	}
+	volumes := make([]dayVolume, 0, len(days))
+	for _, v := range days {
+		volumes = append(volumes, *v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Day < volumes[j].Day })
+	if len(volumes) == 0 {
+		Logger.Fatal().Msg("No record")
+	}
+
+	// The first and last days are likely partial
+	full := volumes
+	if len(full) > 2 {
+		full = full[1 : len(full)-1]
+	}
+	bytes, lines, total := make([]float64, len(full)), 0.0, 0.0
+	for i, v := range full {
+		bytes[i] = float64(v.Bytes)
+		lines += float64(v.Lines)
+		total += float64(v.Bytes)
+	}
+	a, b := linearTrend(bytes)
+	rate := a + b*float64(len(full)-1)
+	if len(full) < minTrendDays {
+		// Too few days for a trend, the mean rate goes on
+		rate, b = total/float64(len(full)), 0
+	}
+	report := map[string]interface{}{
+		"days":          volumes,
+		"lines_per_day": lines / float64(len(full)),
+		"bytes_per_day": rate,
+		"trend":         b,
+	}
+
+	var left uint64
+	var err error
+	switch {
+	case free != "":
+		left, err = parseByteSize(free)
+	case partition != "":
+		left, err = diskFree(partition)
+	}
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to get the free space")
+	}
+	fillDays := -1
+	if left > 0 {
+		// The daily volume keeps on following the trend
+		total = 0
+		for d := 1; d <= maxForecastDays; d++ {
+			if daily := rate + b*float64(d); daily > 0 {
+				total += daily
+			}
+			if total >= float64(left) {
+				fillDays = d
+				break
+			}
+		}
+		report["free"] = left
+		if fillDays >= 0 {
+			report["full"] = sf.getClock().Now().AddDate(0, 0, fillDays).Format("2006-01-02")
+		}
+	}
+
+	if flagJson {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+	for _, v := range volumes {
+		fmt.Printf("%s %10d lines %12s\n", v.Day, v.Lines, fmtByteSize(float64(v.Bytes)))
+	}
+	trend := fmtByteSize(b)
+	if b >= 0 {
+		trend = "+" + trend
+	}
+	fmt.Printf("%.0f lines/day, %s/day, trend %s/day per day, over %d full days\n",
+		lines/float64(len(full)), fmtByteSize(rate), trend, len(full))
+	switch {
+	case left == 0:
+	case fillDays < 0:
+		fmt.Printf("%s free, not full within %d days\n", fmtByteSize(float64(left)), maxForecastDays)
+	default:
+		fmt.Printf("%s free, full in %d days (%s)\n", fmtByteSize(float64(left)), fillDays, report["full"])
+	}
+}
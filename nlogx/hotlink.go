@@ -0,0 +1,161 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// hotlinker is a site embedding the assets of the site, with the bandwidth it
+// costs.
+type hotlinker struct {
+	Site     string `json:"site"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Assets   int    `json:"assets"`
+	TopAsset string `json:"top_asset"`
+
+	assets map[string]int
+}
+
+// nginxValidReferers prints a location of nginx only serving the assets to
+// the site, the search engines and the direct requests, the worst offenders
+// listed in comments.
+func nginxValidReferers(sites []string, worst []*hotlinker) {
+	fmt.Println("# Blocks the hotlinking of the assets, e.g. by:")
+	for _, h := range worst {
+		fmt.Printf("#   %s, %s\n", h.Site, fmtByteSize(float64(h.Bytes)))
+	}
+	fmt.Println(`location ~* \.(png|jpe?g|gif|webp|avif|svg|ico|mp[34]|webm|pdf|woff2?|ttf|otf)$ {`)
+	names := []string{"none", "blocked", "server_names"}
+	for _, s := range sites {
+		names = append(names, s, "*."+s)
+	}
+	names = append(names, `~\.google\.`, `~\.bing\.`, `~\.duckduckgo\.`)
+	fmt.Printf("    valid_referers %s;\n", strings.Join(names, " "))
+	fmt.Println("    if ($invalid_referer) {")
+	fmt.Println("        return 403;")
+	fmt.Println("    }")
+	fmt.Println("}")
+}
+
+func mainHotlink(args []string) {
+	var sf streamFlags
+	var sites []string
+	var rf reportFlags
+	var nginx, flagJson bool
+
+	fs := pflag.NewFlagSet("hotlink", pflag.ExitOnError)
+	fs.StringSliceVar(&sites, "site", nil, "Hosts of the site, with the sites of the channels of the configuration and the host logged")
+	rf.register(fs, "referring sites", 20, hotlinker{})
+	fs.BoolVar(&nginx, "nginx", false, "Print a location of nginx blocking the hotlinking, with valid_referers")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the referring sites as JSON objects")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	records := sf.records()
+	if sf.cfg != nil {
+		sites = append(sites, sf.cfg.Channels.Sites...)
+	}
+	cc, err := newChannelClassifier(channelConfig{Sites: sites})
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the classifier of the referrers")
+	}
+	hosts := make(map[string]bool)
+	linkers := make(map[string]*hotlinker)
+	for r := range records {
+		if r.Code != 200 && r.Code != 206 {
+			continue
+		}
+		p := r.Path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		if !staticAssets.MatchString(path.Ext(p)) || r.Referrer == "" || r.Referrer == "-" {
+			continue
+		}
+		u, err := url.Parse(r.Referrer)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		site := strings.ToLower(u.Hostname())
+		// The host logged is the site itself, e.g. a virtual host
+		host, _ := logs.SplitAddrPort(strings.ToLower(logs.ToString(r.Extra["host"])))
+		if host != "" && host != "-" {
+			hosts[host] = true
+		}
+		if site == host || hosts[site] || cc.internal(site) || cc.organic.MatchString(site) {
+			continue
+		}
+		h, ok := linkers[site]
+		if !ok {
+			h = &hotlinker{Site: site, assets: make(map[string]int)}
+			linkers[site] = h
+		}
+		h.Requests++
+		h.Bytes += r.Bytes
+		h.assets[p]++
+	}
+	if len(sites) == 0 && len(hosts) == 0 {
+		Logger.Warn().Msg("Neither --site nor the host logged, all the referrers may be reported")
+	}
+
+	report := make([]*hotlinker, 0, len(linkers))
+	for _, h := range linkers {
+		// The sites linked from their own assets, e.g. a vhost not logged
+		if hosts[h.Site] {
+			continue
+		}
+		h.Assets = len(h.assets)
+		best := 0
+		for asset, n := range h.assets {
+			if n > best || n == best && asset < h.TopAsset {
+				h.TopAsset, best = asset, n
+			}
+		}
+		report = append(report, h)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Site < report[j].Site
+	})
+	rf.apply(&report)
+
+	switch {
+	case nginx:
+		for _, s := range sites {
+			hosts[strings.ToLower(s)] = true
+		}
+		names := make([]string, 0, len(hosts))
+		for host := range hosts {
+			names = append(names, host)
+		}
+		sort.Strings(names)
+		nginxValidReferers(names, report)
+	case flagJson:
+		encoder := json.NewEncoder(os.Stdout)
+		for _, h := range report {
+			encoder.Encode(h)
+		}
+	default:
+		fmt.Printf("%-40s %9s %12s %7s %s\n", "SITE", "REQUESTS", "BANDWIDTH", "ASSETS", "TOP ASSET")
+		for _, h := range report {
+			fmt.Printf("%-40s %9d %12s %7d %s\n", h.Site, h.Requests, fmtByteSize(float64(h.Bytes)), h.Assets, h.TopAsset)
+		}
+	}
+}
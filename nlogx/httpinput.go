@@ -0,0 +1,212 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// httpInput fetches the logs given as URLs, e.g. the presigned URLs of an
+// object store. The encodings are decoded here rather than by the transport,
+// that only knows gzip.
+var httpInput = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DisableCompression:    true,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// isURLLocation tells if the location is a log to fetch over HTTP
+func isURLLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// decodeContent undoes the Content-Encoding of a response, the encodings
+// being listed in the order they were applied.
+func decodeContent(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var err error
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var in io.Reader = body
+		switch strings.ToLower(strings.TrimSpace(encodings[i])) {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			in, err = gzip.NewReader(body)
+		case "deflate":
+			in, err = zlib.NewReader(body)
+		case "zstd":
+			in, err = logs.ZstdCommand(body)
+		default:
+			err = fmt.Errorf("unsupported Content-Encoding %q", encodings[i])
+		}
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		body = &chainedCloser{Reader: in, closers: []io.Closer{in.(io.Closer), body}}
+	}
+	return body, nil
+}
+
+// chainedCloser closes a decoder then the stream it reads
+type chainedCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c *chainedCloser) Close() error {
+	var err error
+	for _, closer := range c.closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// httpFetcher fetches the URLs with the headers of the user, e.g. for
+// authentication, resuming the downloads interrupted.
+type httpFetcher struct {
+	header  http.Header
+	retries int
+	// clock spaces the retries
+	clock logs.Clock
+}
+
+// newHTTPFetcher returns a fetcher sending the headers, like
+// "Authorization: Bearer TOKEN"
+func newHTTPFetcher(headers []string, retries int, clock logs.Clock) (*httpFetcher, error) {
+	f := &httpFetcher{header: make(http.Header), retries: retries, clock: clock}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid header %q, expected NAME: VALUE", h)
+		}
+		f.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return f, nil
+}
+
+// get requests the URL from the offset on, the part asked being the same
+// version as the first one, known by its validator.
+func (f *httpFetcher) get(url string, offset int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range f.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate, zstd")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	rep, err := httpInput.Do(req)
+	if err != nil {
+		if ue, ok := err.(*neturl.Error); ok {
+			ue.URL = redactURL(ue.URL)
+		}
+		return nil, err
+	}
+	expected := http.StatusOK
+	if offset > 0 {
+		expected = http.StatusPartialContent
+	}
+	if rep.StatusCode != expected {
+		defer rep.Body.Close()
+		io.Copy(ioutil.Discard, io.LimitReader(rep.Body, 64*1024))
+		if offset > 0 && rep.StatusCode == http.StatusOK {
+			return nil, errors.New("the download cannot be resumed, the log changed or the server ignores the ranges")
+		}
+		return nil, fmt.Errorf("%s", rep.Status)
+	}
+	return rep, nil
+}
+
+// resumableBody is the body of a response that, once interrupted, is
+// requested again from where it stopped.
+type resumableBody struct {
+	f         *httpFetcher
+	url       string
+	body      io.ReadCloser
+	offset    int64
+	validator string
+	retries   int
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF || b.retries >= b.f.retries {
+			return n, err
+		}
+		b.retries++
+		Logger.Warn().Str("url", redactURL(b.url)).Int64("offset", b.offset).Int("retry", b.retries).Err(err).Msg("Download interrupted, resumed")
+		b.body.Close()
+		sleep(b.f.clock, time.Duration(b.retries)*time.Second)
+		rep, rerr := b.f.get(b.url, b.offset, b.validator)
+		if rerr != nil {
+			b.body = ioutil.NopCloser(strings.NewReader(""))
+			return n, fmt.Errorf("%v, then %v", err, rerr)
+		}
+		b.body = rep.Body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (b *resumableBody) Close() error { return b.body.Close() }
+
+// redactURL strips the query of a URL, e.g. the signature of a presigned one
+func redactURL(url string) string {
+	return strings.SplitN(url, "?", 2)[0]
+}
+
+// fetch returns the body of the log at the URL, without its
+// Content-Encoding, the chunks of the transfer being joined by the client.
+func (f *httpFetcher) fetch(url string) (io.ReadCloser, error) {
+	var rep *http.Response
+	var err error
+	for retry := 0; ; retry++ {
+		if rep, err = f.get(url, 0, ""); err == nil {
+			break
+		}
+		// The connection failed rather than the server answering
+		if _, ok := err.(*neturl.Error); !ok || retry >= f.retries {
+			return nil, err
+		}
+		Logger.Warn().Str("url", redactURL(url)).Int("retry", retry+1).Err(err).Msg("Download failed, retried")
+		sleep(f.clock, time.Duration(retry+1)*time.Second)
+	}
+	// A weak ETag never validates a range
+	validator := rep.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = rep.Header.Get("Last-Modified")
+	}
+	body := &resumableBody{f: f, url: url, body: rep.Body, validator: validator}
+	if rep.Header.Get("Accept-Ranges") != "bytes" {
+		// Nothing to resume, fail at once
+		body.retries = f.retries
+	}
+	return decodeContent(rep.Header.Get("Content-Encoding"), body)
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+type breach struct {
+	when  int64
+	path  string
+	code  int
+	fails int
+	total int
+}
+
+// clientTransitions tracks the statuses of the requests of one client
+type clientTransitions struct {
+	ip       string
+	total    int
+	fails    int
+	breaches []breach
+}
+
+func isDenied(code int) bool {
+	return code == 401 || code == 403 || code == 404
+}
+
+// suspicion is higher for the clients with many successes on sensitive paths
+// after a long and mostly denied probing.
+func (c *clientTransitions) suspicion() float64 {
+	if len(c.breaches) == 0 {
+		return 0
+	}
+	b := c.breaches[0]
+	ratio := float64(b.fails) / float64(b.total)
+	return float64(len(c.breaches)) * ratio * math.Log2(1+float64(b.fails))
+}
+
+// huntColumns are the fields of the suspects, as in JSON
+var huntColumns = []string{"src", "suspicion", "probes", "denied", "first", "successes", "paths", "requests"}
+
+// summary is the JSON object of a suspect, since its first breach
+func (c *clientTransitions) summary() map[string]interface{} {
+	b := c.breaches[0]
+	paths := make([]string, 0, len(c.breaches))
+	for _, b := range c.breaches {
+		paths = append(paths, b.path)
+	}
+	return map[string]interface{}{
+		"src":       c.ip,
+		"suspicion": c.suspicion(),
+		"probes":    b.total,
+		"denied":    b.fails,
+		"first":     b.when,
+		"successes": len(c.breaches),
+		"paths":     paths,
+		"requests":  c.total,
+	}
+}
+
+func mainHunt(args []string) {
+	var sf streamFlags
+	var flagJson bool
+	var minProbes int
+	var minRatio float64
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("hunt", pflag.ExitOnError)
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the suspicious clients as JSON objects")
+	fs.IntVar(&minProbes, "min-probes", 5, "Min number of denied requests before a success")
+	fs.Float64Var(&minRatio, "min-ratio", 0.7, "Min ratio of denied requests before a success")
+	rf.registerColumns(fs, "suspicious clients", 0, huntColumns)
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	expr, sensitive, err := makeOrRegex(sensitivePaths)
+	if err != nil {
+		Logger.Fatal().Str("expr", expr).Err(err).Msg("Failed to build the regex matching the sensitive paths")
+	}
+
+	clients := make(map[string]*clientTransitions)
+	for r := range sf.records() {
+		c, ok := clients[r.Ip]
+		if !ok {
+			c = &clientTransitions{ip: r.Ip}
+			clients[r.Ip] = c
+		}
+		if r.Code >= 200 && r.Code < 300 && sensitive.MatchString(r.Path) &&
+			c.fails >= minProbes && float64(c.fails) >= minRatio*float64(c.total) {
+			c.breaches = append(c.breaches, breach{when: r.When, path: r.Path, code: r.Code, fails: c.fails, total: c.total})
+		}
+		c.total++
+		if isDenied(r.Code) {
+			c.fails++
+		}
+	}
+
+	suspects := make([]*clientTransitions, 0)
+	for _, c := range clients {
+		if len(c.breaches) > 0 {
+			suspects = append(suspects, c)
+		}
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		si, sj := suspects[i].suspicion(), suspects[j].suspicion()
+		if si != sj {
+			return si > sj
+		}
+		return suspects[i].ip < suspects[j].ip
+	})
+
+	summaries := make([]map[string]interface{}, len(suspects))
+	for i, c := range suspects {
+		summaries[i] = c.summary()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, i := range rf.order(len(suspects), func(i int, name string) interface{} { return summaries[i][name] }) {
+		c := suspects[i]
+		b := c.breaches[0]
+		if flagJson {
+			encoder.Encode(summaries[i])
+			continue
+		}
+		fmt.Printf("%-15s %7.2f  %d/%d denied, then %d successes from %s\n",
+			c.ip, c.suspicion(), b.fails, b.total, len(c.breaches), fmtTime(b.when))
+		for _, b := range c.breaches {
+			fmt.Printf("  %s %d %s\n", fmtTime(b.when), b.code, b.path)
+		}
+	}
+}
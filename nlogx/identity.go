@@ -0,0 +1,29 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+func identify(in <-chan logs.Record) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			r.ID = r.Identity()
+			out <- r
+		}
+	}()
+	return out
+}
+
+func fmtID(r logs.Record) string {
+	if r.ID == "" {
+		return ""
+	}
+	return " id=" + r.ID
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// incidentTool raises and resolves the incidents of the conditions notified
+// by the digests, e.g. an error rate above the threshold, into a tool paging
+// the people on call.
+type incidentTool struct {
+	name string
+	// request returns the request triggering or resolving the incident
+	request func(e *digestEvent, dedupKey string) (*http.Request, error)
+}
+
+func jsonRequest(target string, body interface{}) (*http.Request, error) {
+	raw, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", target, bytes.NewReader(raw))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, err
+}
+
+// pagerDuty sends the events to the Events API v2 of PagerDuty, through the
+// routing key of an integration.
+func pagerDuty(endpoint, routingKey string) *incidentTool {
+	return &incidentTool{name: "pagerduty", request: func(e *digestEvent, dedupKey string) (*http.Request, error) {
+		body := map[string]interface{}{"routing_key": routingKey, "dedup_key": dedupKey, "event_action": "trigger"}
+		if e.Resolved {
+			body["event_action"] = "resolve"
+		} else {
+			body["payload"] = map[string]interface{}{
+				"summary": e.Message, "source": "nlogx", "severity": e.Severity, "component": e.Subject,
+				"class": e.Kind, "custom_details": map[string]string{"key": e.Key},
+			}
+		}
+		return jsonRequest(endpoint, body)
+	}}
+}
+
+// opsgeniePriorities are the priorities of Opsgenie per severity
+var opsgeniePriorities = map[string]string{"critical": "P1", "error": "P2", "warning": "P3", "info": "P5"}
+
+// opsgenie sends the events to the Alert API of Opsgenie, the alias of the
+// alert closing it later.
+func opsgenie(endpoint, apiKey string) *incidentTool {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	return &incidentTool{name: "opsgenie", request: func(e *digestEvent, dedupKey string) (*http.Request, error) {
+		var req *http.Request
+		var err error
+		if e.Resolved {
+			req, err = jsonRequest(endpoint+"/"+url.PathEscape(dedupKey)+"/close?identifierType=alias",
+				map[string]string{"source": "nlogx", "note": e.Message})
+		} else {
+			req, err = jsonRequest(endpoint, map[string]interface{}{
+				"message": e.Message, "alias": dedupKey, "source": "nlogx", "priority": opsgeniePriorities[e.Severity],
+				"entity": e.Subject, "tags": []string{"nlogx", e.Kind}, "details": map[string]string{"key": e.Key},
+			})
+		}
+		if err == nil {
+			req.Header.Set("Authorization", "GenieKey "+apiKey)
+		}
+		return req, err
+	}}
+}
+
+// send triggers or resolves the incident of the condition of the event, the
+// same condition always deduplicated into the same incident.
+func (it *incidentTool) send(e *digestEvent, prefix string) error {
+	req, err := it.request(e, prefix+":"+e.Kind+":"+e.Subject)
+	if err != nil {
+		return err
+	}
+	rep, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	rep.Body.Close()
+	if rep.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: status %d", it.name, rep.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// discoverLogs returns the logs of a directory whose names match, or the files
+// matching a glob, the oldest first.
+func discoverLogs(dirOrGlob, names string) ([]string, error) {
+	pattern := dirOrGlob
+	if st, err := os.Stat(dirOrGlob); err == nil && st.IsDir() {
+		pattern = filepath.Join(dirOrGlob, names)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]logs.LogFile, 0, len(paths))
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if st.IsDir() {
+			continue
+		}
+		files = append(files, logs.LogFile{Path: path, Mtime: st.ModTime().UnixNano()})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no log found", dirOrGlob)
+	}
+	return logs.SortLogs(files), nil
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// inspectedRecord is a record of the inspected client, or of another client
+// around it for the context.
+type inspectedRecord struct {
+	logs.Record
+	Context bool `json:"context,omitempty"`
+}
+
+// inspectedSession is a session of the inspected client, with the context of
+// its requests.
+type inspectedSession struct {
+	Start    int64             `json:"start"`
+	End      int64             `json:"end"`
+	Requests int               `json:"requests"`
+	Bytes    int64             `json:"bytes"`
+	Errors   int               `json:"errors"`
+	Records  []inspectedRecord `json:"records"`
+}
+
+// inspection is the activity of a client, as a time-ordered tree
+type inspection struct {
+	Src      string              `json:"src"`
+	Country  string              `json:"country,omitempty"`
+	ASN      uint                `json:"asn,omitempty"`
+	Requests int                 `json:"requests"`
+	Sessions []*inspectedSession `json:"sessions"`
+}
+
+// inspector follows the records of a client, with the ones of the other
+// clients just before and after each of its requests, as "grep -C" does.
+type inspector struct {
+	addr    string
+	context int
+	idle    int64
+
+	before []logs.Record
+	after  int
+	// owners are, for each record kept, the index of the request of the
+	// client it belongs or is the context to.
+	records []inspectedRecord
+	owners  []int
+	last    int
+}
+
+func (in *inspector) add(r logs.Record) {
+	if r.Ip != in.addr {
+		if in.after > 0 {
+			in.after--
+			in.records = append(in.records, inspectedRecord{Record: r, Context: true})
+			in.owners = append(in.owners, in.last)
+		} else if in.context > 0 {
+			if len(in.before) == in.context {
+				in.before = in.before[1:]
+			}
+			in.before = append(in.before, r)
+		}
+		return
+	}
+	in.last = len(in.records) + len(in.before)
+	for _, b := range in.before {
+		in.records = append(in.records, inspectedRecord{Record: b, Context: true})
+		in.owners = append(in.owners, in.last)
+	}
+	in.before = in.before[:0]
+	in.records = append(in.records, inspectedRecord{Record: r})
+	in.owners = append(in.owners, in.last)
+	in.after = in.context
+}
+
+// tree splits the requests of the client into sessions, each record of the
+// context going with the request it surrounds.
+func (in *inspector) tree() *inspection {
+	out := &inspection{Src: in.addr, Sessions: make([]*inspectedSession, 0)}
+	sessionOf := make(map[int]*inspectedSession)
+	var current *inspectedSession
+	for i, r := range in.records {
+		if r.Context {
+			continue
+		}
+		if current == nil || r.When-current.End > in.idle {
+			current = &inspectedSession{Start: r.When}
+			out.Sessions = append(out.Sessions, current)
+		}
+		if out.Requests == 0 {
+			out.Country, out.ASN = r.Country, r.ASN
+		}
+		out.Requests++
+		current.End = r.When
+		current.Requests++
+		current.Bytes += r.Bytes
+		if r.Code >= 400 {
+			current.Errors++
+		}
+		sessionOf[i] = current
+	}
+	for i, r := range in.records {
+		s := sessionOf[in.owners[i]]
+		s.Records = append(s.Records, r)
+	}
+	return out
+}
+
+func (s *inspectedSession) print(index int, last bool) {
+	branch, indent := "├─", "│  "
+	if last {
+		branch, indent = "└─", "   "
+	}
+	fmt.Printf("%s session %d, %s → %s (%s), %d requests, %s, %d errors\n", branch, index,
+		fmtTime(s.Start), fmtTime(s.End), time.Duration(s.End-s.Start)*time.Second,
+		s.Requests, fmtByteSize(float64(s.Bytes)), s.Errors)
+	// The last request of the client closes the branches, its context after
+	// it is only indented.
+	lastRequest := 0
+	for i, r := range s.Records {
+		if !r.Context {
+			lastRequest = i
+		}
+	}
+	for i, r := range s.Records {
+		if r.Context {
+			fmt.Printf("%s   · %s %-15s %3d %s %s\n", indent, fmtTime(r.When), r.Ip, r.Code, r.Method, r.Path)
+			continue
+		}
+		branch := "├─"
+		if i == lastRequest {
+			branch = "└─"
+		}
+		fmt.Printf("%s%s %s %3d %-6s %s %s%s\n", indent, branch, fmtTime(r.When), r.Code, r.Method, r.Path,
+			fmtByteSize(float64(r.Bytes)), fmtExtra(r.Record))
+	}
+}
+
+func mainInspect(args []string) {
+	var sf streamFlags
+	var idle time.Duration
+	var flagJson bool
+	var in inspector
+
+	fs := pflag.NewFlagSet("inspect", pflag.ExitOnError)
+	fs.DurationVar(&idle, "idle", 30*time.Minute, "Idle period closing a session")
+	fs.IntVar(&in.context, "context", 2, "Number of records of the other clients shown before and after each request")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the tree as a JSON object")
+	sf.register(fs, 0)
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		Logger.Fatal().Msg("Expected the address of the client")
+	}
+	in.addr = fs.Arg(0)
+	sf.files = fs.Args()[1:]
+	in.idle = int64(idle / time.Second)
+	// The client and its context are kept even if well known, in the order
+	// of the log.
+	sf.allSources = true
+	sf.ordered = true
+
+	for r := range sf.records() {
+		in.add(r)
+	}
+	tree := in.tree()
+	if tree.Requests == 0 {
+		Logger.Warn().Str("src", in.addr).Msg("No request from that client")
+		return
+	}
+
+	if flagJson {
+		json.NewEncoder(os.Stdout).Encode(tree)
+		return
+	}
+	fmt.Printf("%s", tree.Src)
+	if tree.Country != "" {
+		fmt.Printf(" %s", tree.Country)
+	}
+	if tree.ASN != 0 {
+		fmt.Printf(" AS%d", tree.ASN)
+	}
+	fmt.Printf(", %d requests in %d sessions\n", tree.Requests, len(tree.Sessions))
+	for i, s := range tree.Sessions {
+		s.print(i+1, i == len(tree.Sessions)-1)
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+type indicator struct {
+	id    string
+	kind  string // ip, url or domain
+	value string
+	cidr  *net.IPNet
+
+	count int
+	first int64
+	last  int64
+}
+
+// intelFeed matches the records against the indicators of a set of threat-intel
+// feeds and keeps track of the indicators sighted.
+type intelFeed struct {
+	ips     map[string][]*indicator
+	cidrs   []*indicator
+	paths   map[string][]*indicator
+	urls    map[string][]*indicator
+	domains map[string][]*indicator
+}
+
+var stixComparison = regexp.MustCompile(`(ipv4-addr|ipv6-addr|url|domain-name):value\s*(=|ISSUBSET)\s*'((?:[^'\\]|\\.)*)'`)
+
+var errUnknownFeed = errors.New("Unknown feed format")
+
+func newIntelFeed() *intelFeed {
+	return &intelFeed{
+		ips:     make(map[string][]*indicator),
+		paths:   make(map[string][]*indicator),
+		urls:    make(map[string][]*indicator),
+		domains: make(map[string][]*indicator),
+	}
+}
+
+// load reads a STIX 2.x bundle, a MISP event or a CSV file of indicators.
+// The CSV lines are either "value" or "type,value[,id]".
+func (f *intelFeed) load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		return f.loadJSON(raw)
+	}
+	return f.loadCSV(bytes.NewReader(raw))
+}
+
+func (f *intelFeed) loadJSON(raw []byte) error {
+	var doc struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			Type    string `json:"type"`
+			Id      string `json:"id"`
+			Pattern string `json:"pattern"`
+		} `json:"objects"`
+		Event *mispFeedEvent `json:"Event"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	switch {
+	case doc.Type == "bundle":
+		for _, o := range doc.Objects {
+			if o.Type != "indicator" {
+				continue
+			}
+			for _, m := range stixComparison.FindAllStringSubmatch(o.Pattern, -1) {
+				value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[3])
+				switch m[1] {
+				case "ipv4-addr", "ipv6-addr":
+					f.add(o.Id, "ip", value)
+				case "url":
+					f.add(o.Id, "url", value)
+				case "domain-name":
+					f.add(o.Id, "domain", value)
+				}
+			}
+		}
+	case doc.Event != nil:
+		attributes := doc.Event.Attribute
+		for _, o := range doc.Event.Object {
+			attributes = append(attributes, o.Attribute...)
+		}
+		for _, a := range attributes {
+			switch a.Type {
+			case "ip-src", "ip-dst":
+				f.add(a.Uuid, "ip", a.Value)
+			case "ip-src|port", "ip-dst|port":
+				f.add(a.Uuid, "ip", strings.SplitN(a.Value, "|", 2)[0])
+			case "url", "uri":
+				f.add(a.Uuid, "url", a.Value)
+			case "domain", "hostname":
+				f.add(a.Uuid, "domain", a.Value)
+			}
+		}
+	default:
+		return errUnknownFeed
+	}
+	return nil
+}
+
+type mispFeedAttribute struct {
+	Uuid  string `json:"uuid"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type mispFeedEvent struct {
+	Attribute []mispFeedAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispFeedAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+func (f *intelFeed) loadCSV(in io.Reader) error {
+	r := csv.NewReader(in)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch len(fields) {
+		case 0:
+		case 1:
+			f.add(fields[0], guessIndicatorKind(fields[0]), fields[0])
+		case 2:
+			f.add(fields[1], fields[0], fields[1])
+		default:
+			f.add(fields[2], fields[0], fields[1])
+		}
+	}
+}
+
+func guessIndicatorKind(value string) string {
+	if net.ParseIP(value) != nil {
+		return "ip"
+	}
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return "ip"
+	}
+	if strings.HasPrefix(value, "/") || strings.Contains(value, "://") {
+		return "url"
+	}
+	return "domain"
+}
+
+func (f *intelFeed) add(id, kind, value string) {
+	if value == "" {
+		return
+	}
+	if id == "" {
+		id = value
+	}
+	ind := &indicator{id: id, kind: kind, value: value}
+	switch kind {
+	case "ip", "ip-src", "ip-dst":
+		ind.kind = "ip"
+		if strings.Contains(value, "/") {
+			if _, cidr, err := net.ParseCIDR(value); err == nil {
+				ind.cidr = cidr
+				f.cidrs = append(f.cidrs, ind)
+			}
+		} else {
+			f.ips[value] = append(f.ips[value], ind)
+		}
+	case "url", "uri":
+		ind.kind = "url"
+		f.urls[value] = append(f.urls[value], ind)
+		if u, err := url.Parse(value); err == nil && u.Path != "" {
+			p := u.Path
+			if u.RawQuery != "" {
+				p += "?" + u.RawQuery
+			}
+			f.paths[p] = append(f.paths[p], ind)
+		}
+	case "domain", "hostname":
+		ind.kind = "domain"
+		f.domains[strings.ToLower(value)] = append(f.domains[strings.ToLower(value)], ind)
+	}
+}
+
+// match returns the indicators the record matches by its source address, its
+// path or its referrer, each once, e.g. an URL matching both the path and the
+// referrer.
+func (f *intelFeed) match(r logs.Record) []*indicator {
+	var out []*indicator
+	add := func(l ...*indicator) {
+		for _, ind := range l {
+			found := false
+			for _, other := range out {
+				found = found || other == ind
+			}
+			if !found {
+				out = append(out, ind)
+			}
+		}
+	}
+	add(f.ips[r.Ip]...)
+	if len(f.cidrs) > 0 {
+		if ip := net.ParseIP(r.Ip); ip != nil {
+			for _, ind := range f.cidrs {
+				if ind.cidr.Contains(ip) {
+					add(ind)
+				}
+			}
+		}
+	}
+	add(f.paths[r.Path]...)
+	add(f.urls[r.Referrer]...)
+	if len(f.domains) > 0 && r.Referrer != "-" {
+		if u, err := url.Parse(r.Referrer); err == nil && u.Hostname() != "" {
+			add(f.domains[strings.ToLower(u.Hostname())]...)
+		}
+	}
+	return out
+}
+
+// hasIndicator tells if the record is already tagged with that indicator
+func hasIndicator(r *logs.Record, id string) bool {
+	for _, other := range r.Indicators {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// tag annotates the records with the identifiers of the indicators they match
+func (f *intelFeed) tag(in <-chan logs.Record) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		for r := range in {
+			for _, ind := range f.match(r) {
+				// The same identifier, e.g. of an address and its network
+				if hasIndicator(&r, ind.id) {
+					continue
+				}
+				if ind.count == 0 || r.When < ind.first {
+					ind.first = r.When
+				}
+				if r.When > ind.last {
+					ind.last = r.When
+				}
+				ind.count++
+				r.Indicators = append(r.Indicators, ind.id)
+			}
+			out <- r
+		}
+	}()
+	return out
+}
+
+// sighted returns the indicators matched at least once, in the order of their
+// first sighting. It must only be called once the tagged stream is drained.
+func (f *intelFeed) sighted() []*indicator {
+	seen := make(map[*indicator]bool)
+	out := make([]*indicator, 0)
+	collect := func(l []*indicator) {
+		for _, ind := range l {
+			if ind.count > 0 && !seen[ind] {
+				seen[ind] = true
+				out = append(out, ind)
+			}
+		}
+	}
+	for _, l := range f.ips {
+		collect(l)
+	}
+	collect(f.cidrs)
+	for _, l := range f.urls {
+		collect(l)
+	}
+	for _, l := range f.domains {
+		collect(l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].first != out[j].first {
+			return out[i].first < out[j].first
+		}
+		return out[i].id < out[j].id
+	})
+	return out
+}
+
+// report logs the sighted indicators and, if a path is given, dumps them as
+// JSON lines into that file.
+func (f *intelFeed) report(path string) {
+	all := f.sighted()
+	for _, ind := range all {
+		Logger.Info().Str("id", ind.id).Str("kind", ind.kind).Str("value", ind.value).
+			Int("count", ind.count).Str("first", fmtTime(ind.first)).Str("last", fmtTime(ind.last)).
+			Msg("Indicator sighted")
+	}
+	if path == "" {
+		return
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		Logger.Fatal().Str("path", path).Err(err).Msg("Failed to create the sightings report")
+	}
+	defer out.Close()
+	encoder := json.NewEncoder(out)
+	for _, ind := range all {
+		encoder.Encode(map[string]interface{}{
+			"id":    ind.id,
+			"kind":  ind.kind,
+			"value": ind.value,
+			"count": ind.count,
+			"first": ind.first,
+			"last":  ind.last,
+		})
+	}
+}
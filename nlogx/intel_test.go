@@ -0,0 +1,36 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+func TestTagCountsEachIndicatorOnce(t *testing.T) {
+	f := newIntelFeed()
+	f.add("campaign", "ip", "192.0.2.66")
+	f.add("campaign", "ip", "192.0.2.0/24")
+	f.add("", "url", "http://evil.example/x")
+
+	in := make(chan logs.Record, 1)
+	// The URL matches both the path and the referrer
+	in <- logs.Record{Ip: "192.0.2.66", Path: "/x", Referrer: "http://evil.example/x"}
+	close(in)
+	var tagged []logs.Record
+	for r := range f.tag(in) {
+		tagged = append(tagged, r)
+	}
+	if got := tagged[0].Indicators; len(got) != 2 || got[0] != "campaign" || got[1] != "http://evil.example/x" {
+		t.Fatalf("Expected each indicator once, got %v", got)
+	}
+	for _, ind := range f.sighted() {
+		if ind.id == "http://evil.example/x" && ind.count != 1 {
+			t.Errorf("Expected the URL sighted once, got %d", ind.count)
+		}
+	}
+}
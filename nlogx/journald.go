@@ -0,0 +1,91 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// journalEntry is an entry of "journalctl --output json", whose message is a
+// string, or an array of bytes if it is not valid UTF-8.
+type journalEntry struct {
+	Message interface{} `json:"MESSAGE"`
+}
+
+func (e *journalEntry) message() string {
+	switch m := e.Message.(type) {
+	case string:
+		return m
+	case []interface{}:
+		b := make([]byte, 0, len(m))
+		for _, x := range m {
+			if f, ok := x.(float64); ok {
+				b = append(b, byte(f))
+			}
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// readJournal returns the messages logged by the units into systemd-journald,
+// a line each, through journalctl. since is an epoch, or 0 for the whole
+// journal.
+func readJournal(units []string, since int64, follow bool) (io.Reader, error) {
+	args := []string{"--output", "json", "--no-pager", "--quiet"}
+	for _, u := range units {
+		args = append(args, "--unit", u)
+	}
+	if since > 0 {
+		args = append(args, "--since", fmt.Sprintf("@%d", since))
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+	cmd := exec.Command("journalctl", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		in := bufio.NewReaderSize(stdout, 64*1024)
+		for {
+			line, err := in.ReadBytes('\n')
+			if len(line) > 0 {
+				var e journalEntry
+				if json.Unmarshal(line, &e) == nil {
+					if m := strings.TrimRight(e.message(), "\r\n"); m != "" {
+						if _, err := io.WriteString(pw, m+"\n"); err != nil {
+							cmd.Process.Kill()
+							break
+						}
+					}
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err := cmd.Wait(); err != nil {
+			pw.CloseWithError(fmt.Errorf("journalctl: %v", err))
+			return
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
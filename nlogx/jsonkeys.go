@@ -0,0 +1,97 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// jsonMapper renames the keys of the JSON records
+type jsonMapper struct {
+	keys map[string]logs.JsonKey
+}
+
+// newJSONMapper starts from a preset and applies a list of "field=key"
+// overrides. The derived fields can also be renamed.
+func newJSONMapper(preset string, overrides []string) (*jsonMapper, error) {
+	base, ok := logs.JsonPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("Unknown JSON preset %q", preset)
+	}
+	m := &jsonMapper{keys: make(map[string]logs.JsonKey, len(base))}
+	for k, v := range base {
+		m.keys[k] = v
+	}
+	for _, o := range overrides {
+		tokens := strings.SplitN(o, "=", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, fmt.Errorf("Invalid JSON key mapping %q", o)
+		}
+		field := tokens[0]
+		if alias, ok := logs.FieldAliases[field]; ok {
+			field = alias
+		}
+		k := m.keys[field]
+		k.Key = tokens[1]
+		m.keys[field] = k
+	}
+	return m, nil
+}
+
+func setNested(obj map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := obj[p].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			obj[p] = sub
+		}
+		obj = sub
+	}
+	obj[parts[len(parts)-1]] = value
+}
+
+// object builds the JSON object of the record. As in the default output, the
+// empty optional fields are omitted.
+func (m *jsonMapper) object(r *logs.Record) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for _, name := range fieldNames() {
+		k := m.keys[name]
+		var v interface{}
+		if k.Conv != nil {
+			v = k.Conv(r)
+		} else {
+			v, _ = r.Field(name)
+		}
+		switch name {
+		case "id", "user", "country", "asn":
+			if !truthy(v) {
+				continue
+			}
+		}
+		setNested(obj, k.Key, v)
+	}
+	if len(r.Indicators) > 0 {
+		setNested(obj, m.keys["indicators"].Key, r.Indicators)
+	}
+	extras := make([]string, 0, len(r.Extra))
+	for name := range r.Extra {
+		extras = append(extras, name)
+	}
+	sort.Strings(extras)
+	for _, name := range extras {
+		if k, ok := m.keys[name]; ok {
+			setNested(obj, k.Key, r.Extra[name])
+		} else {
+			setNested(obj, m.keys["extra"].Key+"."+name, r.Extra[name])
+		}
+	}
+	return obj
+}
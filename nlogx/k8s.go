@@ -0,0 +1,282 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ingressSelector selects the controllers of the ingress-nginx chart
+	ingressSelector = "app.kubernetes.io/name=ingress-nginx,app.kubernetes.io/component=controller"
+	serviceAccount  = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kubeClient talks to the API server of the cluster nlogx runs in, or else of
+// the current context of the kubeconfig.
+type kubeClient struct {
+	http   *http.Client
+	server string
+	token  string
+}
+
+// kubeConfig is the subset of a kubeconfig needed to reach the API server,
+// without the authentication plugins.
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server   string `yaml:"server"`
+			CA       string `yaml:"certificate-authority"`
+			CAData   string `yaml:"certificate-authority-data"`
+			Insecure bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token     string      `yaml:"token"`
+			TokenFile string      `yaml:"tokenFile"`
+			Cert      string      `yaml:"client-certificate"`
+			CertData  string      `yaml:"client-certificate-data"`
+			Key       string      `yaml:"client-key"`
+			KeyData   string      `yaml:"client-key-data"`
+			Exec      interface{} `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// pemOf returns the PEM of a kubeconfig, inline in base64 or else in a file
+func pemOf(data, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func newKubeClient() (*kubeClient, error) {
+	tlsConfig := &tls.Config{}
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		token, err := ioutil.ReadFile(filepath.Join(serviceAccount, "token"))
+		if err != nil {
+			return nil, err
+		}
+		ca, err := ioutil.ReadFile(filepath.Join(serviceAccount, "ca.crt"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		return &kubeClient{
+			http:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			server: "https://" + net.JoinHostPort(host, os.Getenv("KUBERNETES_SERVICE_PORT")),
+			token:  strings.TrimSpace(string(token)),
+		}, nil
+	}
+
+	path := filepath.SplitList(os.Getenv("KUBECONFIG"))
+	if len(path) == 0 || path[0] == "" {
+		home, _ := os.UserHomeDir()
+		path = []string{filepath.Join(home, ".kube", "config")}
+	}
+	raw, err := ioutil.ReadFile(path[0])
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeConfig
+	if err = yaml.Unmarshal(raw, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path[0], err)
+	}
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	client := &kubeClient{}
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.Insecure
+		ca, err := pemOf(c.Cluster.CAData, c.Cluster.CA)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("%s: no cluster for the context %q", path[0], kc.CurrentContext)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil {
+			return nil, fmt.Errorf("%s: the authentication plugins are not supported, use a token", path[0])
+		}
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(u.User.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+			client.token = strings.TrimSpace(string(token))
+		}
+		cert, err := pemOf(u.User.CertData, u.User.Cert)
+		if err != nil {
+			return nil, err
+		}
+		key, err := pemOf(u.User.KeyData, u.User.Key)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	client.http = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return client, nil
+}
+
+func (k *kubeClient) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", k.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	rep, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode != http.StatusOK {
+		defer rep.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(rep.Body).Decode(&status)
+		return nil, fmt.Errorf("kubernetes: %s: %d %s", path, rep.StatusCode, status.Message)
+	}
+	return rep, nil
+}
+
+// pods returns the names of the running pods of the namespace matching the
+// label selector.
+func (k *kubeClient) pods(namespace, selector string) ([]string, error) {
+	rep, err := k.get("/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods", url.Values{"labelSelector": {selector}})
+	if err != nil {
+		return nil, err
+	}
+	defer rep.Body.Close()
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err = json.NewDecoder(rep.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(list.Items))
+	for _, p := range list.Items {
+		if p.Status.Phase == "Running" {
+			out = append(out, p.Metadata.Name)
+		}
+	}
+	return out, nil
+}
+
+// readKubernetes returns the lines logged by the container of the pods
+// matching the selector, the replicas of ingress-nginx by default, merged.
+// since is an epoch, or 0 for all the logs kept by the kubelet.
+func readKubernetes(namespace, selector, container string, since int64, follow bool) (io.Reader, error) {
+	k, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := k.pods(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, errors.New("No running pod matches the selector")
+	}
+	query := url.Values{"container": {container}, "follow": {strconv.FormatBool(follow)}}
+	if since > 0 {
+		query.Set("sinceTime", time.Unix(since, 0).UTC().Format(time.RFC3339))
+	}
+
+	pr, pw := io.Pipe()
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod string) {
+			defer wg.Done()
+			rep, err := k.get("/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(pod)+"/log", query)
+			if err != nil {
+				Logger.Warn().Str("pod", pod).Err(err).Msg("Failed to read the logs of the pod")
+				return
+			}
+			defer rep.Body.Close()
+			w := &lineWriter{out: pw}
+			_, err = io.Copy(w, rep.Body)
+			if len(w.partial) > 0 {
+				w.Write([]byte("\n"))
+			}
+			if err != nil {
+				Logger.Warn().Str("pod", pod).Err(err).Msg("Failed to read the logs of the pod")
+			}
+		}(pod)
+	}
+	go func() {
+		wg.Wait()
+		pw.Close()
+	}()
+	return pr, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// kafkaCommand returns the path of kcat, formerly named kafkacat
+func kafkaCommand() (string, error) {
+	for _, name := range []string{"kcat", "kafkacat"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("no kcat command to consume the topic")
+}
+
+// readKafka returns the messages of the topic, a line each, consumed by kcat
+// as a member of the group, whose offsets are committed by the brokers as the
+// messages are read. Unless followed, it stops at the end of the partitions.
+// The options are the properties of librdkafka, like security.protocol=SSL.
+func readKafka(brokers, topic, group string, options []string, follow bool) (io.Reader, error) {
+	path, err := kafkaCommand()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-q", "-b", brokers, "-G", group, "-f", "%s\n"}
+	for _, o := range options {
+		args = append(args, "-X", o)
+	}
+	if !follow {
+		args = append(args, "-e")
+	}
+	cmd := exec.Command(path, append(args, topic)...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, stdout)
+		if werr := cmd.Wait(); werr != nil && err == nil {
+			err = fmt.Errorf("kcat: %v", werr)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
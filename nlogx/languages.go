@@ -0,0 +1,282 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// acceptedLanguage is a language of an Accept-Language header, with its weight
+type acceptedLanguage struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the languages accepted, the preferred first, the
+// invalid tags and those refused (q=0) being dropped. E.g. "fr-CH, fr;q=0.9,
+// en;q=0.8, *;q=0.5"
+func parseAcceptLanguage(header string) []acceptedLanguage {
+	langs := make([]acceptedLanguage, 0, 4)
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		tag := strings.ToLower(strings.TrimSpace(parts[0]))
+		if !validLanguageTag(tag) {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, acceptedLanguage{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	return langs
+}
+
+// validLanguageTag accepts the BCP 47 tags in their usual shape, and *
+func validLanguageTag(tag string) bool {
+	if tag == "*" {
+		return true
+	}
+	if tag == "" || len(tag) > 35 || tag[0] == '-' || tag[len(tag)-1] == '-' {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// languageOf returns the language of a tag, with its region or without, the
+// region in capitals as usual, e.g. fr-CH or fr
+func languageOf(tag string, regions bool) string {
+	parts := strings.Split(tag, "-")
+	if !regions || len(parts) < 2 {
+		return parts[0]
+	}
+	if len(parts[1]) == 2 {
+		return parts[0] + "-" + strings.ToUpper(parts[1])
+	}
+	return parts[0] + "-" + parts[1]
+}
+
+// sectionOf returns the section of the site of a path, its first segments
+func sectionOf(p string, depth int) string {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) > depth {
+		segments = segments[:depth]
+	}
+	if segments[0] == "" {
+		return "/"
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// audience counts the visitors of a country or a section per preferred
+// language, and those accepting none of the languages offered.
+type audience struct {
+	By        string         `json:"by"`
+	Name      string         `json:"name"`
+	Visitors  int            `json:"visitors"`
+	Languages map[string]int `json:"languages"`
+	Unserved  int            `json:"unserved,omitempty"`
+}
+
+func (a *audience) top(n int) []string {
+	langs := make([]string, 0, len(a.Languages))
+	for lang := range a.Languages {
+		langs = append(langs, lang)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if a.Languages[langs[i]] != a.Languages[langs[j]] {
+			return a.Languages[langs[i]] > a.Languages[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+	if n > 0 && len(langs) > n {
+		langs = langs[:n]
+	}
+	return langs
+}
+
+// visitorLanguages is what a visitor, an address and a User-Agent, accepts
+type visitorLanguages struct {
+	preferred string
+	served    bool
+	country   string
+	sections  map[string]bool
+}
+
+func mainLanguages(args []string) {
+	var sf streamFlags
+	var offered []string
+	var regions bool
+	var depth, nbLanguages int
+	var rf reportFlags
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("languages", pflag.ExitOnError)
+	fs.StringSliceVar(&offered, "offered", nil, "Languages the site is offered in, to count the visitors unserved (like en,fr)")
+	fs.BoolVar(&regions, "regions", false, "Tell the regional variants apart, like fr-CH and fr-FR")
+	fs.IntVar(&depth, "section-depth", 1, "Number of segments of the paths that make a section of the site")
+	rf.register(fs, "countries and sections", 10, audience{})
+	fs.IntVar(&nbLanguages, "languages", 3, "Max number of languages reported per country and per section")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the audiences as JSON objects")
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+	rf.check()
+
+	if depth < 1 {
+		Logger.Fatal().Int("depth", depth).Msg("Invalid section depth")
+	}
+	if sf.geoPath == "" {
+		Logger.Warn().Msg("Without --geoip, the languages are not broken down by country")
+	}
+	offers := make(map[string]bool)
+	for _, lang := range offered {
+		offers[strings.ToLower(strings.TrimSpace(lang))] = true
+	}
+	// The crawlers send no language or an arbitrary one
+	sf.channel = true
+
+	visitors := make(map[string]*visitorLanguages)
+	logged := false
+	for r := range sf.records() {
+		header, ok := r.Extra["http_accept_language"]
+		if !ok || logs.ToString(r.Extra["channel"]) == channelBot {
+			continue
+		}
+		logged = true
+		key := r.Ip + " " + r.Agent
+		v, ok := visitors[key]
+		if !ok {
+			v = &visitorLanguages{sections: make(map[string]bool)}
+			visitors[key] = v
+		}
+		// The latest header prevails, the visitor possibly changing it
+		if langs := parseAcceptLanguage(logs.ToString(header)); len(langs) > 0 {
+			v.preferred, v.served = "", len(offers) == 0
+			for _, l := range langs {
+				if v.preferred == "" && l.tag != "*" {
+					v.preferred = languageOf(l.tag, regions)
+				}
+				if l.tag == "*" || offers[l.tag] || offers[languageOf(l.tag, false)] {
+					v.served = true
+				}
+			}
+		}
+		if r.Country != "" {
+			v.country = r.Country
+		}
+		v.sections[sectionOf(r.Path, depth)] = true
+	}
+	if !logged {
+		Logger.Fatal().Msg("Log $http_accept_language for the languages of the visitors")
+	}
+
+	total := &audience{By: "total", Name: "*", Languages: make(map[string]int)}
+	groups := map[string]map[string]*audience{"country": {}, "section": {}}
+	count := func(by, name string, v *visitorLanguages) {
+		a, ok := groups[by][name]
+		if !ok {
+			a = &audience{By: by, Name: name, Languages: make(map[string]int)}
+			groups[by][name] = a
+		}
+		a.Visitors++
+		a.Languages[v.preferred]++
+		if !v.served {
+			a.Unserved++
+		}
+	}
+	for _, v := range visitors {
+		if v.preferred == "" {
+			v.preferred = "?"
+		}
+		total.Visitors++
+		total.Languages[v.preferred]++
+		if !v.served {
+			total.Unserved++
+		}
+		if v.country != "" {
+			count("country", v.country, v)
+		}
+		for section := range v.sections {
+			count("section", section, v)
+		}
+	}
+
+	// The largest audiences first
+	report := make(map[string][]*audience)
+	for by, audiences := range groups {
+		for _, a := range audiences {
+			report[by] = append(report[by], a)
+		}
+		sort.Slice(report[by], func(i, j int) bool {
+			x, y := report[by][i], report[by][j]
+			if x.Visitors != y.Visitors {
+				return x.Visitors > y.Visitors
+			}
+			return x.Name < y.Name
+		})
+		rows := report[by]
+		rf.apply(&rows)
+		report[by] = rows
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, by := range []string{"country", "section"} {
+			for _, a := range report[by] {
+				encoder.Encode(a)
+			}
+		}
+		encoder.Encode(total)
+		return
+	}
+	line := func(a *audience) {
+		shares := make([]string, 0, nbLanguages)
+		for _, lang := range a.top(nbLanguages) {
+			shares = append(shares, fmt.Sprintf("%s %.1f%%", lang, 100*float64(a.Languages[lang])/float64(a.Visitors)))
+		}
+		unserved := "-"
+		if len(offers) > 0 {
+			unserved = fmt.Sprintf("%.1f%%", 100*float64(a.Unserved)/float64(a.Visitors))
+		}
+		fmt.Printf("%-30s %9d %9s  %s\n", a.Name, a.Visitors, unserved, strings.Join(shares, ", "))
+	}
+	for _, by := range []string{"country", "section"} {
+		if len(report[by]) == 0 {
+			continue
+		}
+		fmt.Printf("%-30s %9s %9s  %s\n", strings.ToUpper(by), "VISITORS", "UNSERVED", "LANGUAGES")
+		for _, a := range report[by] {
+			line(a)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%-30s %9s %9s  %s\n", "TOTAL", "VISITORS", "UNSERVED", "LANGUAGES")
+	line(total)
+}
@@ -0,0 +1,313 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	// rfc5424Header matches the envelope of RFC 5424:
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA
+	rfc5424Header = regexp.MustCompile(`^<\d{1,3}>1 \S+ \S+ \S+ \S+ \S+ (?:-|(?:\[(?:[^\]\\]|\\.)*\])+)(?: |$)`)
+	// rfc3164Header matches the envelope of RFC 3164, as sent by the syslog:
+	// directive of nginx: <PRI>Mmm dd hh:mm:ss HOSTNAME TAG:
+	// The hostname is omitted with nohostname, and the tag is required to tell
+	// it from the payload.
+	rfc3164Header = regexp.MustCompile(`^<\d{1,3}>(?:[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d )?(?:(?:\S+ )?[^\s:\[]+(?:\[\d+\])?: )?`)
+)
+
+// stripSyslog returns the payload of a syslog frame, the frame itself if it
+// has no envelope.
+func stripSyslog(frame string) string {
+	if loc := rfc5424Header.FindStringIndex(frame); loc != nil {
+		return strings.TrimPrefix(frame[loc[1]:], "\ufeff")
+	}
+	if loc := rfc3164Header.FindStringIndex(frame); loc != nil {
+		return frame[loc[1]:]
+	}
+	return frame
+}
+
+// writeFrame writes the payload of each line of the frame, a line at a time
+// so that the lines of the concurrent clients do not mix.
+func writeFrame(frame string, out io.Writer) error {
+	for _, line := range strings.Split(strings.TrimRight(frame, "\r\n"), "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line == "" {
+			continue
+		}
+		if _, err := io.WriteString(out, stripSyslog(line)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveSyslogUDP(addr string, out io.Writer) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	Logger.Info().Str("addr", conn.LocalAddr().String()).Msg("Listening for syslog over UDP")
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if err = writeFrame(string(buf[:n]), out); err != nil {
+			return err
+		}
+	}
+}
+
+func serveSyslogTCP(addr string, out io.Writer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	Logger.Info().Str("addr", l.Addr().String()).Msg("Listening for syslog over TCP")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := readSyslogStream(bufio.NewReader(conn), out); err != nil && err != io.EOF {
+				Logger.Warn().Str("peer", conn.RemoteAddr().String()).Err(err).Msg("Syslog connection failed")
+			}
+		}()
+	}
+}
+
+// readSyslogStream splits a TCP stream into frames, by octet counting or by
+// the end of line (RFC 6587), whichever each frame starts with.
+func readSyslogStream(in *bufio.Reader, out io.Writer) error {
+	for {
+		first, err := in.Peek(1)
+		if err != nil {
+			return err
+		}
+		var frame string
+		if first[0] >= '0' && first[0] <= '9' {
+			length, err := in.ReadString(' ')
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+			if err != nil || n > 1<<20 {
+				return fmt.Errorf("Invalid frame length %q", length)
+			}
+			buf := make([]byte, n)
+			if _, err = io.ReadFull(in, buf); err != nil {
+				return err
+			}
+			frame = string(buf)
+		} else if frame, err = in.ReadString('\n'); err != nil && frame == "" {
+			return err
+		}
+		if err := writeFrame(frame, out); err != nil {
+			return err
+		}
+	}
+}
+
+// ingestMessageKeys are the keys of the raw line in the objects shipped by the
+// HTTP sinks of vector, fluent-bit and the like.
+var ingestMessageKeys = []string{"message", "log", "msg"}
+
+// ingestObject returns the line of a shipped object, its raw line if any, or
+// else the object itself, e.g. a JSON record.
+func ingestObject(raw json.RawMessage) string {
+	var obj map[string]interface{}
+	if json.Unmarshal(raw, &obj) == nil {
+		for _, k := range ingestMessageKeys {
+			if line, ok := obj[k].(string); ok {
+				return line
+			}
+		}
+	}
+	return string(raw)
+}
+
+// ingestBatch returns the lines of a batch POSTed as text/plain (a line each),
+// as NDJSON or as a JSON array of objects.
+func ingestBatch(contentType string, body io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	add := func(line string) {
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		var batch []json.RawMessage
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			return nil, err
+		}
+		for _, raw := range batch {
+			add(ingestObject(raw))
+		}
+	case "application/x-ndjson", "application/jsonlines", "application/json-lines":
+		in := bufio.NewScanner(body)
+		in.Buffer(make([]byte, 64*1024), 1<<20)
+		for in.Scan() {
+			if line := strings.TrimSpace(in.Text()); line != "" {
+				add(ingestObject(json.RawMessage(line)))
+			}
+		}
+		if err := in.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			add(line)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// serveIngestHTTP receives the batches of lines POSTed to any path, a batch
+// being written at once so that the batches of the concurrent clients do not
+// mix.
+func serveIngestHTTP(addr string, out io.Writer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	Logger.Info().Str("addr", l.Addr().String()).Msg("Listening for batches over HTTP")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POST the lines", http.StatusMethodNotAllowed)
+			return
+		}
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		batch, err := ingestBatch(req.Header.Get("Content-Type"), http.MaxBytesReader(w, ioutil.NopCloser(body), 64<<20))
+		if err != nil {
+			Logger.Warn().Str("peer", req.RemoteAddr).Err(err).Msg("Invalid batch")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err = out.Write(batch); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.Serve(l, handler)
+}
+
+func mainListen(args []string) {
+	var sf streamFlags
+	var syslogURL, httpAddr, gelfURL string
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("listen", pflag.ExitOnError)
+	fs.StringVar(&syslogURL, "syslog", "udp://0.0.0.0:5514", "Address to receive the syslog frames on, udp://HOST:PORT or tcp://HOST:PORT")
+	fs.StringVar(&httpAddr, "http", "", "Address to receive the batches POSTed over HTTP on (like 0.0.0.0:8080), instead of syslog")
+	fs.StringVar(&gelfURL, "gelf", "", "Address to receive the GELF messages on (like udp://0.0.0.0:12201 or tcp://...), instead of syslog")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump JSON records at the output")
+	sf.register(fs, 0)
+	sf.parse(fs, args)
+
+	// The format sent by nginx is known, no need to wait for a sample
+	if !fs.Changed("log-format") {
+		sf.logFormat = "combined"
+	}
+	pr, pw := io.Pipe()
+	sf.input = pr
+	if httpAddr != "" {
+		go func() {
+			err := serveIngestHTTP(httpAddr, pw)
+			Logger.Fatal().Err(err).Msg("HTTP receiver failed")
+		}()
+	}
+	if gelfURL != "" {
+		u, err := url.Parse(gelfURL)
+		if err != nil || u.Host == "" {
+			Logger.Fatal().Str("url", gelfURL).Msg("Invalid GELF address")
+		}
+		var serve func(addr string, out io.Writer) error
+		switch u.Scheme {
+		case "udp":
+			// The chunks expire with the time of the pipeline
+			serve = func(addr string, out io.Writer) error { return serveGELFUDP(addr, out, sf.getClock()) }
+		case "tcp":
+			serve = serveGELFTCP
+		default:
+			Logger.Fatal().Str("scheme", u.Scheme).Msg("Invalid GELF transport, expected udp or tcp")
+		}
+		go func() {
+			err := serve(u.Host, pw)
+			Logger.Fatal().Err(err).Msg("GELF receiver failed")
+		}()
+	}
+	// Also when asked explicitly
+	if httpAddr == "" && gelfURL == "" || fs.Changed("syslog") {
+		u, err := url.Parse(syslogURL)
+		if err != nil || u.Host == "" {
+			Logger.Fatal().Str("url", syslogURL).Msg("Invalid syslog address")
+		}
+		var serve func(addr string, out io.Writer) error
+		switch u.Scheme {
+		case "udp":
+			serve = serveSyslogUDP
+		case "tcp":
+			serve = serveSyslogTCP
+		default:
+			Logger.Fatal().Str("scheme", u.Scheme).Msg("Invalid syslog transport, expected udp or tcp")
+		}
+		go func() {
+			err := serve(u.Host, pw)
+			Logger.Fatal().Err(err).Msg("Syslog receiver failed")
+		}()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	sf.emits = true
+	for r := range sf.records() {
+		if flagJson {
+			encoder.Encode(&r)
+		} else {
+			fmt.Printf("%s %-15s %d %s %s %q%s\n", fmtTime(r.When), r.Ip, r.Code, r.Path, r.Referrer, r.Agent, fmtIndicators(r)+fmtExtra(r)+fmtID(r))
+		}
+	}
+}
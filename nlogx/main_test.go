@@ -0,0 +1,97 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+var now = time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+// accessLog returns a line of the access log per age, the path telling it
+func accessLog(ages ...time.Duration) string {
+	var sb strings.Builder
+	for _, age := range ages {
+		when := now.Add(-age).Format("02/Jan/2006:15:04:05 -0700")
+		sb.WriteString(`192.0.2.1 - - [` + when + `] "GET /` + age.String() + ` HTTP/1.1" 200 12 "-" "curl/7.68.0"` + "\n")
+	}
+	return sb.String()
+}
+
+// windowPaths returns the paths of the records kept by the flags, at the time
+// of the clock.
+func windowPaths(t *testing.T, clock logs.Clock, input string, args ...string) []string {
+	var sf streamFlags
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	sf.register(fs, 0)
+	sf.parse(fs, append([]string{"-S"}, args...))
+	sf.clock = clock
+	sf.input = strings.NewReader(input)
+	var out []string
+	for r := range sf.records() {
+		out = append(out, r.Path)
+	}
+	return out
+}
+
+func TestTimeWindows(t *testing.T) {
+	input := accessLog(47*time.Hour, 25*time.Hour, 3*time.Hour, 30*time.Minute, 0)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "/47h0m0s /25h0m0s /3h0m0s /30m0s /0s"},
+		{[]string{"-d", "1"}, "/3h0m0s /30m0s /0s"},
+		{[]string{"-d", "2"}, "/47h0m0s /25h0m0s /3h0m0s /30m0s /0s"},
+		{[]string{"-p", "1h"}, "/30m0s /0s"},
+		{[]string{"-d", "1", "-p", "2h"}, "/25h0m0s /3h0m0s /30m0s /0s"},
+	} {
+		got := strings.Join(windowPaths(t, logs.NewFakeClock(now), input, tc.args...), " ")
+		if got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestTimeWindowFollowsTheClock(t *testing.T) {
+	input := accessLog(3*time.Hour, 30*time.Minute, 0)
+	clock := logs.NewFakeClock(now)
+	if got := strings.Join(windowPaths(t, clock, input, "-p", "1h"), " "); got != "/30m0s /0s" {
+		t.Fatalf("Expected the last hour, got %q", got)
+	}
+	clock.Advance(45 * time.Minute)
+	if got := strings.Join(windowPaths(t, clock, input, "-p", "1h"), " "); got != "/0s" {
+		t.Fatalf("Expected the last record, got %q", got)
+	}
+}
+
+func TestSleepOnTheClock(t *testing.T) {
+	clock := logs.NewFakeClock(now)
+	done := make(chan struct{})
+	go func() {
+		sleep(clock, 3*time.Second)
+		close(done)
+	}()
+	for advanced := time.Duration(0); ; advanced += time.Second {
+		select {
+		case <-done:
+			if advanced < 3*time.Second {
+				t.Fatalf("Woken up after %v only", advanced)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			if advanced > time.Minute {
+				t.Fatal("Still asleep after a minute of the clock")
+			}
+			clock.Advance(time.Second)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cronField is the set of the values a field of a schedule accepts, as bits
+type cronField uint64
+
+// cronSchedule is a schedule of cron: the minute, the hour, the day of the
+// month, the month and the day of the week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// As cron, a day matches either of the days when both are restricted
+	domAny, dowAny bool
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCronValue parses a number or a name, the names starting at the min
+func parseCronValue(s string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + i, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// parseCronField parses a list of values, ranges and steps: 5, 1-5, */15,
+// 0-30/10 or mon-fri.
+func parseCronField(s string, min, max int, names []string) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], min, names); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], min, names); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func parseCronSchedule(s string) (cronSchedule, error) {
+	var cs cronSchedule
+	all := strings.Fields(s)
+	fields := all
+	if len(fields) != 5 {
+		return cs, fmt.Errorf("schedule %q: expected 5 fields: minute hour day month weekday", s)
+	}
+	var err error
+	for _, f := range []struct {
+		field    *cronField
+		min, max int
+		names    []string
+	}{
+		{&cs.minute, 0, 59, nil}, {&cs.hour, 0, 23, nil}, {&cs.dom, 1, 31, nil},
+		{&cs.month, 1, 12, cronMonths}, {&cs.dow, 0, 7, cronDays},
+	} {
+		if *f.field, err = parseCronField(fields[0], f.min, f.max, f.names); err != nil {
+			return cs, err
+		}
+		fields = fields[1:]
+	}
+	// Sunday is either 0 or 7
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.domAny, cs.dowAny = strings.HasPrefix(all[2], "*"), strings.HasPrefix(all[4], "*")
+	return cs, nil
+}
+
+// matches tells if the schedule starts at the minute of t
+func (cs *cronSchedule) matches(t time.Time) bool {
+	if cs.minute&(1<<uint(t.Minute())) == 0 || cs.hour&(1<<uint(t.Hour())) == 0 ||
+		cs.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := cs.dom&(1<<uint(t.Day())) != 0, cs.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dow
+	case cs.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// maintenanceWindow is a period starting on a schedule, during which the
+// notifications and the anomalies are suppressed, or only tagged.
+type maintenanceWindow struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"`
+	Duration string `yaml:"duration"`
+	// Action is suppress, the default, or tag
+	Action string `yaml:"action"`
+	// Zone is the time zone of the schedule, the local one by default
+	Zone string `yaml:"zone"`
+
+	cron     cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+func (w *maintenanceWindow) UnmarshalYAML(node *yaml.Node) error {
+	type plain maintenanceWindow
+	if err := node.Decode((*plain)(w)); err != nil {
+		return err
+	}
+	if w.Name == "" {
+		w.Name = w.Schedule
+	}
+	var err error
+	if w.cron, err = parseCronSchedule(w.Schedule); err != nil {
+		return fmt.Errorf("maintenance: %s: %v", w.Name, err)
+	}
+	if w.duration, err = time.ParseDuration(w.Duration); err != nil || w.duration < time.Minute {
+		return fmt.Errorf("maintenance: %s: invalid duration %q", w.Name, w.Duration)
+	}
+	switch w.Action {
+	case "":
+		w.Action = "suppress"
+	case "suppress", "tag":
+	default:
+		return fmt.Errorf("maintenance: %s: unknown action %q, expected suppress or tag", w.Name, w.Action)
+	}
+	w.location = time.Local
+	if w.Zone != "" {
+		if w.location, err = time.LoadLocation(w.Zone); err != nil {
+			return fmt.Errorf("maintenance: %s: %v", w.Name, err)
+		}
+	}
+	return nil
+}
+
+// overlaps tells if the window is open at any time of [from, to), the epochs
+// of the log, by looking back for a start up to its duration before.
+func (w *maintenanceWindow) overlaps(from, to int64) bool {
+	first := time.Unix(from, 0).In(w.location).Add(-w.duration).Truncate(time.Minute)
+	for t := first; t.Unix() < to; t = t.Add(time.Minute) {
+		if t.Unix()+int64(w.duration/time.Second) > from && w.cron.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceWindows are the windows of the configuration
+type maintenanceWindows []maintenanceWindow
+
+// during returns the first window open in [from, to), nil if none
+func (ws maintenanceWindows) during(from, to int64) *maintenanceWindow {
+	if to <= from {
+		to = from + 1
+	}
+	for i := range ws {
+		if ws[i].overlaps(from, to) {
+			return &ws[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// msgpackSchema is the version of the layout of the records in MessagePack.
+// Each record is an array of the version followed by the fields, in order:
+//
+//	0  version     uint    1
+//	1  src         str
+//	2  t           int     seconds since the epoch
+//	3  method      str
+//	4  path        str
+//	5  version     int     0 for HTTP/1.0, 1 for HTTP/1.1, 2 for HTTP/2.0
+//	6  status      int
+//	7  bytes       int
+//	8  referrer    str
+//	9  agent       str
+//	10 user        str     empty if none
+//	11 country     str     empty if none
+//	12 asn         int     0 if none
+//	13 indicators  array of str
+//	14 extra       map of str to any
+//	15 id          str     empty if none, since the version 2
+const msgpackSchema = 2
+
+var errMsgpackFormat = errors.New("Invalid MessagePack record")
+
+type msgpackWriter struct {
+	w   *bufio.Writer
+	buf [9]byte
+}
+
+func newMsgpackWriter(w io.Writer) *msgpackWriter {
+	return &msgpackWriter{w: bufio.NewWriterSize(w, 64*1024)}
+}
+
+func (m *msgpackWriter) header(small, base byte, n int) {
+	switch {
+	case small != 0 && n < 16:
+		m.w.WriteByte(small | byte(n))
+	case n < 1<<16:
+		m.buf[0] = base
+		binary.BigEndian.PutUint16(m.buf[1:], uint16(n))
+		m.w.Write(m.buf[:3])
+	default:
+		m.buf[0] = base + 1
+		binary.BigEndian.PutUint32(m.buf[1:], uint32(n))
+		m.w.Write(m.buf[:5])
+	}
+}
+
+func (m *msgpackWriter) str(s string) {
+	switch n := len(s); {
+	case n < 32:
+		m.w.WriteByte(0xa0 | byte(n))
+	case n < 1<<8:
+		m.w.WriteByte(0xd9)
+		m.w.WriteByte(byte(n))
+	case n < 1<<16:
+		m.buf[0] = 0xda
+		binary.BigEndian.PutUint16(m.buf[1:], uint16(n))
+		m.w.Write(m.buf[:3])
+	default:
+		m.buf[0] = 0xdb
+		binary.BigEndian.PutUint32(m.buf[1:], uint32(n))
+		m.w.Write(m.buf[:5])
+	}
+	m.w.WriteString(s)
+}
+
+func (m *msgpackWriter) int(i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		m.w.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		m.w.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		m.buf[0] = 0xd2
+		binary.BigEndian.PutUint32(m.buf[1:], uint32(i))
+		m.w.Write(m.buf[:5])
+	default:
+		m.buf[0] = 0xd3
+		binary.BigEndian.PutUint64(m.buf[1:], uint64(i))
+		m.w.Write(m.buf[:9])
+	}
+}
+
+func (m *msgpackWriter) value(v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		m.w.WriteByte(0xc0)
+	case bool:
+		if x {
+			m.w.WriteByte(0xc3)
+		} else {
+			m.w.WriteByte(0xc2)
+		}
+	case int64:
+		m.int(x)
+	case int:
+		m.int(int64(x))
+	case float64:
+		m.buf[0] = 0xcb
+		binary.BigEndian.PutUint64(m.buf[1:], math.Float64bits(x))
+		m.w.Write(m.buf[:9])
+	case string:
+		m.str(x)
+	case []string:
+		m.header(0x90, 0xdc, len(x))
+		for _, s := range x {
+			m.str(s)
+		}
+	case []interface{}:
+		m.header(0x90, 0xdc, len(x))
+		for _, e := range x {
+			m.value(e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m.header(0x80, 0xde, len(keys))
+		for _, k := range keys {
+			m.str(k)
+			m.value(x[k])
+		}
+	default:
+		m.str(logs.ToString(x))
+	}
+}
+
+func (m *msgpackWriter) record(r *logs.Record) {
+	m.header(0x90, 0xdc, 16)
+	m.int(msgpackSchema)
+	m.str(r.Ip)
+	m.int(r.When)
+	m.str(r.Method)
+	m.str(r.Path)
+	m.int(int64(r.Version))
+	m.int(int64(r.Code))
+	m.int(r.Bytes)
+	m.str(r.Referrer)
+	m.str(r.Agent)
+	m.str(r.User)
+	m.str(r.Country)
+	m.int(int64(r.ASN))
+	m.value(r.Indicators)
+	m.value(r.Extra)
+	m.str(r.ID)
+}
+
+func (m *msgpackWriter) flush() error {
+	return m.w.Flush()
+}
+
+type msgpackReader struct {
+	r *bufio.Reader
+}
+
+func (m *msgpackReader) bytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(m.r, b)
+	return b, err
+}
+
+func (m *msgpackReader) uint(n int) (uint64, error) {
+	b, err := m.bytes(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// value decodes any MessagePack object, the maps with string keys only
+func (m *msgpackReader) value() (interface{}, error) {
+	c, err := m.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return m.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return m.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		b, err := m.bytes(int(c & 0x1f))
+		return string(b), err
+	}
+	sized := func(n int) (int, error) {
+		u, err := m.uint(n)
+		return int(u), err
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := m.uint(1 << (c - 0xcc))
+		return int64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		u, err := m.uint(n)
+		shift := uint(64 - 8*n)
+		return int64(u<<shift) >> shift, err
+	case 0xca:
+		u, err := m.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := m.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		width := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[c]
+		n, err := sized(width)
+		if err != nil {
+			return nil, err
+		}
+		b, err := m.bytes(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := sized(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return m.arrayOf(n)
+	case 0xde, 0xdf:
+		n, err := sized(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return m.mapOf(n)
+	}
+	return nil, fmt.Errorf("Unsupported MessagePack type 0x%02x", c)
+}
+
+func (m *msgpackReader) arrayOf(n int) ([]interface{}, error) {
+	out := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (m *msgpackReader) mapOf(n int) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		out[logs.ToString(k)] = v
+	}
+	return out, nil
+}
+
+func (m *msgpackReader) record() (logs.Record, error) {
+	var r logs.Record
+	v, err := m.value()
+	if err != nil {
+		return r, err
+	}
+	a, ok := v.([]interface{})
+	if !ok || len(a) < 15 || (a[0] != int64(1) && a[0] != int64(msgpackSchema)) {
+		return r, errMsgpackFormat
+	}
+	str := func(i int) string { return logs.ToString(a[i]) }
+	num := func(i int) int64 { n, _ := logs.ToNumber(a[i]).(int64); return n }
+	r = logs.Record{
+		Ip: str(1), When: num(2), Method: str(3), Path: str(4), Version: int(num(5)),
+		Code: int(num(6)), Bytes: num(7), Referrer: str(8), Agent: str(9),
+		User: str(10), Country: str(11), ASN: uint(num(12)),
+	}
+	if l, ok := a[13].([]interface{}); ok {
+		for _, x := range l {
+			r.Indicators = append(r.Indicators, logs.ToString(x))
+		}
+	}
+	if x, ok := a[14].(map[string]interface{}); ok && len(x) > 0 {
+		r.Extra = x
+	}
+	if len(a) > 15 {
+		r.ID = str(15)
+	}
+	return r, nil
+}
+
+func mainDecode(args []string) {
+	fs := pflag.NewFlagSet("decode", pflag.ExitOnError)
+	parseFlags(fs, args)
+
+	in := &msgpackReader{r: bufio.NewReaderSize(os.Stdin, 64*1024)}
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		r, err := in.record()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			Logger.Fatal().Err(err).Msg("Read error")
+		}
+		encoder.Encode(&r)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// objectStore lists and reads the objects of a bucket through the command of
+// its cloud, that already knows the credentials of the user.
+type objectStore struct {
+	scheme string
+	// list returns the objects of the bucket under the prefix
+	list func(bucket, prefix string) ([]logs.LogFile, error)
+	// cat returns the command writing the object to its output
+	cat func(bucket, key string) *exec.Cmd
+}
+
+// objectStores are the stores of the locations like s3://bucket/prefix, the
+// account of Azure being the first element: az://account/container/prefix
+var objectStores = map[string]*objectStore{
+	"s3": {
+		scheme: "s3",
+		list: func(bucket, prefix string) ([]logs.LogFile, error) {
+			var out struct {
+				Contents []struct {
+					Key          string `json:"Key"`
+					LastModified string `json:"LastModified"`
+				} `json:"Contents"`
+			}
+			err := runJSON(&out, "aws", "s3api", "list-objects-v2", "--bucket", bucket, "--prefix", prefix, "--output", "json")
+			files := make([]logs.LogFile, 0, len(out.Contents))
+			for _, o := range out.Contents {
+				files = append(files, logs.LogFile{Path: o.Key, Mtime: parseObjectTime(o.LastModified)})
+			}
+			return files, err
+		},
+		cat: func(bucket, key string) *exec.Cmd {
+			return exec.Command("aws", "s3", "cp", "--quiet", "s3://"+bucket+"/"+key, "-")
+		},
+	},
+	"gs": {
+		scheme: "gs",
+		list: func(bucket, prefix string) ([]logs.LogFile, error) {
+			var out []struct {
+				Name    string `json:"name"`
+				Updated string `json:"updated"`
+				// The newer releases of gcloud
+				UpdateTime string `json:"update_time"`
+			}
+			err := runJSON(&out, "gcloud", "storage", "objects", "list", "gs://"+bucket+"/"+prefix+"**", "--format", "json")
+			files := make([]logs.LogFile, 0, len(out))
+			for _, o := range out {
+				if o.Updated == "" {
+					o.Updated = o.UpdateTime
+				}
+				files = append(files, logs.LogFile{Path: o.Name, Mtime: parseObjectTime(o.Updated)})
+			}
+			return files, err
+		},
+		cat: func(bucket, key string) *exec.Cmd {
+			return exec.Command("gcloud", "storage", "cat", "gs://"+bucket+"/"+key)
+		},
+	},
+	"az": {
+		scheme: "az",
+		list: func(bucket, prefix string) ([]logs.LogFile, error) {
+			account, container := splitAzureBucket(bucket)
+			var out []struct {
+				Name       string `json:"name"`
+				Properties struct {
+					LastModified string `json:"lastModified"`
+				} `json:"properties"`
+			}
+			err := runJSON(&out, "az", "storage", "blob", "list", "--auth-mode", "login", "--account-name", account,
+				"--container-name", container, "--prefix", prefix, "--num-results", "*", "--output", "json")
+			files := make([]logs.LogFile, 0, len(out))
+			for _, o := range out {
+				files = append(files, logs.LogFile{Path: o.Name, Mtime: parseObjectTime(o.Properties.LastModified)})
+			}
+			return files, err
+		},
+		cat: func(bucket, key string) *exec.Cmd {
+			account, container := splitAzureBucket(bucket)
+			return exec.Command("az", "storage", "blob", "download", "--auth-mode", "login", "--account-name", account,
+				"--container-name", container, "--name", key, "--file", "/dev/stdout", "--no-progress", "--output", "none")
+		},
+	},
+}
+
+func splitAzureBucket(bucket string) (string, string) {
+	parts := strings.SplitN(bucket, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func parseObjectTime(s string) int64 {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z07:00", "2006-01-02 15:04:05Z07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano()
+		}
+	}
+	return 0
+}
+
+// runJSON runs the command and decodes its output into out, its error output
+// telling why it failed.
+func runJSON(out interface{}, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	raw, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// isObjectLocation tells if the location is the one of objects, like
+// s3://bucket/prefix, rather than a local path.
+func isObjectLocation(location string) bool {
+	i := strings.Index(location, "://")
+	if i < 0 {
+		return false
+	}
+	_, ok := objectStores[location[:i]]
+	return ok
+}
+
+// objectLocation is a bucket and a prefix, optionally ending with a glob
+// that the keys must match, e.g. s3://logs/nginx/*access*.log*
+type objectLocation struct {
+	store  *objectStore
+	bucket string
+	prefix string
+	glob   string
+}
+
+func parseObjectLocation(location string) (objectLocation, error) {
+	i := strings.Index(location, "://")
+	loc := objectLocation{store: objectStores[location[:i]]}
+	rest := location[i+3:]
+	// The bucket of Azure is the account then the container
+	parts := 1
+	if loc.store.scheme == "az" {
+		parts = 2
+	}
+	elements := strings.SplitN(rest, "/", parts+1)
+	if len(elements) < parts || elements[0] == "" || elements[parts-1] == "" {
+		return loc, fmt.Errorf("Invalid location %q", location)
+	}
+	loc.bucket = strings.Join(elements[:parts], "/")
+	if len(elements) > parts {
+		loc.prefix = elements[parts]
+	}
+	if j := strings.IndexAny(loc.prefix, "*?["); j >= 0 {
+		if _, err := path.Match(loc.prefix, ""); err != nil {
+			return loc, err
+		}
+		loc.glob, loc.prefix = loc.prefix, loc.prefix[:j]
+	}
+	return loc, nil
+}
+
+// listObjects returns the keys of the logs of the location, the oldest first
+// as the logs of a directory.
+func (loc objectLocation) listObjects() ([]string, error) {
+	files, err := loc.store.list(loc.bucket, loc.prefix)
+	if err != nil {
+		return nil, err
+	}
+	matching := files[:0]
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, "/") {
+			continue
+		}
+		if loc.glob != "" {
+			if ok, _ := path.Match(loc.glob, f.Path); !ok {
+				continue
+			}
+		}
+		matching = append(matching, f)
+	}
+	return logs.SortLogs(matching), nil
+}
+
+// readObjects returns the lines of the objects of the locations, listed
+// first, then read in turn, each decompressed on its own. The URLs are
+// fetched with the fetcher.
+func readObjects(locations []string, fetcher *httpFetcher) (io.Reader, error) {
+	type object struct {
+		loc objectLocation
+		key string
+		// Or else the URL to fetch
+		url string
+	}
+	var objects []object
+	for _, location := range locations {
+		if isURLLocation(location) {
+			objects = append(objects, object{url: location})
+			continue
+		}
+		loc, err := parseObjectLocation(location)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := loc.listObjects()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("%s: no log found", location)
+		}
+		for _, key := range keys {
+			objects = append(objects, object{loc: loc, key: key})
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		out := bufio.NewWriterSize(pw, 64*1024)
+		// The last line of an object never joins the first of the next
+		copyObject := func(stdout io.Reader) error {
+			in, err := logs.Decompress(stdout)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			w := &lineWriter{out: out}
+			if _, err = io.Copy(w, in); err == nil && len(w.partial) > 0 {
+				_, err = w.Write([]byte("\n"))
+			}
+			return err
+		}
+		for _, o := range objects {
+			var err error
+			url := o.url
+			if url != "" {
+				url = redactURL(url)
+				Logger.Debug().Str("url", url).Msg("Reading")
+				var body io.ReadCloser
+				if body, err = fetcher.fetch(o.url); err == nil {
+					err = copyObject(body)
+					body.Close()
+				}
+			} else {
+				url = o.loc.store.scheme + "://" + o.loc.bucket + "/" + o.key
+				Logger.Debug().Str("object", url).Msg("Reading")
+				cmd := o.loc.store.cat(o.loc.bucket, o.key)
+				cmd.Stderr = os.Stderr
+				var stdout io.Reader
+				if stdout, err = cmd.StdoutPipe(); err == nil {
+					err = cmd.Start()
+				}
+				if err == nil {
+					err = copyObject(stdout)
+					if werr := cmd.Wait(); werr != nil && err == nil {
+						err = werr
+					}
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("%s: %v", url, err))
+				return
+			}
+		}
+		if err := out.Flush(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
@@ -0,0 +1,12 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+// outputOrder sorts the records by time then by all their fields, so that the
+// output does not depend on the order of arrival of the records.
+var outputOrder = parseSortKeys([]string{
+	"t", "src", "method", "path", "version", "status", "bytes", "referrer", "agent", "user",
+})
@@ -0,0 +1,197 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// unowned is the owner of the paths matching no prefix
+const unowned = "-"
+
+type ownedPrefix struct {
+	prefix string
+	owner  string
+}
+
+// ownership maps the prefixes of the paths to the teams or the services
+// owning them. E.g.
+//
+//	/api/payments/: payments
+//	/api/: platform
+//	/static/: frontend
+type ownership struct {
+	// prefixes are sorted by decreasing length, so that the longest matches
+	prefixes []ownedPrefix
+}
+
+func loadOwners(path string) (*ownership, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err = yaml.Unmarshal(raw, &node); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(node.Content) == 0 {
+		return &ownership{}, nil
+	}
+	m := node.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expected a mapping of path prefixes to owners", path)
+	}
+	o := &ownership{}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		prefix, owner := m.Content[i].Value, m.Content[i+1].Value
+		if prefix == "" || owner == "" {
+			return nil, fmt.Errorf("%s: line %d: empty prefix or owner", path, m.Content[i].Line)
+		}
+		o.prefixes = append(o.prefixes, ownedPrefix{prefix: prefix, owner: owner})
+	}
+	sort.SliceStable(o.prefixes, func(i, j int) bool {
+		return len(o.prefixes[i].prefix) > len(o.prefixes[j].prefix)
+	})
+	return o, nil
+}
+
+// owner returns the owner of the path, by its longest prefix
+func (o *ownership) owner(path string) string {
+	for _, p := range o.prefixes {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.owner
+		}
+	}
+	return unowned
+}
+
+// enrich sets the "owner" extra field of the record
+func (o *ownership) enrich(r *logs.Record) {
+	r.SetExtra("owner", o.owner(r.Path))
+}
+
+// ownerReport is the slice of the traffic of an owner
+type ownerReport struct {
+	Owner     string  `json:"owner"`
+	Requests  int     `json:"requests"`
+	Bytes     int64   `json:"bytes"`
+	Denied    int     `json:"denied"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       float64 `json:"latency_p50_ms,omitempty"`
+	P95       float64 `json:"latency_p95_ms,omitempty"`
+	Attacks   int     `json:"attacks"`
+	Attackers int     `json:"attackers"`
+
+	latencies []float64
+	attackers map[string]bool
+}
+
+func mainOwners(args []string) {
+	var sf streamFlags
+	var only []string
+	var rf reportFlags
+	var flagJson bool
+	var table string
+	var nbColumns int64
+
+	fs := pflag.NewFlagSet("owners", pflag.ExitOnError)
+	fs.StringSliceVar(&only, "owner", make([]string, 0), "Only report these owners")
+	rf.register(fs, "owners", 0, ownerReport{})
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the owners as JSON objects")
+	fs.StringVar(&table, "table", tablePlain, "Style of the table: plain, border or markdown")
+	fs.Int64VarP(&nbColumns, "columns", "c", terminalColumns(), "Max line length of the table")
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	if sf.ownersPath == "" {
+		Logger.Fatal().Msg("An ownership file is required (--owners)")
+	}
+	sieve, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+	keep := make(map[string]bool)
+	for _, o := range only {
+		keep[o] = true
+	}
+
+	reports := make(map[string]*ownerReport)
+	for r := range sf.records() {
+		owner := logs.ToString(r.Extra["owner"])
+		if len(keep) > 0 && !keep[owner] {
+			continue
+		}
+		rep, ok := reports[owner]
+		if !ok {
+			rep = &ownerReport{Owner: owner, attackers: make(map[string]bool)}
+			reports[owner] = rep
+		}
+		rep.Requests++
+		rep.Bytes += r.Bytes
+		if isDenied(r.Code) {
+			rep.Denied++
+		}
+		if r.Code >= 500 {
+			rep.Errors++
+		}
+		if ms, ok := latencyMs(&r); ok {
+			rep.latencies = append(rep.latencies, float64(ms))
+		}
+		if len(sieve.match(r)) > 0 {
+			rep.Attacks++
+			rep.attackers[r.Ip] = true
+		}
+	}
+
+	out := make([]*ownerReport, 0, len(reports))
+	for _, rep := range reports {
+		rep.ErrorRate = float64(rep.Errors) / float64(rep.Requests)
+		rep.Attackers = len(rep.attackers)
+		if len(rep.latencies) > 0 {
+			rep.P50 = percentileMs(rep.latencies, 50)
+			rep.P95 = percentileMs(rep.latencies, 95)
+		}
+		out = append(out, rep)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Requests != out[j].Requests {
+			return out[i].Requests > out[j].Requests
+		}
+		return out[i].Owner < out[j].Owner
+	})
+	rf.apply(&out)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, rep := range out {
+			encoder.Encode(rep)
+		}
+		return
+	}
+	columns := []string{"owner", "requests", "bytes", "denied", "5xx", "error_rate", "p50_ms", "p95_ms", "attacks", "attackers"}
+	rows := make([][]interface{}, 0, len(out))
+	for _, rep := range out {
+		var p50, p95 interface{}
+		if len(rep.latencies) > 0 {
+			p50, p95 = rep.P50, rep.P95
+		}
+		rows = append(rows, []interface{}{rep.Owner, int64(rep.Requests), fmtByteSize(float64(rep.Bytes)),
+			int64(rep.Denied), int64(rep.Errors), fmt.Sprintf("%.2f%%", 100*rep.ErrorRate), p50, p95,
+			int64(rep.Attacks), int64(rep.Attackers)})
+	}
+	renderTable(os.Stdout, table, int(nbColumns), columns, rows)
+}
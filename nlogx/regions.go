@@ -0,0 +1,141 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+// regionStats compares the service of a country or an AS to the others
+type regionStats struct {
+	Region    string  `json:"region"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Median    float64 `json:"median_ms"`
+	P90       float64 `json:"p90_ms"`
+	// Slow and Failing tell the region is worse than the whole traffic
+	Slow    bool `json:"slow"`
+	Failing bool `json:"failing"`
+
+	latencies []float64
+}
+
+func percentileMs(values []float64, p float64) float64 {
+	f, _ := toFloat(percentile(values, p))
+	return f
+}
+
+func mainRegions(args []string) {
+	var sf streamFlags
+	var by string
+	var minRequests int
+	var slowFactor, errorMargin float64
+	var flagJson bool
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("regions", pflag.ExitOnError)
+	fs.StringVar(&by, "by", "country", "Group the requests by country or asn")
+	fs.IntVar(&minRequests, "min-requests", 20, "Min number of requests of a region to be compared")
+	fs.Float64Var(&slowFactor, "slow-factor", 1.5, "Min ratio of the median latency of a slow region to the global one")
+	fs.Float64Var(&errorMargin, "error-margin", 0.02, "Min excess of the error rate of a failing region over the global one")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the regions as JSON objects")
+	rf.register(fs, "regions", 0, regionStats{})
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	if by != "country" && by != "asn" {
+		Logger.Fatal().Str("by", by).Msg("Expected country or asn")
+	}
+	if sf.geoPath == "" && sf.asnPath == "" {
+		Logger.Fatal().Msg("A GeoIP database is required (--geoip or --asn-db)")
+	}
+
+	all := &regionStats{Region: "*"}
+	regions := make(map[string]*regionStats)
+	for r := range sf.records() {
+		key := r.Country
+		if by == "asn" {
+			key = fmt.Sprintf("AS%d", r.ASN)
+			if r.ASN == 0 {
+				key = ""
+			}
+		}
+		if key == "" {
+			key = "?"
+		}
+		s, ok := regions[key]
+		if !ok {
+			s = &regionStats{Region: key}
+			regions[key] = s
+		}
+		for _, acc := range []*regionStats{s, all} {
+			acc.Requests++
+			if r.Code >= 500 {
+				acc.Errors++
+			}
+			if ms, ok := latencyMs(&r); ok {
+				acc.latencies = append(acc.latencies, float64(ms))
+			}
+		}
+	}
+	if all.Requests == 0 {
+		return
+	}
+
+	summarize := func(s *regionStats) {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		s.Median, s.P90 = percentileMs(s.latencies, 50), percentileMs(s.latencies, 90)
+	}
+	summarize(all)
+	if len(all.latencies) == 0 {
+		Logger.Warn().Msg("No latency in the records, only the errors are compared")
+	}
+	report := make([]*regionStats, 0, len(regions))
+	for _, s := range regions {
+		if s.Requests < minRequests {
+			continue
+		}
+		summarize(s)
+		s.Slow = len(s.latencies) > 0 && all.Median > 0 && s.Median >= slowFactor*all.Median
+		s.Failing = s.ErrorRate >= all.ErrorRate+errorMargin
+		report = append(report, s)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Region < report[j].Region
+	})
+	rf.apply(&report)
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.Encode(all)
+		for _, s := range report {
+			encoder.Encode(s)
+		}
+		return
+	}
+	fmt.Printf("%-10s %8s %7s %10s %10s\n", "REGION", "REQUESTS", "ERRORS", "MEDIAN", "P90")
+	for _, s := range append([]*regionStats{all}, report...) {
+		flags := ""
+		if s.Slow {
+			flags += " slow"
+		}
+		if s.Failing {
+			flags += " failing"
+		}
+		fmt.Printf("%-10s %8d %6.2f%% %8.0fms %8.0fms%s\n",
+			s.Region, s.Requests, 100*s.ErrorRate, s.Median, s.P90, flags)
+	}
+}
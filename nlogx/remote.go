@@ -0,0 +1,121 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// rotatedCompressed matches the compressed rotations of a log
+var rotatedCompressed = regexp.MustCompile(`\.(?:gz|bz2|zst)$`)
+
+// shellQuote quotes s for the shell of the remote host
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteCommand returns the arguments of ssh streaming a log of the target,
+// like user@host:/var/log/nginx/access.log, or ssh://user@host:2222/PATH
+// for another port, compressed by the host if gz, or followed.
+func remoteCommand(target string, gz, follow bool) ([]string, error) {
+	var host, path string
+	args := []string{"-o", "BatchMode=yes", "-e", "none"}
+	if strings.HasPrefix(target, "ssh://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Hostname() == "" || u.Path == "" || u.Path == "/" {
+			return nil, fmt.Errorf("Invalid remote log %q, expected ssh://[USER@]HOST[:PORT]/PATH", target)
+		}
+		host, path = u.Hostname(), u.Path
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+	} else {
+		i := strings.IndexByte(target, ':')
+		if i <= 0 || i == len(target)-1 {
+			return nil, fmt.Errorf("Invalid remote log %q, expected [USER@]HOST:PATH", target)
+		}
+		host, path = target[:i], target[i+1:]
+	}
+	var cmd string
+	switch {
+	case follow:
+		cmd = "tail -n +1 -F " + shellQuote(path)
+	case gz && !rotatedCompressed.MatchString(path):
+		cmd = "gzip -c " + shellQuote(path)
+	default:
+		// The compressed logs are decompressed afterwards
+		cmd = "cat " + shellQuote(path)
+	}
+	return append(args, host, "--", cmd), nil
+}
+
+// readRemote returns the lines of the logs of the targets, streamed over ssh
+// concurrently and merged. A failing host is reported without stopping the
+// others.
+func readRemote(targets []string, gz, follow bool) (io.Reader, error) {
+	commands := make([]*exec.Cmd, 0, len(targets))
+	for _, target := range targets {
+		args, err := remoteCommand(target, gz, follow)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, exec.Command("ssh", args...))
+	}
+
+	pr, pw := io.Pipe()
+	var wg sync.WaitGroup
+	for i, cmd := range commands {
+		wg.Add(1)
+		go func(target string, cmd *exec.Cmd) {
+			defer wg.Done()
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			stdout, err := cmd.StdoutPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				Logger.Warn().Str("remote", target).Err(err).Msg("Failed to read the remote log")
+				return
+			}
+			w := &lineWriter{out: pw}
+			in, err := logs.Decompress(stdout)
+			if err == nil {
+				_, err = io.Copy(w, in)
+				in.Close()
+			}
+			if len(w.partial) > 0 {
+				w.Write([]byte("\n"))
+			}
+			// Drained, for ssh not to be blocked on a write
+			io.Copy(ioutil.Discard, stdout)
+			if werr := cmd.Wait(); werr != nil && err == nil {
+				err = fmt.Errorf("ssh: %v: %s", werr, strings.TrimSpace(stderr.String()))
+			}
+			if err != nil {
+				Logger.Warn().Str("remote", target).Err(err).Msg("Failed to read the remote log")
+			}
+		}(targets[i], cmd)
+	}
+	go func() {
+		wg.Wait()
+		pw.Close()
+	}()
+	return pr, nil
+}
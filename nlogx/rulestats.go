@@ -0,0 +1,153 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+// ruleStats are the evidences about a rule, to tune the rule set
+type ruleStats struct {
+	Field   string `json:"field"`
+	Expr    string `json:"expr"`
+	Hits    int    `json:"hits"`
+	Sources int    `json:"sources"`
+	// Suspects counts the flagged sources that also made successful
+	// authenticated requests matching no rule, i.e. the candidate false
+	// positives.
+	Suspects int     `json:"suspects"`
+	Score    float64 `json:"score"`
+}
+
+// sourceActivity tells which rules flagged a source, and whether it also
+// behaved like a legit user.
+type sourceActivity struct {
+	rules  map[int]bool
+	normal int
+}
+
+// tunedRules returns the threat signatures and the avoided agents of the
+// default display, the rules whose statistics are reported.
+func tunedRules() (*threatSieve, error) {
+	ts, err := newThreatSieve()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, sig := range ts.signatures {
+		known[sig.field+"\x00"+sig.expr] = true
+	}
+	for _, expr := range avoidedAgents {
+		if known["agent\x00"+expr] {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		ts.signatures = append(ts.signatures, signature{field: "agent", expr: expr, re: re})
+	}
+	return ts, nil
+}
+
+func mainRuleStats(args []string) {
+	var sf streamFlags
+	var format string
+	var unused bool
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("rule-stats", pflag.ExitOnError)
+	fs.StringVarP(&format, "format", "f", "text", "Format of the report: text, json or csv")
+	fs.BoolVar(&unused, "unused", false, "Also report the rules that never matched")
+	rf.register(fs, "rules", 0, ruleStats{})
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	// The records first, that load the rules of the configuration
+	records := sf.records()
+	ts, err := tunedRules()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid rule")
+	}
+	stats := make([]ruleStats, len(ts.signatures))
+	index := make(map[string]int)
+	for i, sig := range ts.signatures {
+		stats[i] = ruleStats{Field: sig.field, Expr: sig.expr}
+		index[sig.field+"\x00"+sig.expr] = i
+	}
+
+	sources := make(map[string]*sourceActivity)
+	for r := range records {
+		a, ok := sources[r.Ip]
+		if !ok {
+			a = &sourceActivity{rules: make(map[int]bool)}
+			sources[r.Ip] = a
+		}
+		matched := ts.match(r)
+		for _, sig := range matched {
+			i := index[sig.field+"\x00"+sig.expr]
+			stats[i].Hits++
+			a.rules[i] = true
+		}
+		if len(matched) == 0 && r.User != "" && r.Code < 400 {
+			a.normal++
+		}
+	}
+	for _, a := range sources {
+		for i := range a.rules {
+			stats[i].Sources++
+			if a.normal > 0 {
+				stats[i].Suspects++
+			}
+		}
+	}
+
+	report := make([]ruleStats, 0, len(stats))
+	for _, s := range stats {
+		if s.Hits == 0 && !unused {
+			continue
+		}
+		// The share of the flagged sources that look legit, lower is better
+		if s.Sources > 0 {
+			s.Score = float64(s.Sources-s.Suspects) / float64(s.Sources)
+		}
+		report = append(report, s)
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Hits > report[j].Hits })
+	rf.apply(&report)
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		for _, s := range report {
+			encoder.Encode(s)
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"field", "expr", "hits", "sources", "suspects", "score"})
+		for _, s := range report {
+			w.Write([]string{s.Field, s.Expr, strconv.Itoa(s.Hits), strconv.Itoa(s.Sources),
+				strconv.Itoa(s.Suspects), strconv.FormatFloat(s.Score, 'f', 3, 64)})
+		}
+		w.Flush()
+	case "text":
+		fmt.Printf("%-8s %-32s %8s %8s %8s %6s\n", "FIELD", "RULE", "HITS", "SOURCES", "SUSPECTS", "SCORE")
+		for _, s := range report {
+			fmt.Printf("%-8s %-32s %8d %8d %8d %6.3f\n", s.Field, s.Expr, s.Hits, s.Sources, s.Suspects, s.Score)
+		}
+	default:
+		Logger.Fatal().Str("format", format).Msg("Unknown format")
+	}
+}
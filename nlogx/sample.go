@@ -0,0 +1,44 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// sampleScale is the resolution of the sampling rates, 0.01%
+const sampleScale = 10000
+
+// parseSampleRate accepts a percentage, like 10%, or a ratio, like 0.1
+func parseSampleRate(s string) (float64, error) {
+	ratio, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err == nil && strings.HasSuffix(s, "%") {
+		ratio /= 100
+	}
+	if err != nil || ratio <= 0 || ratio > 1 {
+		return 0, fmt.Errorf("Invalid sampling rate %q, expected a percentage (like 10%%) or a ratio", s)
+	}
+	return ratio, nil
+}
+
+// makeSampleSieve keeps all the records of a subset of the values of the
+// field, e.g. of the clients, rather than a subset of the lines, so that the
+// sessions and the funnels of the clients sampled stay whole. The subset
+// only depends on the values hashed, thus is the same across runs and hosts.
+func makeSampleSieve(field string, ratio float64) logs.SieveFilter {
+	threshold := uint64(ratio * sampleScale)
+	return func(r logs.Record) bool {
+		v, _ := r.Field(field)
+		h := fnv.New64a()
+		h.Write([]byte(logs.ToString(v)))
+		return h.Sum64()%sampleScale < threshold
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// jsonSchema is the subset of JSON Schema describing the records
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	// Additional is false when no other property may appear
+	Additional *bool `json:"additionalProperties,omitempty"`
+}
+
+// recordSchema describes the fields of the Record, as in the JSON output
+var recordSchema = map[string]*jsonSchema{
+	"id":         {Type: "string", Description: "Stable UUID of the record, with --record-id"},
+	"src":        {Type: "string", Description: "Address of the client"},
+	"user":       {Type: "string", Description: "Authenticated user"},
+	"t":          {Type: "integer", Description: "Time of the request, in seconds since the epoch"},
+	"method":     {Type: "string", Description: "Method of the request"},
+	"path":       {Type: "string", Description: "Path of the request, with its query string"},
+	"version":    {Type: "integer", Description: "HTTP version, 0 for 1.0, 1 for 1.1, 2 for 2.0"},
+	"status":     {Type: "integer", Description: "Status of the response"},
+	"bytes":      {Type: "integer", Description: "Size of the response body"},
+	"referrer":   {Type: "string", Description: "Referer header"},
+	"agent":      {Type: "string", Description: "User-Agent header"},
+	"country":    {Type: "string", Description: "ISO code of the country of the client, with --geoip"},
+	"asn":        {Type: "integer", Description: "Autonomous system of the client, with --asn-db"},
+	"indicators": {Type: "array", Items: &jsonSchema{Type: "string"}, Description: "Indicators of a threat"},
+}
+
+// formatExtras returns the extra fields set by a format, and whether the
+// format may set any other one, e.g. the variables logged in JSON.
+func formatExtras(name string) (map[string]string, bool) {
+	switch name {
+	case "haproxy":
+		out := map[string]string{
+			"frontend": "string", "backend": "string", "server": "string", "termination": "string",
+			"retries": "integer", "srv_queue": "integer", "backend_queue": "integer", "ssl": "boolean",
+			"request_headers": "string", "response_headers": "string",
+		}
+		for _, t := range append(logs.HaproxyTimers, logs.HaproxyCounters...) {
+			out[t] = "integer"
+		}
+		for _, f := range logs.HaproxyCaptureFields() {
+			out[f] = "string"
+		}
+		return out, false
+	case "w3c":
+		out := map[string]string{"time_taken": "integer"}
+		for _, extra := range logs.CloudFrontFields {
+			out[extra] = "string"
+		}
+		for _, extra := range []string{"request_bytes", "port"} {
+			out[extra] = "integer"
+		}
+		out["time_to_first_byte"] = "number"
+		return out, false
+	case "varnish":
+		return map[string]string{"host": "string"}, false
+	case "vhost_combined":
+		return map[string]string{"host": "string", "port": "integer"}, false
+	case "ingress_nginx":
+		return map[string]string{
+			"request_length": "integer", "request_time": "number", "upstream": "string", "upstream_status": "integer",
+		}, false
+	case "error":
+		return map[string]string{
+			"level": "string", "message": "string", "pid": "integer", "tid": "integer", "connection": "integer",
+			"server": "string", "host": "string", "upstream": "string",
+		}, false
+	case "caddy":
+		return map[string]string{"host": "string", "bytes_read": "integer", "request_time": "number"}, false
+	case "traefik":
+		return map[string]string{
+			"host": "string", "router": "string", "service": "string", "service_url": "string", "entrypoint": "string",
+			"origin_status": "integer", "request_count": "integer", "retries": "integer", "request_time": "number",
+		}, false
+	case "envoy":
+		return map[string]string{
+			"received_bytes": "integer", "request_time": "number", "upstream_service_time": "integer",
+			"response_flags": "string", "response_code_details": "string", "host": "string", "upstream": "string",
+			"upstream_cluster": "string", "forwarded_for": "string", "sni": "string", "route": "string",
+		}, false
+	case "alb":
+		out := map[string]string{
+			"host": "string", "port": "integer", "elb": "string", "target": "string", "request_time": "number",
+			"target_status": "integer", "received_bytes": "integer", "ssl_cipher": "string", "ssl_protocol": "string",
+			"target_group": "string",
+		}
+		for _, t := range logs.AlbTimers {
+			out[t] = "number"
+		}
+		for _, f := range logs.AlbFields {
+			out[f] = "string"
+		}
+		return out, false
+	case "apache":
+		return map[string]string{"ident": "string", "request_time": "number", "host": "string", "port": "integer"}, false
+	case "combined", "common":
+		return nil, false
+	case "auto", "mixed":
+		out := make(map[string]string)
+		for _, f := range logs.LogFormats {
+			fields, _ := formatExtras(f.Name)
+			for k, t := range fields {
+				out[k] = t
+			}
+		}
+		return out, true
+	}
+	// The JSON formats
+	return nil, true
+}
+
+// exprType infers the JSON type of the values of an expression, or "" when it
+// depends on the records.
+func exprType(e expression) string {
+	switch x := e.(type) {
+	case *exprLiteral:
+		switch x.value.(type) {
+		case string:
+			return "string"
+		case int64:
+			return "integer"
+		case float64:
+			return "number"
+		case bool:
+			return "boolean"
+		}
+	case *exprField:
+		name := x.name
+		if alias, ok := logs.FieldAliases[name]; ok {
+			name = alias
+		}
+		if s, ok := recordSchema[name]; ok {
+			return s.Type
+		}
+	case *exprMatch:
+		return "boolean"
+	case *exprUnary:
+		if x.op == "!" {
+			return "boolean"
+		}
+		return exprType(x.x)
+	case *exprBinary:
+		switch x.op {
+		case "==", "!=", "<", "<=", ">", ">=", "&&", "||":
+			return "boolean"
+		}
+		tx, ty := exprType(x.x), exprType(x.y)
+		switch {
+		case x.op == "+" && (tx == "string" || ty == "string"):
+			return "string"
+		case tx == "integer" && ty == "integer":
+			return "integer"
+		case tx == "" || ty == "":
+			return ""
+		}
+		return "number"
+	case *exprCall:
+		switch x.name {
+		case "lower", "upper", "trim", "replace", "join", "str":
+			return "string"
+		case "contains", "startswith", "endswith":
+			return "boolean"
+		case "len", "int":
+			return "integer"
+		case "float":
+			return "number"
+		case "split":
+			return "array"
+		case "if":
+			if len(x.args) == 3 {
+				if t := exprType(x.args[1]); t == exprType(x.args[2]) {
+					return t
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// schemaType returns the JSON type of a value
+func schemaType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int, int64, uint:
+		return "integer"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []string:
+		return "array"
+	}
+	return ""
+}
+
+// property sets the schema of a key of the JSON records, whose dots denote
+// nested objects as in the output.
+func (s *jsonSchema) property(key string, p *jsonSchema, required bool) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := s.Properties[part]
+		if !ok {
+			sub = &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+			s.Properties[part] = sub
+		}
+		if required && !s.isRequired(part) {
+			s.Required = append(s.Required, part)
+		}
+		s = sub
+	}
+	last := parts[len(parts)-1]
+	if existing, ok := s.Properties[last]; ok && existing.Properties != nil && p.Properties != nil {
+		for k, v := range p.Properties {
+			existing.Properties[k] = v
+		}
+		return
+	}
+	s.Properties[last] = p
+	if required {
+		s.Required = append(s.Required, last)
+	}
+}
+
+func (s *jsonSchema) isRequired(name string) bool {
+	for _, r := range s.Required {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSchema describes the records of the format, with the derived fields of
+// the configuration, under the keys of the mapper.
+func buildSchema(format string, cfg *config, mapper *jsonMapper) *jsonSchema {
+	no := false
+	s := &jsonSchema{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		Title:       "nlogx record",
+		Description: "A record parsed from a log in the " + format + " format",
+		Type:        "object",
+		Properties:  make(map[string]*jsonSchema),
+		Additional:  &no,
+	}
+	optional := map[string]bool{"id": true, "user": true, "country": true, "asn": true, "indicators": true}
+	for _, name := range append(fieldNames(), "indicators") {
+		k := mapper.keys[name]
+		p := *recordSchema[name]
+		if k.Conv != nil {
+			// The preset formats the value, e.g. the time as RFC 3339
+			sample := k.Conv(&logs.Record{})
+			p.Type = schemaType(sample)
+			p.Description = fmt.Sprintf("%s, like %v", strings.SplitN(p.Description, ",", 2)[0], sample)
+		}
+		s.property(k.Key, &p, !optional[name])
+	}
+
+	fields, open := formatExtras(format)
+	extra := &jsonSchema{
+		Type:        "object",
+		Description: "Fields beyond the usual ones, set by the format or derived by the configuration",
+		Properties:  make(map[string]*jsonSchema),
+	}
+	if !open {
+		extra.Additional = &no
+	}
+	extras := make(map[string]*jsonSchema)
+	for k, t := range fields {
+		extras[k] = &jsonSchema{Type: t}
+	}
+	for _, d := range cfg.Fields {
+		p := &jsonSchema{Type: exprType(d.expr), Description: "Derived from " + d.src}
+		if p.Type == "array" {
+			p.Items = &jsonSchema{Type: "string"}
+		}
+		extras[d.name] = p
+	}
+	for name, p := range extras {
+		if k, ok := mapper.keys[name]; ok {
+			s.property(k.Key, p, false)
+		} else {
+			extra.Properties[name] = p
+		}
+	}
+	s.property(mapper.keys["extra"].Key, extra, false)
+	return s
+}
+
+func mainSchema(args []string) {
+	var logFormat, configPath, jsonPreset string
+	var jsonKeys []string
+
+	fs := pflag.NewFlagSet("schema", pflag.ExitOnError)
+	fs.StringVar(&logFormat, "log-format", "auto", "Format of the input: "+fmtFormatNames())
+	fs.StringVarP(&configPath, "config", "C", "", "Path to the configuration file")
+	fs.StringVar(&jsonPreset, "json-preset", "short", "Keys of the JSON records: short, ecs or nginx")
+	fs.StringSliceVar(&jsonKeys, "json-keys", make([]string, 0), "Rename keys of the JSON records (like src=client_ip)")
+	parseFlags(fs, args)
+
+	if logFormat != "auto" {
+		if _, err := logs.LookupFormat(logFormat); err != nil {
+			Logger.Fatal().Err(err).Msg("Invalid log format")
+		}
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to load the configuration")
+	}
+	mapper, err := newJSONMapper(jsonPreset, jsonKeys)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid JSON keys")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(buildSchema(logFormat, cfg, mapper))
+}
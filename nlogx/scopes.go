@@ -0,0 +1,131 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// ruleScope overrides the rules for the records of some label, e.g. a virtual
+// host: more patterns to avoid, and exceptions to the global ones.
+type ruleScope struct {
+	Agents         []string `yaml:"agents"`
+	Referrers      []string `yaml:"referrers"`
+	AllowAgents    []string `yaml:"allow_agents"`
+	AllowReferrers []string `yaml:"allow_referrers"`
+}
+
+// compiledScope is a scope whose patterns are joined into regexes, nil when
+// empty.
+type compiledScope struct {
+	name                        string
+	agents, referrers           *regexp.Regexp
+	allowAgents, allowReferrers *regexp.Regexp
+}
+
+// scopeSet finds the scope of the records by the value of their field, the
+// exact names first, then the globs (like *.example.com) in their order.
+type scopeSet struct {
+	field  string
+	scopes []*compiledScope
+}
+
+// ruleScopes are the scopes of the configuration, nil if none
+var ruleScopes *scopeSet
+
+func compileScopePatterns(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	_, re, err := makeOrRegex(patterns)
+	return re, err
+}
+
+func newScopeSet(rules ruleLists) (*scopeSet, error) {
+	if len(rules.Scopes) == 0 {
+		return nil, nil
+	}
+	s := &scopeSet{field: rules.ScopeField}
+	if s.field == "" {
+		s.field = "host"
+	}
+	for name, scope := range rules.Scopes {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("scopes: %s: %v", name, err)
+		}
+		cs := &compiledScope{name: name}
+		for _, p := range []struct {
+			re       **regexp.Regexp
+			patterns []string
+		}{
+			{&cs.agents, scope.Agents}, {&cs.referrers, scope.Referrers},
+			{&cs.allowAgents, scope.AllowAgents}, {&cs.allowReferrers, scope.AllowReferrers},
+		} {
+			re, err := compileScopePatterns(p.patterns)
+			if err != nil {
+				return nil, fmt.Errorf("scopes: %s: %v", name, err)
+			}
+			*p.re = re
+		}
+		s.scopes = append(s.scopes, cs)
+	}
+	sort.Slice(s.scopes, func(i, j int) bool {
+		gi, gj := strings.ContainsAny(s.scopes[i].name, "*?["), strings.ContainsAny(s.scopes[j].name, "*?[")
+		if gi != gj {
+			return gj
+		}
+		return s.scopes[i].name < s.scopes[j].name
+	})
+	return s, nil
+}
+
+// lookup returns the scope of the record, or nil
+func (s *scopeSet) lookup(r *logs.Record) *compiledScope {
+	if s == nil {
+		return nil
+	}
+	v, ok := r.Field(s.field)
+	if !ok {
+		return nil
+	}
+	label := logs.ToString(v)
+	for _, cs := range s.scopes {
+		if ok, _ := path.Match(cs.name, label); ok {
+			return cs
+		}
+	}
+	return nil
+}
+
+// avoidAgent tells if the scope avoids the agent, given the verdict of the
+// global rules.
+func (cs *compiledScope) avoidAgent(agent string, avoided bool) bool {
+	if cs == nil {
+		return avoided
+	}
+	if avoided {
+		return cs.allowAgents == nil || !cs.allowAgents.MatchString(agent)
+	}
+	return cs.agents != nil && cs.agents.MatchString(agent)
+}
+
+// avoidReferrer tells if the scope avoids the referrer, given the verdict of
+// the global rules.
+func (cs *compiledScope) avoidReferrer(referrer string, avoided bool) bool {
+	if cs == nil {
+		return avoided
+	}
+	if avoided {
+		return cs.allowReferrers == nil || !cs.allowReferrers.MatchString(referrer)
+	}
+	return cs.referrers != nil && cs.referrers.MatchString(referrer)
+}
@@ -0,0 +1,313 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// securitySeverities are the scores of the findings per severity, the score of
+// the summary being their sum.
+var securitySeverities = []struct {
+	name  string
+	score int
+}{
+	{"critical", 10}, {"high", 5}, {"medium", 2}, {"low", 1},
+}
+
+func severityScore(severity string) int {
+	for _, s := range securitySeverities {
+		if s.name == severity {
+			return s.score
+		}
+	}
+	return 0
+}
+
+// securityFinding is a notable fact of the day, scored by its severity
+type securityFinding struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// count is the number of facts gathered into the finding, it scores each
+	count int
+}
+
+// securityCount is a path or a source with its count
+type securityCount struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	Country string `json:"country,omitempty"`
+}
+
+// securitySummary is the one page summary of the security of a day
+type securitySummary struct {
+	Start    string            `json:"start"`
+	End      string            `json:"end"`
+	Severity string            `json:"severity"`
+	Score    int               `json:"score"`
+	Requests int               `json:"requests"`
+	Hostile  int               `json:"hostile"`
+	Blocked  int               `json:"blocked"`
+	Served   int               `json:"served"`
+	Sources  int               `json:"sources"`
+	Findings []securityFinding `json:"findings"`
+	// NewAttackers are the hostile sources unseen during the baseline
+	NewAttackers []securityCount `json:"new_attackers"`
+	ProbedPaths  []securityCount `json:"probed_paths"`
+}
+
+// securitySource is the activity of a hostile source over the day
+type securitySource struct {
+	requests int
+	country  string
+	// The probing then the successes on sensitive paths, as nlogx hunt
+	fails, breaches int
+}
+
+// topCounts returns the names of highest counts, the ties by name, unless
+// sorted otherwise by the flags of the report
+func topCounts(counts map[string]int, rf *reportFlags) []securityCount {
+	out := make([]securityCount, 0, len(counts))
+	for name, c := range counts {
+		out = append(out, securityCount{Name: name, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	rf.apply(&out)
+	return out
+}
+
+var securityHTML = template.Must(template.New("security").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Security summary {{.Start}}</title>
+<style>body{font-family:sans-serif;max-width:50em;margin:auto}td,th{padding:0 1em 0 0;text-align:left}
+.critical{color:#b00}.high{color:#d60}.medium{color:#a80}.low{color:#666}</style></head><body>
+<h1>Security summary: <span class="{{.Severity}}">{{.Severity}}</span> ({{.Score}})</h1>
+<p>From {{.Start}} to {{.End}}: {{.Requests}} requests, {{.Hostile}} hostile from {{.Sources}} sources,
+{{.Blocked}} blocked and {{.Served}} served.</p>
+<h2>Findings</h2>{{if .Findings}}<ul>{{range .Findings}}
+<li class="{{.Severity}}"><b>{{.Severity}}</b> {{.Message}}</li>{{end}}
+</ul>{{else}}<p>Nothing notable.</p>{{end}}
+<h2>New attackers</h2>{{if .NewAttackers}}<table>{{range .NewAttackers}}
+<tr><td>{{.Name}}</td><td>{{.Country}}</td><td>{{.Count}}</td></tr>{{end}}
+</table>{{else}}<p>None.</p>{{end}}
+<h2>Most probed paths</h2>{{if .ProbedPaths}}<table>{{range .ProbedPaths}}
+<tr><td>{{.Name}}</td><td>{{.Count}} sources</td></tr>{{end}}
+</table>{{else}}<p>None.</p>{{end}}
+</body></html>
+`))
+
+func (s *securitySummary) printText() {
+	fmt.Printf("Security summary from %s to %s: %s (score %d)\n\n", s.Start, s.End, s.Severity, s.Score)
+	fmt.Printf("%d requests, %d hostile from %d sources, %d blocked and %d served\n",
+		s.Requests, s.Hostile, s.Sources, s.Blocked, s.Served)
+	fmt.Println("\nFindings:")
+	if len(s.Findings) == 0 {
+		fmt.Println("  nothing notable")
+	}
+	for _, f := range s.Findings {
+		fmt.Printf("  %-8s %s\n", f.Severity, f.Message)
+	}
+	fmt.Println("\nNew attackers:")
+	if len(s.NewAttackers) == 0 {
+		fmt.Println("  none")
+	}
+	for _, a := range s.NewAttackers {
+		fmt.Printf("  %-39s %2s %6d requests\n", a.Name, a.Country, a.Count)
+	}
+	fmt.Println("\nMost probed paths:")
+	if len(s.ProbedPaths) == 0 {
+		fmt.Println("  none")
+	}
+	for _, p := range s.ProbedPaths {
+		fmt.Printf("  %6d sources %s\n", p.Count, p.Name)
+	}
+}
+
+func mainSecurity(args []string) {
+	var sf streamFlags
+	var span time.Duration
+	var format string
+	var minProbes int
+	var rf reportFlags
+	var surge, errorRate float64
+
+	fs := pflag.NewFlagSet("security", pflag.ExitOnError)
+	fs.DurationVar(&span, "span", 24*time.Hour, "Period summarized, until now, the records before being the baseline")
+	fs.StringVarP(&format, "format", "f", "text", "Format of the summary: text, html or json")
+	rf.register(fs, "new attackers and probed paths", 10, securityCount{})
+	fs.IntVar(&minProbes, "min-probes", 5, "Min number of denied requests before a success on a sensitive path")
+	fs.Float64Var(&surge, "surge", 3, "Ratio of the hostile requests to their daily mean of the baseline, notified as a surge")
+	fs.Float64Var(&errorRate, "error-rate", 0.05, "Rate of the 5xx notified")
+	sf.register(fs, 8)
+	sf.parse(fs, args)
+	rf.check()
+
+	if format != "text" && format != "html" && format != "json" {
+		Logger.Fatal().Str("format", format).Msg("Unknown format")
+	}
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+	expr, sensitive, err := makeOrRegex(sensitivePaths)
+	if err != nil {
+		Logger.Fatal().Str("expr", expr).Err(err).Msg("Failed to build the regex matching the sensitive paths")
+	}
+
+	end := sf.getClock().Now().Unix()
+	start := end - int64(span/time.Second)
+	summary := &securitySummary{Start: fmtTime(start), End: fmtTime(end)}
+	// The hostile sources and requests of the baseline, before the span
+	baseline := make(map[string]bool)
+	var baselineHostile int
+	var baselineFirst int64
+	sources := make(map[string]*securitySource)
+	probes := make(map[string]map[string]bool)
+	var serverErrors int
+	servedPaths := make(map[string]int)
+	for r := range sf.records() {
+		hostile := len(ts.match(r)) > 0
+		if r.When < start {
+			if baselineFirst == 0 || r.When < baselineFirst {
+				baselineFirst = r.When
+			}
+			if hostile {
+				baseline[r.Ip] = true
+				baselineHostile++
+			}
+			continue
+		}
+		summary.Requests++
+		if r.Code >= 500 {
+			serverErrors++
+		}
+		s := sources[r.Ip]
+		if hostile {
+			summary.Hostile++
+			if r.Code >= 400 {
+				summary.Blocked++
+			} else {
+				summary.Served++
+				servedPaths[normalizeProbe(r.Path)]++
+			}
+			if s == nil {
+				s = &securitySource{country: r.Country}
+				sources[r.Ip] = s
+			}
+			s.requests++
+			path := normalizeProbe(r.Path)
+			if probes[path] == nil {
+				probes[path] = make(map[string]bool)
+			}
+			probes[path][r.Ip] = true
+		}
+		// Only the sources hostile at least once are followed
+		if s == nil {
+			continue
+		}
+		if r.Code >= 200 && r.Code < 300 && sensitive.MatchString(r.Path) && s.fails >= minProbes {
+			s.breaches++
+		}
+		if isDenied(r.Code) {
+			s.fails++
+		}
+	}
+	summary.Sources = len(sources)
+
+	addN := func(count int, severity, format string, args ...interface{}) {
+		summary.Findings = append(summary.Findings,
+			securityFinding{Severity: severity, Message: fmt.Sprintf(format, args...), count: count})
+	}
+	add := func(severity, format string, args ...interface{}) {
+		addN(1, severity, format, args...)
+	}
+	// One page: the top findings of a kind, then the count of the others
+	breaches := make(map[string]int)
+	newAttackers := make(map[string]int)
+	for ip, s := range sources {
+		if s.breaches > 0 {
+			breaches[ip] = s.breaches
+		}
+		if !baseline[ip] {
+			newAttackers[ip] = s.requests
+		}
+	}
+	for _, b := range topCounts(breaches, &rf) {
+		add("critical", "%s succeeded %d times on sensitive paths after %d denied requests, see nlogx hunt",
+			b.Name, b.Count, sources[b.Name].fails)
+	}
+	if rf.limit > 0 && len(breaches) > rf.limit {
+		n := len(breaches) - rf.limit
+		addN(n, "critical", "%d more sources succeeded on sensitive paths after a probing", n)
+	}
+	for _, p := range topCounts(servedPaths, &rf) {
+		add("high", "%d hostile requests on %s were served, not blocked", p.Count, p.Name)
+	}
+	if rf.limit > 0 && len(servedPaths) > rf.limit {
+		n := len(servedPaths) - rf.limit
+		addN(n, "high", "Hostile requests on %d more paths were served", n)
+	}
+	if baselineFirst > 0 && baselineFirst < start {
+		days := float64(start-baselineFirst) / 86400
+		if days < 1 {
+			days = 1
+		}
+		mean := float64(baselineHostile) / days * span.Hours() / 24
+		if mean > 0 && float64(summary.Hostile) >= surge*mean {
+			add("medium", "A surge of %d hostile requests, %.1f times the %.0f of the baseline",
+				summary.Hostile, float64(summary.Hostile)/mean, mean)
+		}
+	}
+	if summary.Requests > 0 {
+		if rate := float64(serverErrors) / float64(summary.Requests); rate > errorRate {
+			add("medium", "The error rate is %.2f%%, above %.2f%%", 100*rate, 100*errorRate)
+		}
+	}
+	if len(newAttackers) > 0 {
+		add("low", "%d new attackers, unseen during the baseline", len(newAttackers))
+	}
+	sort.SliceStable(summary.Findings, func(i, j int) bool {
+		return severityScore(summary.Findings[i].Severity) > severityScore(summary.Findings[j].Severity)
+	})
+	summary.Severity = "none"
+	for _, f := range summary.Findings {
+		summary.Score += f.count * severityScore(f.Severity)
+	}
+	if len(summary.Findings) > 0 {
+		summary.Severity = summary.Findings[0].Severity
+	}
+	summary.NewAttackers = topCounts(newAttackers, &rf)
+	for i := range summary.NewAttackers {
+		summary.NewAttackers[i].Country = sources[summary.NewAttackers[i].Name].country
+	}
+	probed := make(map[string]int, len(probes))
+	for path, ips := range probes {
+		probed[path] = len(ips)
+	}
+	summary.ProbedPaths = topCounts(probed, &rf)
+
+	switch format {
+	case "json":
+		json.NewEncoder(os.Stdout).Encode(summary)
+	case "html":
+		if err := securityHTML.Execute(os.Stdout, summary); err != nil {
+			Logger.Fatal().Err(err).Msg("Write error")
+		}
+	default:
+		summary.printText()
+	}
+}
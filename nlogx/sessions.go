@@ -0,0 +1,198 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// session is a sequence of requests of a client, without any idle period
+type session struct {
+	Src      string `json:"src"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Errors   int    `json:"errors"`
+}
+
+// inventoryEntry summarizes all the activity of a client
+type inventoryEntry struct {
+	Src      string         `json:"src"`
+	First    int64          `json:"first"`
+	Last     int64          `json:"last"`
+	Requests int            `json:"requests"`
+	Bytes    int64          `json:"bytes"`
+	Sessions int            `json:"sessions"`
+	Statuses map[string]int `json:"statuses"`
+	Agents   []string       `json:"agents"`
+	Country  string         `json:"country,omitempty"`
+	ASN      uint           `json:"asn,omitempty"`
+}
+
+// maxInventoryAgents bounds the number of distinct agents kept per client
+const maxInventoryAgents = 5
+
+// stateFlags are the flags of the analyses keyed by client
+type stateFlags struct {
+	idle     time.Duration
+	stateDir string
+	maxKeys  int
+	json     bool
+}
+
+func (stf *stateFlags) register(fs *pflag.FlagSet) {
+	fs.DurationVar(&stf.idle, "idle", 30*time.Minute, "Idle period closing a session")
+	fs.StringVar(&stf.stateDir, "state-dir", "", "Spill the state of the clients into a database in that directory")
+	fs.IntVar(&stf.maxKeys, "max-keys", 100000, "Max number of clients kept in memory with --state-dir")
+	fs.BoolVarP(&stf.json, "json", "j", false, "Dump JSON objects")
+}
+
+func (stf *stateFlags) open(newState func() interface{}) *keyedState {
+	state, err := openKeyedState(stf.stateDir, stf.maxKeys, newState)
+	if err != nil {
+		Logger.Fatal().Str("dir", stf.stateDir).Err(err).Msg("Failed to open the state")
+	}
+	return state
+}
+
+// run updates the state of the client of each record, then passes each state
+// to done. The state is closed, its directory removed, before an error is
+// returned.
+func (stf *stateFlags) run(records <-chan logs.Record, newState func() interface{},
+	update func(r logs.Record, v interface{}), done func(key string, v interface{})) error {
+	state := stf.open(newState)
+	defer state.close()
+	for r := range records {
+		v, err := state.get(r.Ip)
+		if err != nil {
+			return err
+		}
+		update(r, v)
+	}
+	return state.each(done)
+}
+
+func (s *session) print(encoder *json.Encoder) {
+	if encoder != nil {
+		encoder.Encode(s)
+		return
+	}
+	fmt.Printf("%s %-15s %10s %6d requests %10d bytes %5d errors\n",
+		fmtTime(s.Start), s.Src, time.Duration(s.End-s.Start)*time.Second, s.Requests, s.Bytes, s.Errors)
+}
+
+func mainSessions(args []string) {
+	var sf streamFlags
+	var stf stateFlags
+
+	fs := pflag.NewFlagSet("sessions", pflag.ExitOnError)
+	stf.register(fs)
+	sf.register(fs, 1)
+	sf.parse(fs, args)
+
+	var encoder *json.Encoder
+	if stf.json {
+		encoder = json.NewEncoder(os.Stdout)
+	}
+	idle := int64(stf.idle / time.Second)
+	update := func(r logs.Record, v interface{}) {
+		s := v.(*session)
+		if s.Requests > 0 && r.When-s.End > idle {
+			s.print(encoder)
+			*s = session{}
+		}
+		if s.Requests == 0 {
+			s.Src, s.Start = r.Ip, r.When
+		}
+		s.End = r.When
+		s.Requests++
+		s.Bytes += r.Bytes
+		if r.Code >= 400 {
+			s.Errors++
+		}
+	}
+	// The sessions still open
+	done := func(key string, v interface{}) {
+		if s := v.(*session); s.Requests > 0 {
+			s.print(encoder)
+		}
+	}
+	if err := stf.run(sf.records(), func() interface{} { return &session{} }, update, done); err != nil {
+		Logger.Fatal().Err(err).Msg("State error")
+	}
+}
+
+func mainInventory(args []string) {
+	var sf streamFlags
+	var stf stateFlags
+
+	fs := pflag.NewFlagSet("inventory", pflag.ExitOnError)
+	stf.register(fs)
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+
+	idle := int64(stf.idle / time.Second)
+	update := func(r logs.Record, v interface{}) {
+		e := v.(*inventoryEntry)
+		if e.Requests == 0 {
+			e.Src, e.First = r.Ip, r.When
+			e.Statuses = make(map[string]int)
+		}
+		if e.Requests == 0 || r.When-e.Last > idle {
+			e.Sessions++
+		}
+		e.Last = r.When
+		e.Requests++
+		e.Bytes += r.Bytes
+		e.Statuses[fmt.Sprintf("%dxx", r.Code/100)]++
+		if r.Country != "" {
+			e.Country, e.ASN = r.Country, r.ASN
+		}
+		if len(e.Agents) < maxInventoryAgents {
+			known := false
+			for _, a := range e.Agents {
+				known = known || a == r.Agent
+			}
+			if !known {
+				e.Agents = append(e.Agents, r.Agent)
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	done := func(key string, v interface{}) {
+		e := v.(*inventoryEntry)
+		if stf.json {
+			encoder.Encode(e)
+			return
+		}
+		classes := make([]string, 0, len(e.Statuses))
+		for c, n := range e.Statuses {
+			classes = append(classes, fmt.Sprintf("%s:%d", c, n))
+		}
+		sort.Strings(classes)
+		fmt.Printf("%-15s %s .. %s %6d requests %4d sessions %10d bytes %s\n",
+			e.Src, fmtTime(e.First), fmtTime(e.Last), e.Requests, e.Sessions, e.Bytes, strings.Join(classes, " "))
+		if e.Country != "" {
+			fmt.Printf("  geo:   %s AS%d\n", e.Country, e.ASN)
+		}
+		for _, a := range e.Agents {
+			fmt.Printf("  agent: %q\n", a)
+		}
+	}
+	if err := stf.run(sf.records(), func() interface{} { return &inventoryEntry{} }, update, done); err != nil {
+		Logger.Fatal().Err(err).Msg("State error")
+	}
+}
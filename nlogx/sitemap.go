@@ -0,0 +1,167 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// sitemapFile is either a set of URLs or an index of other sitemaps
+type sitemapFile struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// sitemapPath returns the path of a URL of the sitemap, as logged by nginx
+func sitemapPath(loc string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(loc))
+	if err != nil {
+		return "", err
+	}
+	if u.EscapedPath() == "" {
+		return "/", nil
+	}
+	return u.EscapedPath(), nil
+}
+
+// loadSitemap returns the set of the paths of a sitemap file
+func loadSitemap(path string, paths map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var doc sitemapFile
+	if err = xml.NewDecoder(f).Decode(&doc); err != nil {
+		return err
+	}
+	if len(doc.Sitemaps) > 0 {
+		// The sitemaps of an index are remote, they must be given explicitly
+		Logger.Warn().Str("path", path).Int("sitemaps", len(doc.Sitemaps)).Msg("Sitemap index ignored")
+	}
+	for _, u := range doc.URLs {
+		p, err := sitemapPath(u.Loc)
+		if err != nil {
+			Logger.Warn().Str("loc", u.Loc).Err(err).Msg("Invalid URL in the sitemap")
+			continue
+		}
+		paths[p] = true
+	}
+	return nil
+}
+
+type sitemapEntry struct {
+	path string
+	hits int
+}
+
+func mainSitemap(args []string) {
+	var sf streamFlags
+	var flagJson, allStatuses bool
+	var minHits int
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("sitemap", pflag.ExitOnError)
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the differences as JSON objects")
+	fs.BoolVar(&allStatuses, "all-statuses", false, "Also count the requests failing with an error status")
+	fs.IntVar(&minHits, "min-hits", 1, "Min number of hits of a path missing from the sitemap")
+	rf.registerColumns(fs, "paths", 0, []string{"path", "hits"})
+	fs.Lookup("limit").Usage = "Max number of paths missing from the sitemap and of paths never requested reported"
+	sf.register(fs, 30)
+	parseFlags(fs, args)
+	rf.check()
+
+	if fs.NArg() == 0 {
+		Logger.Fatal().Msg("Expected the path of at least one sitemap")
+	}
+	sitemap := make(map[string]bool)
+	for _, path := range fs.Args() {
+		if err := loadSitemap(path, sitemap); err != nil {
+			Logger.Fatal().Str("path", path).Err(err).Msg("Failed to load the sitemap")
+		}
+	}
+
+	hits := make(map[string]int)
+	for r := range sf.records() {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			continue
+		}
+		if !allStatuses && r.Code >= 400 {
+			continue
+		}
+		path := r.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		hits[path]++
+	}
+
+	missing := make([]sitemapEntry, 0)
+	for path, n := range hits {
+		if !sitemap[path] && n >= minHits {
+			missing = append(missing, sitemapEntry{path: path, hits: n})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].hits != missing[j].hits {
+			return missing[i].hits > missing[j].hits
+		}
+		return missing[i].path < missing[j].path
+	})
+	unvisited := make([]string, 0)
+	for path := range sitemap {
+		if hits[path] == 0 {
+			unvisited = append(unvisited, path)
+		}
+	}
+	sort.Strings(unvisited)
+	nbMissing, nbUnvisited := len(missing), len(unvisited)
+	kept := make([]sitemapEntry, 0, len(missing))
+	for _, i := range rf.order(len(missing), func(i int, name string) interface{} {
+		if name == "path" {
+			return missing[i].path
+		}
+		return missing[i].hits
+	}) {
+		kept = append(kept, missing[i])
+	}
+	missing = kept
+	if rf.limit > 0 && len(unvisited) > rf.limit {
+		unvisited = unvisited[:rf.limit]
+	}
+
+	if flagJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, e := range missing {
+			encoder.Encode(map[string]interface{}{"path": e.path, "hits": e.hits, "diff": "not-in-sitemap"})
+		}
+		for _, path := range unvisited {
+			encoder.Encode(map[string]interface{}{"path": path, "hits": 0, "diff": "no-traffic"})
+		}
+		return
+	}
+	fmt.Printf("Requested but not in the sitemap: %d paths\n", nbMissing)
+	for _, e := range missing {
+		fmt.Printf("  %8d %s\n", e.hits, e.path)
+	}
+	fmt.Printf("In the sitemap but not requested: %d of %d paths\n", nbUnvisited, len(sitemap))
+	for _, path := range unvisited {
+		fmt.Printf("  %s\n", path)
+	}
+}
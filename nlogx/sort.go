@@ -0,0 +1,269 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// parseSortKeys parses a list of "field[:desc]" (or ":asc")
+func parseSortKeys(specs []string) []sortKey {
+	out := make([]sortKey, 0, len(specs))
+	for _, spec := range specs {
+		k := sortKey{field: spec}
+		if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+			switch strings.ToLower(spec[i+1:]) {
+			case "desc":
+				k = sortKey{field: spec[:i], desc: true}
+			case "asc":
+				k = sortKey{field: spec[:i]}
+			}
+		}
+		out = append(out, k)
+	}
+	return out
+}
+
+// checkSortKeys fails on the first key that is not a known column
+func checkSortKeys(keys []sortKey, known func(name string) bool) error {
+	for _, k := range keys {
+		if !known(k.field) {
+			return fmt.Errorf("Unknown field %q", k.field)
+		}
+	}
+	return nil
+}
+
+// recordColumns are the fields of the records to sort by
+func recordColumns() map[string]bool {
+	columns := make(map[string]bool)
+	for name := range logs.RecordFields {
+		columns[name] = true
+	}
+	for name := range logs.FieldAliases {
+		columns[name] = true
+	}
+	return columns
+}
+
+func compareByKeys(keys []sortKey, get func(name string) interface{}, other func(name string) interface{}) int {
+	for _, k := range keys {
+		c := compareValues(get(k.field), other(k.field))
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// sortRecords buffers all the records and emits them in the order of the keys,
+// the equal records keeping their order of arrival.
+func sortRecords(in <-chan logs.Record, keys []sortKey) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		all := make([]logs.Record, 0)
+		for r := range in {
+			all = append(all, r)
+		}
+		sort.SliceStable(all, func(i, j int) bool {
+			a, b := &all[i], &all[j]
+			getA := func(name string) interface{} { v, _ := a.Field(name); return v }
+			getB := func(name string) interface{} { v, _ := b.Field(name); return v }
+			return compareByKeys(keys, getA, getB) < 0
+		})
+		for _, r := range all {
+			out <- r
+		}
+	}()
+	return out
+}
+
+// limitRecords only lets the first records pass, then drains the input
+func limitRecords(in <-chan logs.Record, limit int) <-chan logs.Record {
+	out := make(chan logs.Record, 32)
+	go func() {
+		defer close(out)
+		n := 0
+		for r := range in {
+			if n < limit {
+				out <- r
+			}
+			n++
+		}
+	}()
+	return out
+}
+
+// sortRows sorts the rows of a report by the keys, given the names of its
+// columns, checked by checkSortKeys.
+func sortRows(columns []string, rows [][]interface{}, keys []sortKey) {
+	index := make(map[string]int, len(columns))
+	for i, c := range columns {
+		index[c] = i
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		getA := func(name string) interface{} {
+			if k, ok := index[name]; ok {
+				return rows[i][k]
+			}
+			return nil
+		}
+		getB := func(name string) interface{} {
+			if k, ok := index[name]; ok {
+				return rows[j][k]
+			}
+			return nil
+		}
+		return compareByKeys(keys, getA, getB) < 0
+	})
+}
+
+// reportFlags are the --sort-by and --limit of a report, whose rows are sorted
+// by their fields named as in the JSON output, after the order of the report.
+type reportFlags struct {
+	sortBy  []string
+	limit   int
+	keys    []sortKey
+	columns map[string]bool
+	fields  map[string]int
+}
+
+// register adds the flags of a report of rows like row, a struct or a pointer
+// to a struct, limited by default to that number of rows (0 for all).
+func (rf *reportFlags) register(fs *pflag.FlagSet, what string, limit int, row interface{}) {
+	t := reflect.TypeOf(row)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	rf.fields = make(map[string]int)
+	var names []string
+	example := ""
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+		rf.fields[name] = i
+		names = append(names, name)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Float64:
+			if example == "" {
+				example = name
+			}
+		}
+	}
+	rf.registerColumns(fs, what, limit, names)
+	if example != "" {
+		fs.Lookup("sort-by").Usage = "Sort the " + what + " by their fields, as in JSON (like " + example + ":desc)"
+	}
+}
+
+// registerColumns adds the flags of a table of rows, given its columns
+func (rf *reportFlags) registerColumns(fs *pflag.FlagSet, what string, limit int, columns []string) {
+	rf.columns = make(map[string]bool, len(columns))
+	for _, c := range columns {
+		rf.columns[c] = true
+	}
+	fs.StringSliceVar(&rf.sortBy, "sort-by", make([]string, 0), "Sort the "+what+" by columns: "+strings.Join(columns, ", "))
+	fs.IntVar(&rf.limit, "limit", limit, "Max number of "+what+" reported")
+}
+
+// check parses the sort keys, once the flags parsed
+func (rf *reportFlags) check() {
+	rf.keys = parseSortKeys(rf.sortBy)
+	if err := checkSortKeys(rf.keys, func(name string) bool { return rf.columns[name] }); err != nil {
+		Logger.Fatal().Strs("sort-by", rf.sortBy).Err(err).Msg("Invalid sort keys")
+	}
+	if rf.limit < 0 {
+		Logger.Fatal().Int("limit", rf.limit).Msg("Invalid limit")
+	}
+}
+
+// sortValue normalizes a field of a row for compareValues, the lists and
+// the maps compared by their length.
+func sortValue(f reflect.Value) interface{} {
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(f.Uint())
+	case reflect.Float32, reflect.Float64:
+		return f.Float()
+	case reflect.Slice, reflect.Map:
+		return int64(f.Len())
+	case reflect.Invalid:
+		return nil
+	}
+	return f.Interface()
+}
+
+// apply sorts the rows, a pointer to a slice of the rows registered, by the
+// keys, the rows equal keeping their order, then keeps the first ones.
+func (rf *reportFlags) apply(rows interface{}) {
+	v := reflect.ValueOf(rows).Elem()
+	if len(rf.keys) > 0 {
+		field := func(i int) func(name string) interface{} {
+			row := reflect.Indirect(v.Index(i))
+			return func(name string) interface{} { return sortValue(row.Field(rf.fields[name])) }
+		}
+		sort.SliceStable(v.Interface(), func(i, j int) bool {
+			return compareByKeys(rf.keys, field(i), field(j)) < 0
+		})
+	}
+	if rf.limit > 0 && v.Len() > rf.limit {
+		v.Set(v.Slice(0, rf.limit))
+	}
+}
+
+// order returns the indexes of the n rows kept of a report registered by its
+// columns, sorted by the keys, given the value of a column of a row.
+func (rf *reportFlags) order(n int, column func(i int, name string) interface{}) []int {
+	out := make([]int, n)
+	for i := range out {
+		out[i] = i
+	}
+	if len(rf.keys) > 0 {
+		sort.SliceStable(out, func(i, j int) bool {
+			getA := func(name string) interface{} { return sortValue(reflect.ValueOf(column(out[i], name))) }
+			getB := func(name string) interface{} { return sortValue(reflect.ValueOf(column(out[j], name))) }
+			return compareByKeys(rf.keys, getA, getB) < 0
+		})
+	}
+	if rf.limit > 0 && n > rf.limit {
+		out = out[:rf.limit]
+	}
+	return out
+}
+
+// applyTable sorts the rows of a table registered by its columns, then keeps
+// the first ones.
+func (rf *reportFlags) applyTable(columns []string, rows [][]interface{}) [][]interface{} {
+	if len(rf.keys) > 0 {
+		sortRows(columns, rows, rf.keys)
+	}
+	if rf.limit > 0 && len(rows) > rf.limit {
+		rows = rows[:rf.limit]
+	}
+	return rows
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var stateBucket = []byte("state")
+
+// keyedState maps keys, e.g. the addresses of the clients, to the states of an
+// analysis. Without a directory, the states stay in memory. With a directory,
+// at most maxKeys states stay in memory and the others are spilled into an
+// embedded database, so that the analyses of months of logs run in bounded
+// memory.
+type keyedState struct {
+	cache    map[string]interface{}
+	maxKeys  int
+	newState func() interface{}
+
+	dir string
+	db  *bolt.DB
+}
+
+func openKeyedState(parent string, maxKeys int, newState func() interface{}) (*keyedState, error) {
+	s := &keyedState{cache: make(map[string]interface{}), maxKeys: maxKeys, newState: newState}
+	if parent == "" {
+		return s, nil
+	}
+	var err error
+	if s.dir, err = ioutil.TempDir(parent, "nlogx-state-"); err != nil {
+		return nil, err
+	}
+	// The state is scratch data, the durability is useless
+	opts := &bolt.Options{NoSync: true, NoFreelistSync: true}
+	if s.db, err = bolt.Open(filepath.Join(s.dir, "state.db"), 0600, opts); err != nil {
+		os.RemoveAll(s.dir)
+		return nil, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the state of the key, a new one if the key is unknown. The state
+// may be modified until the next call to get.
+func (s *keyedState) get(key string) (interface{}, error) {
+	if v, ok := s.cache[key]; ok {
+		return v, nil
+	}
+	v := s.newState()
+	if s.db != nil {
+		if len(s.cache) >= s.maxKeys {
+			if err := s.spill(); err != nil {
+				return nil, err
+			}
+		}
+		err := s.db.View(func(tx *bolt.Tx) error {
+			if raw := tx.Bucket(stateBucket).Get([]byte(key)); raw != nil {
+				return json.Unmarshal(raw, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.cache[key] = v
+	return v, nil
+}
+
+// spill writes the states in memory into the database, in one transaction
+func (s *keyedState) spill() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		for k, v := range s.cache {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(k), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.cache = make(map[string]interface{})
+	}
+	return err
+}
+
+// each calls fn with all the states, in the order of the keys
+func (s *keyedState) each(fn func(key string, v interface{})) error {
+	if s.db == nil {
+		keys := make([]string, 0, len(s.cache))
+		for k := range s.cache {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fn(k, s.cache[k])
+		}
+		return nil
+	}
+	if err := s.spill(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).ForEach(func(k, raw []byte) error {
+			v := s.newState()
+			if err := json.Unmarshal(raw, v); err != nil {
+				return err
+			}
+			fn(string(k), v)
+			return nil
+		})
+	})
+}
+
+// close drops the database, if any
+func (s *keyedState) close() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	os.RemoveAll(s.dir)
+	return err
+}
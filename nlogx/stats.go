@@ -0,0 +1,139 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// gammaQ is the regularized upper incomplete gamma function Q(a, x), by its
+// series below a+1 and its continued fraction above.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lg)
+	}
+	// Lentz's method
+	const tiny = 1e-300
+	b := x + 1 - a
+	c, d := 1/tiny, 1/b
+	h := d
+	for n := 1; n < 1000; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+// chiSquareTest tests the independence of the rows and the columns of a table
+// of counts, and returns the statistic, the degrees of freedom and the p-value.
+// The empty columns are ignored.
+func chiSquareTest(table [][]float64) (stat float64, df int, p float64) {
+	rows := make([]float64, len(table))
+	cols := make([]float64, len(table[0]))
+	total := 0.0
+	for i, row := range table {
+		for j, n := range row {
+			rows[i] += n
+			cols[j] += n
+			total += n
+		}
+	}
+	nonEmpty := 0
+	for j := range cols {
+		if cols[j] > 0 {
+			nonEmpty++
+		}
+	}
+	df = (len(rows) - 1) * (nonEmpty - 1)
+	if df <= 0 || total == 0 {
+		return 0, df, 1
+	}
+	for i, row := range table {
+		for j, n := range row {
+			if cols[j] == 0 || rows[i] == 0 {
+				continue
+			}
+			expected := rows[i] * cols[j] / total
+			stat += (n - expected) * (n - expected) / expected
+		}
+	}
+	return stat, df, gammaQ(float64(df)/2, stat/2)
+}
+
+// mannWhitneyTest tests whether the values of b tend to differ from those of
+// a, by the normal approximation of the U statistic with the correction of the
+// ties, and returns U (of a), z and the two-sided p-value.
+func mannWhitneyTest(a, b []float64) (u, z, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 0, 0, 1
+	}
+	type value struct {
+		v     float64
+		first bool
+	}
+	all := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, value{v, true})
+	}
+	for _, v := range b {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	var ranks1, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		// The tied values share the mean of their ranks
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].first {
+				ranks1 += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	u = ranks1 - n1*(n1+1)/2
+	n := n1 + n2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return u, 0, 1
+	}
+	z = (u - n1*n2/2) / sigma
+	return u, z, math.Erfc(math.Abs(z) / math.Sqrt2)
+}
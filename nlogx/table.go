@@ -0,0 +1,215 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+const (
+	tablePlain    = "plain"
+	tableBorder   = "border"
+	tableMarkdown = "markdown"
+)
+
+func fmtCell(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', 2, 64)
+	}
+	if v == nil {
+		return "-"
+	}
+	return logs.ToString(v)
+}
+
+// truncate cuts the string to the width, with an ellipsis
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 1 {
+		return string([]rune(s)[:width])
+	}
+	return string([]rune(s)[:width-1]) + "…"
+}
+
+// fitWidths shrinks the widest columns until the table fits the max width
+func fitWidths(widths []int, sep, maxWidth int) {
+	if maxWidth <= 0 {
+		return
+	}
+	total := func() int {
+		t := sep * (len(widths) - 1)
+		for _, w := range widths {
+			t += w
+		}
+		return t
+	}
+	for total() > maxWidth {
+		widest := 0
+		for i, w := range widths {
+			if w > widths[widest] {
+				widest = i
+			}
+		}
+		if widths[widest] <= 3 {
+			return
+		}
+		widths[widest]--
+	}
+}
+
+// renderTable displays aligned columns, the numbers aligned to the right. The
+// plain and bordered tables are shrunk to fit the width, if positive.
+func renderTable(w io.Writer, style string, maxWidth int, columns []string, rows [][]interface{}) {
+	widths := make([]int, len(columns))
+	numeric := make([]bool, len(columns))
+	for i, c := range columns {
+		widths[i] = utf8.RuneCountInString(c)
+		numeric[i] = true
+	}
+	cells := make([][]string, len(rows))
+	for i, row := range rows {
+		cells[i] = make([]string, len(row))
+		for j, v := range row {
+			cells[i][j] = fmtCell(v)
+			if style == tableMarkdown {
+				cells[i][j] = strings.ReplaceAll(cells[i][j], "|", `\|`)
+			}
+			if n := utf8.RuneCountInString(cells[i][j]); n > widths[j] {
+				widths[j] = n
+			}
+			if _, ok := toFloat(logs.ToNumber(v)); !ok && v != nil {
+				numeric[j] = false
+			}
+		}
+	}
+
+	switch style {
+	case tableBorder:
+		fitWidths(widths, 3, maxWidth-4)
+	case tableMarkdown:
+	default:
+		fitWidths(widths, 2, maxWidth)
+	}
+
+	pad := func(j int, v string, last bool) string {
+		v = truncate(v, widths[j])
+		n := widths[j] - utf8.RuneCountInString(v)
+		if numeric[j] {
+			return strings.Repeat(" ", n) + v
+		}
+		if last {
+			return v
+		}
+		return v + strings.Repeat(" ", n)
+	}
+	line := func(values []string) {
+		sb := strings.Builder{}
+		switch style {
+		case tableBorder, tableMarkdown:
+			sb.WriteString("| ")
+			for j, v := range values {
+				if j > 0 {
+					sb.WriteString(" | ")
+				}
+				sb.WriteString(pad(j, v, false))
+			}
+			sb.WriteString(" |")
+		default:
+			for j, v := range values {
+				if j > 0 {
+					sb.WriteString("  ")
+				}
+				sb.WriteString(pad(j, v, j == len(values)-1))
+			}
+		}
+		fmt.Fprintln(w, sb.String())
+	}
+	rule := func() {
+		parts := make([]string, len(widths))
+		switch style {
+		case tableBorder:
+			for j, width := range widths {
+				parts[j] = strings.Repeat("-", width+2)
+			}
+			fmt.Fprintln(w, "+"+strings.Join(parts, "+")+"+")
+		case tableMarkdown:
+			for j, width := range widths {
+				if numeric[j] {
+					parts[j] = strings.Repeat("-", width+1) + ":"
+				} else {
+					parts[j] = strings.Repeat("-", width+2)
+				}
+			}
+			fmt.Fprintln(w, "|"+strings.Join(parts, "|")+"|")
+		}
+	}
+
+	if style == tableBorder {
+		rule()
+	}
+	line(columns)
+	rule()
+	for _, c := range cells {
+		line(c)
+	}
+	if style == tableBorder {
+		rule()
+	}
+}
+
+// renderRecords buffers the records and displays them as a table, with a
+// column per derived field.
+func renderRecords(w io.Writer, style string, maxWidth int, in <-chan logs.Record) {
+	all := make([]logs.Record, 0)
+	extras := make(map[string]bool)
+	withIndicators, withID := false, false
+	for r := range in {
+		all = append(all, r)
+		for k := range r.Extra {
+			extras[k] = true
+		}
+		withIndicators = withIndicators || len(r.Indicators) > 0
+		withID = withID || r.ID != ""
+	}
+	extraNames := make([]string, 0, len(extras))
+	for k := range extras {
+		extraNames = append(extraNames, k)
+	}
+	sort.Strings(extraNames)
+
+	columns := []string{"time", "src", "status", "method", "path", "referrer", "agent"}
+	if withIndicators {
+		columns = append(columns, "indicators")
+	}
+	columns = append(columns, extraNames...)
+	if withID {
+		columns = append(columns, "id")
+	}
+	rows := make([][]interface{}, 0, len(all))
+	for _, r := range all {
+		row := []interface{}{fmtTime(r.When), r.Ip, int64(r.Code), r.Method, r.Path, r.Referrer, r.Agent}
+		if withIndicators {
+			row = append(row, strings.Join(r.Indicators, ","))
+		}
+		for _, k := range extraNames {
+			row = append(row, r.Extra[k])
+		}
+		if withID {
+			row = append(row, r.ID)
+		}
+		rows = append(rows, row)
+	}
+	renderTable(w, style, maxWidth, columns, rows)
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// ruleCase is a sample line with the rules expected to match it or not. The
+// rules are named by their field and their pattern, e.g. "agent:zgrab". E.g.
+//
+//   - line: '192.0.2.1 - - [13/Oct/2026:06:51:53 +0000] "GET /.env HTTP/1.1" 404 0 "-" "zgrab/0.x"'
+//     match: ["agent:zgrab", "path:/\\.env"]
+//     no-match: ["agent:^Nuclei"]
+//     kept: false
+type ruleCase struct {
+	Line    string   `yaml:"line"`
+	Format  string   `yaml:"format"`
+	Match   []string `yaml:"match"`
+	NoMatch []string `yaml:"no-match"`
+	// Kept is the expected verdict of the default display, if set
+	Kept *bool `yaml:"kept"`
+}
+
+// ruleResult counts the cases of a rule
+type ruleResult struct {
+	passed, failed int
+	failures       []string
+}
+
+func loadRuleCases(path string) ([]ruleCase, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []ruleCase
+	if err = yaml.Unmarshal(raw, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cases, nil
+}
+
+// parseCaseLine parses the line of a case with its format, or the first able to
+func parseCaseLine(c ruleCase) (logs.Record, error) {
+	f := logs.MixedFormat(logs.LogFormats[0])
+	if c.Format != "" {
+		var err error
+		if f, err = logs.LookupFormat(c.Format); err != nil {
+			return logs.Record{}, err
+		}
+	}
+	r, ok := f.Parse(c.Line)
+	if !ok {
+		return r, fmt.Errorf("unparsable line")
+	}
+	return r, nil
+}
+
+func mainTestRules(args []string) {
+	var rulesPath, casesPath string
+	var verbose bool
+
+	fs := pflag.NewFlagSet("test-rules", pflag.ExitOnError)
+	fs.StringVar(&rulesPath, "rules", "", "Path to the configuration file with the rules")
+	fs.StringVar(&casesPath, "cases", "", "Path to the YAML file of the cases")
+	fs.BoolVarP(&verbose, "verbose", "v", false, "Also report the passed rules")
+	parseFlags(fs, args)
+
+	if casesPath == "" {
+		Logger.Fatal().Msg("Expected the cases (--cases)")
+	}
+	cfg, err := loadConfig(rulesPath)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to load the configuration")
+	}
+	cfg.applyRules()
+	cases, err := loadRuleCases(casesPath)
+	if err != nil {
+		Logger.Fatal().Str("path", casesPath).Err(err).Msg("Failed to load the cases")
+	}
+	ts, err := tunedRules()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid rule")
+	}
+	known := make(map[string]bool)
+	for _, sig := range ts.signatures {
+		known[sig.field+":"+sig.expr] = true
+	}
+
+	results := make(map[string]*ruleResult)
+	check := func(rule string, ok bool, i int, why string) {
+		res, found := results[rule]
+		if !found {
+			res = &ruleResult{}
+			results[rule] = res
+		}
+		if ok {
+			res.passed++
+		} else {
+			res.failed++
+			res.failures = append(res.failures, fmt.Sprintf("case %d: %s", i+1, why))
+		}
+	}
+
+	rs := &ruleSet{cfg: cfg}
+	explain := rs.rules()
+	for i, c := range cases {
+		r, err := parseCaseLine(c)
+		if err != nil {
+			check("(line)", false, i, err.Error())
+			continue
+		}
+		matched := make(map[string]bool)
+		for _, sig := range ts.match(r) {
+			matched[sig.field+":"+sig.expr] = true
+		}
+		for _, rule := range c.Match {
+			switch {
+			case !known[rule]:
+				check(rule, false, i, "unknown rule")
+			default:
+				check(rule, matched[rule], i, "expected to match")
+			}
+		}
+		for _, rule := range c.NoMatch {
+			switch {
+			case !known[rule]:
+				check(rule, false, i, "unknown rule")
+			default:
+				check(rule, !matched[rule], i, "expected not to match")
+			}
+		}
+		if c.Kept != nil {
+			decisions, kept := logs.Explain(r, explain...)
+			why := "expected to be kept"
+			if !*c.Kept {
+				why = "expected to be rejected"
+			}
+			for _, d := range decisions {
+				if d.Verdict == logs.VerdictReject {
+					why += ", rejected by " + d.Rule + ": " + d.Reason
+				}
+			}
+			check("(display)", kept == *c.Kept, i, why)
+		}
+	}
+
+	rules := make([]string, 0, len(results))
+	for rule := range results {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	failed := 0
+	for _, rule := range rules {
+		res := results[rule]
+		if res.failed == 0 {
+			if verbose {
+				fmt.Printf("PASS %s (%d cases)\n", rule, res.passed)
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s (%d of %d cases)\n", rule, res.failed, res.failed+res.passed)
+		fmt.Printf("  %s\n", strings.Join(res.failures, "\n  "))
+	}
+	fmt.Printf("%d rules tested over %d cases, %d failed\n", len(rules), len(cases), failed)
+	if failed > 0 {
+		Logger.Fatal().Int("failed", failed).Msg("Rule tests failed")
+	}
+}
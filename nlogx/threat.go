@@ -0,0 +1,132 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"regexp"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// attackPaths lists request paths that only vulnerability scanners and exploit
+// kits ask for, on a site that runs neither PHP nor any of the probed products.
+var attackPaths = []string{
+	`\.php`,
+	`\.asp`,
+	`\.\./`,
+	`%00`,
+	`\$\{jndi:`,
+	`/\.env`,
+	`/\.git/`,
+	`/\.aws/`,
+	`/\.ssh/`,
+	`^/wp-`,
+	`/xmlrpc`,
+	`/cgi-bin/`,
+	`/phpmyadmin`,
+	`/phpunit/`,
+	`/jsonws/`,
+	`/actuator/`,
+	`/boaform/`,
+	`/HNAP1`,
+	`/solr/`,
+	`/manager/html`,
+	`/owa/`,
+	`/console`,
+	`/shell`,
+	`/setup\.cgi`,
+	`/config\.json`,
+	`(?i)select.+from`,
+	`(?i)<script`,
+}
+
+// attackAgents lists the User-Agent of offensive tools. Unlike avoidedAgents,
+// it does not list the legit crawlers.
+var attackAgents = []string{
+	"^Nuclei",
+	"IDBTE4M",
+	"Nikto",
+	"masscan",
+	"Nmap",
+	"sqlmap",
+	"zgrab",
+}
+
+// sensitivePaths lists the paths whose successful access by a client that was
+// probing the site hints at a breach.
+var sensitivePaths = []string{
+	`^/admin`,
+	`^/wp-admin`,
+	`^/wp-login`,
+	`(?i)login`,
+	`/\.env`,
+	`/\.git/`,
+	`/backup`,
+	`/config`,
+	`/console`,
+	`/manager/`,
+	`/phpmyadmin`,
+	`/server-status`,
+	`/shell`,
+	`\.sql`,
+	`/phpunit/`,
+	`/jsonws/`,
+}
+
+type signature struct {
+	field string
+	expr  string
+	re    *regexp.Regexp
+}
+
+// threatSieve tells which signatures of hostile traffic a record matches.
+type threatSieve struct {
+	signatures []signature
+}
+
+func newThreatSieve() (*threatSieve, error) {
+	ts := &threatSieve{}
+	add := func(field string, tags []string) error {
+		for _, expr := range tags {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return err
+			}
+			ts.signatures = append(ts.signatures, signature{field: field, expr: expr, re: re})
+		}
+		return nil
+	}
+	if err := add("path", attackPaths); err != nil {
+		return nil, err
+	}
+	if err := add("agent", attackAgents); err != nil {
+		return nil, err
+	}
+	if err := add("referrer", avoidedReferrer); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// match returns the signatures matched by the record, or nil if none matched.
+func (ts *threatSieve) match(r logs.Record) []signature {
+	var out []signature
+	for _, sig := range ts.signatures {
+		var value string
+		switch sig.field {
+		case "path":
+			value = r.Path
+		case "agent":
+			value = r.Agent
+		case "referrer":
+			value = r.Referrer
+		}
+		if sig.re.MatchString(value) {
+			out = append(out, sig)
+		}
+	}
+	return out
+}
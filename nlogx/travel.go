@@ -0,0 +1,133 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+type travelStep struct {
+	ip   string
+	when int64
+	loc  geoLocation
+}
+
+// travelHop is a move between two successive requests of an account that is
+// faster than the max speed.
+type travelHop struct {
+	from, to travelStep
+	km       float64
+	kmh      float64
+}
+
+type travelAccount struct {
+	user     string
+	last     travelStep
+	requests int
+	hops     []travelHop
+}
+
+func (h travelHop) summary() map[string]interface{} {
+	step := func(s travelStep) map[string]interface{} {
+		return map[string]interface{}{"src": s.ip, "t": s.when, "country": s.loc.Country, "city": s.loc.City}
+	}
+	return map[string]interface{}{"from": step(h.from), "to": step(h.to), "km": int(h.km), "kmh": int(h.kmh)}
+}
+
+func mainTravel(args []string) {
+	var sf streamFlags
+	var flagJson bool
+	var maxSpeed float64
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("travel", pflag.ExitOnError)
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the watch list as JSON objects")
+	fs.Float64Var(&maxSpeed, "max-speed", 900, "Max plausible speed of a traveller (in km/h)")
+	rf.registerColumns(fs, "accounts", 0, []string{"user", "requests", "hops"})
+	sf.register(fs, 7)
+	sf.parse(fs, args)
+	rf.check()
+
+	if sf.geoPath == "" {
+		Logger.Fatal().Msg("A GeoIP database with locations is required (--geoip)")
+	}
+
+	accounts := make(map[string]*travelAccount)
+	r1 := sf.records()
+	for r := range r1 {
+		if r.User == "" {
+			continue
+		}
+		step := travelStep{ip: r.Ip, when: r.When, loc: sf.geo.lookup(r.Ip)}
+		a, ok := accounts[r.User]
+		if !ok {
+			a = &travelAccount{user: r.User}
+			accounts[r.User] = a
+		}
+		a.requests++
+		if !step.loc.located {
+			continue
+		}
+		if a.last.loc.located && a.last.loc.Country != step.loc.Country {
+			km := distanceKm(a.last.loc, step.loc)
+			hours := float64(step.when-a.last.when) / 3600
+			if hours < 1.0/3600 {
+				hours = 1.0 / 3600
+			}
+			if kmh := km / hours; kmh > maxSpeed {
+				a.hops = append(a.hops, travelHop{from: a.last, to: step, km: km, kmh: kmh})
+			}
+		}
+		a.last = step
+	}
+
+	watch := make([]*travelAccount, 0)
+	for _, a := range accounts {
+		if len(a.hops) > 0 {
+			watch = append(watch, a)
+		}
+	}
+	sort.Slice(watch, func(i, j int) bool {
+		if len(watch[i].hops) != len(watch[j].hops) {
+			return len(watch[i].hops) > len(watch[j].hops)
+		}
+		return watch[i].user < watch[j].user
+	})
+
+	column := func(i int, name string) interface{} {
+		switch name {
+		case "user":
+			return watch[i].user
+		case "requests":
+			return watch[i].requests
+		}
+		return len(watch[i].hops)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, i := range rf.order(len(watch), column) {
+		a := watch[i]
+		if flagJson {
+			hops := make([]interface{}, 0, len(a.hops))
+			for _, h := range a.hops {
+				hops = append(hops, h.summary())
+			}
+			encoder.Encode(map[string]interface{}{"user": a.user, "requests": a.requests, "hops": hops})
+			continue
+		}
+		fmt.Printf("%s: %d impossible travels in %d requests\n", a.user, len(a.hops), a.requests)
+		for _, h := range a.hops {
+			fmt.Printf("  %s %-15s %-2s -> %s %-15s %-2s %6d km %8d km/h\n",
+				fmtTime(h.from.when), h.from.ip, h.from.loc.Country,
+				fmtTime(h.to.when), h.to.ip, h.to.loc.Country, int(h.km), int(h.kmh))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// watchLogs returns the paths of the files created in the directory, or moved
+// into it, whose name matches the pattern, as notified by inotify.
+func watchLogs(dir, pattern string, clock logs.Clock) (<-chan string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	out := make(chan string, 16)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil || n <= 0 {
+				Logger.Warn().Str("dir", dir).Err(err).Msg("Watch failed, no more log discovered")
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				raw := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+				offset += syscall.SizeofInotifyEvent + int(ev.Len)
+				name := string(bytes.TrimRight(raw, "\x00"))
+				if ev.Mask&syscall.IN_ISDIR != 0 {
+					continue
+				}
+				if ok, _ := filepath.Match(pattern, name); ok {
+					out <- filepath.Join(dir, name)
+				}
+			}
+		}
+	}()
+	return out, nil
+}
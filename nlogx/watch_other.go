@@ -0,0 +1,43 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// watchLogs returns the paths of the files appearing in the directory whose
+// name matches the pattern, polled every second without inotify.
+func watchLogs(dir, pattern string, clock logs.Clock) (<-chan string, error) {
+	glob := filepath.Join(dir, pattern)
+	paths, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, path := range paths {
+		known[path] = true
+	}
+	out := make(chan string, 16)
+	go func() {
+		for range clock.NewTicker(time.Second).C() {
+			paths, _ := filepath.Glob(glob)
+			for _, path := range paths {
+				if !known[path] {
+					known[path] = true
+					out <- path
+				}
+			}
+		}
+	}()
+	return out, nil
+}
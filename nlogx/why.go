@@ -0,0 +1,239 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jfsmig/nginx-logs/logs"
+	"github.com/spf13/pflag"
+)
+
+// ruleSet holds the rules of the default display, to explain which of them
+// keep or reject a record.
+type ruleSet struct {
+	allSources bool
+	allAgents  bool
+	intelTag   bool
+	addrs      []string
+	where      []string
+	cfg        *config
+	geo        *geoDB
+	feed       *intelFeed
+}
+
+// matchingPatterns returns the patterns matching the value
+func matchingPatterns(patterns []string, value string) []string {
+	var out []string
+	for _, p := range patterns {
+		if re, err := regexp.Compile(p); err == nil && re.MatchString(value) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// decide returns the decision of a rule, with its reason formatted
+func decide(rule, verdict, format string, args ...interface{}) []logs.Decision {
+	return []logs.Decision{{Rule: rule, Verdict: verdict, Reason: fmt.Sprintf(format, args...)}}
+}
+
+// knownField tells if the record explained has that field, the extra ones
+// being only its host and the derived ones
+func (rs *ruleSet) knownField(name string) bool {
+	return recordColumns()[name] || name == "host" || rs.cfg.derived(name, len(rs.cfg.Fields))
+}
+
+// intelKept tells if the feeds keep the record whatever its agent and its
+// referrer, once tagged by the intel rule
+func (rs *ruleSet) intelKept(r *logs.Record) bool {
+	return rs.feed != nil && !rs.intelTag && len(r.Indicators) > 0
+}
+
+// rules returns the rules in the order of the pipeline of the default display,
+// each explaining why it would display or reject a record. The rules hold no
+// state of a record, so that they explain any number of them.
+func (rs *ruleSet) rules() []logs.Rule {
+	explicit, wellKnown := makeAddrSieve(rs.addrs), makeAddrSieve(nil)
+	out := []logs.Rule{func(r *logs.Record) []logs.Decision {
+		if len(rs.addrs) > 0 {
+			if !explicit(*r) {
+				return decide("source", logs.VerdictReject, "%s is not among the explicit sources (-x)", r.Ip)
+			}
+			return decide("source", logs.VerdictKeep, "%s is an explicit source (-x)", r.Ip)
+		} else if rs.allSources {
+			return decide("source", logs.VerdictKeep, "the well-known sources are kept (-S)")
+		} else if !wellKnown(*r) {
+			return decide("source", logs.VerdictReject, "%s is a well-known source", r.Ip)
+		}
+		return decide("source", logs.VerdictKeep, "%s is not a well-known source", r.Ip)
+	}}
+
+	if rs.geo != nil {
+		out = append(out, func(r *logs.Record) []logs.Decision {
+			loc := rs.geo.lookup(r.Ip)
+			r.Country, r.ASN = loc.Country, loc.ASN
+			return decide("geoip", logs.VerdictInfo, "country=%s asn=%d org=%q", loc.Country, loc.ASN, loc.Org)
+		})
+	}
+	if len(rs.cfg.Fields) > 0 {
+		out = append(out, func(r *logs.Record) []logs.Decision {
+			rs.cfg.deriveRecord(r)
+			return decide("fields", logs.VerdictInfo, "%s", strings.TrimSpace(fmtExtra(*r)))
+		})
+	}
+	for _, src := range rs.where {
+		src := src
+		sieve, err := makeWhereSieve(src, rs.knownField)
+		out = append(out, func(r *logs.Record) []logs.Decision {
+			switch {
+			case err != nil:
+				return decide("where", logs.VerdictReject, "invalid expression %q: %v", src, err)
+			case !sieve(*r):
+				return decide("where", logs.VerdictReject, "%q is false", src)
+			}
+			return decide("where", logs.VerdictKeep, "%q is true", src)
+		})
+	}
+
+	if rs.feed != nil {
+		out = append(out, func(r *logs.Record) []logs.Decision {
+			for _, ind := range rs.feed.match(*r) {
+				if !hasIndicator(r, ind.id) {
+					r.Indicators = append(r.Indicators, ind.id)
+				}
+			}
+			switch {
+			case rs.intelTag:
+				return decide("intel", logs.VerdictInfo, "indicators: %s", strings.Join(r.Indicators, ", "))
+			case len(r.Indicators) == 0:
+				return decide("intel", logs.VerdictReject, "no indicator of the feeds matches (-i)")
+			}
+			return decide("intel", logs.VerdictKeep, "matches %s, whatever its agent and referrer", strings.Join(r.Indicators, ", "))
+		})
+	}
+
+	out = append(out, func(r *logs.Record) []logs.Decision {
+		scope := ruleScopes.lookup(r)
+		if rs.allAgents || rs.intelKept(r) {
+			return decide("agent", logs.VerdictKeep, "the agents are not filtered")
+		} else if m := matchingPatterns(avoidedAgents, r.Agent); r.Agent == "-" || len(m) > 0 {
+			reason := "the agent is missing (see -a)"
+			if r.Agent != "-" {
+				reason = fmt.Sprintf("the agent matches %s (see -A)", strings.Join(m, ", "))
+			}
+			if scope.avoidAgent(r.Agent, true) {
+				return decide("agent", logs.VerdictReject, "%s", reason)
+			}
+			return decide("agent", logs.VerdictKeep, "%s, but the scope %s allows it", reason, scope.name)
+		} else if scope.avoidAgent(r.Agent, false) {
+			return decide("agent", logs.VerdictReject, "the agent matches the patterns of the scope %s", scope.name)
+		}
+		return decide("agent", logs.VerdictKeep, "the agent matches no avoided pattern")
+	})
+
+	out = append(out, func(r *logs.Record) []logs.Decision {
+		scope := ruleScopes.lookup(r)
+		if rs.intelKept(r) {
+			return decide("referrer", logs.VerdictKeep, "the referrers are not filtered")
+		} else if m := matchingPatterns(avoidedReferrer, r.Referrer); len(m) > 0 {
+			if scope.avoidReferrer(r.Referrer, true) {
+				return decide("referrer", logs.VerdictReject, "the referrer matches %s", strings.Join(m, ", "))
+			}
+			return decide("referrer", logs.VerdictKeep, "the referrer matches %s, but the scope %s allows it", strings.Join(m, ", "), scope.name)
+		} else if scope.avoidReferrer(r.Referrer, false) {
+			return decide("referrer", logs.VerdictReject, "the referrer matches the patterns of the scope %s", scope.name)
+		}
+		return decide("referrer", logs.VerdictKeep, "the referrer matches no avoided pattern")
+	})
+
+	// The signatures do not filter the display, but they drive the reports
+	if ts, err := newThreatSieve(); err == nil {
+		out = append(out, func(r *logs.Record) []logs.Decision {
+			var out []logs.Decision
+			for _, sig := range ts.match(*r) {
+				out = append(out, decide("threat", logs.VerdictInfo, "the %s matches the signature %s", sig.field, sig.expr)...)
+			}
+			return out
+		})
+	}
+	return out
+}
+
+func mainWhy(args []string) {
+	var rs ruleSet
+	var r logs.Record
+	var configPath, geoPath, asnPath, host string
+	var intelFeeds []string
+	var flagJson bool
+
+	fs := pflag.NewFlagSet("why", pflag.ExitOnError)
+	fs.BoolVarP(&rs.allSources, "source", "S", false, "Keep well-known sources")
+	fs.StringSliceVarP(&rs.addrs, "addr", "x", make([]string, 0), "Only keep records from specific and explicit sources")
+	fs.BoolVarP(&rs.allAgents, "all-agents", "A", false, "Show suspicious User-Agent")
+	fs.StringArrayVarP(&rs.where, "where", "w", make([]string, 0), "Only keep records matching an expression (like 'status >= 500')")
+	fs.StringSliceVarP(&intelFeeds, "intel", "i", make([]string, 0), "Only keep records matching the indicators of a threat-intel feed")
+	fs.BoolVar(&rs.intelTag, "intel-tag", false, "Keep all the records, tagged with the indicators they match")
+	fs.StringVarP(&configPath, "config", "C", "", "Path to the configuration file")
+	fs.StringVar(&geoPath, "geoip", "", "Path to a GeoLite2-City (or -Country) database")
+	fs.StringVar(&asnPath, "asn-db", "", "Path to a GeoLite2-ASN database")
+	fs.StringVarP(&r.Agent, "user-agent", "a", "-", "User-Agent of the request")
+	fs.StringVarP(&r.Referrer, "referrer", "r", "-", "Referrer of the request")
+	fs.StringVar(&r.Method, "method", "GET", "Method of the request")
+	fs.StringVar(&r.Path, "path", "/", "Path of the request")
+	fs.IntVar(&r.Code, "status", 200, "Status of the reply")
+	fs.StringVar(&host, "host", "", "Virtual host of the request, for the scopes of the rules")
+	fs.BoolVarP(&flagJson, "json", "j", false, "Dump the decisions as JSON")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		Logger.Fatal().Msg("Expected the address of the source")
+	}
+	r.Ip = fs.Arg(0)
+	r.Version = logs.VersionToCode["HTTP/1.1"]
+	if host != "" {
+		r.SetExtra("host", host)
+	}
+
+	var err error
+	if rs.cfg, err = loadConfig(configPath); err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to load the configuration")
+	}
+	rs.cfg.applyRules()
+	if geoPath != "" || asnPath != "" {
+		if rs.geo, err = openGeoDB(geoPath, asnPath); err != nil {
+			Logger.Fatal().Err(err).Msg("Failed to open the GeoIP databases")
+		}
+	}
+	if len(intelFeeds) > 0 {
+		rs.feed = newIntelFeed()
+		for _, path := range intelFeeds {
+			if err := rs.feed.load(path); err != nil {
+				Logger.Fatal().Str("path", path).Err(err).Msg("Failed to load the threat-intel feed")
+			}
+		}
+	}
+
+	decisions, kept := logs.Explain(r, rs.rules()...)
+	if flagJson {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"src": r.Ip, "kept": kept, "decisions": decisions,
+		})
+		return
+	}
+	for _, d := range decisions {
+		fmt.Printf("%-8s %-6s %s\n", d.Rule, d.Verdict, d.Reason)
+	}
+	if kept {
+		fmt.Println("=> kept")
+	} else {
+		fmt.Println("=> rejected")
+	}
+}
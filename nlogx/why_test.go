@@ -0,0 +1,44 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jfsmig/nginx-logs/logs"
+)
+
+// verdictOf returns the verdict of a rule among the decisions
+func verdictOf(decisions []logs.Decision, rule string) string {
+	for _, d := range decisions {
+		if d.Rule == rule {
+			return d.Verdict
+		}
+	}
+	return ""
+}
+
+func TestRulesExplainSeveralRecords(t *testing.T) {
+	rs := &ruleSet{allSources: true, cfg: &config{}, feed: newIntelFeed(), where: []string{"status >= 200"}}
+	rs.feed.add("bad-ip", "ip", "192.0.2.66")
+	rules := rs.rules()
+
+	hostile := logs.Record{Ip: "192.0.2.66", Agent: "-", Referrer: "-", Code: 200, Path: "/"}
+	decisions, kept := logs.Explain(hostile, rules...)
+	if !kept || verdictOf(decisions, "agent") != logs.VerdictKeep {
+		t.Fatalf("Expected the indicator to keep the record whatever its agent, got %+v", decisions)
+	}
+
+	// The agents stay filtered for the next records
+	other := logs.Record{Ip: "192.0.2.7", Agent: "-", Referrer: "-", Code: 200, Path: "/"}
+	decisions, kept = logs.Explain(other, rules...)
+	if kept || verdictOf(decisions, "agent") != logs.VerdictReject {
+		t.Fatalf("Expected the missing agent to reject the record, got %+v", decisions)
+	}
+	if verdictOf(decisions, "where") != logs.VerdictKeep {
+		t.Fatalf("Expected the expression to keep the record, got %+v", decisions)
+	}
+}
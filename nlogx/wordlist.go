@@ -0,0 +1,112 @@
+// Copyright (C) 2020-2021 nlogx's AUTHORS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// scannerPaths gathers the probes of a source, kept if the source scans
+type scannerPaths struct {
+	scanning bool
+	paths    map[string]bool
+}
+
+// normalizeProbe returns the path of a probe without its query, decoded and
+// without the repeated slashes.
+func normalizeProbe(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func mainWordlist(args []string) {
+	var sf streamFlags
+	var minSources int
+	var counts, matchedOnly bool
+	var rf reportFlags
+
+	fs := pflag.NewFlagSet("wordlist", pflag.ExitOnError)
+	fs.IntVar(&minSources, "min-sources", 1, "Min number of scanning sources that probed a path")
+	fs.BoolVarP(&counts, "counts", "c", false, "Prefix each path with the number of sources that probed it")
+	fs.BoolVar(&matchedOnly, "matched-only", false, "Only keep the probes matching a signature, not all the denied requests of the scanners")
+	rf.registerColumns(fs, "paths", 0, []string{"path", "sources"})
+	sf.register(fs, 30)
+	sf.parse(fs, args)
+	rf.check()
+
+	ts, err := newThreatSieve()
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Failed to build the signatures of hostile traffic")
+	}
+
+	// A source is scanning as soon as one of its requests matches a signature,
+	// its denied requests before are probes too.
+	sources := make(map[string]*scannerPaths)
+	for r := range sf.records() {
+		matched := len(ts.match(r)) > 0
+		if !matched && (matchedOnly || !isDenied(r.Code)) {
+			continue
+		}
+		s, ok := sources[r.Ip]
+		if !ok {
+			s = &scannerPaths{paths: make(map[string]bool)}
+			sources[r.Ip] = s
+		}
+		s.scanning = s.scanning || matched
+		s.paths[normalizeProbe(r.Path)] = true
+	}
+
+	probes := make(map[string]int)
+	for _, s := range sources {
+		if !s.scanning {
+			continue
+		}
+		for p := range s.paths {
+			probes[p]++
+		}
+	}
+	paths := make([]string, 0, len(probes))
+	for p, n := range probes {
+		if n >= minSources {
+			paths = append(paths, p)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if probes[paths[i]] != probes[paths[j]] {
+			return probes[paths[i]] > probes[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	for _, i := range rf.order(len(paths), func(i int, name string) interface{} {
+		if name == "path" {
+			return paths[i]
+		}
+		return probes[paths[i]]
+	}) {
+		p := paths[i]
+		if counts {
+			fmt.Printf("%d %s\n", probes[p], p)
+		} else {
+			fmt.Println(p)
+		}
+	}
+}